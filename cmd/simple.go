@@ -2,35 +2,99 @@ package main
 
 import (
 	"context"
+	"embed"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/darcinc/Simple/data"
 	"github.com/darcinc/Simple/model"
 	"github.com/darcinc/Simple/reflex"
+	"github.com/darcinc/Simple/service"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"html/template"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	EnvListenAddress = "LISTEN_ADDRESS"
+	EnvReadTimeout   = "READ_TIMEOUT"
+	// EnvWriteTimeout bounds writing every response, media included, so it's unset by
+	// default to let long videos stream.
+	EnvWriteTimeout = "WRITE_TIMEOUT"
+	// EnvResponseTimeout bounds the responses of the searches, /images and /files.
+	EnvResponseTimeout = "RESPONSE_TIMEOUT"
+	EnvShutdownTimeout = "SHUTDOWN_TIMEOUT"
+	// EnvReplicationPolicy is the default policy of the replicate subcommand.
+	EnvReplicationPolicy = "REPLICATION_POLICY"
+	// EnvDerivativeSizes names the sizes of derivative served, e.g. thumbnail=160x160.
+	EnvDerivativeSizes = "DERIVATIVE_SIZES"
+	// EnvDerivativeDirectory is the directory derivatives are stored in.
+	EnvDerivativeDirectory = "DERIVATIVE_DIRECTORY"
+	// EnvDerivativeBucket is the S3 bucket derivatives are stored in, instead of a directory.
+	EnvDerivativeBucket = "DERIVATIVE_S3_BUCKET"
+	EnvDerivativePrefix = "DERIVATIVE_S3_PREFIX"
+)
+
+//go:embed templates/*.html
+var templates embed.FS
+
+// serverConfig holds the settings for the http server, taken from the environment.
+type serverConfig struct {
+	ListenAddress   string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ResponseTimeout time.Duration
+	ShutdownTimeout time.Duration
+}
+
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// loadServerConfig reads the server settings.  Timeouts are given as Go durations,
+// e.g. READ_TIMEOUT=10s.
+func loadServerConfig() (serverConfig, error) {
+	config := serverConfig{ListenAddress: os.Getenv(EnvListenAddress)}
+	if config.ListenAddress == "" {
+		config.ListenAddress = ":8080"
+	}
+
+	var err error
+	if config.ReadTimeout, err = durationFromEnv(EnvReadTimeout, 15*time.Second); err != nil {
+		return serverConfig{}, err
+	}
+	if config.WriteTimeout, err = durationFromEnv(EnvWriteTimeout, 0); err != nil {
+		return serverConfig{}, err
+	}
+	if config.ResponseTimeout, err = durationFromEnv(EnvResponseTimeout, 30*time.Second); err != nil {
+		return serverConfig{}, err
+	}
+	if config.ShutdownTimeout, err = durationFromEnv(EnvShutdownTimeout, 30*time.Second); err != nil {
+		return serverConfig{}, err
+	}
+	return config, nil
+}
+
 func initSystem(pool *pgxpool.Pool) {
 	r := reflex.GlobalReflex()
 
 	r.Register("timeout", 15*time.Second)
 	r.Register("caller", func(dm reflex.Reflex) (interface{}, bool) {
-		timeout, ok := dm.MustGet("timeout").(time.Duration)
-		if !ok {
-			log.Printf("Warning - timeout was not set to an instance of duration, using 15 seconds")
-			timeout = 15 * time.Second
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-
-		conn, err := pool.Acquire(ctx)
-		if err != nil {
-			log.Printf("Error - Failed to acquire new database connection: %v", err)
-			return nil, false
-		}
-		return data.NewDBCaller(conn), true
+		return data.NewPoolCaller(pool), true
 	})
 	r.Register("fileService", func(dm reflex.Reflex) (interface{}, bool) {
 		caller, ok := dm.MustGet("caller").(data.DBCaller)
@@ -50,6 +114,15 @@ func initSystem(pool *pgxpool.Pool) {
 
 		return data.NewMetadataServer(caller), true
 	})
+	r.Register("publishedEntityService", func(dm reflex.Reflex) (interface{}, bool) {
+		caller, ok := dm.MustGet("caller").(data.DBCaller)
+		if !ok {
+			log.Printf("Error - Database connection is not a DBCaller")
+			return nil, false
+		}
+
+		return data.NewPublishedEntityServer(caller), true
+	})
 	r.Register("imageRepository", func(dm reflex.Reflex) (interface{}, bool) {
 		metadataService, ok := dm.MustGet("metadataService").(data.MetadataServer)
 		if !ok {
@@ -59,9 +132,445 @@ func initSystem(pool *pgxpool.Pool) {
 
 		return model.NewImageRepository(metadataService), true
 	})
+	r.Register("ImageSearcher", func(dm reflex.Reflex) (interface{}, bool) {
+		repository, ok := dm.MustGet("imageRepository").(model.ImageRepository)
+		if !ok {
+			log.Printf("Error - Image repository is not a model.ImageRepository")
+			return nil, false
+		}
+
+		publisher, ok := dm.MustGet("publishedEntityService").(data.PublishedEntityService)
+		if !ok {
+			log.Printf("Error - Published entity service is not a data.PublishedEntityService")
+			return nil, false
+		}
+
+		return service.ImageSearcher{Repository: repository, Publisher: publisher}, true
+	})
+}
+
+// registerLocators makes the other kinds of locator available: media served over
+// http and https, and the S3 store when S3_ENDPOINT is set.  The S3 client is
+// registered as s3Client for the replicate subcommand.
+func registerLocators() error {
+	httpConfig, err := data.HTTPConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	data.RegisterHTTPLocator(httpConfig)
+
+	endpoint := os.Getenv(data.EnvS3Endpoint)
+	if endpoint == "" {
+		reflex.GlobalReflex().Register("s3Client", func(dm reflex.Reflex) (interface{}, bool) {
+			return nil, false
+		})
+		return nil
+	}
+
+	client, err := data.NewS3Client(data.S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv(data.EnvS3Region),
+		AccessKey: os.Getenv(data.EnvS3AccessKey),
+		SecretKey: os.Getenv(data.EnvS3SecretKey),
+	})
+	if err != nil {
+		return err
+	}
+	data.RegisterS3Locator(client)
+	reflex.GlobalReflex().Register("s3Client", client)
+	return nil
+}
+
+// registerDerivatives makes the derivative generator available when there is somewhere
+// to store derivatives, either DERIVATIVE_DIRECTORY or DERIVATIVE_S3_BUCKET.
+func registerDerivatives() error {
+	r := reflex.GlobalReflex()
+	sizes := data.DefaultDerivativeSizes
+	if text := os.Getenv(EnvDerivativeSizes); text != "" {
+		parsed, err := data.ParseDerivativeSizes(text)
+		if err != nil {
+			return err
+		}
+		sizes = parsed
+	}
+
+	caller, ok := r.MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+
+	var store data.DerivativeStore
+	if bucket := os.Getenv(EnvDerivativeBucket); bucket != "" {
+		client, ok := r.Get("s3Client")
+		if !ok {
+			return fmt.Errorf("%s must be set to store derivatives in a bucket", data.EnvS3Endpoint)
+		}
+		store = data.NewS3Uploader(caller, client.(data.S3Client), bucket, os.Getenv(EnvDerivativePrefix))
+	} else if directory := os.Getenv(EnvDerivativeDirectory); directory != "" {
+		store = data.NewFileSystemTarget(directory)
+	}
+
+	if store == nil {
+		r.Register("derivativeGenerator", func(dm reflex.Reflex) (interface{}, bool) {
+			return nil, false
+		})
+		return nil
+	}
+	r.Register("derivativeGenerator", data.NewDerivativeGenerator(caller, store, sizes))
+	return nil
+}
+
+// newServer routes the endpoints onto a server configured with the given settings.
+func newServer(config serverConfig) (*http.Server, error) {
+	pages, err := template.ParseFS(templates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	searchPage := pages.Lookup("search.html")
+	errorPage := pages.Lookup("error.html")
+
+	timeout, ok := reflex.GlobalReflex().MustGet("timeout").(time.Duration)
+	if !ok {
+		log.Printf("Warning - timeout was not set to an instance of duration, using 15 seconds")
+		timeout = 15 * time.Second
+	}
+
+	// Only the searches are cut off, media is streamed for as long as it takes.
+	bounded := func(handler http.Handler) http.Handler {
+		if config.ResponseTimeout <= 0 {
+			return handler
+		}
+		return http.TimeoutHandler(handler, config.ResponseTimeout, "The request took too long")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/images", bounded(service.ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage, Timeout: timeout}))
+	mux.Handle("/files", bounded(service.FilesHandler{ErrorPage: errorPage, Timeout: timeout}))
+	mux.Handle(service.PermalinkPrefix, service.PermalinkHandler{ErrorPage: errorPage})
+	mux.Handle(service.MediaPrefix, service.MediaHandler{ErrorPage: errorPage})
+	mux.Handle(service.DerivativePrefix, service.DerivativeHandler{ErrorPage: errorPage})
+
+	return &http.Server{
+		Addr:         config.ListenAddress,
+		Handler:      mux,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+	}, nil
+}
+
+// serve runs the server until it fails or ctx is done.  Once ctx is done the server
+// stops taking new connections and waits, up to the shutdown timeout, for the requests
+// in flight to finish.
+func serve(ctx context.Context, server *http.Server, shutdownTimeout time.Duration) error {
+	failed := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", server.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+		close(failed)
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// ingest catalogues the files under each of the roots.  It can be stopped and run again,
+// carrying on from where it was.
+func ingest(ctx context.Context, roots []string) error {
+	if len(roots) == 0 {
+		return errors.New("usage: simple ingest <directory>...")
+	}
+
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+	ingester := data.NewIngester(caller)
+
+	for _, root := range roots {
+		result, err := ingester.Ingest(ctx, root)
+		for _, failure := range result.Failed {
+			log.Printf("Warning - Unable to ingest %s: %v", failure.Path, failure.Err)
+		}
+		log.Printf("Ingested %s: %d files, %d added, %d duplicates, %d unchanged, %d failed",
+			root, result.Scanned, result.Added, result.Duplicates, result.Unchanged, len(result.Failed))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify rehashes the data at every locator, then lists the locators whose data is
+// missing, unreadable or corrupt.  It fails if there are any, so it can be run on a schedule.
+func verify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	workers := flags.Int("workers", runtime.NumCPU(), "number of locators checked at once")
+	reportOnly := flags.Bool("report", false, "list the results of the last verification without checking again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+	verifier := data.NewVerifier(caller, *workers)
+
+	if !*reportOnly {
+		result, err := verifier.Verify(ctx)
+		log.Printf("Verified %d locators: %d ok, %d missing, %d unreadable, %d corrupt",
+			result.Checked, result.OK, result.Missing, result.Unreadable, result.Corrupt)
+		if err != nil {
+			return err
+		}
+	}
+
+	failed, err := verifier.Verifications(ctx, data.VerificationMissing, data.VerificationUnreadable,
+		data.VerificationCorrupt)
+	if err != nil {
+		return err
+	}
+	for _, verification := range failed {
+		fmt.Printf("%s\t%s:%s\tencoding %d\t%s\t%s\n", verification.Verified.Format(time.RFC3339),
+			verification.Source, verification.Path, verification.EncodingID, verification.Status, verification.Detail)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d locators failed verification", len(failed))
+	}
+	return nil
+}
+
+// replicate copies encodings to the targets given until each has the copies the
+// policy asks for.
+func replicate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replicate", flag.ContinueOnError)
+	policyText := flags.String("policy", os.Getenv(EnvReplicationPolicy),
+		"copies needed per mime type, e.g. image/tiff=2:1,*=1 for two copies of a tiff, one off box")
+	directory := flags.String("directory", "", "directory to copy encodings into")
+	bucket := flags.String("s3-bucket", "", "S3 bucket to copy encodings into")
+	prefix := flags.String("s3-prefix", "", "prefix of the keys of the encodings copied into the bucket")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	policy, err := data.ParseReplicationPolicy(*policyText)
+	if err != nil {
+		return err
+	}
+
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+
+	var targets []data.ReplicaTarget
+	if *bucket != "" {
+		client, ok := reflex.GlobalReflex().Get("s3Client")
+		if !ok {
+			return fmt.Errorf("%s must be set to copy into a bucket", data.EnvS3Endpoint)
+		}
+		targets = append(targets, data.NewS3Uploader(caller, client.(data.S3Client), *bucket, *prefix))
+	}
+	if *directory != "" {
+		targets = append(targets, data.NewFileSystemTarget(*directory))
+	}
+	if len(targets) == 0 {
+		return errors.New("usage: simple replicate [-policy rules] [-directory dir] [-s3-bucket bucket [-s3-prefix prefix]]")
+	}
+
+	replicator := data.NewReplicator(caller, policy, targets...).WithProgress(func(progress data.ReplicationProgress) {
+		if progress.Checked%1000 == 0 {
+			log.Printf("Replicating: %d encodings checked, %d under replicated, %d copies made, %d failed",
+				progress.Checked, progress.UnderReplicated, progress.Copied, progress.Failed)
+		}
+	})
+
+	result, err := replicator.Reconcile(ctx)
+	for _, failure := range result.Failures {
+		log.Printf("Warning - Unable to replicate encoding %d: %v", failure.EncodingID, failure.Err)
+	}
+	log.Printf("Replicated %d encodings: %d under replicated, %d copies made, %d failed",
+		result.Checked, result.UnderReplicated, result.Copied, result.Failed)
+	return err
+}
+
+// dedupe lists the metadata that describe the same media.  With -merge, each of
+// them is merged into one.
+func dedupe(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	merge := flags.Bool("merge", false, "merge the duplicates instead of only listing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+	deduper := data.NewDeduper(caller)
+
+	proposals, err := deduper.Proposals(ctx)
+	if err != nil {
+		return err
+	}
+
+	merged := 0
+	for _, proposal := range proposals {
+		ids := make([]string, len(proposal.Metadata))
+		for i, metadata := range proposal.Metadata {
+			ids[i] = fmt.Sprint(metadata.ID)
+		}
+		fmt.Printf("%s\tmetadata %s\tinto %d, captured %s, tags %s\n", proposal.Hash, strings.Join(ids, ","),
+			proposal.Merged.ID, proposal.Merged.Date.Format(time.RFC3339), strings.Join(proposal.Merged.Tags, ","))
+		if !*merge {
+			continue
+		}
+
+		if _, err := deduper.Merge(ctx, proposal); errors.Is(err, data.ErrStaleProposal) {
+			log.Printf("Warning - Skipped %s: %v", proposal.Hash, err)
+		} else if err != nil {
+			return err
+		} else {
+			merged++
+		}
+	}
+
+	log.Printf("Found %d duplicates, merged %d", len(proposals), merged)
+	return nil
+}
+
+// phash computes the perceptual hashes of images catalogued without one.
+func phash(ctx context.Context, args []string) error {
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+
+	hashed, err := data.NewPerceptualIndex(caller).Backfill(ctx)
+	log.Printf("Computed perceptual hashes of %d images", hashed)
+	return err
+}
+
+// derivatives generates every derivative of every image that doesn't have one yet.
+func derivatives(ctx context.Context, args []string) error {
+	generator, ok := reflex.GlobalReflex().Get("derivativeGenerator")
+	if !ok {
+		return fmt.Errorf("%s or %s must be set to generate derivatives", EnvDerivativeDirectory, EnvDerivativeBucket)
+	}
+
+	result, err := generator.(data.DerivativeGenerator).GenerateAll(ctx)
+	for _, failure := range result.Failures {
+		log.Printf("Warning - Unable to make the %s derivative of metadata %d: %v", failure.Size, failure.MetadataID, failure.Err)
+	}
+	log.Printf("Checked %d metadata: %d derivatives generated, %d skipped, %d failed",
+		result.Checked, result.Generated, result.Skipped, len(result.Failures))
+	return err
+}
+
+// geocode names the locations of metadata captured with coordinates but no location,
+// after the places in the gazetteer.  Places can be added to the gazetteer first from
+// a CSV file of name, latitude, longitude and radius in metres.
+func geocode(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("geocode", flag.ContinueOnError)
+	places := flags.String("places", "", "CSV file of name,latitude,longitude,radius to add to the gazetteer first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	caller, ok := reflex.GlobalReflex().MustGet("caller").(data.DBCaller)
+	if !ok {
+		return errors.New("database connection is not a DBCaller")
+	}
+	gazetteer := data.NewGazetteer(caller)
+
+	if *places != "" {
+		added, err := loadPlaces(ctx, gazetteer, *places)
+		log.Printf("Added %d places to the gazetteer", added)
+		if err != nil {
+			return err
+		}
+	}
+
+	named, err := gazetteer.NameLocations(ctx)
+	log.Printf("Named the locations of %d metadata", named)
+	return err
+}
+
+// loadPlaces adds each place in the CSV file to the gazetteer, stopping at the first
+// that can't be added.
+func loadPlaces(ctx context.Context, gazetteer data.Gazetteer, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	added := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return added, nil
+		}
+		if err != nil {
+			return added, err
+		}
+
+		place := data.Place{Name: strings.TrimSpace(record[0])}
+		numbers := []*float64{&place.Latitude, &place.Longitude, &place.Radius}
+		for i, number := range numbers {
+			if *number, err = strconv.ParseFloat(strings.TrimSpace(record[i+1]), 64); err != nil {
+				return added, fmt.Errorf("%s, place %d: %w", path, added+1, err)
+			}
+		}
+		if _, err := gazetteer.Add(ctx, place); err != nil {
+			return added, fmt.Errorf("%s, place %d: %w", path, added+1, err)
+		}
+		added++
+	}
+}
+
+// subcommands are run instead of the server when named as the first argument.
+var subcommands = map[string]func(ctx context.Context, args []string) error{
+	"ingest":      ingest,
+	"verify":      verify,
+	"replicate":   replicate,
+	"dedupe":      dedupe,
+	"phash":       phash,
+	"derivatives": derivatives,
+	"geocode":     geocode,
 }
 
 func main() {
+	keys, err := data.LoadIdentifierKeys()
+	if err != nil {
+		log.Printf("Unable to load identifier keys: %v", err)
+		os.Exit(1)
+	}
+	data.SetIdentifierKeys(keys)
+
+	config, err := loadServerConfig()
+	if err != nil {
+		log.Printf("Unable to read server configuration: %v", err)
+		os.Exit(1)
+	}
+
+	if err := registerLocators(); err != nil {
+		log.Printf("Unable to configure locators: %v", err)
+		os.Exit(1)
+	}
+
 	DBURI := os.Getenv("DB_URI")
 
 	poolConfig, err := pgxpool.ParseConfig(DBURI)
@@ -76,6 +585,39 @@ func main() {
 		os.Exit(1)
 
 	}
+	defer pool.Close()
 
 	initSystem(pool)
+	if err := registerDerivatives(); err != nil {
+		log.Printf("Unable to configure derivatives: %v", err)
+		pool.Close()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			if err := command(ctx, os.Args[2:]); err != nil {
+				log.Printf("%s failed: %v", os.Args[1], err)
+				pool.Close()
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	server, err := newServer(config)
+	if err != nil {
+		log.Printf("Unable to create server: %v", err)
+		pool.Close()
+		os.Exit(1)
+	}
+
+	if err := serve(ctx, server, config.ShutdownTimeout); err != nil {
+		log.Printf("Server stopped: %v", err)
+		pool.Close()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const (
+	// SourceZip is the source of a locator for a member of a zip archive on the
+	// local filesystem.  Its path is the archive and the member, archive!/member.
+	SourceZip = "zip"
+
+	archiveSeparator = "!/"
+)
+
+var (
+	ErrInvalidArchivePath = errors.New("archive locator path must be archive!/member")
+)
+
+func init() {
+	RegisterLocator(SourceZip, func(path string) (Locator, error) {
+		parts := strings.SplitN(path, archiveSeparator, 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidArchivePath, path)
+		}
+		return zipLocator{Archive: parts[0], Member: parts[1]}, nil
+	})
+}
+
+type zipLocator struct {
+	Archive string
+	Member  string
+}
+
+func (zl zipLocator) Source() string {
+	return SourceZip
+}
+
+// Data decompresses the member as it's read.  The archive stays open until the
+// stream is closed.
+func (zl zipLocator) Data() (io.ReadCloser, error) {
+	archive, err := zip.OpenReader(zl.Archive)
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := archive.Open(zl.Member)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return archiveMember{ReadCloser: member, archive: archive}, nil
+}
+
+func (zl zipLocator) URL() url.URL {
+	return url.URL{
+		Scheme: SourceZip,
+		Path:   zl.StoredPath(),
+	}
+}
+
+func (zl zipLocator) StoredPath() string {
+	return zl.Archive + archiveSeparator + zl.Member
+}
+
+// archiveMember closes the archive along with the member read from it.
+type archiveMember struct {
+	io.ReadCloser
+	archive io.Closer
+}
+
+func (am archiveMember) Close() error {
+	err := am.ReadCloser.Close()
+	if archiveErr := am.archive.Close(); err == nil {
+		err = archiveErr
+	}
+	return err
+}
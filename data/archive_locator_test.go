@@ -0,0 +1,74 @@
+package data
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestArchive writes a zip holding the test content as photos/bar.jpg.
+func writeTestArchive(t *testing.T) string {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	member, err := archive.Create("photos/bar.jpg")
+	if err != nil {
+		t.Fatalf("Unable to add to the test archive: %v", err)
+	}
+	if _, err := member.Write([]byte(testContent)); err != nil {
+		t.Fatalf("Unable to write to the test archive: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Unable to close the test archive: %v", err)
+	}
+	return writeTestFile(t, t.TempDir(), "2021.zip", buffer.Bytes())
+}
+
+func TestZipLocator_Data(t *testing.T) {
+	path := writeTestArchive(t)
+	l, err := NewLocator(SourceZip, path+"!/photos/bar.jpg")
+	if err != nil {
+		t.Fatalf("Unexpected error building the locator: %v", err)
+	}
+
+	data, err := l.Data()
+	if err != nil {
+		t.Fatalf("Unexpected error opening the member: %v", err)
+	}
+	content, err := io.ReadAll(data)
+	if err != nil || string(content) != testContent {
+		t.Errorf("Expected the content of the member but got %q, %v", content, err)
+	}
+	if err := data.Close(); err != nil {
+		t.Errorf("Unexpected error closing the member: %v", err)
+	}
+
+	if stored, err := locatorPath(l); err != nil || stored != path+"!/photos/bar.jpg" {
+		t.Errorf("Expected the archive and member to be stored but got %s, %v", stored, err)
+	}
+
+	if u := l.URL(); u.String() != "zip://"+filepath.ToSlash(path)+"%21/photos/bar.jpg" {
+		t.Errorf("Expected a zip URL but got %s", u.String())
+	}
+}
+
+func TestZipLocator_MissingMember(t *testing.T) {
+	l, err := NewLocator(SourceZip, writeTestArchive(t)+"!/photos/foo.jpg")
+	if err != nil {
+		t.Fatalf("Unexpected error building the locator: %v", err)
+	}
+
+	if _, err := l.Data(); err == nil {
+		t.Errorf("Expected a missing member to fail to open")
+	}
+}
+
+func TestZipLocator_InvalidPath(t *testing.T) {
+	for _, path := range []string{"/a/2021.zip", "!/bar.jpg", "/a/2021.zip!/"} {
+		if _, err := NewLocator(SourceZip, path); !errors.Is(err, ErrInvalidArchivePath) {
+			t.Errorf("Expected %q to be invalid but got %v", path, err)
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 func createTestDBCaller() (*TestDBCaller, context.Context) {
 	pgxIface, _ := pgxmock.NewPool()
 	mockDB := &TestDBCaller{
-		pgxIface,
+		Conn: pgxIface,
 	}
 
 	return mockDB, context.Background()
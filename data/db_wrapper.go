@@ -13,6 +13,8 @@ type DBCaller interface {
 	QueryRow(ctx context.Context, query string, params ...interface{}) pgx.Row
 	Exec(ctx context.Context, query string, params ...interface{}) (pgconn.CommandTag, error)
 	Begin(ctx context.Context) (DBCaller, error)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
 	Release()
 }
 
@@ -24,6 +26,12 @@ type PGXTxCaller struct {
 	trans pgx.Tx
 }
 
+// PGXPoolCaller runs each statement on a connection borrowed from the pool, so
+// it can be shared for the life of the process without holding a connection.
+type PGXPoolCaller struct {
+	pool *pgxpool.Pool
+}
+
 func NewDBCaller(conn *pgxpool.Conn) DBCaller {
 	return PGXDBCaller{
 		conn: conn,
@@ -57,6 +65,64 @@ func (p PGXDBCaller) Begin(ctx context.Context) (DBCaller, error) {
 	}, nil
 }
 
+// Commit is a no-op outside of a transaction, since every statement on a plain
+// connection is already committed.
+func (p PGXDBCaller) Commit(_ context.Context) error {
+	log.Printf("Warning - calling commit outside of a transaction")
+	return nil
+}
+
+// Rollback is a no-op outside of a transaction.
+func (p PGXDBCaller) Rollback(_ context.Context) error {
+	log.Printf("Warning - calling rollback outside of a transaction")
+	return nil
+}
+
+func NewPoolCaller(pool *pgxpool.Pool) DBCaller {
+	return PGXPoolCaller{
+		pool: pool,
+	}
+}
+
+func (p PGXPoolCaller) Query(ctx context.Context, query string, params ...interface{}) (pgx.Rows, error) {
+	return p.pool.Query(ctx, query, params...)
+}
+
+func (p PGXPoolCaller) QueryRow(ctx context.Context, query string, params ...interface{}) pgx.Row {
+	return p.pool.QueryRow(ctx, query, params...)
+}
+
+func (p PGXPoolCaller) Exec(ctx context.Context, query string, params ...interface{}) (pgconn.CommandTag, error) {
+	return p.pool.Exec(ctx, query, params...)
+}
+
+func (p PGXPoolCaller) Begin(ctx context.Context) (DBCaller, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return PGXTxCaller{
+		trans: tx,
+	}, nil
+}
+
+// Commit is a no-op outside of a transaction.
+func (p PGXPoolCaller) Commit(_ context.Context) error {
+	log.Printf("Warning - calling commit outside of a transaction")
+	return nil
+}
+
+// Rollback is a no-op outside of a transaction.
+func (p PGXPoolCaller) Rollback(_ context.Context) error {
+	log.Printf("Warning - calling rollback outside of a transaction")
+	return nil
+}
+
+// Release does nothing, the connections belong to the pool.
+func (p PGXPoolCaller) Release() {
+}
+
 func (p PGXTxCaller) Query(ctx context.Context, query string, params ...interface{}) (pgx.Rows, error) {
 	return p.trans.Query(ctx, query, params...)
 }
@@ -73,6 +139,14 @@ func (p PGXTxCaller) Begin(ctx context.Context) (DBCaller, error) {
 	return p, nil
 }
 
+func (p PGXTxCaller) Commit(ctx context.Context) error {
+	return p.trans.Commit(ctx)
+}
+
+func (p PGXTxCaller) Rollback(ctx context.Context) error {
+	return p.trans.Rollback(ctx)
+}
+
 func (p PGXTxCaller) Release() {
 	log.Printf("Warning - calling release on a transaction")
 }
@@ -9,7 +9,9 @@ import (
 
 // TestDBCaller a mocking object for database queries.
 type TestDBCaller struct {
-	Conn pgxmock.PgxPoolIface
+	Conn       pgxmock.PgxPoolIface
+	Committed  bool
+	RolledBack bool
 }
 
 func (tdbc *TestDBCaller) Query(ctx context.Context, query string, params ...interface{}) (pgx.Rows, error) {
@@ -27,6 +29,16 @@ func (tdbc *TestDBCaller) Begin(ctx context.Context) (DBCaller, error) {
 	return tdbc, nil
 }
 
+func (tdbc *TestDBCaller) Commit(_ context.Context) error {
+	tdbc.Committed = true
+	return nil
+}
+
+func (tdbc *TestDBCaller) Rollback(_ context.Context) error {
+	tdbc.RolledBack = true
+	return nil
+}
+
 func (tdbc *TestDBCaller) Release() {
 
 }
@@ -0,0 +1,346 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	selectDuplicateHashes = `SELECT file_hash, array_agg(DISTINCT metadata_id ORDER BY metadata_id)
+		FROM encoding
+		WHERE file_hash <> ''
+		GROUP BY file_hash
+		HAVING count(DISTINCT metadata_id) > 1
+		ORDER BY file_hash`
+	lockMetadata         = `SELECT id FROM metadata WHERE id = ANY($1) ORDER BY id FOR UPDATE`
+	moveEncoding         = `UPDATE encoding SET metadata_id = $1 WHERE id = $2`
+	moveEncodingLocators = `UPDATE locator SET encoding_id = $1
+		WHERE encoding_id = $2 AND NOT EXISTS (
+			SELECT 1 FROM locator kept
+			WHERE kept.encoding_id = $1 AND kept.source = locator.source AND kept.path = locator.path)`
+	repointPublishedEntity = `UPDATE published_entity SET referenced_id = $3,
+			canonical = canonical AND NOT EXISTS (
+				SELECT 1 FROM published_entity kept
+				WHERE kept.referenced_entity = $1 AND kept.referenced_id = $3 AND kept.canonical)
+		WHERE referenced_entity = $1 AND referenced_id = $2`
+	deleteMetadata = `DELETE FROM metadata WHERE id = $1`
+)
+
+var (
+	ErrStaleProposal = errors.New("duplicates have changed since the merge was proposed")
+)
+
+// MergeProposal is metadata that share the data of an encoding, and so describe
+// the same media.
+type MergeProposal struct {
+	Hash string
+	// Metadata are the entries sharing the hash, in order of id.  The first is kept
+	// and the others are merged into it.
+	Metadata []Metadata
+	// Merged is the kept metadata as it will be after the merge.
+	Merged Metadata
+}
+
+// Deduper finds metadata that describe the same media, because they have encodings
+// with the same hash, and merges them once the merge is confirmed.
+type Deduper struct {
+	db DBCaller
+}
+
+func NewDeduper(db DBCaller) Deduper {
+	return Deduper{
+		db: db,
+	}
+}
+
+// Proposals returns a merge for each hash found under more than one metadata.  The
+// same metadata can be in more than one proposal, in which case merging one makes the
+// others stale.
+func (dd Deduper) Proposals(ctx context.Context) ([]MergeProposal, error) {
+	duplicates, err := dd.duplicateHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := dbMetadataServer{db: dd.db}
+	var result []MergeProposal
+	for _, duplicate := range duplicates {
+		proposal, err := ms.propose(ctx, duplicate.hash, duplicate.metadataIDs)
+		if errors.Is(err, ErrStaleProposal) {
+			// Changed since the duplicates were found.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, proposal)
+	}
+	return result, nil
+}
+
+type duplicateHash struct {
+	hash        string
+	metadataIDs []int64
+}
+
+func (dd Deduper) duplicateHashes(ctx context.Context) ([]duplicateHash, error) {
+	rows, err := dd.db.Query(ctx, selectDuplicateHashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []duplicateHash
+	for rows.Next() {
+		var duplicate duplicateHash
+		if err := rows.Scan(&duplicate.hash, &duplicate.metadataIDs); err != nil {
+			return nil, err
+		}
+		result = append(result, duplicate)
+	}
+	return result, rows.Err()
+}
+
+// propose reads the metadata and works out the merge.  ErrStaleProposal is returned
+// if any of them is gone or no longer has an encoding with the hash.
+func (dms dbMetadataServer) propose(ctx context.Context, hash string, metadataIDs []int64) (MergeProposal, error) {
+	ids := append([]int64(nil), metadataIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	proposal := MergeProposal{Hash: hash}
+	for _, id := range ids {
+		metadata, err := dms.FindById(ctx, id)
+		if err != nil {
+			return MergeProposal{}, err
+		}
+		if metadata == nil || !hasHash(*metadata, hash) {
+			return MergeProposal{}, fmt.Errorf("%w: metadata %d", ErrStaleProposal, id)
+		}
+		proposal.Metadata = append(proposal.Metadata, *metadata)
+	}
+	if len(proposal.Metadata) < 2 {
+		return MergeProposal{}, fmt.Errorf("%w: only one metadata has %s", ErrStaleProposal, hash)
+	}
+
+	proposal.Merged = mergeMetadata(proposal.Metadata)
+	return proposal, nil
+}
+
+func hasHash(metadata Metadata, hash string) bool {
+	for _, encoding := range metadata.Data {
+		if encoding.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMetadata folds the others into the first.  Tags are the union of all of them,
+// and the date is the earliest, preferring dates read from the media over estimates.
+// The location and coordinates of the first are kept if it has them.  Encodings with
+// the same hash become one, the earliest, with all of their locators.
+func mergeMetadata(all []Metadata) Metadata {
+	merged := all[0]
+	merged.Tags = []string{}
+	merged.Data = nil
+
+	seenTags := map[string]bool{}
+	encodings := map[string]int{}
+	for i, metadata := range all {
+		for _, tag := range metadata.Tags {
+			if !seenTags[tag] {
+				seenTags[tag] = true
+				merged.Tags = append(merged.Tags, tag)
+			}
+		}
+
+		if i > 0 {
+			if earlierDate(metadata, merged) {
+				merged.Date = metadata.Date
+				merged.DateEstimated = metadata.DateEstimated
+			}
+			if merged.Location == "" {
+				merged.Location = metadata.Location
+			}
+			if merged.Coordinates == nil {
+				merged.Coordinates = metadata.Coordinates
+			}
+			if merged.Description == "" {
+				merged.Description = metadata.Description
+			}
+		}
+
+		for _, encoding := range metadata.Data {
+			existing, ok := encodings[encoding.Hash]
+			if !ok || encoding.Hash == "" {
+				encodings[encoding.Hash] = len(merged.Data)
+				encoding.Locator = append([]Locator(nil), encoding.Locator...)
+				merged.Data = append(merged.Data, encoding)
+				continue
+			}
+			merged.Data[existing].Locator = unionLocators(merged.Data[existing].Locator, encoding.Locator)
+		}
+	}
+	return merged
+}
+
+// earlierDate reports whether the candidate's date should replace the current one.
+func earlierDate(candidate, current Metadata) bool {
+	if candidate.DateEstimated != current.DateEstimated {
+		return !candidate.DateEstimated
+	}
+	return candidate.Date.Before(current.Date)
+}
+
+func unionLocators(kept, added []Locator) []Locator {
+	seen := map[locatorKey]bool{}
+	for _, l := range kept {
+		path, _ := locatorPath(l)
+		seen[locatorKey{source: l.Source(), path: path}] = true
+	}
+	for _, l := range added {
+		path, _ := locatorPath(l)
+		key := locatorKey{source: l.Source(), path: path}
+		if !seen[key] {
+			seen[key] = true
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// Merge carries out the proposal in a single transaction.  The metadata are read
+// again and locked, and if they no longer match the proposal ErrStaleProposal is
+// returned without changing anything.  Published identifiers of the metadata and
+// encodings that are merged away are moved onto the ones kept, so their permalinks
+// still resolve.  If the ones kept are published already, their own identifiers stay
+// canonical.
+func (dd Deduper) Merge(ctx context.Context, proposal MergeProposal) (Metadata, error) {
+	tx, err := dd.db.Begin(ctx)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	merged, err := dd.merge(ctx, tx, proposal)
+	if err != nil {
+		rollback(ctx, tx)
+		return Metadata{}, err
+	}
+
+	return merged, tx.Commit(ctx)
+}
+
+func (dd Deduper) merge(ctx context.Context, tx DBCaller, proposal MergeProposal) (Metadata, error) {
+	ids := make([]int64, len(proposal.Metadata))
+	for i, metadata := range proposal.Metadata {
+		ids[i] = metadata.ID
+	}
+	if _, err := tx.Exec(ctx, lockMetadata, ids); err != nil {
+		return Metadata{}, err
+	}
+
+	ms := dbMetadataServer{db: tx}
+	current, err := ms.propose(ctx, proposal.Hash, ids)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !sameEncodings(current.Metadata, proposal.Metadata) {
+		return Metadata{}, fmt.Errorf("%w: encodings of %s", ErrStaleProposal, proposal.Hash)
+	}
+
+	kept := current.Metadata[0]
+	keptEncodings := map[string]int64{}
+	for _, encoding := range kept.Data {
+		if _, ok := keptEncodings[encoding.Hash]; !ok && encoding.Hash != "" {
+			keptEncodings[encoding.Hash] = encoding.ID
+		}
+	}
+
+	for _, metadata := range current.Metadata[1:] {
+		for _, encoding := range metadata.Data {
+			keptID, ok := keptEncodings[encoding.Hash]
+			if !ok {
+				if _, err := tx.Exec(ctx, moveEncoding, kept.ID, encoding.ID); err != nil {
+					return Metadata{}, err
+				}
+				if encoding.Hash != "" {
+					keptEncodings[encoding.Hash] = encoding.ID
+				}
+				continue
+			}
+
+			if err := dd.collapseEncoding(ctx, tx, keptID, encoding.ID); err != nil {
+				return Metadata{}, err
+			}
+		}
+
+		if err := repointPublished(ctx, tx, EntityMetadata, metadata.ID, kept.ID); err != nil {
+			return Metadata{}, err
+		}
+		if _, err := tx.Exec(ctx, deleteMetadata, metadata.ID); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	merged := current.Merged
+	latitude, longitude, altitude := merged.coordinateArgs()
+	_, err = tx.Exec(ctx, updateMetadata, merged.ID, merged.Date, merged.DateEstimated,
+		merged.Location, merged.Tags, latitude, longitude, altitude, merged.Description)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return merged, nil
+}
+
+// collapseEncoding moves the locators and derivatives of the duplicate onto the kept
+// encoding and removes the duplicate.
+func (dd Deduper) collapseEncoding(ctx context.Context, tx DBCaller, keptID, duplicateID int64) error {
+	if _, err := tx.Exec(ctx, moveEncodingLocators, keptID, duplicateID); err != nil {
+		return err
+	}
+	// Whatever is left was already a locator of the kept encoding.
+	if _, err := tx.Exec(ctx, deleteEncodingLocators, duplicateID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, moveDerivatives, keptID, duplicateID); err != nil {
+		return err
+	}
+	// Likewise whatever derivatives are left are sizes the kept encoding already has.
+	if err := deleteDerivatives(ctx, tx, duplicateID); err != nil {
+		return err
+	}
+	if err := repointPublished(ctx, tx, EntityEncoding, duplicateID, keptID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, deleteEncoding, duplicateID)
+	return err
+}
+
+// repointPublished moves the identifiers of the merged entity onto the kept one, so they
+// go on working.  If the kept entity is already published its own identifier stays the
+// canonical one.
+func repointPublished(ctx context.Context, tx DBCaller, entity string, fromID, toID int64) error {
+	_, err := tx.Exec(ctx, repointPublishedEntity, entity, fromID, toID)
+	return err
+}
+
+// sameEncodings reports whether each metadata still has the encodings that were
+// proposed.
+func sameEncodings(current, proposed []Metadata) bool {
+	if len(current) != len(proposed) {
+		return false
+	}
+	for i := range current {
+		if current[i].ID != proposed[i].ID || len(current[i].Data) != len(proposed[i].Data) {
+			return false
+		}
+		for j := range current[i].Data {
+			if current[i].Data[j].ID != proposed[i].Data[j].ID {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+// dedupeRows returns the rows found for a metadata with a single located encoding.
+func dedupeRows(id int64, date time.Time, estimated bool, location string, tags []string,
+	encodingID int64, hash string, path string) *pgxmock.Rows {
+	return pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	}).AddRow(id, date, estimated, location, tags, nil, nil, nil, "", "",
+		encodingID, time.Duration(0), Resolution{Width: 1024, Height: 768, Scan: 'P'}, MimeJPEG, hash,
+		encodingID*10, SourceFile, path)
+}
+
+var (
+	dedupeEarly = time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	dedupeLate  = time.Date(2021, 3, 20, 13, 24, 56, 0, time.UTC)
+)
+
+func TestMergeMetadata(t *testing.T) {
+	all := []Metadata{
+		{
+			ID:            1,
+			Date:          dedupeEarly,
+			DateEstimated: true,
+			Tags:          []string{"beach", "family"},
+			Data: []Encoding{
+				{ID: 10, Hash: "ABCD", Locator: []Locator{fileSystemLocator{Path: "/a/bar.jpg"}}},
+			},
+		},
+		{
+			ID:       2,
+			Date:     dedupeLate,
+			Location: "Brighton",
+			Tags:     []string{"family", "summer"},
+			Data: []Encoding{
+				{ID: 20, Hash: "ABCD", Locator: []Locator{
+					fileSystemLocator{Path: "/a/bar.jpg"},
+					fileSystemLocator{Path: "/b/bar.jpg"},
+				}},
+				{ID: 21, Hash: "EF01", Locator: []Locator{fileSystemLocator{Path: "/b/bar-small.jpg"}}},
+			},
+		},
+	}
+
+	merged := mergeMetadata(all)
+
+	if merged.ID != 1 || merged.Location != "Brighton" {
+		t.Errorf("Expected the first metadata to be kept with the location of the second but got %+v", merged)
+	}
+	if !merged.Date.Equal(dedupeLate) || merged.DateEstimated {
+		t.Errorf("Expected the date read from the media over the estimate but got %v, %v", merged.Date, merged.DateEstimated)
+	}
+	if !reflect.DeepEqual(merged.Tags, []string{"beach", "family", "summer"}) {
+		t.Errorf("Expected the union of the tags but got %v", merged.Tags)
+	}
+
+	if len(merged.Data) != 2 || merged.Data[0].ID != 10 || merged.Data[1].ID != 21 {
+		t.Fatalf("Expected encodings 10 and 21 but got %+v", merged.Data)
+	}
+	expected := []Locator{fileSystemLocator{Path: "/a/bar.jpg"}, fileSystemLocator{Path: "/b/bar.jpg"}}
+	if !reflect.DeepEqual(merged.Data[0].Locator, expected) {
+		t.Errorf("Expected the locators of both encodings but got %v", merged.Data[0].Locator)
+	}
+	if len(all[0].Data[0].Locator) != 1 {
+		t.Errorf("Expected the proposed metadata to be left alone")
+	}
+}
+
+func TestMergeMetadata_EarliestDate(t *testing.T) {
+	merged := mergeMetadata([]Metadata{
+		{ID: 1, Date: dedupeLate, Tags: []string{}},
+		{ID: 2, Date: dedupeEarly, Tags: []string{}},
+	})
+
+	if !merged.Date.Equal(dedupeEarly) {
+		t.Errorf("Expected the earliest date but got %v", merged.Date)
+	}
+}
+
+func expectDuplicates(caller *TestDBCaller) {
+	caller.Conn.ExpectQuery(`SELECT file_hash, array_agg`).
+		WillReturnRows(pgxmock.NewRows([]string{"file_hash", "array_agg"}).
+			AddRow("ABCD", []int64{2, 1}))
+	expectDuplicateMetadata(caller)
+}
+
+func expectDuplicateMetadata(caller *TestDBCaller) {
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeLate, false, "", []string{"beach"}, 10, "ABCD", "/a/bar.jpg"))
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(2)).
+		WillReturnRows(dedupeRows(2, dedupeEarly, false, "Brighton", []string{"summer"}, 20, "ABCD", "/b/bar.jpg"))
+}
+
+func TestDeduper_Proposals(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	expectDuplicates(caller)
+
+	proposals, err := NewDeduper(caller).Proposals(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error finding duplicates: %v", err)
+	}
+
+	if len(proposals) != 1 || proposals[0].Hash != "ABCD" || len(proposals[0].Metadata) != 2 {
+		t.Fatalf("Expected a single proposal for ABCD but got %+v", proposals)
+	}
+	merged := proposals[0].Merged
+	if merged.ID != 1 || !merged.Date.Equal(dedupeEarly) || !reflect.DeepEqual(merged.Tags, []string{"beach", "summer"}) {
+		t.Errorf("Expected metadata 1 with the earliest date and both tags but got %+v", merged)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDeduper_Merge(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	expectDuplicates(caller)
+	deduper := NewDeduper(caller)
+	proposals, _ := deduper.Proposals(ctx)
+
+	caller.Conn.ExpectExec(`SELECT id FROM metadata WHERE id = ANY`).
+		WithArgs([]int64{1, 2}).
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	expectDuplicateMetadata(caller)
+	caller.Conn.ExpectExec(`UPDATE locator SET encoding_id`).WithArgs(int64(10), int64(20)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM locator WHERE encoding_id`).WithArgs(int64(20)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	// The thumbnails of the duplicate are kept for the sizes the kept encoding hasn't got.
+	caller.Conn.ExpectExec(`UPDATE encoding_derivative SET source_id`).WithArgs(int64(10), int64(20)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM locator\s+WHERE encoding_id IN \(SELECT encoding_id FROM encoding_derivative`).
+		WithArgs(int64(20)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	caller.Conn.ExpectExec(`DELETE FROM encoding\s+WHERE id IN \(SELECT encoding_id FROM encoding_derivative`).
+		WithArgs(int64(20)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	// The identifiers of the merged entities are kept, as ones that aren't canonical if
+	// the kept entity is published too, rather than being deleted.
+	caller.Conn.ExpectExec(`UPDATE published_entity SET referenced_id = \$3,\s+canonical = canonical AND NOT EXISTS`).
+		WithArgs(EntityEncoding, int64(20), int64(10)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM encoding`).WithArgs(int64(20)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`UPDATE published_entity SET referenced_id = \$3,\s+canonical = canonical AND NOT EXISTS`).
+		WithArgs(EntityMetadata, int64(2), int64(1)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM metadata`).WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`UPDATE metadata SET`).
+		WithArgs(int64(1), dedupeEarly, false, "Brighton", []string{"beach", "summer"}, noCoordinate, noCoordinate, noCoordinate, "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	merged, err := deduper.Merge(ctx, proposals[0])
+	if err != nil {
+		t.Fatalf("Unexpected error merging: %v", err)
+	}
+
+	if !caller.Committed || caller.RolledBack {
+		t.Errorf("Expected the merge to be committed")
+	}
+	if len(merged.Data) != 1 || len(merged.Data[0].Locator) != 2 {
+		t.Errorf("Expected a single encoding with both locators but got %+v", merged.Data)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDeduper_MergeStale(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	expectDuplicates(caller)
+	deduper := NewDeduper(caller)
+	proposals, _ := deduper.Proposals(ctx)
+
+	caller.Conn.ExpectExec(`SELECT id FROM metadata WHERE id = ANY`).
+		WithArgs([]int64{1, 2}).
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeLate, false, "", []string{"beach"}, 10, "ABCD", "/a/bar.jpg"))
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(2)).
+		WillReturnRows(dedupeRows(2, dedupeEarly, false, "Brighton", []string{"summer"}, 20, "EF01", "/b/bar.jpg"))
+
+	if _, err := deduper.Merge(ctx, proposals[0]); !errors.Is(err, ErrStaleProposal) {
+		t.Errorf("Expected the proposal to be stale but got %v", err)
+	}
+	if caller.Committed || !caller.RolledBack {
+		t.Errorf("Expected the merge to be rolled back")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
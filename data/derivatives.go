@@ -0,0 +1,483 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Derivatives are encodings generated from another encoding of the same metadata,
+// such as a thumbnail.  Which encoding each was made from, and at what size, is kept
+// in the encoding_derivative table:
+//
+//	CREATE TABLE encoding_derivative (
+//		encoding_id BIGINT PRIMARY KEY REFERENCES encoding (id) ON DELETE CASCADE,
+//		source_id   BIGINT NOT NULL REFERENCES encoding (id) ON DELETE CASCADE,
+//		size        VARCHAR(32) NOT NULL,
+//		UNIQUE (source_id, size)
+//	);
+const (
+	selectMetadataDerivatives = `SELECT encoding_derivative.encoding_id, encoding_derivative.source_id, encoding_derivative.size
+		FROM encoding_derivative
+			INNER JOIN encoding on encoding.id = encoding_derivative.encoding_id
+		WHERE encoding.metadata_id = $1`
+	insertDerivative = `INSERT INTO encoding_derivative (encoding_id, source_id, size)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (source_id, size) DO NOTHING
+		RETURNING encoding_id`
+	deleteDerivativeLocators = `DELETE FROM locator
+		WHERE encoding_id IN (SELECT encoding_id FROM encoding_derivative WHERE source_id = $1)`
+	deleteDerivativeEncodings = `DELETE FROM encoding
+		WHERE id IN (SELECT encoding_id FROM encoding_derivative WHERE source_id = $1)`
+	moveDerivatives = `UPDATE encoding_derivative SET source_id = $1
+		WHERE source_id = $2 AND size NOT IN (SELECT size FROM encoding_derivative WHERE source_id = $1)`
+	updateSourceResolution = `UPDATE encoding SET resolution = ROW($2, $3, $4)::resolution
+		WHERE id = $1`
+	selectMetadataIdsPaging = `SELECT id FROM metadata
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+)
+
+const (
+	// derivativeBatchSize is how many metadata GenerateAll reads at a time.
+	derivativeBatchSize = 500
+	// derivativeJPEGQuality is the quality JPEG derivatives are encoded with.
+	derivativeJPEGQuality = 85
+)
+
+var (
+	ErrNotDerivable        = errors.New("metadata has no image that can be decoded")
+	ErrInvalidDerivative   = errors.New("invalid derivative size")
+	ErrUnknownDerivative   = errors.New("unknown derivative size")
+	DefaultDerivativeSizes = []DerivativeSize{
+		{Name: "thumbnail", Width: 160, Height: 160},
+		{Name: "preview", Width: 1024, Height: 1024},
+	}
+)
+
+// DerivativeSize is a box that derivatives are scaled down to fit in, keeping the
+// proportions of the image.
+type DerivativeSize struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// ParseDerivativeSizes reads sizes written as comma separated name=WIDTHxHEIGHT,
+// e.g. thumbnail=160x160,preview=1024x1024.
+func ParseDerivativeSizes(text string) ([]DerivativeSize, error) {
+	var result []DerivativeSize
+	names := map[string]bool{}
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		named := strings.SplitN(part, "=", 2)
+		if len(named) != 2 || named[0] == "" {
+			return nil, fmt.Errorf("%w: %q is not name=WIDTHxHEIGHT", ErrInvalidDerivative, part)
+		}
+		dimensions := strings.SplitN(strings.ToLower(named[1]), "x", 2)
+		if len(dimensions) != 2 {
+			return nil, fmt.Errorf("%w: %q is not name=WIDTHxHEIGHT", ErrInvalidDerivative, part)
+		}
+		width, widthErr := strconv.Atoi(dimensions[0])
+		height, heightErr := strconv.Atoi(dimensions[1])
+		if widthErr != nil || heightErr != nil || width < 1 || height < 1 {
+			return nil, fmt.Errorf("%w: %q is not name=WIDTHxHEIGHT", ErrInvalidDerivative, part)
+		}
+		if names[named[0]] {
+			return nil, fmt.Errorf("%w: %q is named twice", ErrInvalidDerivative, named[0])
+		}
+		names[named[0]] = true
+		result = append(result, DerivativeSize{Name: named[0], Width: width, Height: height})
+	}
+	return result, nil
+}
+
+// fit returns the dimensions of an image scaled down to fit in the size, and
+// whether it needs scaling at all.
+func (ds DerivativeSize) fit(width, height int) (int, int, bool) {
+	if width <= ds.Width && height <= ds.Height {
+		return width, height, false
+	}
+	if width*ds.Height > height*ds.Width {
+		return ds.Width, max1(height * ds.Width / width), true
+	}
+	return max1(width * ds.Height / height), ds.Height, true
+}
+
+func max1(value int) int {
+	if value < 1 {
+		return 1
+	}
+	return value
+}
+
+// DerivativeStore keeps the content of generated derivatives, named by its hash.
+type DerivativeStore interface {
+	Store(ctx context.Context, hash, mimeType string, content []byte) (Locator, error)
+}
+
+// DerivativeResult counts what GenerateAll did.
+type DerivativeResult struct {
+	Checked   int
+	Generated int
+	Skipped   int
+	Failures  []DerivativeFailure
+}
+
+// DerivativeFailure is metadata a derivative couldn't be made for.
+type DerivativeFailure struct {
+	MetadataID int64
+	Size       string
+	Err        error
+}
+
+// DerivativeGenerator renders smaller versions of images into a store, adding each
+// as another encoding of the metadata.  JPEG, PNG and GIF images, or any other
+// format registered with the image package, can be decoded.  JPEGs are rendered as
+// JPEG and everything else as PNG, keeping any transparency.
+type DerivativeGenerator struct {
+	db    DBCaller
+	store DerivativeStore
+	sizes []DerivativeSize
+}
+
+func NewDerivativeGenerator(db DBCaller, store DerivativeStore, sizes []DerivativeSize) DerivativeGenerator {
+	return DerivativeGenerator{
+		db:    db,
+		store: store,
+		sizes: sizes,
+	}
+}
+
+// Size returns the size with the name.
+func (dg DerivativeGenerator) Size(name string) (DerivativeSize, error) {
+	for _, size := range dg.sizes {
+		if size.Name == name {
+			return size, nil
+		}
+	}
+	return DerivativeSize{}, fmt.Errorf("%w: %q", ErrUnknownDerivative, name)
+}
+
+// derivative is a row of encoding_derivative.
+type derivative struct {
+	sourceID int64
+	size     string
+}
+
+// Derivative returns the encoding of the metadata at the size, generating it the
+// first time it's asked for.  An image that already fits in the size is returned as
+// it is.
+func (dg DerivativeGenerator) Derivative(ctx context.Context, metadataID int64, size DerivativeSize) (Encoding, error) {
+	encoding, _, err := dg.derive(ctx, metadataID, size)
+	return encoding, err
+}
+
+// derive returns the derivative, reporting whether it had to be generated.
+func (dg DerivativeGenerator) derive(ctx context.Context, metadataID int64, size DerivativeSize) (Encoding, bool, error) {
+	metadata, derivatives, err := dg.load(ctx, metadataID)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+
+	source, ok := derivativeSource(metadata, derivatives)
+	if !ok {
+		return Encoding{}, false, fmt.Errorf("%w: metadata %d", ErrNotDerivable, metadataID)
+	}
+	if existing, ok := findDerivative(metadata, derivatives, source.ID, size.Name); ok {
+		return existing, false, nil
+	}
+
+	encoding, created, err := dg.generate(ctx, metadata.ID, source, size)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	if created {
+		return encoding, encoding.ID != source.ID, nil
+	}
+
+	// It was generated by another request at the same time.
+	metadata, derivatives, err = dg.load(ctx, metadataID)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	if existing, ok := findDerivative(metadata, derivatives, source.ID, size.Name); ok {
+		return existing, false, nil
+	}
+	return Encoding{}, false, fmt.Errorf("%w: %s derivative of encoding %d", ErrNoLocator, size.Name, source.ID)
+}
+
+// load reads the metadata with its derivatives, keyed by the id of their encoding.
+func (dg DerivativeGenerator) load(ctx context.Context, metadataID int64) (Metadata, map[int64]derivative, error) {
+	metadata, err := dbMetadataServer{db: dg.db}.FindById(ctx, metadataID)
+	if err != nil {
+		return Metadata{}, nil, err
+	}
+	if metadata == nil {
+		return Metadata{}, nil, fmt.Errorf("%w: %d", ErrMetadataNotFound, metadataID)
+	}
+
+	rows, err := dg.db.Query(ctx, selectMetadataDerivatives, metadataID)
+	if err != nil {
+		return Metadata{}, nil, err
+	}
+	defer rows.Close()
+
+	derivatives := map[int64]derivative{}
+	for rows.Next() {
+		var encodingID int64
+		var d derivative
+		if err := rows.Scan(&encodingID, &d.sourceID, &d.size); err != nil {
+			return Metadata{}, nil, err
+		}
+		derivatives[encodingID] = d
+	}
+	return *metadata, derivatives, rows.Err()
+}
+
+// derivativeSource is the first image of the metadata that isn't itself a derivative.
+func derivativeSource(metadata Metadata, derivatives map[int64]derivative) (Encoding, bool) {
+	for _, encoding := range metadata.Data {
+		if _, ok := derivatives[encoding.ID]; !ok && isImage(encoding.MimeType) {
+			return encoding, true
+		}
+	}
+	return Encoding{}, false
+}
+
+func findDerivative(metadata Metadata, derivatives map[int64]derivative, sourceID int64, size string) (Encoding, bool) {
+	for _, encoding := range metadata.Data {
+		if d, ok := derivatives[encoding.ID]; ok && d.sourceID == sourceID && d.size == size {
+			return encoding, true
+		}
+	}
+	return Encoding{}, false
+}
+
+// generate renders the source at the size and records it, reporting false if another
+// derivative of the size was recorded first.  The dimensions of the source are read
+// from its header and recorded as its resolution before it's decoded, so a source
+// that already fits is returned without being decoded, or read again later.
+func (dg DerivativeGenerator) generate(ctx context.Context, metadataID int64, source Encoding, size DerivativeSize) (Encoding, bool, error) {
+	known := source.Resolution.Width > 0 && source.Resolution.Height > 0
+	if _, _, scale := size.fit(source.Resolution.Width, source.Resolution.Height); known && !scale {
+		return source, true, nil
+	}
+
+	stream, err := OpenEncodingContext(ctx, source)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	defer stream.Close()
+
+	config, format, r, err := readImageConfig(stream)
+	if err != nil {
+		return Encoding{}, false, fmt.Errorf("%w: encoding %d: %v", ErrNotDerivable, source.ID, err)
+	}
+	if config.Width != source.Resolution.Width || config.Height != source.Resolution.Height {
+		_, err := dg.db.Exec(ctx, updateSourceResolution, source.ID, config.Width, config.Height, scanString('P'))
+		if err != nil {
+			return Encoding{}, false, err
+		}
+	}
+
+	width, height, scale := size.fit(config.Width, config.Height)
+	if !scale {
+		return source, true, nil
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return Encoding{}, false, fmt.Errorf("%w: encoding %d: %v", ErrNotDerivable, source.ID, err)
+	}
+
+	var content bytes.Buffer
+	encoding := Encoding{
+		Resolution: Resolution{Width: width, Height: height, Scan: 'P'},
+		MimeType:   MimePNG,
+	}
+	scaled := scaleImage(img, width, height)
+	if format == "jpeg" {
+		encoding.MimeType = MimeJPEG
+		err = jpeg.Encode(&content, scaled, &jpeg.Options{Quality: derivativeJPEGQuality})
+	} else {
+		err = png.Encode(&content, scaled)
+	}
+	if err != nil {
+		return Encoding{}, false, err
+	}
+
+	sum := sha256.Sum256(content.Bytes())
+	encoding.Hash = hex.EncodeToString(sum[:])
+	l, err := dg.store.Store(ctx, encoding.Hash, encoding.MimeType, content.Bytes())
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	encoding.Locator = []Locator{l}
+
+	return dg.record(ctx, metadataID, source.ID, size.Name, encoding)
+}
+
+// record adds the derivative as an encoding of the metadata in one transaction.
+func (dg DerivativeGenerator) record(ctx context.Context, metadataID, sourceID int64, size string, encoding Encoding) (Encoding, bool, error) {
+	tx, err := dg.db.Begin(ctx)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+
+	created, err := dbMetadataServer{db: tx}.createEncoding(ctx, tx, metadataID, encoding)
+	if err != nil {
+		rollback(ctx, tx)
+		return Encoding{}, false, err
+	}
+
+	var encodingID int64
+	err = tx.QueryRow(ctx, insertDerivative, created.ID, sourceID, size).Scan(&encodingID)
+	if err == pgx.ErrNoRows {
+		rollback(ctx, tx)
+		return Encoding{}, false, nil
+	}
+	if err != nil {
+		rollback(ctx, tx)
+		return Encoding{}, false, err
+	}
+
+	return created, true, tx.Commit(ctx)
+}
+
+// deleteDerivatives removes the encodings generated from the source, along with their
+// locators.  Their encoding_derivative rows go with the encodings.
+func deleteDerivatives(ctx context.Context, tx DBCaller, sourceID int64) error {
+	if _, err := tx.Exec(ctx, deleteDerivativeLocators, sourceID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, deleteDerivativeEncodings, sourceID)
+	return err
+}
+
+// GenerateAll makes every size of derivative for each metadata with an image, ahead
+// of it being asked for.  Metadata without an image that can be decoded are skipped,
+// and a derivative that fails is recorded in the result.  It stops if ctx is done.
+func (dg DerivativeGenerator) GenerateAll(ctx context.Context) (DerivativeResult, error) {
+	var result DerivativeResult
+	var lastID int64
+	for {
+		ids, err := dg.metadataIds(ctx, lastID)
+		if err != nil {
+			return result, err
+		}
+
+		for _, id := range ids {
+			lastID = id
+			result.Checked++
+			for _, size := range dg.sizes {
+				if err := ctx.Err(); err != nil {
+					return result, err
+				}
+
+				_, generated, err := dg.derive(ctx, id, size)
+				if errors.Is(err, ErrNotDerivable) {
+					result.Skipped++
+					break
+				}
+				if err != nil {
+					result.Failures = append(result.Failures, DerivativeFailure{MetadataID: id, Size: size.Name, Err: err})
+					continue
+				}
+				if generated {
+					result.Generated++
+				}
+			}
+		}
+
+		if len(ids) < derivativeBatchSize {
+			return result, nil
+		}
+	}
+}
+
+func (dg DerivativeGenerator) metadataIds(ctx context.Context, afterID int64) ([]int64, error) {
+	rows, err := dg.db.Query(ctx, selectMetadataIdsPaging, afterID, derivativeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// scaleImage shrinks the image to width x height, averaging the pixels that fall in
+// each pixel of the result.
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	sums := make([][4]uint64, width*height)
+	counts := make([]uint64, width*height)
+
+	columns := make([]int, bounds.Dx())
+	for x := range columns {
+		columns[x] = x * width / bounds.Dx()
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * height / bounds.Dy() * width
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cell := row + columns[x-bounds.Min.X]
+			r, g, b, a := rgbaAt(img, x, y)
+			sums[cell][0] += uint64(r)
+			sums[cell][1] += uint64(g)
+			sums[cell][2] += uint64(b)
+			sums[cell][3] += uint64(a)
+			counts[cell]++
+		}
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, sum := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		n := counts[i]
+		result.SetRGBA64(i%width, i/width, color.RGBA64{
+			R: uint16(sum[0] / n),
+			G: uint16(sum[1] / n),
+			B: uint16(sum[2] / n),
+			A: uint16(sum[3] / n),
+		})
+	}
+	return result
+}
+
+// rgbaAt reads the alpha premultiplied colour of a pixel, converting JPEG pixels
+// directly rather than through the color.Color interface.
+func rgbaAt(img image.Image, x, y int) (uint32, uint32, uint32, uint32) {
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		yi, ci := ycbcr.YOffset(x, y), ycbcr.COffset(x, y)
+		r, g, b := color.YCbCrToRGB(ycbcr.Y[yi], ycbcr.Cb[ci], ycbcr.Cr[ci])
+		return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+	}
+	return img.At(x, y).RGBA()
+}
@@ -0,0 +1,295 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestParseDerivativeSizes(t *testing.T) {
+	sizes, err := ParseDerivativeSizes("thumbnail=160x160, poster=640x360")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing: %v", err)
+	}
+
+	expected := []DerivativeSize{
+		{Name: "thumbnail", Width: 160, Height: 160},
+		{Name: "poster", Width: 640, Height: 360},
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, sizes)
+	}
+
+	for _, invalid := range []string{"thumbnail", "thumbnail=160", "thumbnail=0x160", "=160x160", "a=1x1,a=2x2"} {
+		if _, err := ParseDerivativeSizes(invalid); !errors.Is(err, ErrInvalidDerivative) {
+			t.Errorf("Expected %q to be invalid but got %v", invalid, err)
+		}
+	}
+}
+
+func TestDerivativeSize_Fit(t *testing.T) {
+	thumbnail := DerivativeSize{Name: "thumbnail", Width: 160, Height: 160}
+
+	if width, height, scale := thumbnail.fit(640, 480); width != 160 || height != 120 || !scale {
+		t.Errorf("Expected a landscape image to fit the width but got %dx%d, %v", width, height, scale)
+	}
+	if width, height, scale := thumbnail.fit(480, 640); width != 120 || height != 160 || !scale {
+		t.Errorf("Expected a portrait image to fit the height but got %dx%d, %v", width, height, scale)
+	}
+	if _, _, scale := thumbnail.fit(100, 80); scale {
+		t.Errorf("Expected an image that already fits not to be scaled")
+	}
+}
+
+func TestScaleImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			level := uint8(0)
+			if x%2 == 1 {
+				level = 200
+			}
+			img.Set(x, y, color.RGBA{R: level, G: level, B: level, A: 255})
+		}
+	}
+
+	scaled := scaleImage(img, 2, 1)
+	if scaled.Bounds().Dx() != 2 || scaled.Bounds().Dy() != 1 {
+		t.Fatalf("Expected a 2x1 image but got %v", scaled.Bounds())
+	}
+	if c := scaled.RGBAAt(0, 0); c.R != 100 || c.A != 255 {
+		t.Errorf("Expected the average of the pixels but got %+v", c)
+	}
+}
+
+// storedDerivative records what was given to Store.
+type storedDerivative struct {
+	hash     string
+	mimeType string
+	content  []byte
+}
+
+type mockDerivativeStore struct {
+	stored *[]storedDerivative
+}
+
+func (ms mockDerivativeStore) Store(_ context.Context, hash, mimeType string, content []byte) (Locator, error) {
+	*ms.stored = append(*ms.stored, storedDerivative{hash: hash, mimeType: mimeType, content: content})
+	return fileSystemLocator{Path: "/derivatives/" + hash}, nil
+}
+
+// writeTestImage writes a JPEG of the test scene, returning its path and hash.
+func writeTestImage(t *testing.T, width, height int) (string, string) {
+	content := encodeTestImage(t, testScene(width, height, false), true)
+	path := filepath.Join(t.TempDir(), "scene.jpg")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Unable to write the test image: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	return path, hex.EncodeToString(sum[:])
+}
+
+func TestDerivativeGenerator_Derivative(t *testing.T) {
+	path, hash := writeTestImage(t, 640, 480)
+	var stored []storedDerivative
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeEarly, false, "", []string{}, 10, hash, path))
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}))
+	caller.Conn.ExpectExec(`UPDATE encoding SET resolution`).WithArgs(int64(10), 640, 480, "P").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(1), pgxmock.AnyArg(), 160, 120, "P", MimeJPEG, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(11)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(110)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding_derivative`).WithArgs(int64(11), int64(10), "thumbnail").
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id"}).AddRow(int64(11)))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{stored: &stored}, DefaultDerivativeSizes)
+	thumbnail, _ := generator.Size("thumbnail")
+	encoding, err := generator.Derivative(ctx, 1, thumbnail)
+	if err != nil {
+		t.Fatalf("Unexpected error generating: %v", err)
+	}
+
+	if encoding.ID != 11 || encoding.MimeType != MimeJPEG || encoding.Resolution.Width != 160 || encoding.Resolution.Height != 120 {
+		t.Errorf("Expected a 160x120 JPEG encoding but got %+v", encoding)
+	}
+	if len(stored) != 1 || stored[0].hash != encoding.Hash {
+		t.Fatalf("Expected the derivative to be stored under its hash but got %d stored", len(stored))
+	}
+
+	sum := sha256.Sum256(stored[0].content)
+	if hex.EncodeToString(sum[:]) != encoding.Hash {
+		t.Errorf("Expected the hash of the stored content")
+	}
+	if !caller.Committed {
+		t.Errorf("Expected the derivative to be committed")
+	}
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDerivativeGenerator_Existing(t *testing.T) {
+	rows := dedupeRows(1, dedupeEarly, false, "", []string{}, 10, "ABCD", "/a/scene.jpg").
+		AddRow(int64(1), dedupeEarly, false, "", []string{}, nil, nil, nil, "", "",
+			int64(11), nil, Resolution{Width: 160, Height: 120, Scan: 'P'}, MimeJPEG, "EF01",
+			int64(110), SourceFile, "/derivatives/EF01")
+	var stored []storedDerivative
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).WillReturnRows(rows)
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}).
+			AddRow(int64(11), int64(10), "thumbnail"))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{stored: &stored}, DefaultDerivativeSizes)
+	thumbnail, _ := generator.Size("thumbnail")
+	encoding, err := generator.Derivative(ctx, 1, thumbnail)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if encoding.ID != 11 {
+		t.Errorf("Expected the existing derivative but got %+v", encoding)
+	}
+	if len(stored) != 0 {
+		t.Errorf("Expected nothing to be generated but %d were stored", len(stored))
+	}
+}
+
+func TestDerivativeGenerator_AlreadyFits(t *testing.T) {
+	path, hash := writeTestImage(t, 120, 90)
+	var stored []storedDerivative
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeEarly, false, "", []string{}, 10, hash, path))
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}))
+	// The dimensions are recorded so the source isn't read again.
+	caller.Conn.ExpectExec(`UPDATE encoding SET resolution`).WithArgs(int64(10), 120, 90, "P").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{stored: &stored}, DefaultDerivativeSizes)
+	thumbnail, _ := generator.Size("thumbnail")
+	encoding, err := generator.Derivative(ctx, 1, thumbnail)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if encoding.ID != 10 || len(stored) != 0 {
+		t.Errorf("Expected the source to be served as it is but got %+v", encoding)
+	}
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDerivativeGenerator_RecordedFits(t *testing.T) {
+	// The 1024x768 resolution already recorded fits, so the missing file isn't read.
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeEarly, false, "", []string{}, 10, "ABCD", "/a/missing.jpg"))
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{}, DefaultDerivativeSizes)
+	preview, _ := generator.Size("preview")
+	encoding, err := generator.Derivative(ctx, 1, preview)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if encoding.ID != 10 {
+		t.Errorf("Expected the source to be served as it is but got %+v", encoding)
+	}
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDerivativeGenerator_TooLarge(t *testing.T) {
+	content := largePNG(t)
+	path := writeTestFile(t, t.TempDir(), "huge.png", content)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeEarly, false, "", []string{}, 10, contentHash(content), path))
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{}, DefaultDerivativeSizes)
+	thumbnail, _ := generator.Size("thumbnail")
+	if _, err := generator.Derivative(ctx, 1, thumbnail); !errors.Is(err, ErrNotDerivable) {
+		t.Errorf("Expected an image too large to decode not to be derivable but got %v", err)
+	}
+}
+
+func TestDerivativeGenerator_WebP(t *testing.T) {
+	// A lossless 1x1 WebP.
+	content := []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")
+	path := writeTestFile(t, t.TempDir(), "dot.webp", content)
+	rows := pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	}).AddRow(int64(1), dedupeEarly, false, "", []string{}, nil, nil, nil, "", "",
+		int64(10), time.Duration(0), Resolution{}, MimeWEBP, contentHash(content),
+		int64(100), SourceFile, path)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).WillReturnRows(rows)
+	caller.Conn.ExpectQuery(`SELECT encoding_derivative.encoding_id`).WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id", "source_id", "size"}))
+	caller.Conn.ExpectExec(`UPDATE encoding SET resolution`).WithArgs(int64(10), 1, 1, "P").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{}, DefaultDerivativeSizes)
+	thumbnail, _ := generator.Size("thumbnail")
+	encoding, err := generator.Derivative(ctx, 1, thumbnail)
+	if err != nil {
+		t.Fatalf("Expected the WebP to be decoded but got %v", err)
+	}
+
+	if encoding.ID != 10 {
+		t.Errorf("Expected the WebP to be served as it is but got %+v", encoding)
+	}
+}
+
+func TestDerivativeGenerator_UnknownSize(t *testing.T) {
+	caller, _ := createTestDBCaller()
+	generator := NewDerivativeGenerator(caller, mockDerivativeStore{}, DefaultDerivativeSizes)
+
+	if _, err := generator.Size("poster"); !errors.Is(err, ErrUnknownDerivative) {
+		t.Errorf("Expected an unknown size but got %v", err)
+	}
+}
+
+func TestFileSystemTarget_Store(t *testing.T) {
+	root := t.TempDir()
+	content := []byte(testContent)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	l, err := NewFileSystemTarget(root).Store(context.Background(), hash, MimePNG, content)
+	if err != nil {
+		t.Fatalf("Unexpected error storing: %v", err)
+	}
+
+	expected := filepath.Join(root, hash[:2], hash)
+	if path, _ := locatorPath(l); path != expected {
+		t.Errorf("Expected the derivative at %s but got %s", expected, path)
+	}
+	if written, err := os.ReadFile(expected); err != nil || string(written) != testContent {
+		t.Errorf("Expected the content to be written but got %v", err)
+	}
+}
@@ -0,0 +1,589 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidExif = errors.New("invalid exif data")
+)
+
+const (
+	exifDateLayout   = "2006:01:02 15:04:05"
+	sidecarExtension = ".xmp"
+	// maxIFDEntries guards against a corrupt entry count sending us reading
+	// through the whole file.
+	maxIFDEntries = 1024
+	// maxJPEGHeader is as far into a JPEG we look for the APP1 segments.
+	maxJPEGHeader = 1 << 20
+
+	tagImageDescription = 0x010E
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTime       = 0x9011
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+
+	exifByte      = 1
+	exifASCII     = 2
+	exifShort     = 3
+	exifLong      = 4
+	exifRational  = 5
+	exifUndefined = 7
+	exifSRational = 10
+
+	nsDublinCore = "http://purl.org/dc/elements/1.1/"
+	nsExif       = "http://ns.adobe.com/exif/1.0/"
+	nsPhotoshop  = "http://ns.adobe.com/photoshop/1.0/"
+	nsXMP        = "http://ns.adobe.com/xap/1.0/"
+	nsRDF        = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsXML        = "http://www.w3.org/XML/1998/namespace"
+	// xmpDefaultLanguage marks the default of the alternatives of a language
+	// alternative, such as dc:description.
+	xmpDefaultLanguage = "x-default"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte(nsXMP + "\x00")
+	// xmpDateLayouts are the forms of ISO 8601 allowed by XMP, most precise first.
+	xmpDateLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04Z07:00",
+		"2006-01-02T15:04",
+		"2006-01-02",
+	}
+)
+
+// EmbeddedMetadata is what the media says about itself, in its EXIF or XMP data,
+// or in an XMP sidecar file next to it.
+type EmbeddedMetadata struct {
+	// DateTimeOriginal is when the media was captured, or zero if it isn't known.
+	DateTimeOriginal time.Time
+	Coordinates      *Coordinates
+	Keywords         []string
+	Description      string
+}
+
+// merge fills in whatever is missing from em with what's in other.  Keywords
+// from both are kept.
+func (em EmbeddedMetadata) merge(other EmbeddedMetadata) EmbeddedMetadata {
+	if em.DateTimeOriginal.IsZero() {
+		em.DateTimeOriginal = other.DateTimeOriginal
+	}
+	if em.Coordinates == nil {
+		em.Coordinates = other.Coordinates
+	}
+	if em.Description == "" {
+		em.Description = other.Description
+	}
+
+	em.Keywords = uniqueKeywords(em.Keywords, other.Keywords)
+	return em
+}
+
+// uniqueKeywords joins the lists of keywords, keeping the first of any repeats.
+func uniqueKeywords(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, keywords := range lists {
+		for _, keyword := range keywords {
+			if !seen[keyword] {
+				seen[keyword] = true
+				result = append(result, keyword)
+			}
+		}
+	}
+	return result
+}
+
+// ReadEmbeddedMetadata reads the EXIF and XMP data from a JPEG or TIFF file, and
+// the XMP sidecar for any file.  A sidecar is named either for the file without
+// its extension, bar.xmp, or with it, bar.jpg.xmp.  What's in the sidecar wins, as
+// that is where editors write their changes.
+func ReadEmbeddedMetadata(path, mimeType string) (EmbeddedMetadata, error) {
+	var result EmbeddedMetadata
+	for _, sidecar := range []string{strings.TrimSuffix(path, filepath.Ext(path)) + sidecarExtension, path + sidecarExtension} {
+		content, err := os.ReadFile(sidecar)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return EmbeddedMetadata{}, err
+		}
+		found, err := parseXMP(content)
+		if err != nil {
+			return EmbeddedMetadata{}, err
+		}
+		result = result.merge(found)
+	}
+
+	var embedded EmbeddedMetadata
+	var err error
+	switch mimeType {
+	case MimeJPEG:
+		embedded, err = readJPEGMetadata(path)
+	case MimeTIFF:
+		embedded, err = readTIFFMetadata(path)
+	}
+	if err != nil {
+		return EmbeddedMetadata{}, err
+	}
+
+	return result.merge(embedded), nil
+}
+
+func readTIFFMetadata(path string) (EmbeddedMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EmbeddedMetadata{}, err
+	}
+	defer f.Close()
+
+	return parseExif(f)
+}
+
+// readJPEGMetadata walks the segments at the start of the JPEG, up to the image
+// data, reading the EXIF and XMP from the APP1 segments.
+func readJPEGMetadata(path string) (EmbeddedMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EmbeddedMetadata{}, err
+	}
+	defer f.Close()
+
+	r := io.LimitReader(f, maxJPEGHeader)
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return EmbeddedMetadata{}, ErrInvalidExif
+	}
+
+	var result EmbeddedMetadata
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return result, nil
+		}
+		if header[0] != 0xFF {
+			return result, ErrInvalidExif
+		}
+		// Start of scan or end of image, the metadata is all before this.
+		if header[1] == 0xDA || header[1] == 0xD9 {
+			return result, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return result, ErrInvalidExif
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return result, nil
+		}
+		if header[1] != 0xE1 {
+			continue
+		}
+
+		var found EmbeddedMetadata
+		switch {
+		case bytes.HasPrefix(segment, exifHeader):
+			found, err = parseExif(bytes.NewReader(segment[len(exifHeader):]))
+		case bytes.HasPrefix(segment, xmpHeader):
+			found, err = parseXMP(segment[len(xmpHeader):])
+		}
+		if err != nil {
+			return EmbeddedMetadata{}, err
+		}
+		result = result.merge(found)
+	}
+}
+
+// exifReader reads the image file directories of TIFF structured data.
+type exifReader struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+}
+
+// ifdEntry is a single tag of an image file directory.  The value holds the
+// four bytes that are either the value itself or the offset to it.
+type ifdEntry struct {
+	kind  uint16
+	count uint32
+	value [4]byte
+}
+
+func (er exifReader) uint16At(offset int64) (uint16, error) {
+	var b [2]byte
+	if _, err := er.r.ReadAt(b[:], offset); err != nil {
+		return 0, err
+	}
+	return er.order.Uint16(b[:]), nil
+}
+
+// readIFD reads the directory at offset, keyed by tag.
+func (er exifReader) readIFD(offset int64) (map[uint16]ifdEntry, error) {
+	count, err := er.uint16At(offset)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxIFDEntries {
+		return nil, ErrInvalidExif
+	}
+
+	raw := make([]byte, int(count)*12)
+	if _, err := er.r.ReadAt(raw, offset+2); err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint16]ifdEntry, count)
+	for i := 0; i < int(count); i++ {
+		field := raw[i*12 : (i+1)*12]
+		entry := ifdEntry{
+			kind:  er.order.Uint16(field[2:]),
+			count: er.order.Uint32(field[4:]),
+		}
+		copy(entry.value[:], field[8:])
+		result[er.order.Uint16(field)] = entry
+	}
+	return result, nil
+}
+
+// data returns the bytes of the value of an entry.
+func (er exifReader) data(entry ifdEntry) ([]byte, error) {
+	var size uint32
+	switch entry.kind {
+	case exifByte, exifASCII, exifUndefined:
+		size = 1
+	case exifShort:
+		size = 2
+	case exifLong:
+		size = 4
+	case exifRational, exifSRational:
+		size = 8
+	default:
+		return nil, ErrInvalidExif
+	}
+	if entry.count > maxJPEGHeader/size {
+		return nil, ErrInvalidExif
+	}
+
+	length := size * entry.count
+	if length <= 4 {
+		return entry.value[:length], nil
+	}
+	result := make([]byte, length)
+	if _, err := er.r.ReadAt(result, int64(er.order.Uint32(entry.value[:]))); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (er exifReader) ascii(entries map[uint16]ifdEntry, tag uint16) string {
+	entry, ok := entries[tag]
+	if !ok || entry.kind != exifASCII {
+		return ""
+	}
+	value, err := er.data(entry)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+func (er exifReader) offset(entries map[uint16]ifdEntry, tag uint16) (int64, bool) {
+	entry, ok := entries[tag]
+	if !ok || entry.kind != exifLong || entry.count != 1 {
+		return 0, false
+	}
+	return int64(er.order.Uint32(entry.value[:])), true
+}
+
+func (er exifReader) rationals(entries map[uint16]ifdEntry, tag uint16) []float64 {
+	entry, ok := entries[tag]
+	if !ok || entry.kind != exifRational {
+		return nil
+	}
+	value, err := er.data(entry)
+	if err != nil {
+		return nil
+	}
+
+	result := make([]float64, entry.count)
+	for i := range result {
+		numerator := er.order.Uint32(value[i*8:])
+		denominator := er.order.Uint32(value[i*8+4:])
+		if denominator == 0 {
+			return nil
+		}
+		result[i] = float64(numerator) / float64(denominator)
+	}
+	return result
+}
+
+// parseExif reads the capture date, description and GPS position from TIFF
+// structured data, as found in a TIFF file or the APP1 segment of a JPEG.
+func parseExif(r io.ReaderAt) (EmbeddedMetadata, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return EmbeddedMetadata{}, ErrInvalidExif
+	}
+
+	er := exifReader{r: r}
+	switch string(header[:2]) {
+	case "II":
+		er.order = binary.LittleEndian
+	case "MM":
+		er.order = binary.BigEndian
+	default:
+		return EmbeddedMetadata{}, ErrInvalidExif
+	}
+	if er.order.Uint16(header[2:]) != 42 {
+		return EmbeddedMetadata{}, ErrInvalidExif
+	}
+
+	ifd0, err := er.readIFD(int64(er.order.Uint32(header[4:])))
+	if err != nil {
+		return EmbeddedMetadata{}, ErrInvalidExif
+	}
+
+	result := EmbeddedMetadata{Description: er.ascii(ifd0, tagImageDescription)}
+	date, zone := er.ascii(ifd0, tagDateTime), ""
+	if offset, ok := er.offset(ifd0, tagExifIFD); ok {
+		if exif, err := er.readIFD(offset); err == nil {
+			if original := er.ascii(exif, tagDateTimeOriginal); original != "" {
+				date, zone = original, er.ascii(exif, tagOffsetTime)
+			}
+		}
+	}
+	result.DateTimeOriginal = exifDate(date, zone)
+
+	if offset, ok := er.offset(ifd0, tagGPSIFD); ok {
+		if gps, err := er.readIFD(offset); err == nil {
+			result.Coordinates = er.coordinates(gps)
+		}
+	}
+
+	return result, nil
+}
+
+// exifDate parses an EXIF date.  EXIF doesn't record the time zone unless the
+// offset is given, so without it the date is taken as UTC.
+func exifDate(date, zone string) time.Time {
+	if date == "" {
+		return time.Time{}
+	}
+	if zone != "" {
+		if t, err := time.Parse(exifDateLayout+"-07:00", date+zone); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(exifDateLayout, date)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func (er exifReader) coordinates(gps map[uint16]ifdEntry) *Coordinates {
+	latitude, ok := degrees(er.rationals(gps, tagGPSLatitude), er.ascii(gps, tagGPSLatitudeRef), "S")
+	if !ok {
+		return nil
+	}
+	longitude, ok := degrees(er.rationals(gps, tagGPSLongitude), er.ascii(gps, tagGPSLongitudeRef), "W")
+	if !ok {
+		return nil
+	}
+
+	result := &Coordinates{Latitude: latitude, Longitude: longitude}
+	if altitude := er.rationals(gps, tagGPSAltitude); len(altitude) == 1 {
+		// An altitude reference of one means below sea level.
+		if ref, ok := gps[tagGPSAltitudeRef]; ok && ref.value[0] == 1 {
+			altitude[0] = -altitude[0]
+		}
+		result.Altitude = &altitude[0]
+	}
+	return result
+}
+
+// degrees turns degrees, minutes and seconds into decimal degrees, negative
+// in the given direction.
+func degrees(dms []float64, ref, negative string) (float64, bool) {
+	if len(dms) != 3 {
+		return 0, false
+	}
+	result := dms[0] + dms[1]/60 + dms[2]/3600
+	if strings.EqualFold(ref, negative) {
+		result = -result
+	}
+	return result, true
+}
+
+// parseXMP reads the capture date, GPS position, keywords and description from an
+// XMP packet.  Properties may be given as attributes of rdf:Description or as
+// elements.  Of the languages the description is given in, the default is taken,
+// or the first if none is marked as the default.
+func parseXMP(content []byte) (EmbeddedMetadata, error) {
+	properties := make(map[xml.Name]string)
+	var keywords []string
+	var description, language string
+
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	var path []xml.Name
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return EmbeddedMetadata{}, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name)
+			language = ""
+			for _, attr := range t.Attr {
+				if attr.Name == (xml.Name{Space: nsXML, Local: "lang"}) {
+					language = attr.Value
+					continue
+				}
+				properties[attr.Name] = attr.Value
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		case xml.CharData:
+			if len(path) == 0 {
+				continue
+			}
+			value := strings.TrimSpace(string(t))
+			if value == "" {
+				continue
+			}
+			current := path[len(path)-1]
+			if current == (xml.Name{Space: nsRDF, Local: "li"}) {
+				switch {
+				case within(path, xml.Name{Space: nsDublinCore, Local: "subject"}):
+					keywords = append(keywords, value)
+				case within(path, xml.Name{Space: nsDublinCore, Local: "description"}):
+					if description == "" || language == xmpDefaultLanguage {
+						description = value
+					}
+				}
+				continue
+			}
+			properties[current] = value
+		}
+	}
+
+	var result EmbeddedMetadata
+	for _, name := range []xml.Name{
+		{Space: nsExif, Local: "DateTimeOriginal"},
+		{Space: nsPhotoshop, Local: "DateCreated"},
+		{Space: nsXMP, Local: "CreateDate"},
+	} {
+		if result.DateTimeOriginal = xmpDate(properties[name]); !result.DateTimeOriginal.IsZero() {
+			break
+		}
+	}
+
+	latitude, okLatitude := xmpDegrees(properties[xml.Name{Space: nsExif, Local: "GPSLatitude"}])
+	longitude, okLongitude := xmpDegrees(properties[xml.Name{Space: nsExif, Local: "GPSLongitude"}])
+	if okLatitude && okLongitude {
+		result.Coordinates = &Coordinates{Latitude: latitude, Longitude: longitude}
+		if altitude, ok := xmpRational(properties[xml.Name{Space: nsExif, Local: "GPSAltitude"}]); ok {
+			if properties[xml.Name{Space: nsExif, Local: "GPSAltitudeRef"}] == "1" {
+				altitude = -altitude
+			}
+			result.Coordinates.Altitude = &altitude
+		}
+	}
+
+	result.Keywords = uniqueKeywords(keywords)
+	result.Description = description
+	if result.Description == "" {
+		result.Description = properties[xml.Name{Space: nsDublinCore, Local: "description"}]
+	}
+	return result, nil
+}
+
+func within(path []xml.Name, name xml.Name) bool {
+	for _, element := range path {
+		if element == name {
+			return true
+		}
+	}
+	return false
+}
+
+func xmpDate(value string) time.Time {
+	for _, layout := range xmpDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// xmpDegrees parses an XMP GPS coordinate, given as "DDD,MM,SSk" or "DDD,MM.mmk"
+// where k is the direction N, S, E or W.
+func xmpDegrees(value string) (float64, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	direction := strings.ToUpper(value[len(value)-1:])
+	parts := strings.Split(value[:len(value)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+
+	dms := []float64{0, 0, 0}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		dms[i] = f
+	}
+
+	switch direction {
+	case "N", "E":
+		return degrees(dms, direction, "")
+	case "S", "W":
+		return degrees(dms, direction, direction)
+	}
+	return 0, false
+}
+
+// xmpRational parses an XMP rational, such as 1234/10.
+func xmpRational(value string) (float64, bool) {
+	parts := strings.Split(value, "/")
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	if len(parts) == 1 {
+		return numerator, true
+	}
+	denominator, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || denominator == 0 || len(parts) > 2 {
+		return 0, false
+	}
+	return numerator / denominator, true
+}
@@ -0,0 +1,265 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testTag struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+// writeIFD lays out a big endian directory at offset, followed by the values that
+// don't fit in the entries.
+func writeIFD(offset uint32, tags []testTag) []byte {
+	ifd := make([]byte, 2+12*len(tags)+4)
+	binary.BigEndian.PutUint16(ifd, uint16(len(tags)))
+
+	var values []byte
+	valueOffset := offset + uint32(len(ifd))
+	for i, tag := range tags {
+		field := ifd[2+12*i:]
+		binary.BigEndian.PutUint16(field, tag.tag)
+		binary.BigEndian.PutUint16(field[2:], tag.kind)
+		binary.BigEndian.PutUint32(field[4:], tag.count)
+		if len(tag.value) <= 4 {
+			copy(field[8:12], tag.value)
+			continue
+		}
+		binary.BigEndian.PutUint32(field[8:], valueOffset+uint32(len(values)))
+		values = append(values, tag.value...)
+	}
+	return append(ifd, values...)
+}
+
+func testLong(value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return b
+}
+
+func testRationals(values ...uint32) []byte {
+	var result []byte
+	for _, value := range values {
+		result = append(result, testLong(value)...)
+	}
+	return result
+}
+
+func asciiTag(tag uint16, value string) testTag {
+	return testTag{tag: tag, kind: exifASCII, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+// buildTestExif builds TIFF structured data of Tower Bridge, taken in London at
+// 13:24:56 on March 20, 2021, an hour ahead of UTC.
+func buildTestExif() []byte {
+	description := asciiTag(tagImageDescription, "Tower Bridge")
+	ifd0Size := 2 + 3*12 + 4 + len(description.value)
+	exifOffset := uint32(8 + ifd0Size)
+	exif := writeIFD(exifOffset, []testTag{
+		asciiTag(tagDateTimeOriginal, "2021:03:20 13:24:56"),
+		asciiTag(tagOffsetTime, "+01:00"),
+	})
+	gpsOffset := exifOffset + uint32(len(exif))
+	gps := writeIFD(gpsOffset, []testTag{
+		asciiTag(tagGPSLatitudeRef, "N"),
+		{tag: tagGPSLatitude, kind: exifRational, count: 3, value: testRationals(51, 1, 30, 1, 0, 1)},
+		asciiTag(tagGPSLongitudeRef, "W"),
+		{tag: tagGPSLongitude, kind: exifRational, count: 3, value: testRationals(0, 1, 7, 1, 30, 1)},
+		{tag: tagGPSAltitude, kind: exifRational, count: 1, value: testRationals(355, 10)},
+	})
+	ifd0 := writeIFD(8, []testTag{
+		description,
+		{tag: tagExifIFD, kind: exifLong, count: 1, value: testLong(exifOffset)},
+		{tag: tagGPSIFD, kind: exifLong, count: 1, value: testLong(gpsOffset)},
+	})
+
+	result := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	result = append(result, ifd0...)
+	result = append(result, exif...)
+	return append(result, gps...)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    photoshop:DateCreated="2020-08-20T09:30:00-04:00"
+    exif:GPSLatitude="40,41.1N"
+    exif:GPSLongitude="74,2,40.2W">
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>boat</rdf:li>
+     <rdf:li>man</rdf:li>
+     <rdf:li>boat</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="fr">La statue de la Liberté</rdf:li>
+     <rdf:li xml:lang="x-default">The Statue of Liberty</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+   <exif:GPSAltitude>93/1</exif:GPSAltitude>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+// buildTestJPEG wraps the EXIF and XMP in the APP1 segments of a JPEG.
+func buildTestJPEG(exif []byte, xmp string) []byte {
+	result := []byte{0xFF, 0xD8}
+	for _, payload := range [][]byte{append(exifHeader, exif...), append(xmpHeader, xmp...)} {
+		segment := []byte{0xFF, 0xE1, 0, 0}
+		binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+		result = append(append(result, segment...), payload...)
+	}
+	return append(result, 0xFF, 0xDA, 0, 2, 0xFF, 0xD9)
+}
+
+func TestParseExif(t *testing.T) {
+	embedded, err := parseExif(bytes.NewReader(buildTestExif()))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing exif: %v", err)
+	}
+
+	expected := time.Date(2021, 03, 20, 12, 24, 56, 0, time.UTC)
+	if !embedded.DateTimeOriginal.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, embedded.DateTimeOriginal)
+	}
+
+	if embedded.Description != "Tower Bridge" {
+		t.Errorf("Expected the image description but got %q", embedded.Description)
+	}
+
+	coordinates := embedded.Coordinates
+	if coordinates == nil {
+		t.Fatal("Expected GPS coordinates")
+	}
+
+	if coordinates.Latitude != 51.5 || coordinates.Longitude != -0.125 {
+		t.Errorf("Expected 51.5, -0.125 but got %v, %v", coordinates.Latitude, coordinates.Longitude)
+	}
+
+	if coordinates.Altitude == nil || *coordinates.Altitude != 35.5 {
+		t.Errorf("Expected an altitude of 35.5 but got %v", coordinates.Altitude)
+	}
+}
+
+func TestParseExif_Invalid(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("XX\x00\x2A\x00\x00\x00\x08"),
+		[]byte("MM\x00\x2A\x00\x00\xFF\xFF"),
+	} {
+		if _, err := parseExif(bytes.NewReader(data)); err != ErrInvalidExif {
+			t.Errorf("Expected invalid exif for %q but got %v", data, err)
+		}
+	}
+}
+
+func TestParseXMP(t *testing.T) {
+	embedded, err := parseXMP([]byte(testXMP))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing xmp: %v", err)
+	}
+
+	expected := time.Date(2020, 8, 20, 13, 30, 0, 0, time.UTC)
+	if !embedded.DateTimeOriginal.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, embedded.DateTimeOriginal)
+	}
+
+	if len(embedded.Keywords) != 2 || embedded.Keywords[0] != "boat" || embedded.Keywords[1] != "man" {
+		t.Errorf("Expected the keywords boat and man but got %v", embedded.Keywords)
+	}
+
+	if embedded.Description != "The Statue of Liberty" {
+		t.Errorf("Expected the default description but got %q", embedded.Description)
+	}
+
+	coordinates := embedded.Coordinates
+	if coordinates == nil {
+		t.Fatal("Expected GPS coordinates")
+	}
+
+	if coordinates.Latitude != 40.685 || coordinates.Longitude != -(74+2.0/60+40.2/3600) {
+		t.Errorf("Expected the statue of liberty but got %v, %v", coordinates.Latitude, coordinates.Longitude)
+	}
+
+	if coordinates.Altitude == nil || *coordinates.Altitude != 93 {
+		t.Errorf("Expected an altitude of 93 but got %v", coordinates.Altitude)
+	}
+}
+
+func TestReadEmbeddedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "bar.jpg", buildTestJPEG(buildTestExif(), testXMP))
+	writeTestFile(t, dir, "bar.xmp", []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" dc:description="Out at sea">
+   <dc:subject><rdf:Bag><rdf:li>sea</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`))
+
+	embedded, err := ReadEmbeddedMetadata(path, MimeJPEG)
+	if err != nil {
+		t.Fatalf("Unexpected error reading embedded metadata: %v", err)
+	}
+
+	if len(embedded.Keywords) != 3 || embedded.Keywords[0] != "sea" {
+		t.Errorf("Expected the sidecar keyword then those embedded but got %v", embedded.Keywords)
+	}
+
+	expected := time.Date(2021, 03, 20, 12, 24, 56, 0, time.UTC)
+	if !embedded.DateTimeOriginal.Equal(expected) {
+		t.Errorf("Expected the date from the exif, %v, but got %v", expected, embedded.DateTimeOriginal)
+	}
+
+	if embedded.Coordinates == nil || embedded.Coordinates.Latitude != 51.5 {
+		t.Errorf("Expected the coordinates from the exif but got %v", embedded.Coordinates)
+	}
+
+	if embedded.Description != "Out at sea" {
+		t.Errorf("Expected the description from the sidecar but got %q", embedded.Description)
+	}
+}
+
+func TestDescribeFile(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "bar.jpg", buildTestJPEG(buildTestExif(), testXMP))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unable to stat test file: %v", err)
+	}
+
+	metadata := describeFile(path, info, MimeJPEG)
+	if metadata.DateEstimated {
+		t.Error("Expected the date to be read from the exif")
+	}
+
+	if len(metadata.Tags) != 2 || metadata.Coordinates == nil {
+		t.Errorf("Expected tags and coordinates but got %v and %v", metadata.Tags, metadata.Coordinates)
+	}
+
+	if metadata.Description != "Tower Bridge" {
+		t.Errorf("Expected the description from the exif but got %q", metadata.Description)
+	}
+
+	path = writeTestFile(t, filepath.Dir(path), "bar.png", pngHeader)
+	if info, err = os.Stat(path); err != nil {
+		t.Fatalf("Unable to stat test file: %v", err)
+	}
+
+	metadata = describeFile(path, info, MimePNG)
+	if !metadata.DateEstimated || !metadata.Date.Equal(info.ModTime()) {
+		t.Errorf("Expected the modification time as an estimate but got %v", metadata.Date)
+	}
+}
@@ -17,6 +17,16 @@ type FileInfo struct {
 	Size     int64
 }
 
+// Encoding describes the file as an encoding found at its path, so its data can be
+// read like that of any other encoding.  The mime type is taken from the extension.
+func (fi FileInfo) Encoding() Encoding {
+	return Encoding{
+		Locator:  []Locator{fileSystemLocator{Path: fi.FullPath}},
+		MimeType: extensionMimeType(fi.FullPath),
+		Hash:     fi.FileHash,
+	}
+}
+
 var (
 	ErrFileInfoNotFound = errors.New("file info not found")
 )
@@ -34,7 +44,7 @@ const (
 		WHERE name = $1`
 	selectFileInfoByHash = `SELECT id, full_path, file_hash, filename, size
 		FROM all_files
-		WHERE hash = $1`
+		WHERE file_hash = $1`
 )
 
 // FileServer is the interface to the data for the files.
@@ -246,3 +246,18 @@ func TestFileSystemFileService_FindByNameScanError(t *testing.T) {
 		t.Errorf("Expected 0 results but got %d", len(files))
 	}
 }
+
+func TestFileInfo_Encoding(t *testing.T) {
+	info := FileInfo{ID: 45, FullPath: "/photos/bar.JPG", FileHash: "ABCD", Filename: "bar.JPG"}
+
+	encoding := info.Encoding()
+	if encoding.MimeType != MimeJPEG || encoding.Hash != "ABCD" {
+		t.Errorf("Expected a JPEG with the hash of the file but got %+v", encoding)
+	}
+	if len(encoding.Locator) != 1 {
+		t.Fatalf("Expected the file to be the only locator but got %v", encoding.Locator)
+	}
+	if path, err := locatorPath(encoding.Locator[0]); err != nil || path != "/photos/bar.JPG" {
+		t.Errorf("Expected the path of the file but got %s, %v", path, err)
+	}
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Places are named in the gazetteer table, each covering the circle within its radius
+// of a point.  It is filled from whatever list of places suits the collection, such as
+// a GeoNames extract or a few hand entered places like home:
+//
+//	CREATE TABLE gazetteer (
+//		id        BIGSERIAL PRIMARY KEY,
+//		name      TEXT NOT NULL,
+//		latitude  DOUBLE PRECISION NOT NULL,
+//		longitude DOUBLE PRECISION NOT NULL,
+//		radius    DOUBLE PRECISION NOT NULL DEFAULT 1000
+//	);
+//	CREATE INDEX gazetteer_latitude_idx ON gazetteer (latitude);
+const (
+	insertPlace = `INSERT INTO gazetteer (name, latitude, longitude, radius)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`
+)
+
+var (
+	// gazetteerReach is how many degrees of latitude the largest place spans either
+	// side of its point.  Places further than that from a point in latitude can't cover
+	// it, so they're ruled out with gazetteer_latitude_idx before any distance is
+	// worked out.
+	gazetteerReach = fmt.Sprintf(`(SELECT degrees(coalesce(max(radius), 0) / %.1f) FROM gazetteer)`, earthRadius)
+	// selectPlaceAt finds the nearest place that covers a point.
+	selectPlaceAt = fmt.Sprintf(`SELECT id, name, latitude, longitude, radius
+		FROM (
+			SELECT id, name, latitude, longitude, radius, %s AS distance
+			FROM gazetteer
+			WHERE latitude BETWEEN $1::float8 - %[2]s AND $1::float8 + %[2]s
+		) AS places
+		WHERE distance <= radius
+		ORDER BY distance, id
+		LIMIT 1`,
+		haversine("$1::float8", "$2::float8", "latitude", "longitude"), gazetteerReach)
+	// updateUnnamedLocations names the location of the metadata with coordinates but
+	// no location after the nearest place that covers them.
+	updateUnnamedLocations = fmt.Sprintf(`UPDATE metadata SET location = named.name
+		FROM (
+			SELECT metadata.id, (
+				SELECT gazetteer.name FROM gazetteer
+				WHERE gazetteer.latitude BETWEEN metadata.latitude - %[2]s AND metadata.latitude + %[2]s
+					AND %[1]s <= gazetteer.radius
+				ORDER BY %[1]s, gazetteer.id
+				LIMIT 1) AS name
+			FROM metadata
+			WHERE coalesce(metadata.location, '') = '' AND metadata.latitude IS NOT NULL AND metadata.longitude IS NOT NULL
+		) AS named
+		WHERE metadata.id = named.id AND named.name IS NOT NULL`,
+		haversine("metadata.latitude", "metadata.longitude", "gazetteer.latitude", "gazetteer.longitude"), gazetteerReach)
+)
+
+var (
+	ErrPlaceNotFound = errors.New("no place covers the coordinates")
+)
+
+// Place is a named area in the gazetteer.
+type Place struct {
+	ID        int64
+	Name      string
+	Latitude  float64
+	Longitude float64
+	// Radius is how far from its point the place reaches, in metres.
+	Radius float64
+}
+
+// Gazetteer names the places that coordinates fall in, so that metadata captured
+// with coordinates can be given a Location.
+type Gazetteer struct {
+	db DBCaller
+}
+
+func NewGazetteer(db DBCaller) Gazetteer {
+	return Gazetteer{
+		db: db,
+	}
+}
+
+// Add stores a place, returning it with its id.
+func (g Gazetteer) Add(ctx context.Context, place Place) (Place, error) {
+	area := Radius{Latitude: place.Latitude, Longitude: place.Longitude, Meters: place.Radius}
+	if place.Name == "" {
+		return Place{}, fmt.Errorf("%w: the place has no name", ErrInvalidArea)
+	}
+	if err := area.Validate(); err != nil {
+		return Place{}, err
+	}
+
+	err := g.db.QueryRow(ctx, insertPlace, place.Name, place.Latitude, place.Longitude, place.Radius).Scan(&place.ID)
+	if err != nil {
+		return Place{}, err
+	}
+	return place, nil
+}
+
+// PlaceAt returns the nearest place that covers the coordinates, or ErrPlaceNotFound
+// if none does.
+func (g Gazetteer) PlaceAt(ctx context.Context, coordinates Coordinates) (Place, error) {
+	var place Place
+	err := g.db.QueryRow(ctx, selectPlaceAt, coordinates.Latitude, coordinates.Longitude).
+		Scan(&place.ID, &place.Name, &place.Latitude, &place.Longitude, &place.Radius)
+	if err == pgx.ErrNoRows {
+		return Place{}, ErrPlaceNotFound
+	}
+	if err != nil {
+		return Place{}, err
+	}
+	return place, nil
+}
+
+// NameLocations sets the location of the metadata that were captured with coordinates
+// but have no location to the place they were captured in.  It returns how many were
+// named; metadata outside every place are left as they are.
+func (g Gazetteer) NameLocations(ctx context.Context) (int64, error) {
+	tag, err := g.db.Exec(ctx, updateUnnamedLocations)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestGazetteer_Add(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`INSERT INTO gazetteer`).
+		WithArgs("home", 50.82, -0.14, 250.0).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+
+	gazetteer := NewGazetteer(caller)
+	place, err := gazetteer.Add(ctx, Place{Name: "home", Latitude: 50.82, Longitude: -0.14, Radius: 250})
+	if err != nil || place.ID != 3 {
+		t.Errorf("Expected the place to be stored as 3 but got %+v, %v", place, err)
+	}
+
+	for _, invalid := range []Place{{Latitude: 1, Radius: 1}, {Name: "nowhere", Latitude: 1}} {
+		if _, err := gazetteer.Add(ctx, invalid); !errors.Is(err, ErrInvalidArea) {
+			t.Errorf("Expected %+v to be invalid but got %v", invalid, err)
+		}
+	}
+}
+
+func TestGazetteer_PlaceAt(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id, name, latitude, longitude, radius FROM \( .* FROM gazetteer
+			WHERE latitude BETWEEN \$1::float8 - \(SELECT degrees\(coalesce\(max\(radius\), 0\) / 6371008.8\) FROM gazetteer\)
+			AND .* \) AS places WHERE distance <= radius ORDER BY distance, id LIMIT 1`).
+		WithArgs(50.8225, -0.1372).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "name", "latitude", "longitude", "radius"}).
+			AddRow(int64(3), "Brighton", 50.82, -0.14, 5000.0))
+	caller.Conn.ExpectQuery(`FROM gazetteer`).
+		WithArgs(0.0, 0.0).
+		WillReturnError(pgx.ErrNoRows)
+
+	gazetteer := NewGazetteer(caller)
+	place, err := gazetteer.PlaceAt(ctx, Coordinates{Latitude: 50.8225, Longitude: -0.1372})
+	if err != nil || place.Name != "Brighton" || place.Radius != 5000 {
+		t.Errorf("Expected to be in Brighton but got %+v, %v", place, err)
+	}
+
+	if _, err := gazetteer.PlaceAt(ctx, Coordinates{}); !errors.Is(err, ErrPlaceNotFound) {
+		t.Errorf("Expected no place to be found but got %v", err)
+	}
+}
+
+func TestGazetteer_NameLocations(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectExec(`UPDATE metadata SET location = named\.name .*
+			WHERE gazetteer\.latitude BETWEEN metadata\.latitude - \(SELECT degrees\(coalesce\(max\(radius\), 0\) / 6371008.8\) FROM gazetteer\)`).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 4))
+
+	named, err := NewGazetteer(caller).NameLocations(ctx)
+	if err != nil || named != 4 {
+		t.Errorf("Expected 4 locations to be named but got %d, %v", named, err)
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	expected := `(6371008.8 * 2 * asin(least(1, sqrt(
+			power(sin(radians(b - a) / 2), 2) +
+			cos(radians(a)) * cos(radians(b)) * power(sin(radians(y - x) / 2), 2)))))`
+	if distance := haversine("a", "x", "b", "y"); distance != expected {
+		t.Errorf("Expected %s but got %s", expected, distance)
+	}
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// earthRadius is the mean radius of the earth in metres.
+const earthRadius = 6371008.8
+
+var (
+	ErrInvalidArea = errors.New("invalid area")
+)
+
+// Radius is the area within a distance of a point.
+type Radius struct {
+	Latitude  float64
+	Longitude float64
+	Meters    float64
+}
+
+// Box is the area between two latitudes and two longitudes.  A box that crosses the
+// antimeridian has a West greater than its East.
+type Box struct {
+	South float64
+	West  float64
+	North float64
+	East  float64
+}
+
+// Validate checks that the point is on the earth and the distance is positive.
+func (r Radius) Validate() error {
+	if !validLatitude(r.Latitude) || !validLongitude(r.Longitude) || !(r.Meters > 0) {
+		return fmt.Errorf("%w: %g metres of %g, %g", ErrInvalidArea, r.Meters, r.Latitude, r.Longitude)
+	}
+	return nil
+}
+
+// args are the parameters of the WithinRadius clause.
+func (r Radius) args() []interface{} {
+	return []interface{}{r.Latitude, r.Longitude, r.Meters}
+}
+
+// Validate checks that the edges are on the earth and the south edge isn't north
+// of the north edge.
+func (b Box) Validate() error {
+	if !validLatitude(b.South) || !validLatitude(b.North) || b.South > b.North ||
+		!validLongitude(b.West) || !validLongitude(b.East) {
+		return fmt.Errorf("%w: box %g, %g to %g, %g", ErrInvalidArea, b.South, b.West, b.North, b.East)
+	}
+	return nil
+}
+
+// args are the parameters of the WithinBox clause.
+func (b Box) args() []interface{} {
+	return []interface{}{b.South, b.West, b.North, b.East}
+}
+
+func validLatitude(latitude float64) bool {
+	return latitude >= -90 && latitude <= 90
+}
+
+func validLongitude(longitude float64) bool {
+	return longitude >= -180 && longitude <= 180
+}
+
+// haversine is the SQL for the distance in metres between two points given in
+// degrees, using nothing more than the maths functions PostgreSQL comes with.  The
+// least keeps rounding from taking asin out of its domain.
+func haversine(latitude1, longitude1, latitude2, longitude2 string) string {
+	return fmt.Sprintf(`(%.1[5]f * 2 * asin(least(1, sqrt(
+			power(sin(radians(%[3]s - %[1]s) / 2), 2) +
+			cos(radians(%[1]s)) * cos(radians(%[3]s)) * power(sin(radians(%[4]s - %[2]s) / 2), 2)))))`,
+		latitude1, longitude1, latitude2, longitude2, earthRadius)
+}
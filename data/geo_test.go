@@ -0,0 +1,82 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetadataQueryBuilder_WithinRadius(t *testing.T) {
+	query := NewMetadataQueryBuilder().AtLocation().WithinRadius().BetweenDates().Count()
+
+	target := `WHERE location = $1
+		AND (metadata.latitude BETWEEN $2::float8 - degrees($4::float8 / 6371008.8) AND $2::float8 + degrees($4::float8 / 6371008.8)
+			AND (6371008.8 * 2 * asin(least(1, sqrt(
+				power(sin(radians(metadata.latitude - $2::float8) / 2), 2) +
+				cos(radians($2::float8)) * cos(radians(metadata.latitude)) * power(sin(radians(metadata.longitude - $3::float8) / 2), 2)))))
+			<= $4::float8)
+		AND date_captured BETWEEN $5 AND $6`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if !strings.HasSuffix(query, target) {
+		t.Errorf("Expected %s to end %s", query, target)
+	}
+}
+
+func TestMetadataQueryBuilder_WithinBox(t *testing.T) {
+	query := NewMetadataQueryBuilder().AddTags(1).WithinBox().Count()
+
+	target := `WHERE $1 = ANY(tags) AND (metadata.latitude BETWEEN $2::float8 AND $4::float8
+		AND (metadata.longitude BETWEEN $3::float8 AND $5::float8
+			OR ($3::float8 > $5::float8 AND (metadata.longitude >= $3::float8 OR metadata.longitude <= $5::float8))))`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if !strings.HasSuffix(query, target) {
+		t.Errorf("Expected %s to end %s", query, target)
+	}
+}
+
+func TestDbMetadataServer_FindWithin(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, .* WHERE \$1 = ANY\(tags\)
+			AND \(metadata\.latitude BETWEEN \$2::float8 - degrees\(\$4::float8 .*
+			AND \(metadata\.latitude BETWEEN \$5::float8 AND \$7::float8 .*
+		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).
+		WithArgs("boat", 50.82, -0.14, 500.0, 50.0, -1.0, 51.0, 0.5).
+		WillReturnRows(buildMetadataTestResults())
+
+	ms := NewMetadataServer(caller)
+	query := MetadataQuery{
+		Tags:   []string{"boat"},
+		Near:   &Radius{Latitude: 50.82, Longitude: -0.14, Meters: 500},
+		Within: &Box{South: 50, West: -1, North: 51, East: 0.5},
+	}
+	metadata, err := ms.Find(ctx, query)
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(metadata) != 2 {
+		t.Errorf("Expected 2 result but got %d", len(metadata))
+	}
+}
+
+func TestDbMetadataServer_FindInvalidArea(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	ms := NewMetadataServer(caller)
+
+	for _, query := range []MetadataQuery{
+		{Near: &Radius{Latitude: 91, Meters: 10}},
+		{Near: &Radius{Longitude: 10}},
+		{Within: &Box{South: 10, North: -10}},
+		{Within: &Box{West: -181}},
+	} {
+		if _, err := ms.Find(ctx, query); !errors.Is(err, ErrInvalidArea) {
+			t.Errorf("Expected %+v to be an invalid area but got %v", query, err)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 module github.com/darcinc/Simple/data
 
-go 1.17
+go 1.18
 
 require (
 	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgtype v1.8.1
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/pashagolub/pgxmock v1.4.0
+	golang.org/x/image v0.18.0
 )
 
 require (
@@ -17,5 +18,5 @@ require (
 	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
 	github.com/jackc/puddle v1.1.3 // indirect
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
-	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
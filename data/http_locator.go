@@ -0,0 +1,290 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SourceHTTP and SourceHTTPS are the sources of locators for media served by
+	// another server.  Their path is the whole URL.
+	SourceHTTP  = "http"
+	SourceHTTPS = "https"
+
+	EnvHTTPTimeout     = "HTTP_LOCATOR_TIMEOUT"
+	EnvHTTPRetries     = "HTTP_LOCATOR_RETRIES"
+	EnvHTTPBearerToken = "HTTP_LOCATOR_BEARER_TOKEN"
+	EnvHTTPUsername    = "HTTP_LOCATOR_USERNAME"
+	EnvHTTPPassword    = "HTTP_LOCATOR_PASSWORD"
+	// EnvHTTPHosts is the comma separated hosts the credentials are sent to.
+	EnvHTTPHosts = "HTTP_LOCATOR_HOSTS"
+
+	defaultHTTPRetries = 3
+	defaultHTTPBackoff = 500 * time.Millisecond
+)
+
+var (
+	ErrHTTPRequest  = errors.New("http request failed")
+	ErrHTTPNotFound = fmt.Errorf("%w: not found", ErrHTTPRequest)
+)
+
+// HTTPConfig is how media served by other servers is fetched.
+type HTTPConfig struct {
+	// Client makes the requests, defaulting to http.DefaultClient.
+	Client *http.Client
+	// Timeout limits each attempt, including reading the body.  Zero leaves it to
+	// the client.
+	Timeout time.Duration
+	// Retries is how many more times a failed GET is tried.
+	Retries int
+	// Backoff is the wait before the first retry, doubling for each after it.
+	Backoff time.Duration
+	// BearerToken is sent as Authorization: Bearer when set, otherwise Username and
+	// Password are sent as basic auth when Username is set.
+	BearerToken string
+	Username    string
+	Password    string
+	// Hosts are the only hosts the credentials are sent to, given as a host name or
+	// as host:port.  Any host can be named by a locator, so without them the
+	// credentials are never sent.
+	Hosts []string
+}
+
+// credentialsFor reports whether the credentials are to be sent to the host of u.
+func (hc HTTPConfig) credentialsFor(u *url.URL) bool {
+	for _, host := range hc.Hosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPConfigFromEnv reads the HTTP_LOCATOR_* environment variables.  Credentials
+// must be given with the hosts they are for.
+func HTTPConfigFromEnv() (HTTPConfig, error) {
+	config := HTTPConfig{
+		Retries:     defaultHTTPRetries,
+		Backoff:     defaultHTTPBackoff,
+		BearerToken: os.Getenv(EnvHTTPBearerToken),
+		Username:    os.Getenv(EnvHTTPUsername),
+		Password:    os.Getenv(EnvHTTPPassword),
+	}
+	if value := os.Getenv(EnvHTTPTimeout); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("%s: %w", EnvHTTPTimeout, err)
+		}
+		config.Timeout = timeout
+	}
+	if value := os.Getenv(EnvHTTPRetries); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return config, fmt.Errorf("%s: %q is not a number of retries", EnvHTTPRetries, value)
+		}
+		config.Retries = retries
+	}
+	for _, host := range strings.Split(os.Getenv(EnvHTTPHosts), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			config.Hosts = append(config.Hosts, host)
+		}
+	}
+	if (config.BearerToken != "" || config.Username != "") && len(config.Hosts) == 0 {
+		return config, fmt.Errorf("%s must list the hosts the credentials are sent to", EnvHTTPHosts)
+	}
+	return config, nil
+}
+
+// RegisterHTTPLocator resolves stored http and https locators to URLs fetched
+// with the given configuration.
+func RegisterHTTPLocator(config HTTPConfig) {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Timeout > 0 {
+		client := *config.Client
+		client.Timeout = config.Timeout
+		config.Client = &client
+	}
+
+	factory := func(path string) (Locator, error) {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != SourceHTTP && u.Scheme != SourceHTTPS) || u.Host == "" {
+			return nil, fmt.Errorf("%w: %s is not an http URL", ErrHTTPRequest, path)
+		}
+		return httpLocator{config: config, url: *u}, nil
+	}
+	RegisterLocator(SourceHTTP, factory)
+	RegisterLocator(SourceHTTPS, factory)
+}
+
+type httpLocator struct {
+	config HTTPConfig
+	url    url.URL
+}
+
+func (hl httpLocator) Source() string {
+	return hl.url.Scheme
+}
+
+func (hl httpLocator) Data() (io.ReadCloser, error) {
+	response, err := hl.request(context.Background(), http.MethodGet, "")
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// VerifiedData fetches the data, failing the read at the end of the body with
+// ErrHashMismatch if it doesn't hash to the encoding.
+func (hl httpLocator) VerifiedData(hash string) (io.ReadCloser, error) {
+	body, err := hl.Data()
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReader(body, hash), nil
+}
+
+// Open reads the data with ranged GETs.  A server that doesn't support ranges
+// still works, but each seek then reads the data up to the offset again.
+func (hl httpLocator) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	get := func(ctx context.Context, rangeHeader string) (*http.Response, error) {
+		return hl.request(ctx, http.MethodGet, rangeHeader)
+	}
+	return newRangeReader(ctx, get, hl.Stat), nil
+}
+
+// Stat describes the data from the headers of a HEAD request.  The size is -1 if
+// the server doesn't send a Content-Length.
+func (hl httpLocator) Stat(ctx context.Context) (LocatorInfo, error) {
+	response, err := hl.request(ctx, http.MethodHead, "")
+	if err != nil {
+		return LocatorInfo{}, err
+	}
+	response.Body.Close()
+	return responseInfo(response), nil
+}
+
+func (hl httpLocator) URL() url.URL {
+	return hl.url
+}
+
+func (hl httpLocator) StoredPath() string {
+	return hl.url.String()
+}
+
+// request makes the request, retrying after errors that may be temporary: failures
+// to connect, 429 and 5xx responses.  If rangeHeader is set, e.g. bytes=100-, it's
+// sent as the Range header.
+func (hl httpLocator) request(ctx context.Context, method, rangeHeader string) (*http.Response, error) {
+	backoff := hl.config.Backoff
+	for attempt := 0; ; attempt++ {
+		response, retry, err := hl.attempt(ctx, method, rangeHeader)
+		if err == nil {
+			return response, nil
+		}
+		if !retry || attempt >= hl.config.Retries {
+			return nil, err
+		}
+
+		log.Printf("Warning - Retrying %s in %v: %v", hl.url.Redacted(), backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt makes a single request, reporting whether a failure is worth retrying.
+func (hl httpLocator) attempt(ctx context.Context, method, rangeHeader string) (*http.Response, bool, error) {
+	r, err := http.NewRequestWithContext(ctx, method, hl.url.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	switch {
+	case !hl.config.credentialsFor(r.URL):
+	case hl.config.BearerToken != "":
+		r.Header.Set("Authorization", "Bearer "+hl.config.BearerToken)
+	case hl.config.Username != "":
+		r.SetBasicAuth(hl.config.Username, hl.config.Password)
+	}
+
+	response, err := hl.config.Client.Do(r)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	switch {
+	case response.StatusCode == http.StatusOK, response.StatusCode == http.StatusPartialContent:
+		return response, false, nil
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && rangeHeader != "":
+		// The range starts at or past the end, which the range reader takes as the end.
+		return response, false, nil
+	}
+
+	response.Body.Close()
+	failure := ErrHTTPRequest
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		failure = ErrHTTPNotFound
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return nil, retry, fmt.Errorf("%w: %s %s returned %s", failure, method, hl.url.Redacted(), response.Status)
+}
+
+// verifyingReader hashes what is read, returning ErrHashMismatch instead of
+// io.EOF if the data isn't what was expected.
+type verifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func newVerifyingReader(body io.ReadCloser, expected string) *verifyingReader {
+	return &verifyingReader{
+		body:     body,
+		hash:     sha256.New(),
+		expected: expected,
+	}
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.body.Read(p)
+	vr.hash.Write(p[:n])
+	if err == io.EOF {
+		if mismatch := checkHash(vr.hash, vr.expected); mismatch != nil {
+			return n, mismatch
+		}
+	}
+	return n, err
+}
+
+// checkHash returns ErrHashMismatch if what has been hashed isn't what was expected.
+func checkHash(h hash.Hash, expected string) error {
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: expected %s but read %s", ErrHashMismatch, expected, actual)
+	}
+	return nil
+}
+
+func (vr *verifyingReader) Close() error {
+	return vr.body.Close()
+}
@@ -0,0 +1,229 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHTTPLocator(t *testing.T, config HTTPConfig, handler http.HandlerFunc) Locator {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config.Client = server.Client()
+	RegisterHTTPLocator(config)
+
+	l, err := NewLocator(SourceHTTP, server.URL+"/images?id=1234&format=jpeg")
+	if err != nil {
+		t.Fatalf("Unexpected error building the locator: %v", err)
+	}
+	return l
+}
+
+func TestHTTPLocator_Data(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "1234" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, testContent)
+	})
+
+	if l.Source() != SourceHTTP {
+		t.Errorf("Expected an http locator but got %s", l.Source())
+	}
+
+	stream, err := OpenEncoding(Encoding{Locator: []Locator{l}, Hash: contentHash([]byte(testContent))})
+	if err != nil {
+		t.Fatalf("Unexpected error opening the data: %v", err)
+	}
+	defer stream.Close()
+
+	content, err := io.ReadAll(stream)
+	if err != nil || string(content) != testContent {
+		t.Errorf("Expected the content but got %s, %v", content, err)
+	}
+}
+
+func TestHTTPLocator_HashMismatch(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not the content")
+	})
+
+	stream, err := OpenEncoding(Encoding{Locator: []Locator{l}, Hash: contentHash([]byte(testContent))})
+	if err != nil {
+		t.Fatalf("Unexpected error opening the data: %v", err)
+	}
+	defer stream.Close()
+
+	if _, err := io.ReadAll(stream); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Expected a hash mismatch but got %v", err)
+	}
+}
+
+func TestHTTPLocator_BearerToken(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{BearerToken: "token", Username: "ignored", Hosts: []string{"127.0.0.1"}}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, testContent)
+	})
+
+	stream, err := l.Data()
+	if err != nil {
+		t.Fatalf("Expected the token to be sent but got %v", err)
+	}
+	stream.Close()
+}
+
+func TestHTTPLocator_BasicAuth(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{Username: "user", Password: "pass", Hosts: []string{"127.0.0.1"}}, func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, testContent)
+	})
+
+	stream, err := l.Data()
+	if err != nil {
+		t.Fatalf("Expected the credentials to be sent but got %v", err)
+	}
+	stream.Close()
+}
+
+func TestHTTPLocator_CredentialsForOtherHosts(t *testing.T) {
+	var sent atomic.Value
+	sent.Store("")
+	l := newTestHTTPLocator(t, HTTPConfig{BearerToken: "token", Hosts: []string{"photos.example.com"}}, func(w http.ResponseWriter, r *http.Request) {
+		sent.Store(r.Header.Get("Authorization"))
+		io.WriteString(w, testContent)
+	})
+
+	stream, err := l.Data()
+	if err != nil {
+		t.Fatalf("Unexpected error reading: %v", err)
+	}
+	stream.Close()
+
+	if authorization := sent.Load().(string); authorization != "" {
+		t.Errorf("Expected the token to be kept from a host that isn't listed but got %q", authorization)
+	}
+}
+
+func TestHTTPLocator_RangeNotSatisfiableWithoutRange(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	})
+
+	if _, err := l.Data(); !errors.Is(err, ErrHTTPRequest) {
+		t.Errorf("Expected a 416 without a range to fail but got %v", err)
+	}
+}
+
+func TestHTTPLocator_Retry(t *testing.T) {
+	var attempts int32
+	l := newTestHTTPLocator(t, HTTPConfig{Retries: 2, Backoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, testContent)
+	})
+
+	stream, err := l.Data()
+	if err != nil {
+		t.Fatalf("Expected the third attempt to succeed but got %v", err)
+	}
+	stream.Close()
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts but got %d", attempts)
+	}
+}
+
+func TestHTTPLocator_RetriesExhausted(t *testing.T) {
+	var attempts int32
+	l := newTestHTTPLocator(t, HTTPConfig{Retries: 1, Backoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+
+	if _, err := l.Data(); !errors.Is(err, ErrHTTPRequest) {
+		t.Errorf("Expected the request to fail but got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts but got %d", attempts)
+	}
+}
+
+func TestHTTPLocator_NoRetryOnNotFound(t *testing.T) {
+	var attempts int32
+	l := newTestHTTPLocator(t, HTTPConfig{Retries: 3, Backoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.NotFound(w, r)
+	})
+
+	if _, err := l.Data(); !errors.Is(err, ErrHTTPNotFound) || !errors.Is(err, ErrHTTPRequest) {
+		t.Errorf("Expected the request to fail as not found but got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt but got %d", attempts)
+	}
+}
+
+func TestHTTPLocator_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	l := newTestHTTPLocator(t, HTTPConfig{Timeout: 10 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+
+	if _, err := l.Data(); err == nil {
+		t.Errorf("Expected the request to time out")
+	}
+}
+
+func TestRegisterHTTPLocator_InvalidPath(t *testing.T) {
+	RegisterHTTPLocator(HTTPConfig{})
+
+	if _, err := NewLocator(SourceHTTPS, "/images/1234"); !errors.Is(err, ErrHTTPRequest) {
+		t.Errorf("Expected an invalid URL but got %v", err)
+	}
+}
+
+func TestHTTPConfigFromEnv(t *testing.T) {
+	t.Setenv(EnvHTTPTimeout, "5s")
+	t.Setenv(EnvHTTPRetries, "1")
+	t.Setenv(EnvHTTPBearerToken, "token")
+	t.Setenv(EnvHTTPHosts, "photos.example.com, nas.local:8443")
+
+	config, err := HTTPConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error reading the environment: %v", err)
+	}
+	if config.Timeout != 5*time.Second || config.Retries != 1 || config.BearerToken != "token" ||
+		!reflect.DeepEqual(config.Hosts, []string{"photos.example.com", "nas.local:8443"}) {
+		t.Errorf("Unexpected configuration %+v", config)
+	}
+
+	t.Setenv(EnvHTTPHosts, "")
+	if _, err := HTTPConfigFromEnv(); err == nil {
+		t.Errorf("Expected credentials without hosts to fail")
+	}
+	t.Setenv(EnvHTTPHosts, "photos.example.com")
+
+	t.Setenv(EnvHTTPRetries, "lots")
+	if _, err := HTTPConfigFromEnv(); err == nil {
+		t.Errorf("Expected an invalid number of retries to fail")
+	}
+}
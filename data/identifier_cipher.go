@@ -0,0 +1,168 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	EnvIdentifierSecret        = "IDENTIFIER_SECRET"
+	EnvRetiredIdentifierSecret = "IDENTIFIER_RETIRED_SECRETS"
+
+	feistelRounds = 8
+	halfSymbols   = 7
+	halfBits      = 35
+	halfMask      = uint64(1)<<halfBits - 1
+)
+
+var (
+	ErrIdentifierSecretNotSet = errors.New("identifier secret is not set")
+)
+
+// IdentifierCipher is a keyed, reversible permutation of the 70 bit identifier
+// payload.  It is a balanced Feistel network over two 35 bit halves, which are
+// the two 7 symbol groups of the printed identifier.  The round function is an
+// HMAC-SHA256 of the round number and half, keyed with the secret.  Without the
+// secret neither the creation time nor the database id can be read back out of
+// an identifier, and consecutive ids don't produce related identifiers.
+type IdentifierCipher struct {
+	secret []byte
+}
+
+// NewIdentifierCipher returns a cipher keyed with the given secret.
+func NewIdentifierCipher(secret []byte) IdentifierCipher {
+	return IdentifierCipher{
+		secret: append([]byte(nil), secret...),
+	}
+}
+
+func (c IdentifierCipher) round(r int, half uint64) uint64 {
+	var buf [9]byte
+	buf[0] = uint8(r)
+	binary.BigEndian.PutUint64(buf[1:], half)
+
+	mac := hmac.New(sha256.New, c.secret)
+	_, _ = mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & halfMask
+}
+
+// Encrypt permutes a plain identifier payload into the published form.
+func (c IdentifierCipher) Encrypt(payload Identifier) Identifier {
+	l, r := payload.halves()
+	for round := 0; round < feistelRounds; round++ {
+		l, r = r, l^c.round(round, r)
+	}
+	return identifierFromHalves(l, r)
+}
+
+// Decrypt reverses Encrypt, returning the plain payload.
+func (c IdentifierCipher) Decrypt(id Identifier) Identifier {
+	l, r := id.halves()
+	for round := feistelRounds - 1; round >= 0; round-- {
+		l, r = r^c.round(round, l), l
+	}
+	return identifierFromHalves(l, r)
+}
+
+// halves splits the 14 symbols of an identifier into two 35 bit values.
+func (i Identifier) halves() (uint64, uint64) {
+	var l, r uint64
+	for k := 0; k < halfSymbols; k++ {
+		l = l<<5 | uint64(i[k]&mask)
+		r = r<<5 | uint64(i[k+halfSymbols]&mask)
+	}
+	return l, r
+}
+
+func identifierFromHalves(l, r uint64) Identifier {
+	result := make([]uint8, 2*halfSymbols)
+	for k := halfSymbols - 1; k >= 0; k-- {
+		result[k] = uint8(l) & mask
+		result[k+halfSymbols] = uint8(r) & mask
+		l >>= 5
+		r >>= 5
+	}
+	return result
+}
+
+// IdentifierKeys holds the cipher used to mint new identifiers along with the
+// ciphers for keys that have been retired.  Retired keys are never used to mint
+// identifiers, but identifiers minted under them can still be unmasked.
+type IdentifierKeys struct {
+	current IdentifierCipher
+	retired []IdentifierCipher
+}
+
+// NewIdentifierKeys returns the keys for a current secret and any number of
+// retired secrets, most recently retired first.
+func NewIdentifierKeys(current []byte, retired ...[]byte) IdentifierKeys {
+	keys := IdentifierKeys{
+		current: NewIdentifierCipher(current),
+	}
+	for _, secret := range retired {
+		keys.retired = append(keys.retired, NewIdentifierCipher(secret))
+	}
+	return keys
+}
+
+// LoadIdentifierKeys reads the identifier secrets from the environment.  The
+// retired secrets are a comma separated list.
+func LoadIdentifierKeys() (IdentifierKeys, error) {
+	current := os.Getenv(EnvIdentifierSecret)
+	if current == "" {
+		return IdentifierKeys{}, ErrIdentifierSecretNotSet
+	}
+
+	var retired [][]byte
+	for _, secret := range strings.Split(os.Getenv(EnvRetiredIdentifierSecret), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			retired = append(retired, []byte(secret))
+		}
+	}
+
+	return NewIdentifierKeys([]byte(current), retired...), nil
+}
+
+// Mask permutes a payload with the current key.
+func (k IdentifierKeys) Mask(payload Identifier) Identifier {
+	return k.current.Encrypt(payload)
+}
+
+// Unmask returns the candidate payloads for an identifier, one for the current
+// key followed by one for each retired key.
+func (k IdentifierKeys) Unmask(id Identifier) []Identifier {
+	result := []Identifier{k.current.Decrypt(id)}
+	for _, c := range k.retired {
+		result = append(result, c.Decrypt(id))
+	}
+	return result
+}
+
+// identifierKeys has no secret until SetIdentifierKeys is called, and MakeIdentifier
+// refuses to mint identifiers until then rather than masking them with an empty key.
+var identifierKeys IdentifierKeys
+var identifierKeysLock sync.RWMutex
+
+// configured reports whether there is a secret to mint identifiers with.
+func (k IdentifierKeys) configured() bool {
+	return len(k.current.secret) > 0
+}
+
+// SetIdentifierKeys replaces the keys used by MakeIdentifier.  It is meant to be
+// called once while the system starts.
+func SetIdentifierKeys(keys IdentifierKeys) {
+	identifierKeysLock.Lock()
+	defer identifierKeysLock.Unlock()
+	identifierKeys = keys
+}
+
+func currentIdentifierKeys() IdentifierKeys {
+	identifierKeysLock.RLock()
+	defer identifierKeysLock.RUnlock()
+	return identifierKeys
+}
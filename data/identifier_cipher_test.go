@@ -0,0 +1,97 @@
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIdentifierCipher_RoundTrip(t *testing.T) {
+	cipher := NewIdentifierCipher([]byte("deployment secret"))
+	created := time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC)
+
+	for _, id := range []int64{0, 1, 2, 1234, 1 << 40, 1<<54 - 1} {
+		payload := identifierPayload(created, id)
+		masked := cipher.Encrypt(payload)
+		if masked.String() == payload.String() {
+			t.Errorf("expected %d to be masked but got %s", id, masked.String())
+		}
+
+		unmasked := cipher.Decrypt(masked)
+		if unmasked.String() != payload.String() {
+			t.Errorf("expected %s but got %s", payload.String(), unmasked.String())
+		}
+	}
+}
+
+func TestIdentifierCipher_SequentialIds(t *testing.T) {
+	cipher := NewIdentifierCipher([]byte("deployment secret"))
+	created := time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC)
+
+	first := cipher.Encrypt(identifierPayload(created, 1000))
+	second := cipher.Encrypt(identifierPayload(created, 1001))
+
+	same := 0
+	for i := range first {
+		if first[i] == second[i] {
+			same++
+		}
+	}
+
+	// Each symbol has a 1 in 32 chance of matching, so a handful of matches
+	// is expected but an identifier sharing most symbols is not.
+	if same > 4 {
+		t.Errorf("expected consecutive ids to be unrelated but %s and %s share %d symbols",
+			first.String(), second.String(), same)
+	}
+}
+
+func TestIdentifierKeys_Unmask(t *testing.T) {
+	created := time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC)
+	payload := identifierPayload(created, 1234)
+
+	oldKeys := NewIdentifierKeys([]byte("old secret"))
+	minted := oldKeys.Mask(payload)
+
+	rotated := NewIdentifierKeys([]byte("new secret"), []byte("old secret"))
+	if rotated.Mask(payload).String() == minted.String() {
+		t.Error("expected the new key to mint a different identifier")
+	}
+
+	candidates := rotated.Unmask(minted)
+	if len(candidates) != 2 {
+		t.Fatalf("expected a candidate for each key but got %d", len(candidates))
+	}
+
+	if candidates[1].String() != payload.String() {
+		t.Errorf("expected the retired key to unmask %s but got %s", payload.String(), candidates[1].String())
+	}
+}
+
+func TestLoadIdentifierKeys(t *testing.T) {
+	oldCurrent, oldRetired := os.Getenv(EnvIdentifierSecret), os.Getenv(EnvRetiredIdentifierSecret)
+	defer func() {
+		_ = os.Setenv(EnvIdentifierSecret, oldCurrent)
+		_ = os.Setenv(EnvRetiredIdentifierSecret, oldRetired)
+	}()
+
+	_ = os.Setenv(EnvIdentifierSecret, "")
+	if _, err := LoadIdentifierKeys(); err != ErrIdentifierSecretNotSet {
+		t.Errorf("expected secret not set but got %v", err)
+	}
+
+	_ = os.Setenv(EnvIdentifierSecret, "new secret")
+	_ = os.Setenv(EnvRetiredIdentifierSecret, "old secret, older secret")
+	keys, err := LoadIdentifierKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error loading keys: %v", err)
+	}
+
+	if len(keys.retired) != 2 {
+		t.Errorf("expected 2 retired keys but got %d", len(keys.retired))
+	}
+
+	if string(keys.retired[1].secret) != "older secret" {
+		t.Errorf("expected 'older secret' but got %s", string(keys.retired[1].secret))
+	}
+}
@@ -0,0 +1,432 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The ingester keeps the modification time of each file it catalogues, so a file that
+// is edited without changing size, such as by rewriting its EXIF, is read again:
+//
+//	ALTER TABLE all_files ADD COLUMN modified TIMESTAMP WITH TIME ZONE;
+const (
+	selectFileByPath = `SELECT id, file_hash, size, modified FROM all_files
+		WHERE full_path = $1`
+	insertFileInfo = `INSERT INTO all_files (full_path, file_hash, filename, size, modified)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+	updateFileInfo = `UPDATE all_files SET file_hash = $2, size = $3, modified = $4
+		WHERE id = $1`
+	selectEncodingByHash = `SELECT id FROM encoding
+		WHERE file_hash = $1
+		ORDER BY id
+		LIMIT 1`
+	selectLocatorId = `SELECT id FROM locator
+		WHERE encoding_id = $1 AND source = $2 AND path = $3`
+	deleteLocatorByPath = `DELETE FROM locator
+		WHERE source = $1 AND path = $2
+		RETURNING encoding_id`
+	selectOrphanedEncoding = `SELECT metadata_id FROM encoding
+		WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM locator WHERE encoding_id = $1)
+		FOR UPDATE`
+	// Derivatives don't keep the metadata, they are only there for the encodings
+	// they were made from.
+	deleteOrphanedMetadata = `DELETE FROM metadata
+		WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM encoding
+			WHERE metadata_id = $1 AND id NOT IN (SELECT encoding_id FROM encoding_derivative))`
+)
+
+// sniffLength is the most http.DetectContentType looks at.
+const sniffLength = 512
+
+// extensionMimeTypes covers the media that content sniffing doesn't recognise.
+var extensionMimeTypes = map[string]string{
+	".tif":  MimeTIFF,
+	".tiff": MimeTIFF,
+	".mov":  MimeQuickTime,
+	".m4v":  MimeMP4,
+	".mp4":  MimeMP4,
+	".3gp":  Mime3GPP,
+	".3g2":  Mime3GPP2,
+	".mkv":  MimeMatroska,
+	".svg":  MimeSVG,
+}
+
+// IngestOutcome is what ingesting a single file did to the catalogue.
+type IngestOutcome int
+
+const (
+	// IngestUnchanged is a file already catalogued at its path with the same content.
+	IngestUnchanged IngestOutcome = iota
+	// IngestAdded is a file with new content, given its own metadata and encoding.
+	IngestAdded
+	// IngestDuplicate is a file with the same content as an existing encoding, added
+	// as another locator of that encoding.
+	IngestDuplicate
+)
+
+// IngestFailure is a file that could not be ingested.
+type IngestFailure struct {
+	Path string
+	Err  error
+}
+
+// IngestResult counts what happened to the files found by Ingest.
+type IngestResult struct {
+	Scanned    int
+	Added      int
+	Duplicates int
+	Unchanged  int
+	Failed     []IngestFailure
+}
+
+// Ingester catalogues the files under a directory into all_files, metadata,
+// encoding and locator.  Each file is committed on its own, so a scan that is
+// interrupted can simply be run again.  Files already catalogued at the same
+// path, size and modification time are skipped without being read.
+type Ingester struct {
+	db DBCaller
+}
+
+func NewIngester(db DBCaller) Ingester {
+	return Ingester{
+		db: db,
+	}
+}
+
+// Ingest walks the tree under root, ingesting every regular file.  A file that fails
+// is recorded in the result and the walk carries on.  The walk stops if ctx is done.
+func (ig Ingester) Ingest(ctx context.Context, root string) (IngestResult, error) {
+	var result IngestResult
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, IngestFailure{Path: path, Err: err})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Sidecars are read along with the media they describe.
+		if !d.Type().IsRegular() || strings.EqualFold(filepath.Ext(path), sidecarExtension) {
+			return nil
+		}
+
+		result.Scanned++
+		outcome, err := ig.IngestFile(ctx, path)
+		if err != nil {
+			result.Failed = append(result.Failed, IngestFailure{Path: path, Err: err})
+			return nil
+		}
+
+		switch outcome {
+		case IngestAdded:
+			result.Added++
+		case IngestDuplicate:
+			result.Duplicates++
+		default:
+			result.Unchanged++
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// IngestFile catalogues a single file.  A file whose content has changed since it
+// was catalogued is moved onto the encoding for its new content.
+func (ig Ingester) IngestFile(ctx context.Context, path string) (IngestOutcome, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return IngestUnchanged, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return IngestUnchanged, err
+	}
+
+	var fileID, storedSize int64
+	var storedHash string
+	var storedModified *time.Time
+	modified := fileModified(info)
+	err = ig.db.QueryRow(ctx, selectFileByPath, path).Scan(&fileID, &storedHash, &storedSize, &storedModified)
+	switch {
+	case err == pgx.ErrNoRows:
+		// Not catalogued yet.
+	case err != nil:
+		return IngestUnchanged, err
+	case storedSize == info.Size() && storedModified != nil && storedModified.Equal(modified):
+		return IngestUnchanged, nil
+	}
+
+	hash, mimeType, err := hashFile(path)
+	if err != nil {
+		return IngestUnchanged, err
+	}
+	if fileID != 0 && hash == storedHash {
+		// Only the modification time has changed.
+		_, err := ig.db.Exec(ctx, updateFileInfo, fileID, hash, info.Size(), modified)
+		return IngestUnchanged, err
+	}
+
+	tx, err := ig.db.Begin(ctx)
+	if err != nil {
+		return IngestUnchanged, err
+	}
+
+	outcome, err := ig.catalogue(ctx, tx, fileID, path, info, hash, mimeType)
+	if err != nil {
+		rollback(ctx, tx)
+		return IngestUnchanged, err
+	}
+
+	return outcome, tx.Commit(ctx)
+}
+
+// catalogue records the file and its locator within the transaction.  The encoding
+// a changed file used to be located at is removed once it has no locators left, along
+// with its metadata once that has no encodings left.
+func (ig Ingester) catalogue(ctx context.Context, tx DBCaller, fileID int64, path string, info fs.FileInfo,
+	hash, mimeType string) (IngestOutcome, error) {
+	locator := fileSystemLocator{Path: path}
+	modified := fileModified(info)
+
+	var previous []int64
+	if fileID == 0 {
+		err := tx.QueryRow(ctx, insertFileInfo, path, hash, filepath.Base(path), info.Size(), modified).Scan(&fileID)
+		if err != nil {
+			return IngestUnchanged, err
+		}
+	} else {
+		if _, err := tx.Exec(ctx, updateFileInfo, fileID, hash, info.Size(), modified); err != nil {
+			return IngestUnchanged, err
+		}
+		var err error
+		if previous, err = deleteLocators(ctx, tx, locator.Source(), path); err != nil {
+			return IngestUnchanged, err
+		}
+	}
+
+	outcome, err := ig.locate(ctx, tx, locator, info, hash, mimeType)
+	if err != nil {
+		return IngestUnchanged, err
+	}
+
+	for _, encodingID := range previous {
+		if err := deleteOrphans(ctx, tx, encodingID); err != nil {
+			return IngestUnchanged, err
+		}
+	}
+	return outcome, nil
+}
+
+// locate adds the locator to the encoding for the content, creating the encoding and
+// its metadata if the content is new.
+func (ig Ingester) locate(ctx context.Context, tx DBCaller, locator fileSystemLocator, info fs.FileInfo,
+	hash, mimeType string) (IngestOutcome, error) {
+	path := locator.Path
+
+	var encodingID int64
+	err := tx.QueryRow(ctx, selectEncodingByHash, hash).Scan(&encodingID)
+	if err == pgx.ErrNoRows {
+		metadata := describeFile(path, info, mimeType)
+		metadata.Data = []Encoding{describeEncoding(path, mimeType, hash, locator)}
+		created, err := dbMetadataServer{db: tx}.createMetadata(ctx, tx, metadata)
+		if err != nil {
+			return IngestUnchanged, err
+		}
+		if err := indexImage(ctx, tx, created.Data[0].ID, path, mimeType); err != nil {
+			return IngestUnchanged, err
+		}
+		return IngestAdded, nil
+	}
+	if err != nil {
+		return IngestUnchanged, err
+	}
+
+	var locatorID int64
+	err = tx.QueryRow(ctx, selectLocatorId, encodingID, locator.Source(), path).Scan(&locatorID)
+	if err == pgx.ErrNoRows {
+		err = dbMetadataServer{db: tx}.createLocator(ctx, tx, encodingID, locator)
+	}
+	if err != nil {
+		return IngestUnchanged, err
+	}
+	return IngestDuplicate, nil
+}
+
+// deleteLocators removes the locators of a path, returning the encodings they were for.
+func deleteLocators(ctx context.Context, tx DBCaller, source, path string) ([]int64, error) {
+	rows, err := tx.Query(ctx, deleteLocatorByPath, source, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int64
+	for rows.Next() {
+		var encodingID int64
+		if err := rows.Scan(&encodingID); err != nil {
+			return nil, err
+		}
+		result = append(result, encodingID)
+	}
+	return result, rows.Err()
+}
+
+// deleteOrphans removes the encoding, along with its derivatives, if no locators are
+// left for it, and then its metadata if no encodings other than derivatives are left
+// for that.
+func deleteOrphans(ctx context.Context, tx DBCaller, encodingID int64) error {
+	var metadataID int64
+	err := tx.QueryRow(ctx, selectOrphanedEncoding, encodingID).Scan(&metadataID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := deleteDerivatives(ctx, tx, encodingID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, deleteEncoding, encodingID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, deleteOrphanedMetadata, metadataID)
+	return err
+}
+
+// describeFile fills in the metadata from what's embedded in the file.  If the
+// file doesn't say when it was captured, the modification time is used as an
+// estimate.
+func describeFile(path string, info fs.FileInfo, mimeType string) Metadata {
+	embedded, err := ReadEmbeddedMetadata(path, mimeType)
+	if err != nil {
+		log.Printf("Warning - Unable to read the embedded metadata of %s: %v", path, err)
+	}
+
+	result := Metadata{
+		Date:        embedded.DateTimeOriginal,
+		Tags:        embedded.Keywords,
+		Coordinates: embedded.Coordinates,
+		Description: embedded.Description,
+	}
+	if result.Date.IsZero() {
+		result.Date = info.ModTime().UTC()
+		result.DateEstimated = true
+	}
+	if result.Tags == nil {
+		result.Tags = []string{}
+	}
+	return result
+}
+
+// describeEncoding fills in the runtime and resolution of a video from its container.
+// A video that can't be probed is catalogued without them.
+func describeEncoding(path, mimeType, hash string, locator Locator) Encoding {
+	video, err := ProbeVideo(path, mimeType)
+	if err != nil {
+		log.Printf("Warning - Unable to probe the video %s: %v", path, err)
+	}
+
+	return Encoding{
+		Locator:    []Locator{locator},
+		Runtime:    video.Runtime,
+		Resolution: video.Resolution,
+		MimeType:   mimeType,
+		Hash:       hash,
+	}
+}
+
+// indexImage stores the perceptual hash of an image, so it can be found by what it
+// looks like.  An image that can't be decoded is catalogued without one.
+func indexImage(ctx context.Context, tx DBCaller, encodingID int64, path, mimeType string) error {
+	if !isImage(mimeType) {
+		return nil
+	}
+
+	hash, err := perceptualHashFile(path)
+	if err != nil {
+		log.Printf("Warning - Unable to decode %s for its perceptual hash: %v", path, err)
+		return nil
+	}
+	return savePerceptualHash(ctx, tx, encodingID, hash)
+}
+
+// fileModified is the modification time of the file as the database keeps it, to the
+// microsecond.
+func fileModified(info fs.FileInfo) time.Time {
+	return info.ModTime().UTC().Truncate(time.Microsecond)
+}
+
+// hashFile reads the file once, returning the hex SHA-256 of its content and its
+// mime type.
+func hashFile(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", err
+	}
+	head = head[:n]
+
+	hash := sha256.New()
+	hash.Write(head)
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), sniffMimeType(path, head), nil
+}
+
+// sniffMimeType detects the mime type from the content, falling back on the file
+// extension when the content isn't recognised.
+func sniffMimeType(path string, head []byte) string {
+	detected, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		detected = string(MimeBinary)
+	}
+	if detected != string(MimeBinary) && !strings.HasPrefix(detected, "text/") {
+		return detected
+	}
+
+	if byExtension := extensionMimeType(path); byExtension != "" {
+		return byExtension
+	}
+	return detected
+}
+
+// extensionMimeType is the mime type for the extension of the path, or empty if it
+// isn't known.
+func extensionMimeType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := extensionMimeTypes[ext]; ok {
+		return mimeType
+	}
+	if byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return byExtension
+	}
+	return ""
+}
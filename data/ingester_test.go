@@ -0,0 +1,356 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pashagolub/pgxmock"
+)
+
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Unable to write test file: %v", err)
+	}
+	return path
+}
+
+// testFileModified is the modification time of the file as the ingester stores it.
+func testFileModified(t *testing.T, path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unable to stat test file: %v", err)
+	}
+	return fileModified(info)
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSniffMimeType(t *testing.T) {
+	tests := []struct {
+		path     string
+		head     []byte
+		expected string
+	}{
+		{"/foo/bar.png", pngHeader, MimePNG},
+		{"/foo/bar.jpg", []byte("\xFF\xD8\xFF\xE0"), MimeJPEG},
+		{"/foo/bar.tiff", []byte("II*\x00"), MimeTIFF},
+		{"/foo/bar.MOV", []byte("\x00\x00\x00\x14ftypqt  "), "video/quicktime"},
+		{"/foo/bar", []byte{0x00, 0x01, 0x02}, string(MimeBinary)},
+	}
+
+	for _, test := range tests {
+		if mimeType := sniffMimeType(test.path, test.head); mimeType != test.expected {
+			t.Errorf("Expected %s for %s but got %s", test.expected, test.path, mimeType)
+		}
+	}
+}
+
+func TestIngester_IngestFileAdded(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO all_files`).
+		WithArgs(path, hash, "bar.png", int64(len(pngHeader)), testFileModified(t, path)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WithArgs(pgxmock.AnyArg(), true, "", []string{}, noCoordinate, noCoordinate, noCoordinate, "").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(2), pgxmock.AnyArg(), 0, 0, "P", MimePNG, hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestAdded {
+		t.Errorf("Expected the file to be added but got %v", outcome)
+	}
+
+	if !caller.Committed {
+		t.Error("Expected the file to be committed")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_IngestFileUnchanged(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	modified := testFileModified(t, path)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), contentHash(pngHeader), int64(len(pngHeader)), &modified))
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestUnchanged {
+		t.Errorf("Expected the file to be unchanged but got %v", outcome)
+	}
+
+	if caller.Committed {
+		t.Error("Expected nothing to be written for an unchanged file")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_IngestFileChanged(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), "ABCD1234", int64(4), nil))
+	caller.Conn.ExpectExec(`UPDATE all_files`).
+		WithArgs(int64(1), hash, int64(len(pngHeader)), testFileModified(t, path)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`DELETE FROM locator`).
+		WithArgs(pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`SELECT id FROM locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+	caller.Conn.ExpectQuery(`SELECT metadata_id FROM encoding`).
+		WithArgs(int64(2)).
+		WillReturnRows(pgxmock.NewRows([]string{"metadata_id"}).AddRow(int64(5)))
+	caller.Conn.ExpectExec(`DELETE FROM locator\s+WHERE encoding_id IN \(SELECT encoding_id FROM encoding_derivative`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	caller.Conn.ExpectExec(`DELETE FROM encoding\s+WHERE id IN \(SELECT encoding_id FROM encoding_derivative`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	caller.Conn.ExpectExec(`DELETE FROM encoding WHERE id`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM metadata`).
+		WithArgs(int64(5)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestDuplicate {
+		t.Errorf("Expected the file to join the existing encoding but got %v", outcome)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_IngestFileChangedAfterThumbnail(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), "ABCD1234", int64(4), nil))
+	caller.Conn.ExpectExec(`UPDATE all_files`).
+		WithArgs(int64(1), hash, int64(len(pngHeader)), testFileModified(t, path)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`DELETE FROM locator`).
+		WithArgs(pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(6)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(7), pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(8)))
+	// The old encoding has a thumbnail, which goes with it rather than keeping the
+	// metadata as an encoding of its own.
+	caller.Conn.ExpectQuery(`SELECT metadata_id FROM encoding`).
+		WithArgs(int64(2)).
+		WillReturnRows(pgxmock.NewRows([]string{"metadata_id"}).AddRow(int64(5)))
+	caller.Conn.ExpectExec(`DELETE FROM locator\s+WHERE encoding_id IN \(SELECT encoding_id FROM encoding_derivative WHERE source_id = \$1\)`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM encoding\s+WHERE id IN \(SELECT encoding_id FROM encoding_derivative WHERE source_id = \$1\)`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM encoding WHERE id`).
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM metadata\s+WHERE id = \$1 AND NOT EXISTS \(\s+SELECT 1 FROM encoding\s+WHERE metadata_id = \$1 AND id NOT IN \(SELECT encoding_id FROM encoding_derivative\)\)`).
+		WithArgs(int64(5)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestAdded {
+		t.Errorf("Expected the changed file to be added as new media but got %v", outcome)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_IngestFileEditedSameSize(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+	modified := testFileModified(t, path)
+	earlier := modified.Add(-time.Hour)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), "ABCD1234", int64(len(pngHeader)), &earlier))
+	caller.Conn.ExpectExec(`UPDATE all_files`).
+		WithArgs(int64(1), hash, int64(len(pngHeader)), modified).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`DELETE FROM locator`).
+		WithArgs(pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"encoding_id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`SELECT id FROM locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+	caller.Conn.ExpectQuery(`SELECT metadata_id FROM encoding`).
+		WithArgs(int64(2)).
+		WillReturnError(pgx.ErrNoRows)
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestDuplicate {
+		t.Errorf("Expected a file edited without changing size to be read again but got %v", outcome)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_IngestFileTouched(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+	modified := testFileModified(t, path)
+	earlier := modified.Add(-time.Hour)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), hash, int64(len(pngHeader)), &earlier))
+	caller.Conn.ExpectExec(`UPDATE all_files`).
+		WithArgs(int64(1), hash, int64(len(pngHeader)), modified).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	outcome, err := NewIngester(caller).IngestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if outcome != IngestUnchanged {
+		t.Errorf("Expected a file with the same content to be unchanged but got %v", outcome)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIngester_Ingest(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	root := t.TempDir()
+	first := writeTestFile(t, root, "a/bar.png", pngHeader)
+	second := writeTestFile(t, root, "b/bar.png", pngHeader)
+	hash := contentHash(pngHeader)
+	modified := testFileModified(t, first)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(first).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "size", "modified"}).
+			AddRow(int64(1), hash, int64(len(pngHeader)), &modified))
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(second).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO all_files`).
+		WithArgs(second, hash, "bar.png", int64(len(pngHeader)), testFileModified(t, second)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`SELECT id FROM locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), second).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), second).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(5)))
+
+	result, err := NewIngester(caller).Ingest(ctx, root)
+	if err != nil {
+		t.Fatalf("Unexpected error ingesting directory: %v", err)
+	}
+
+	if result.Scanned != 2 || result.Unchanged != 1 || result.Duplicates != 1 || len(result.Failed) != 0 {
+		t.Errorf("Expected one unchanged and one duplicate file but got %+v", result)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
@@ -1,10 +1,42 @@
 package data
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net/url"
 	"os"
+	"sync"
 )
 
+const (
+	// SourceFile is the source of a locator for a file on the local filesystem.
+	SourceFile = "file"
+)
+
+var (
+	ErrUnsupportedLocator   = errors.New("locator type cannot be stored")
+	ErrUnknownLocatorSource = errors.New("unknown locator source")
+	ErrNoLocator            = errors.New("encoding has no locators")
+)
+
+// UnknownLocatorSourceError is returned for a locator whose source has no
+// factory registered, so the data can't be reached.
+type UnknownLocatorSourceError struct {
+	Source string
+	Path   string
+}
+
+func (e UnknownLocatorSourceError) Error() string {
+	return fmt.Sprintf("%v: %q for %s", ErrUnknownLocatorSource, e.Source, e.Path)
+}
+
+func (e UnknownLocatorSourceError) Unwrap() error {
+	return ErrUnknownLocatorSource
+}
+
 // Locator describes the place where the bytes of the media are actually
 // stored.  Locator is an interface so different saved data can be returned
 // for the same metadata.  For example, there may be duplicates of an
@@ -16,6 +48,69 @@ type Locator interface {
 	// Data opens a stream to retrieve the contents of the image at that
 	// location.
 	Data() (io.ReadCloser, error)
+	// URL describes the location in a form that can be handed outside the
+	// system, e.g. file:///foo/bar.jpg for a file on the filesystem.
+	URL() url.URL
+}
+
+// StoredLocator is a Locator that can be saved in the locator table, as its
+// source and the path it returns.  The factory registered for the source turns
+// the path back into the Locator.
+type StoredLocator interface {
+	Locator
+	StoredPath() string
+}
+
+// VerifyingLocator is a Locator that can check its data against the hash of the
+// encoding as it's read, for data that comes from outside the system.
+type VerifyingLocator interface {
+	Locator
+	VerifiedData(hash string) (io.ReadCloser, error)
+}
+
+// LocatorFactory builds the Locator for the path stored in locator.path.
+type LocatorFactory func(path string) (Locator, error)
+
+var (
+	locatorFactoriesLock sync.RWMutex
+	locatorFactories     = map[string]LocatorFactory{
+		SourceFile: func(path string) (Locator, error) {
+			return fileSystemLocator{Path: path}, nil
+		},
+	}
+)
+
+// RegisterLocator makes a kind of locator available, keyed by the value of
+// locator.source.  Registering a source again replaces its factory.
+func RegisterLocator(source string, factory LocatorFactory) {
+	locatorFactoriesLock.Lock()
+	defer locatorFactoriesLock.Unlock()
+
+	locatorFactories[source] = factory
+}
+
+// NewLocator builds the locator stored with the given source and path.  An
+// UnknownLocatorSourceError is returned if nothing is registered for the source.
+func NewLocator(source, path string) (Locator, error) {
+	locatorFactoriesLock.RLock()
+	factory, ok := locatorFactories[source]
+	locatorFactoriesLock.RUnlock()
+
+	if !ok {
+		return nil, UnknownLocatorSourceError{Source: source, Path: path}
+	}
+	return factory(path)
+}
+
+// resolveLocator builds the locator for a stored row.  A row that can't be
+// resolved still round trips, so saving the encoding doesn't drop it, but
+// reading its data returns the error.
+func resolveLocator(source, path string) Locator {
+	l, err := NewLocator(source, path)
+	if err != nil {
+		return unresolvedLocator{source: source, path: path, err: err}
+	}
+	return l
 }
 
 type fileSystemLocator struct {
@@ -23,9 +118,98 @@ type fileSystemLocator struct {
 }
 
 func (fsl fileSystemLocator) Source() string {
-	return "files"
+	return SourceFile
 }
 
 func (fsl fileSystemLocator) Data() (io.ReadCloser, error) {
 	return os.Open(fsl.Path)
 }
+
+func (fsl fileSystemLocator) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(fsl.Path)
+}
+
+func (fsl fileSystemLocator) Stat(ctx context.Context) (LocatorInfo, error) {
+	info, err := os.Stat(fsl.Path)
+	if err != nil {
+		return LocatorInfo{}, err
+	}
+	return LocatorInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (fsl fileSystemLocator) URL() url.URL {
+	return url.URL{
+		Scheme: "file",
+		Path:   fsl.Path,
+	}
+}
+
+func (fsl fileSystemLocator) StoredPath() string {
+	return fsl.Path
+}
+
+// unresolvedLocator stands in for a stored locator that couldn't be built.
+type unresolvedLocator struct {
+	source string
+	path   string
+	err    error
+}
+
+func (ul unresolvedLocator) Source() string {
+	return ul.source
+}
+
+func (ul unresolvedLocator) Data() (io.ReadCloser, error) {
+	return nil, ul.err
+}
+
+func (ul unresolvedLocator) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	return nil, ul.err
+}
+
+func (ul unresolvedLocator) Stat(ctx context.Context) (LocatorInfo, error) {
+	return LocatorInfo{}, ul.err
+}
+
+func (ul unresolvedLocator) URL() url.URL {
+	return url.URL{
+		Scheme: ul.source,
+		Path:   ul.path,
+	}
+}
+
+func (ul unresolvedLocator) StoredPath() string {
+	return ul.path
+}
+
+// OpenEncoding opens the data of the first locator of the encoding that can be
+// read, returning the error of the last one tried if none can.  A VerifyingLocator
+// checks the data against the hash of the encoding.
+func OpenEncoding(encoding Encoding) (io.ReadCloser, error) {
+	err := ErrNoLocator
+	for _, l := range encoding.Locator {
+		var stream io.ReadCloser
+		if verifying, ok := l.(VerifyingLocator); ok && encoding.Hash != "" {
+			stream, err = verifying.VerifiedData(encoding.Hash)
+		} else {
+			stream, err = l.Data()
+		}
+		if err == nil {
+			return stream, nil
+		}
+		log.Printf("Warning - Unable to open %s locator for encoding %d: %v", l.Source(), encoding.ID, err)
+	}
+	return nil, err
+}
+
+// locatorPath returns the value stored in the locator.path column for
+// a given locator.
+func locatorPath(l Locator) (string, error) {
+	if stored, ok := l.(StoredLocator); ok {
+		return stored.StoredPath(), nil
+	}
+	return "", ErrUnsupportedLocator
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+type memoryLocator struct {
+	key string
+}
+
+func (ml memoryLocator) Source() string {
+	return "memory"
+}
+
+func (ml memoryLocator) Data() (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (ml memoryLocator) URL() url.URL {
+	return url.URL{Scheme: "memory", Opaque: ml.key}
+}
+
+func TestNewLocator(t *testing.T) {
+	l, err := NewLocator(SourceFile, "/foo/bar.jpg")
+	if err != nil {
+		t.Fatalf("Unexpected error building a file locator: %v", err)
+	}
+
+	if l.Source() != "file" {
+		t.Errorf("Expected the source to be file but got %s", l.Source())
+	}
+
+	if u := l.URL(); u.String() != "file:///foo/bar.jpg" {
+		t.Errorf("Expected file:///foo/bar.jpg but got %s", u.String())
+	}
+
+	if path, err := locatorPath(l); err != nil || path != "/foo/bar.jpg" {
+		t.Errorf("Expected the path to be stored but got %s, %v", path, err)
+	}
+}
+
+func TestNewLocator_UnknownSource(t *testing.T) {
+	_, err := NewLocator("tape", "/reel/7")
+	if !errors.Is(err, ErrUnknownLocatorSource) {
+		t.Errorf("Expected an unknown source error but got %v", err)
+	}
+
+	var unknown UnknownLocatorSourceError
+	if !errors.As(err, &unknown) || unknown.Source != "tape" || unknown.Path != "/reel/7" {
+		t.Errorf("Expected the unknown source and path but got %v", err)
+	}
+}
+
+func TestRegisterLocator(t *testing.T) {
+	RegisterLocator("memory", func(path string) (Locator, error) {
+		return memoryLocator{key: path}, nil
+	})
+	t.Cleanup(func() {
+		locatorFactoriesLock.Lock()
+		defer locatorFactoriesLock.Unlock()
+		delete(locatorFactories, "memory")
+	})
+
+	l, err := NewLocator("memory", "bar")
+	if err != nil {
+		t.Fatalf("Unexpected error building a registered locator: %v", err)
+	}
+
+	if ml, ok := l.(memoryLocator); !ok || ml.key != "bar" {
+		t.Errorf("Expected the registered locator but got %v", l)
+	}
+
+	if _, err := locatorPath(l); err != ErrUnsupportedLocator {
+		t.Errorf("Expected a locator without a stored path to be unsupported but got %v", err)
+	}
+}
+
+func TestDbMetadataServer_UnknownLocatorSource(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	rows := pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	})
+	rows.AddRow(int64(1), time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local), false, "home", []string{"foo"},
+		nil, nil, nil, "", "", int64(10), time.Second*0, Resolution{Width: 1024, Height: 600, Scan: 'P'},
+		MimeJPEG, "ABCD1234", int64(100), "tape", "/reel/7")
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).WillReturnRows(rows)
+
+	metadata, err := NewMetadataServer(caller).FindById(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected an unknown source to still be found but got %v", err)
+	}
+
+	l := metadata.Data[0].Locator[0]
+	if l.Source() != "tape" {
+		t.Errorf("Expected the stored source but got %s", l.Source())
+	}
+
+	if _, err := l.Data(); !errors.Is(err, ErrUnknownLocatorSource) {
+		t.Errorf("Expected reading the data to fail with an unknown source but got %v", err)
+	}
+
+	if path, err := locatorPath(l); err != nil || path != "/reel/7" {
+		t.Errorf("Expected the locator to keep its stored path but got %s, %v", path, err)
+	}
+}
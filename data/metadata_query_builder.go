@@ -1,49 +1,127 @@
 package data
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+var (
+	ErrUnknownSort = errors.New("unknown sort order")
+)
+
 const (
-	queryBase = `SELECT metadata.id, date_captured, location, tags,
-		encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
-		locator.id, locator.source, locator.path
-	FROM metadata
+	metadataJoins = `FROM metadata
          INNER JOIN encoding on metadata.id = encoding.metadata_id
          INNER JOIN locator on encoding.id = locator.encoding_id`
+	// queryBase takes the snippet of the description that's selected.
+	queryBase = `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude,
+		description, %s,
+		encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
+		locator.id, locator.source, locator.path
+	` + metadataJoins
+	countBase   = `SELECT count(DISTINCT metadata.id) ` + metadataJoins
 	orderClause = `ORDER BY metadata.id, encoding.id, locator.id ASC`
+	// encodingCount is the number of encodings of the metadata on the row.
+	encodingCount = `(SELECT count(*) FROM encoding AS counted WHERE counted.metadata_id = metadata.id)`
+	// textQuery, relevance and snippet take the index of the text being searched for.
+	textQuery = `websearch_to_tsquery('english', $%d)`
+	relevance = `ts_rank(metadata.document, ` + textQuery + `)`
+	snippet   = `ts_headline('english', metadata.description, ` + textQuery + `,
+			'StartSel=' || chr(2) || ', StopSel=' || chr(3))`
+	noSnippet = `''`
+)
+
+// HighlightStart and HighlightStop surround the words of a snippet that matched a
+// text search.
+const (
+	HighlightStart = "\x02"
+	HighlightStop  = "\x03"
+)
+
+// SortOrder is the order metadata are returned in.  Metadata that sort the same
+// are kept in order of id.
+type SortOrder string
+
+const (
+	SortByID             SortOrder = ""
+	SortByDate           SortOrder = "date"
+	SortByDateDescending SortOrder = "-date"
+	SortByLocation       SortOrder = "location"
+	// SortByEncodings puts the metadata with the most encodings first.
+	SortByEncodings SortOrder = "encodings"
+	// SortByRelevance puts the metadata that best match a text search first.
+	SortByRelevance SortOrder = "relevance"
 )
 
-// MetadataQueryBuilder builds a metadata query in a fluent manner.
+// sortKey is the SQL a sort order is written as.  Only these ever reach the query.
+type sortKey struct {
+	expression string
+	descending bool
+	// ranked keys are ranked against the text searched for.
+	ranked bool
+}
+
+var sortKeys = map[SortOrder]sortKey{
+	SortByID:             {expression: "metadata.id"},
+	SortByDate:           {expression: "metadata.date_captured"},
+	SortByDateDescending: {expression: "metadata.date_captured", descending: true},
+	SortByLocation:       {expression: "metadata.location"},
+	SortByEncodings:      {expression: encodingCount, descending: true},
+	SortByRelevance:      {expression: relevance, descending: true, ranked: true},
+}
+
+// ParseSortOrder checks the name of a sort order, such as -date.  An empty name
+// sorts by id.
+func ParseSortOrder(name string) (SortOrder, error) {
+	if _, ok := sortKeys[SortOrder(name)]; !ok {
+		return SortByID, fmt.Errorf("%w: %q", ErrUnknownSort, name)
+	}
+	return SortOrder(name), nil
+}
+
+// MetadataQueryBuilder builds a metadata query in a fluent manner.  The
+// conditions are collected as they're added and the query is put together
+// around them at the end.
 type MetadataQueryBuilder struct {
-	b   strings.Builder
-	idx int
+	b    strings.Builder
+	idx  int
+	sort sortKey
+	// text is the index of the text searched for, if there is one.
+	text int
 }
 
 // NewMetadataQueryBuilder returns a query builder.
 func NewMetadataQueryBuilder() *MetadataQueryBuilder {
 	return &MetadataQueryBuilder{
-		b:   strings.Builder{},
-		idx: 1,
+		b:    strings.Builder{},
+		idx:  1,
+		sort: sortKeys[SortByID],
 	}
 }
 
 func (qb *MetadataQueryBuilder) FindById() string {
 	qb.addFrontMatter()
-	qb.b.WriteString(fmt.Sprintf("metadata.id = $%d %s", qb.idx, orderClause))
-	return qb.b.String()
+	qb.b.WriteString(fmt.Sprintf("metadata.id = $%d ", qb.idx))
+	qb.idx = qb.idx + 1
+	return qb.String()
 }
 
 func (qb *MetadataQueryBuilder) addFrontMatter() *MetadataQueryBuilder {
-	if qb.b.Len() == 0 {
-		_, _ = qb.b.WriteString(fmt.Sprintf("%s WHERE ", queryBase))
-	} else {
+	if qb.b.Len() > 0 {
 		_, _ = qb.b.WriteString(" AND ")
 	}
 	return qb
 }
 
+// where returns the WHERE clause of the conditions, if there are any.
+func (qb *MetadataQueryBuilder) where() string {
+	if qb.b.Len() == 0 {
+		return ""
+	}
+	return "WHERE " + qb.b.String()
+}
+
 // AddTags adds placeholders for tags to pass to the query.
 func (qb *MetadataQueryBuilder) AddTags(ntags int) *MetadataQueryBuilder {
 	qb.addFrontMatter()
@@ -112,11 +190,152 @@ func (qb *MetadataQueryBuilder) ByMimeTypes(ntypes int) *MetadataQueryBuilder {
 	return qb
 }
 
-// String creates the final query string and resets the builder.
+// WithinRadius adds a clause for metadata captured within a distance of a point,
+// taking the latitude and longitude of the point in degrees and then the distance
+// in metres.  The latitudes the circle spans are checked first, so an index on
+// latitude can narrow the search before the distance is worked out.
+func (qb *MetadataQueryBuilder) WithinRadius() *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	latitude := fmt.Sprintf("$%d::float8", qb.idx)
+	longitude := fmt.Sprintf("$%d::float8", qb.idx+1)
+	meters := fmt.Sprintf("$%d::float8", qb.idx+2)
+	qb.b.WriteString(fmt.Sprintf(`(metadata.latitude BETWEEN %[1]s - degrees(%[3]s / %.1[4]f) AND %[1]s + degrees(%[3]s / %.1[4]f)
+			AND %[5]s <= %[3]s) `,
+		latitude, longitude, meters, earthRadius,
+		haversine(latitude, longitude, "metadata.latitude", "metadata.longitude")))
+	qb.idx = qb.idx + 3
+
+	return qb
+}
+
+// WithinBox adds a clause for metadata captured within a box, taking its south,
+// west, north and east edges in degrees.  When west is greater than east the box
+// crosses the antimeridian.
+func (qb *MetadataQueryBuilder) WithinBox() *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	qb.b.WriteString(fmt.Sprintf(`(metadata.latitude BETWEEN $%[1]d::float8 AND $%[3]d::float8
+			AND (metadata.longitude BETWEEN $%[2]d::float8 AND $%[4]d::float8
+				OR ($%[2]d::float8 > $%[4]d::float8 AND (metadata.longitude >= $%[2]d::float8 OR metadata.longitude <= $%[4]d::float8)))) `,
+		qb.idx, qb.idx+1, qb.idx+2, qb.idx+3))
+	qb.idx = qb.idx + 4
+
+	return qb
+}
+
+// Matching adds the clause of an expression to the query.  Its values come from
+// Parameters, in the same place in the arguments.
+func (qb *MetadataQueryBuilder) Matching(expression Expression) *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	c := expressionCompiler{idx: qb.idx}
+	qb.b.WriteString(expression.compile(&c) + " ")
+	qb.idx = c.idx
+
+	return qb
+}
+
+// MatchingText adds a full text search of the description, tags and location to the
+// query, which also selects a snippet of the description with the matches
+// highlighted.  The text is in the syntax of a web search, such as "red boat" -sea.
+func (qb *MetadataQueryBuilder) MatchingText() *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	qb.b.WriteString(fmt.Sprintf("metadata.document @@ "+textQuery+" ", qb.idx))
+	qb.text = qb.idx
+	qb.idx = qb.idx + 1
+
+	return qb
+}
+
+// OrderBy sorts the metadata by one of the sort orders.  An unknown order is
+// left sorted by id.  Sorting by relevance needs MatchingText.
+func (qb *MetadataQueryBuilder) OrderBy(order SortOrder) *MetadataQueryBuilder {
+	if key, ok := sortKeys[order]; ok {
+		qb.sort = key
+	}
+	return qb
+}
+
+// WithIds adds a clause for the metadata with an id in an array.
+func (qb *MetadataQueryBuilder) WithIds() *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	qb.b.WriteString(fmt.Sprintf("metadata.id = ANY($%d) ", qb.idx))
+	qb.idx = qb.idx + 1
+
+	return qb
+}
+
+// After adds a clause for the metadata that sort after a given one.  When sorted by
+// id it takes the id, otherwise it takes the sort key and then the id.
+func (qb *MetadataQueryBuilder) After() *MetadataQueryBuilder {
+	qb.addFrontMatter()
+
+	key, id := qb.idx, qb.idx+1
+	switch {
+	case qb.sort == sortKeys[SortByID]:
+		qb.b.WriteString(fmt.Sprintf("metadata.id > $%d ", qb.idx))
+		qb.idx = qb.idx + 1
+		return qb
+	case qb.sort.descending:
+		qb.b.WriteString(fmt.Sprintf("(%[1]s < $%[2]d OR (%[1]s = $%[2]d AND metadata.id > $%[3]d)) ",
+			qb.sortExpression(), key, id))
+	default:
+		qb.b.WriteString(fmt.Sprintf("(%s, metadata.id) > ($%d, $%d) ", qb.sortExpression(), key, id))
+	}
+	qb.idx = qb.idx + 2
+
+	return qb
+}
+
+// Count creates a query for the number of metadata matching the conditions.  It
+// takes the same parameters as String.
+func (qb *MetadataQueryBuilder) Count() string {
+	return fmt.Sprintf("%s %s", countBase, qb.where())
+}
+
+// PageIds creates a query for the id and sort key of each metadata in a page, taking
+// the most metadata in the page as its last parameter.  The page is chosen by
+// metadata rather than by row, so that a metadata is never split between pages by
+// the rows of its encodings and locators.
+func (qb *MetadataQueryBuilder) PageIds() string {
+	limit := qb.idx
+	qb.idx = qb.idx + 1
+
+	return fmt.Sprintf("SELECT metadata.id, %s %s %s GROUP BY metadata.id ORDER BY %s, metadata.id LIMIT $%d",
+		qb.sortExpression(), metadataJoins, qb.where(), qb.order(), limit)
+}
+
+// sortExpression is the SQL of the sort key, which for a ranked key refers to the
+// text searched for.
+func (qb *MetadataQueryBuilder) sortExpression() string {
+	if qb.sort.ranked {
+		return fmt.Sprintf(qb.sort.expression, qb.text)
+	}
+	return qb.sort.expression
+}
+
+func (qb *MetadataQueryBuilder) order() string {
+	if qb.sort.descending {
+		return qb.sortExpression() + " DESC"
+	}
+	return qb.sortExpression() + " ASC"
+}
+
+func (qb *MetadataQueryBuilder) orderClause() string {
+	if qb.sort == sortKeys[SortByID] {
+		return orderClause
+	}
+	return fmt.Sprintf("ORDER BY %s, metadata.id, encoding.id, locator.id ASC", qb.order())
+}
+
+// String creates the final query string.
 func (qb *MetadataQueryBuilder) String() string {
-	if qb.b.Len() == 0 {
-		return fmt.Sprintf("%s %s", queryBase, orderClause)
+	selected := noSnippet
+	if qb.text > 0 {
+		selected = fmt.Sprintf(snippet, qb.text)
 	}
-	result := fmt.Sprintf("%s %s", qb.b.String(), orderClause)
-	return result
+	return fmt.Sprintf("%s %s %s", fmt.Sprintf(queryBase, selected), qb.where(), qb.orderClause())
 }
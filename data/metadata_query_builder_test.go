@@ -1,6 +1,7 @@
 package data
 
 import (
+	"errors"
 	"regexp"
 	"strings"
 	"testing"
@@ -12,7 +13,7 @@ func TestMetadataQueryBuilder_FindById(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.FindById()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -33,7 +34,7 @@ func TestMetadataQueryBuilder_AddTags(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.AddTags(3).String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -54,7 +55,7 @@ func TestMetadataQueryBuilder_BetweenDates(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.BetweenDates().String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -75,7 +76,7 @@ func TestMetadataQueryBuilder_AtLocation(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.AtLocation().String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -96,7 +97,7 @@ func TestMetadataQueryBuilder_BetweenDatesTagsLocation(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.BetweenDates().AddTags(3).AtLocation().String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -120,7 +121,7 @@ func TestMetadataQueryBuilder_StringString(t *testing.T) {
 	query := qb.AtLocation().String()
 	query = qb.String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -141,7 +142,7 @@ func TestMetadataQueryBuilder_NoMethodsCalled(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -161,7 +162,7 @@ func TestMetadataQueryBuilder_AtLocations(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.AtLocations(3).String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -182,7 +183,7 @@ func TestMetadataQueryBuilder_AtTagsAndLocations(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.AddTags(2).AtLocations(3).String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -203,7 +204,7 @@ func TestMetadataQueryBuilder_AtLocationsAndTags(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.AtLocations(3).AddTags(2).String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -224,7 +225,7 @@ func TestMetadataQueryBuilder_ByMimeTypes(t *testing.T) {
 	qb := NewMetadataQueryBuilder()
 	query := qb.ByMimeTypes(2).String()
 
-	target := `SELECT metadata.id, date_captured, location, tags, 
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata 
@@ -239,4 +240,61 @@ func TestMetadataQueryBuilder_ByMimeTypes(t *testing.T) {
 	if target != query {
 		t.Errorf("Expected %s but got %s", target, query)
 	}
-}
\ No newline at end of file
+}
+func TestMetadataQueryBuilder_OrderBy(t *testing.T) {
+	qb := NewMetadataQueryBuilder()
+	query := qb.OrderBy(SortByEncodings).AtLocation().String()
+
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '',
+			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
+			locator.id, locator.source, locator.path
+		FROM metadata
+			INNER JOIN encoding on metadata.id = encoding.metadata_id
+			INNER JOIN locator on encoding.id = locator.encoding_id
+		WHERE location = $1
+		ORDER BY (SELECT count(*) FROM encoding AS counted WHERE counted.metadata_id = metadata.id) DESC,
+			metadata.id, encoding.id, locator.id ASC`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if target != query {
+		t.Errorf("Expected %s but got %s", target, query)
+	}
+}
+
+func TestMetadataQueryBuilder_MatchingText(t *testing.T) {
+	qb := NewMetadataQueryBuilder()
+	query := qb.OrderBy(SortByRelevance).AddTags(1).MatchingText().String()
+
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description,
+			ts_headline('english', metadata.description, websearch_to_tsquery('english', $2),
+				'StartSel=' || chr(2) || ', StopSel=' || chr(3)),
+			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
+			locator.id, locator.source, locator.path
+		FROM metadata
+			INNER JOIN encoding on metadata.id = encoding.metadata_id
+			INNER JOIN locator on encoding.id = locator.encoding_id
+		WHERE $1 = ANY(tags) AND metadata.document @@ websearch_to_tsquery('english', $2)
+		ORDER BY ts_rank(metadata.document, websearch_to_tsquery('english', $2)) DESC,
+			metadata.id, encoding.id, locator.id ASC`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if target != query {
+		t.Errorf("Expected %s but got %s", target, query)
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	for _, name := range []string{"", "date", "-date", "location", "encodings", "relevance"} {
+		if order, err := ParseSortOrder(name); err != nil || string(order) != name {
+			t.Errorf("Expected %q to be a sort order but got %v", name, err)
+		}
+	}
+
+	if _, err := ParseSortOrder("date; DROP TABLE metadata"); !errors.Is(err, ErrUnknownSort) {
+		t.Errorf("Expected an unknown sort order but got %v", err)
+	}
+}
@@ -3,11 +3,48 @@ package data
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"time"
 
+	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
 )
 
+var (
+	ErrMetadataNotFound = errors.New("metadata not found")
+	ErrEncodingNotFound = errors.New("encoding does not belong to the metadata")
+)
+
+const (
+	insertMetadata = `INSERT INTO metadata (date_captured, date_estimated, location, tags,
+			latitude, longitude, altitude, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`
+	updateMetadata = `UPDATE metadata SET date_captured = $2, date_estimated = $3, location = $4, tags = $5,
+			latitude = $6, longitude = $7, altitude = $8, description = $9
+		WHERE id = $1`
+	insertEncoding = `INSERT INTO encoding (metadata_id, runtime, resolution, mime_type, file_hash)
+		VALUES ($1, $2, ROW($3, $4, $5)::resolution, $6, $7)
+		RETURNING id`
+	updateEncoding = `UPDATE encoding SET runtime = $2, resolution = ROW($3, $4, $5)::resolution,
+			mime_type = $6, file_hash = $7
+		WHERE id = $1`
+	deleteEncoding = `DELETE FROM encoding WHERE id = $1`
+	insertLocator  = `INSERT INTO locator (encoding_id, source, path)
+		VALUES ($1, $2, $3)
+		RETURNING id`
+	deleteLocator = `DELETE FROM locator
+		WHERE encoding_id = $1 AND source = $2 AND path = $3`
+	deleteEncodingLocators = `DELETE FROM locator WHERE encoding_id = $1`
+	selectStoredLocators   = `SELECT encoding.id, locator.source, locator.path
+		FROM encoding
+			LEFT JOIN locator on encoding.id = locator.encoding_id
+		WHERE encoding.metadata_id = $1
+		ORDER BY encoding.id, locator.id`
+)
+
 type MimeType string
 
 const (
@@ -26,6 +63,8 @@ const (
 	MimeWEBP            = "image/webp"
 	Mime3GPP            = "video/3gpp"
 	Mime3GPP2           = "video/3gpp2"
+	MimeQuickTime       = "video/quicktime"
+	MimeMatroska        = "video/x-matroska"
 )
 
 type Resolution struct {
@@ -47,16 +86,86 @@ type Resolution struct {
 // thumbnail.  If the JPEG version is stored in two place, I still
 // have 3 metadata instances, but the JPEG one will have two
 // locations.
+//
+// The estimate flag and the coordinates were added to the metadata table with:
+//
+//	ALTER TABLE metadata
+//		ADD COLUMN date_estimated BOOLEAN NOT NULL DEFAULT FALSE,
+//		ADD COLUMN latitude DOUBLE PRECISION,
+//		ADD COLUMN longitude DOUBLE PRECISION,
+//		ADD COLUMN altitude DOUBLE PRECISION;
+//
+// Searches by area narrow the metadata by latitude first, using:
+//
+//	CREATE INDEX metadata_latitude_idx ON metadata (latitude);
+//
+// The description, and the document the text search looks through, were added with:
+//
+//	ALTER TABLE metadata ADD COLUMN description TEXT NOT NULL DEFAULT '';
+//	CREATE FUNCTION metadata_document(description TEXT, location TEXT, tags TEXT[])
+//		RETURNS TSVECTOR LANGUAGE SQL IMMUTABLE AS $$
+//		SELECT setweight(to_tsvector('english', array_to_string(tags, ' ')), 'A') ||
+//			setweight(to_tsvector('english', coalesce(location, '')), 'B') ||
+//			setweight(to_tsvector('english', description), 'C')
+//	$$;
+//	ALTER TABLE metadata ADD COLUMN document TSVECTOR
+//		GENERATED ALWAYS AS (metadata_document(description, location, tags)) STORED;
+//	CREATE INDEX metadata_document_idx ON metadata USING GIN (document);
 type Metadata struct {
-	ID       int64
-	Date     time.Time
-	Tags     []string
-	Location string
-	Data     []Encoding
+	ID   int64
+	Date time.Time
+	// DateEstimated is set when the capture date couldn't be read from the media,
+	// so Date is only a guess, such as the modification time of the file.
+	DateEstimated bool
+	Tags          []string
+	Location      string
+	// Coordinates are where the media was captured, if it was recorded.
+	Coordinates *Coordinates
+	// Description is free text about what was captured, which a text search looks
+	// through along with the tags and location.
+	Description string
+	// Snippet is the part of the description that matched a text search, with the
+	// matching words between HighlightStart and HighlightStop.  It is only set by a
+	// search with Text.
+	Snippet string
+	Data    []Encoding
+}
+
+// Coordinates are a position on the earth in decimal degrees, north and east
+// being positive.
+type Coordinates struct {
+	Latitude  float64
+	Longitude float64
+	// Altitude is in metres above sea level, if it's known.
+	Altitude *float64
+}
+
+// coordinateArgs returns the latitude, longitude and altitude parameters,
+// which are NULL for metadata without coordinates.
+func (m Metadata) coordinateArgs() (*float64, *float64, *float64) {
+	if m.Coordinates == nil {
+		return nil, nil, nil
+	}
+	return &m.Coordinates.Latitude, &m.Coordinates.Longitude, m.Coordinates.Altitude
+}
+
+// scanCoordinates builds the coordinates from the nullable columns.
+func scanCoordinates(latitude, longitude, altitude pgtype.Float8) *Coordinates {
+	if latitude.Status != pgtype.Present || longitude.Status != pgtype.Present {
+		return nil
+	}
+	result := &Coordinates{
+		Latitude:  latitude.Float,
+		Longitude: longitude.Float,
+	}
+	if altitude.Status == pgtype.Present {
+		result.Altitude = &altitude.Float
+	}
+	return result
 }
 
 /*
-SELECT metadata.id, date_captured, location, tags,
+SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '',
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
 
@@ -93,6 +202,18 @@ type MetadataQuery struct {
 	EndDate   time.Time
 	LocatedAt []string
 	MimeType  []string
+	// Text is searched for in the description, tags and location, in the syntax of a
+	// web search such as "red boat" -sea.  The best matches come first unless another
+	// sort is given.
+	Text string
+	// Near and Within limit the search to metadata captured in an area, by the
+	// coordinates of the capture.
+	Near   *Radius
+	Within *Box
+	// Match is a further condition the metadata must meet, when it's given.
+	Match Expression
+	// Sort is the order of the results, by id when it isn't given.
+	Sort SortOrder
 }
 
 // MetadataServer is an interface to a repository of stored Metadata
@@ -100,6 +221,8 @@ type MetadataQuery struct {
 // repository for matching metadata.
 type MetadataServer interface {
 	Find(ctx context.Context, query MetadataQuery) ([]Metadata, error)
+	// FindPage is Find a page at a time.
+	FindPage(ctx context.Context, query MetadataQuery, page PageRequest) (MetadataPage, error)
 	FindById(ctx context.Context, id int64) (*Metadata, error)
 	FindByTags(ctx context.Context, tags []string) ([]Metadata, error)
 	FindByDateRange(ctx context.Context, start, end time.Time) ([]Metadata, error)
@@ -126,7 +249,7 @@ type dbMetadataServer struct {
 }
 
 /*
-SELECT metadata.id, date_captured, location, tags,
+SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '',
 			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 			locator.id, locator.source, locator.path
  		FROM metadata
@@ -135,96 +258,88 @@ SELECT metadata.id, date_captured, location, tags,
 		WHERE (location = $1 OR location = $2 OR location = $3)
 		ORDER BY metadata.id, encoding.id, locator.id ASC
 */
+
+// processRows builds the metadata from the rows of a metadata query.  Rows are
+// grouped by the ids of the metadata and encodings rather than by being next to
+// each other, so the rows can come back in any order.  Metadata and encodings keep
+// the order they are first seen in.
 func (dms dbMetadataServer) processRows(rows pgx.Rows) ([]Metadata, error) {
 	var result []Metadata
-	var currentID int64 = -1
-	var currentEncodingID int64 = -1
+	metadataIndex := make(map[int64]int)
+	encodingIndex := make(map[int64]int)
 
-	var currentMetadata Metadata
-	var currentEncoding Encoding
-	hasResults := false
 	for rows.Next() {
-		hasResults = true
-
 		var locatorID, encodingID, ID int64
-		var source, location, path, fileHash, mimeType string
+		var source, location, description, snippet, path, fileHash, mimeType string
 		var date time.Time
+		var dateEstimated bool
+		var latitude, longitude, altitude pgtype.Float8
 		var runtime time.Duration
 		var foundTags []string
 		var resolution Resolution
 
-		err := rows.Scan(&ID, &date, &location, &foundTags,
-			&encodingID, &runtime, &resolution, &mimeType, &fileHash,
+		err := rows.Scan(&ID, &date, &dateEstimated, &location, &foundTags, &latitude, &longitude, &altitude,
+			&description, &snippet, &encodingID, &runtime, &resolution, &mimeType, &fileHash,
 			&locatorID, &source, &path)
 		if err != nil {
 			return nil, err
 		}
 
-		switch {
-		case currentID < 0:
-			currentID = ID
-			currentMetadata = Metadata{
-				ID:       ID,
-				Date:     date,
-				Location: location,
-				Tags:     foundTags,
-			}
-			currentEncoding = Encoding{
-				ID:         encodingID,
-				Runtime:    runtime,
-				Resolution: resolution,
-				MimeType:   mimeType,
-				Hash:       fileHash,
-			}
-			currentEncodingID = encodingID
-		case currentID != ID:
-			currentMetadata.Data = append(currentMetadata.Data, currentEncoding)
-			result = append(result, currentMetadata)
-			currentMetadata = Metadata{
-				ID:       ID,
-				Date:     date,
-				Location: location,
-				Tags:     foundTags,
-			}
-			currentID = ID
-			currentEncoding = Encoding{
-				ID:         encodingID,
-				Runtime:    runtime,
-				Resolution: resolution,
-				MimeType:   mimeType,
-				Hash:       fileHash,
-			}
-			currentEncodingID = encodingID
-		case currentEncodingID != encodingID:
-			currentMetadata.Data = append(currentMetadata.Data, currentEncoding)
-			currentEncoding = Encoding{
+		i, ok := metadataIndex[ID]
+		if !ok {
+			i = len(result)
+			metadataIndex[ID] = i
+			result = append(result, Metadata{
+				ID:            ID,
+				Date:          date,
+				DateEstimated: dateEstimated,
+				Location:      location,
+				Tags:          foundTags,
+				Coordinates:   scanCoordinates(latitude, longitude, altitude),
+				Description:   description,
+				Snippet:       snippet,
+			})
+		}
+		metadata := &result[i]
+
+		j, ok := encodingIndex[encodingID]
+		if !ok {
+			j = len(metadata.Data)
+			encodingIndex[encodingID] = j
+			metadata.Data = append(metadata.Data, Encoding{
 				ID:         encodingID,
 				Runtime:    runtime,
 				Resolution: resolution,
 				MimeType:   mimeType,
 				Hash:       fileHash,
-			}
-			currentEncodingID = encodingID
+			})
 		}
 
-		currentEncoding.Locator = append(currentEncoding.Locator, &fileSystemLocator{
-			path,
-		})
-	}
-
-	if hasResults {
-		currentMetadata.Data = append(currentMetadata.Data, currentEncoding)
-		result = append(result, currentMetadata)
+		encoding := &metadata.Data[j]
+		encoding.Locator = append(encoding.Locator, resolveLocator(source, path))
 	}
 
-	return result, nil
+	return result, rows.Err()
 }
 
-// Find searches for matching Metadata, given the query parameters.
-func (dms dbMetadataServer) Find(ctx context.Context, query MetadataQuery) ([]Metadata, error) {
-	builder := NewMetadataQueryBuilder()
+// builder adds the conditions and order of the query to a query builder, returning
+// it with the parameters of the conditions.
+func (query MetadataQuery) builder() (*MetadataQueryBuilder, []interface{}, error) {
+	sort := query.sortOrder()
+	if _, err := ParseSortOrder(string(sort)); err != nil {
+		return nil, nil, err
+	}
+	if sort == SortByRelevance && query.Text == "" {
+		return nil, nil, fmt.Errorf("%w: %q needs text to search for", ErrUnknownSort, sort)
+	}
+	builder := NewMetadataQueryBuilder().OrderBy(sort)
 	var args []interface{}
 
+	if query.Text != "" {
+		builder = builder.MatchingText()
+		args = append(args, query.Text)
+	}
+
 	if len(query.Tags) > 0 {
 		builder = builder.AddTags(len(query.Tags))
 		for _, t := range query.Tags {
@@ -233,13 +348,18 @@ func (dms dbMetadataServer) Find(ctx context.Context, query MetadataQuery) ([]Me
 	}
 
 	if !query.StartDate.IsZero() || !query.EndDate.IsZero() {
+		// A search from a date with no end runs up to now.
+		endDate := query.EndDate
+		if endDate.IsZero() {
+			endDate = time.Now()
+		}
 		builder = builder.BetweenDates()
-		args = append(args, query.StartDate, query.EndDate)
+		args = append(args, query.StartDate, endDate)
 	}
 
 	if len(query.LocatedAt) == 1 {
 		builder = builder.AtLocation()
-		args = append(args, query.LocatedAt)
+		args = append(args, query.LocatedAt[0])
 	}
 
 	if len(query.LocatedAt) > 1 {
@@ -251,11 +371,50 @@ func (dms dbMetadataServer) Find(ctx context.Context, query MetadataQuery) ([]Me
 
 	if len(query.MimeType) > 0 {
 		builder = builder.ByMimeTypes(len(query.MimeType))
-		for _, m := range query.LocatedAt {
+		for _, m := range query.MimeType {
 			args = append(args, m)
 		}
 	}
 
+	if query.Near != nil {
+		if err := query.Near.Validate(); err != nil {
+			return nil, nil, err
+		}
+		builder = builder.WithinRadius()
+		args = append(args, query.Near.args()...)
+	}
+
+	if query.Within != nil {
+		if err := query.Within.Validate(); err != nil {
+			return nil, nil, err
+		}
+		builder = builder.WithinBox()
+		args = append(args, query.Within.args()...)
+	}
+
+	if query.Match != nil {
+		builder = builder.Matching(query.Match)
+		args = append(args, Parameters(query.Match)...)
+	}
+
+	return builder, args, nil
+}
+
+// sortOrder is the order of the results, which for a text search is by relevance
+// unless another order is asked for.
+func (query MetadataQuery) sortOrder() SortOrder {
+	if query.Sort == SortByID && query.Text != "" {
+		return SortByRelevance
+	}
+	return query.Sort
+}
+
+// Find searches for matching Metadata, given the query parameters.
+func (dms dbMetadataServer) Find(ctx context.Context, query MetadataQuery) ([]Metadata, error) {
+	builder, args, err := query.builder()
+	if err != nil {
+		return nil, err
+	}
 	rows, err := dms.db.Query(ctx, builder.String(), args...)
 	if err != nil {
 		return nil, err
@@ -319,10 +478,240 @@ func (dms dbMetadataServer) FindByMimeType(ctx context.Context, mimeTypes []stri
 	return dms.Find(ctx, query)
 }
 
-func (dms dbMetadataServer) Create(_ context.Context, _ Metadata) (Metadata, error) {
-	return Metadata{}, errors.New("not implemented")
+// Create inserts the metadata, its encodings and each encoding's locators in
+// a single transaction.  The returned metadata has every ID filled in.
+func (dms dbMetadataServer) Create(ctx context.Context, metadata Metadata) (Metadata, error) {
+	tx, err := dms.db.Begin(ctx)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	result, err := dms.createMetadata(ctx, tx, metadata)
+	if err != nil {
+		rollback(ctx, tx)
+		return Metadata{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Metadata{}, err
+	}
+
+	return result, nil
+}
+
+// Save updates the metadata row and brings the stored encodings and locators
+// in line with the ones passed in.  Encodings without an ID are inserted,
+// encodings that are no longer present are deleted along with their locators.
+func (dms dbMetadataServer) Save(ctx context.Context, metadata Metadata) error {
+	tx, err := dms.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := dms.saveMetadata(ctx, tx, metadata); err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (dms dbMetadataServer) Save(_ context.Context, _ Metadata) error {
-	return errors.New("not implemented")
+func (dms dbMetadataServer) createMetadata(ctx context.Context, tx DBCaller, metadata Metadata) (Metadata, error) {
+	result := metadata
+	latitude, longitude, altitude := metadata.coordinateArgs()
+	row := tx.QueryRow(ctx, insertMetadata, metadata.Date, metadata.DateEstimated,
+		metadata.Location, metadata.Tags, latitude, longitude, altitude, metadata.Description)
+	if err := row.Scan(&result.ID); err != nil {
+		return Metadata{}, err
+	}
+
+	result.Data = make([]Encoding, len(metadata.Data))
+	for i := range metadata.Data {
+		encoding, err := dms.createEncoding(ctx, tx, result.ID, metadata.Data[i])
+		if err != nil {
+			return Metadata{}, err
+		}
+		result.Data[i] = encoding
+	}
+
+	return result, nil
+}
+
+func (dms dbMetadataServer) createEncoding(ctx context.Context, tx DBCaller, metadataID int64, encoding Encoding) (Encoding, error) {
+	result := encoding
+	res := encoding.Resolution
+	row := tx.QueryRow(ctx, insertEncoding, metadataID, encoding.Runtime,
+		res.Width, res.Height, scanString(res.Scan), encoding.MimeType, encoding.Hash)
+	if err := row.Scan(&result.ID); err != nil {
+		return Encoding{}, err
+	}
+
+	for _, l := range encoding.Locator {
+		if err := dms.createLocator(ctx, tx, result.ID, l); err != nil {
+			return Encoding{}, err
+		}
+	}
+
+	return result, nil
+}
+
+func (dms dbMetadataServer) createLocator(ctx context.Context, tx DBCaller, encodingID int64, l Locator) error {
+	path, err := locatorPath(l)
+	if err != nil {
+		return err
+	}
+
+	var locatorID int64
+	return tx.QueryRow(ctx, insertLocator, encodingID, l.Source(), path).Scan(&locatorID)
+}
+
+// locatorKey identifies a stored locator, since locators don't carry their
+// own id.
+type locatorKey struct {
+	source string
+	path   string
+}
+
+// storedLocators returns the locators currently stored for each encoding of
+// the given metadata.
+func (dms dbMetadataServer) storedLocators(ctx context.Context, tx DBCaller, metadataID int64) (map[int64]map[locatorKey]bool, error) {
+	rows, err := tx.Query(ctx, selectStoredLocators, metadataID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64]map[locatorKey]bool)
+	for rows.Next() {
+		var encodingID int64
+		var source, path pgtype.Text
+		if err := rows.Scan(&encodingID, &source, &path); err != nil {
+			return nil, err
+		}
+
+		if _, ok := result[encodingID]; !ok {
+			result[encodingID] = make(map[locatorKey]bool)
+		}
+		if source.Status == pgtype.Present && path.Status == pgtype.Present {
+			result[encodingID][locatorKey{source: source.String, path: path.String}] = true
+		}
+	}
+
+	return result, rows.Err()
+}
+
+func (dms dbMetadataServer) saveMetadata(ctx context.Context, tx DBCaller, metadata Metadata) error {
+	latitude, longitude, altitude := metadata.coordinateArgs()
+	tag, err := tx.Exec(ctx, updateMetadata, metadata.ID, metadata.Date, metadata.DateEstimated,
+		metadata.Location, metadata.Tags, latitude, longitude, altitude, metadata.Description)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMetadataNotFound
+	}
+
+	stored, err := dms.storedLocators(ctx, tx, metadata.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, encoding := range metadata.Data {
+		if encoding.ID == 0 {
+			if _, err := dms.createEncoding(ctx, tx, metadata.ID, encoding); err != nil {
+				return err
+			}
+			continue
+		}
+
+		existing, ok := stored[encoding.ID]
+		if !ok {
+			return ErrEncodingNotFound
+		}
+		delete(stored, encoding.ID)
+
+		if err := dms.saveEncoding(ctx, tx, encoding, existing); err != nil {
+			return err
+		}
+	}
+
+	// Whatever is left in stored is no longer part of the metadata.
+	var removed []int64
+	for id := range stored {
+		removed = append(removed, id)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+
+	for _, id := range removed {
+		if _, err := tx.Exec(ctx, deleteEncodingLocators, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, deleteEncoding, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (dms dbMetadataServer) saveEncoding(ctx context.Context, tx DBCaller, encoding Encoding, existing map[locatorKey]bool) error {
+	res := encoding.Resolution
+	_, err := tx.Exec(ctx, updateEncoding, encoding.ID, encoding.Runtime,
+		res.Width, res.Height, scanString(res.Scan), encoding.MimeType, encoding.Hash)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range encoding.Locator {
+		path, err := locatorPath(l)
+		if err != nil {
+			return err
+		}
+
+		key := locatorKey{source: l.Source(), path: path}
+		if existing[key] {
+			delete(existing, key)
+			continue
+		}
+
+		if err := dms.createLocator(ctx, tx, encoding.ID, l); err != nil {
+			return err
+		}
+	}
+
+	var removed []locatorKey
+	for key := range existing {
+		removed = append(removed, key)
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		if removed[i].source != removed[j].source {
+			return removed[i].source < removed[j].source
+		}
+		return removed[i].path < removed[j].path
+	})
+
+	for _, key := range removed {
+		if _, err := tx.Exec(ctx, deleteLocator, encoding.ID, key.source, key.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanString converts the scan of a resolution to the single character stored
+// in the database, defaulting to progressive.
+func scanString(scan rune) string {
+	if scan == 0 {
+		return "P"
+	}
+	return string(scan)
+}
+
+// rollback aborts a transaction after a failed write.  The original error is
+// what the caller cares about, so a failed rollback is only logged.
+func rollback(ctx context.Context, tx DBCaller) {
+	if err := tx.Rollback(ctx); err != nil {
+		log.Printf("Error - Failed to rollback transaction: %v", err)
+	}
 }
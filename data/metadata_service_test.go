@@ -2,6 +2,7 @@ package data
 
 import (
 	"errors"
+	"github.com/jackc/pgtype"
 	"github.com/pashagolub/pgxmock"
 	"log"
 	"testing"
@@ -23,21 +24,27 @@ func buildMetadataTestResults() *pgxmock.Rows {
 		metadata 2 would have 2 encodings, with one location each
 		metadata 3 would have 1 encoding in one location.
 
-		SELECT metadata.id, date_captured, location, tags,
+		SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '',
 					encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
 					locator.id, locator.source, locator.path
 
 	*/
 
 	rows := pgxmock.NewRows([]string{
-		"id", "date_captured", "location", "tags", "encoding.id", "runtime", "resolution", "mime_type", "file_hash",
-		"locator.id", "source", "path",
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
 	})
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(10),
 		time.Second*0,
 		Resolution{
@@ -54,8 +61,14 @@ func buildMetadataTestResults() *pgxmock.Rows {
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(10),
 		time.Second*0,
 		Resolution{
@@ -71,8 +84,14 @@ func buildMetadataTestResults() *pgxmock.Rows {
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(11),
 		time.Second*0,
 		Resolution{
@@ -88,8 +107,14 @@ func buildMetadataTestResults() *pgxmock.Rows {
 	rows.AddRow(
 		int64(2),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"work",
 		[]string{"baz", "qux"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(12),
 		time.Second*0,
 		Resolution{
@@ -106,16 +131,25 @@ func buildMetadataTestResults() *pgxmock.Rows {
 	return rows
 }
 
+// noCoordinate is the parameter passed for the coordinates of metadata without any.
+var noCoordinate *float64
+
 func buildSingleResult() *pgxmock.Rows {
 	rows := pgxmock.NewRows([]string{
-		"id", "date_captured", "location", "tags", "encoding.id", "runtime", "resolution", "mime_type", "file_hash",
-		"locator.id", "source", "path",
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
 	})
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(10),
 		time.Second*0,
 		Resolution{
@@ -132,8 +166,14 @@ func buildSingleResult() *pgxmock.Rows {
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(10),
 		time.Second*0,
 		Resolution{
@@ -149,8 +189,14 @@ func buildSingleResult() *pgxmock.Rows {
 	rows.AddRow(
 		int64(1),
 		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		false,
 		"home",
 		[]string{"foo", "bar"},
+		nil,
+		nil,
+		nil,
+		"",
+		"",
 		int64(11),
 		time.Second*0,
 		Resolution{
@@ -186,7 +232,7 @@ func TestNewMetadataServer(t *testing.T) {
 
 func TestDbMetadataServer_FindById(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -211,9 +257,52 @@ func TestDbMetadataServer_FindById(t *testing.T) {
 
 }
 
+func TestDbMetadataServer_FindByIdCoordinates(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	rows := pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	})
+	rows.AddRow(
+		int64(1),
+		time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		true,
+		"home",
+		[]string{"foo", "bar"},
+		pgtype.Float8{Float: 51.5, Status: pgtype.Present},
+		pgtype.Float8{Float: -0.125, Status: pgtype.Present},
+		nil,
+		"",
+		"",
+		int64(10),
+		time.Second*0,
+		Resolution{Width: 1024, Height: 600, Scan: 'P'},
+		MimeJPEG,
+		"ABCD1234",
+		int64(100),
+		"file",
+		"/quz/baz.jpg")
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).WithArgs(int64(1)).WillReturnRows(rows)
+
+	ms := NewMetadataServer(caller)
+	metadata, err := ms.FindById(ctx, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error when retrieving by ID: %v", err)
+	}
+
+	if !metadata.DateEstimated {
+		t.Error("Expected the date to be an estimate")
+	}
+
+	coordinates := metadata.Coordinates
+	if coordinates == nil || coordinates.Latitude != 51.5 || coordinates.Longitude != -0.125 || coordinates.Altitude != nil {
+		t.Errorf("Expected coordinates without an altitude but got %v", coordinates)
+	}
+}
+
 func TestDbMetadataServer_Find(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -278,7 +367,7 @@ func TestDbMetadataServer_Find(t *testing.T) {
 
 func TestDbMetadataServer_FindMultipleLocations(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -308,7 +397,7 @@ func TestDbMetadataServer_FindMultipleLocations(t *testing.T) {
 
 func TestDbMetadataServer_FindEmptyQueryParameters(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -330,7 +419,7 @@ func TestDbMetadataServer_FindEmptyQueryParameters(t *testing.T) {
 
 func TestDbMetadataServer_FindByTags(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -353,14 +442,16 @@ func TestDbMetadataServer_FindByTags(t *testing.T) {
 
 func TestDbMetadataServer_FindMimeType(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
 			INNER JOIN encoding on metadata\.id = encoding\.metadata_id
     		INNER JOIN locator on encoding\.id = locator\.encoding_id
  		WHERE \(encoding\.mime_type = \$1 OR encoding\.mime_type = \$2\)
- 		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).WillReturnRows(buildMetadataTestResults())
+ 		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).
+		WithArgs(MimeJPEG, MimeTIFF).
+		WillReturnRows(buildMetadataTestResults())
 
 	ms := NewMetadataServer(caller)
 	metadata, err := ms.FindByMimeType(ctx, []string{MimeJPEG, MimeTIFF})
@@ -374,11 +465,64 @@ func TestDbMetadataServer_FindMimeType(t *testing.T) {
 	}
 }
 
+func TestDbMetadataServer_FindMatching(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, .* FROM metadata .*
+ 		WHERE \$1 = ANY\(tags\) AND \(\$2 = ANY\(tags\) OR NOT location = \$3\)
+ 		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).
+		WithArgs("foo", "bar", "home").
+		WillReturnRows(buildMetadataTestResults())
+
+	ms := NewMetadataServer(caller)
+	query := MetadataQuery{
+		Tags:  []string{"foo"},
+		Match: Or(Tag("bar"), Not(Location("home"))),
+	}
+	metadata, err := ms.Find(ctx, query)
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(metadata) != 2 {
+		t.Errorf("Expected 2 result but got %d", len(metadata))
+	}
+}
+
+func TestDbMetadataServer_FindText(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	rows := pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	})
+	rows.AddRow(int64(1), time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local), false, "home", []string{"foo"},
+		nil, nil, nil, "A red boat in the harbour", "A red "+HighlightStart+"boat"+HighlightStop+" in the harbour",
+		int64(10), time.Second*0, Resolution{Width: 1024, Height: 600, Scan: 'P'}, MimeJPEG, "ABCD1234",
+		int64(100), "file", "/foo/bar.jpg")
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, .* description, ts_headline\('english', metadata\.description, websearch_to_tsquery\('english', \$1\), .*
+ 		WHERE metadata\.document @@ websearch_to_tsquery\('english', \$1\) AND location = \$2
+ 		ORDER BY ts_rank\(metadata\.document, websearch_to_tsquery\('english', \$1\)\) DESC`).
+		WithArgs("boat", "home").
+		WillReturnRows(rows)
+
+	ms := NewMetadataServer(caller)
+	metadata, err := ms.Find(ctx, MetadataQuery{Text: "boat", LocatedAt: []string{"home"}})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(metadata) != 1 || metadata[0].Description != "A red boat in the harbour" {
+		t.Fatalf("Expected the metadata with its description but got %+v", metadata)
+	}
+	if metadata[0].Snippet != "A red \x02boat\x03 in the harbour" {
+		t.Errorf("Expected a highlighted snippet but got %q", metadata[0].Snippet)
+	}
+}
+
 func TestDbMetadataServer_FindByTagsNoData(t *testing.T) {
 	caller, ctx := createTestDBCaller()
 	caller.Conn.ExpectQuery("SELECT").WillReturnRows(pgxmock.NewRows([]string{
-		"id", "date_captured", "location", "tags", "encoding.id", "runtime", "resolution", "mime_type", "file_hash",
-		"locator.id", "source", "path",
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
 	}))
 
 	ms := NewMetadataServer(caller)
@@ -411,7 +555,7 @@ func TestDbMetadataServer_FindByTagsDatabaseError(t *testing.T) {
 
 func TestDbMetadataServer_FindByDateRange(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
@@ -462,14 +606,16 @@ func TestDbMetadataServer_FindByDateRangeDatabaseError(t *testing.T) {
 
 func TestDbMetadataServer_FindByLocation(t *testing.T) {
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, location, tags, 
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '', 
 			encoding\.id, encoding\.runtime, encoding\.resolution, encoding\.mime_type, encoding\.file_hash,
 			locator\.id, locator\.source, locator\.path
  		FROM metadata 
 			INNER JOIN encoding on metadata\.id = encoding\.metadata_id
     		INNER JOIN locator on encoding\.id = locator\.encoding_id
  		WHERE location = \$1
- 		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).WillReturnRows(buildMetadataTestResults())
+ 		ORDER BY metadata\.id, encoding\.id, locator\.id ASC`).
+		WithArgs("home").
+		WillReturnRows(buildMetadataTestResults())
 
 	ms := NewMetadataServer(caller)
 	metadata, err := ms.FindByLocation(ctx, "home")
@@ -498,3 +644,240 @@ func TestDbMetadataServer_FindByLocationDatabaseError(t *testing.T) {
 		t.Errorf("Expected no metadata but got %d rows", len(metadata))
 	}
 }
+
+func buildNewMetadata() Metadata {
+	return Metadata{
+		Date:     time.Date(2021, 03, 20, 13, 24, 56, 0, time.Local),
+		Tags:     []string{"foo", "bar"},
+		Location: "home",
+		Data: []Encoding{
+			{
+				Resolution: Resolution{Width: 1920, Height: 1080, Scan: 'P'},
+				MimeType:   MimeJPEG,
+				Hash:       "ABCD1234",
+				Locator: []Locator{
+					fileSystemLocator{Path: "/foo/bar.jpg"},
+					fileSystemLocator{Path: "/baz/bar.jpg"},
+				},
+			},
+			{
+				Resolution: Resolution{Width: 4096, Height: 2160, Scan: 'P'},
+				MimeType:   MimeTIFF,
+				Hash:       "1234ABCD",
+				Locator: []Locator{
+					fileSystemLocator{Path: "/archive/bar.tiff"},
+				},
+			},
+		},
+	}
+}
+
+func TestDbMetadataServer_Create(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WithArgs(pgxmock.AnyArg(), false, "home", []string{"foo", "bar"}, noCoordinate, noCoordinate, noCoordinate, "").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(1), pgxmock.AnyArg(), 1920, 1080, "P", MimeJPEG, "ABCD1234").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(7), "file", "/foo/bar.jpg").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(100)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(7), "file", "/baz/bar.jpg").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(101)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(1), pgxmock.AnyArg(), 4096, 2160, "P", MimeTIFF, "1234ABCD").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(8)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(8), "file", "/archive/bar.tiff").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(102)))
+
+	ms := NewMetadataServer(caller)
+	metadata, err := ms.Create(ctx, buildNewMetadata())
+	if err != nil {
+		t.Fatalf("Unexpected error creating metadata: %v", err)
+	}
+
+	if metadata.ID != 1 {
+		t.Errorf("Expected metadata id to be 1 but got %d", metadata.ID)
+	}
+
+	if len(metadata.Data) != 2 || metadata.Data[0].ID != 7 || metadata.Data[1].ID != 8 {
+		t.Errorf("Expected encodings 7 and 8 but got %v", metadata.Data)
+	}
+
+	if !caller.Committed || caller.RolledBack {
+		t.Error("Expected the transaction to be committed")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbMetadataServer_CreateDatabaseError(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WillReturnError(errors.New("random database error"))
+
+	ms := NewMetadataServer(caller)
+	metadata, err := ms.Create(ctx, buildNewMetadata())
+	if err == nil {
+		t.Fatal("Expected database error")
+	}
+
+	if metadata.ID != 0 {
+		t.Errorf("Expected no metadata but got id %d", metadata.ID)
+	}
+
+	if caller.Committed || !caller.RolledBack {
+		t.Error("Expected the transaction to be rolled back")
+	}
+}
+
+func TestDbMetadataServer_Save(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectExec(`UPDATE metadata`).
+		WithArgs(int64(1), pgxmock.AnyArg(), false, "home", []string{"foo", "bar"}, noCoordinate, noCoordinate, noCoordinate, "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`SELECT encoding\.id, locator\.source, locator\.path`).
+		WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "source", "path"}).
+			AddRow(int64(7), "file", "/foo/bar.jpg").
+			AddRow(int64(7), "file", "/old/bar.jpg").
+			AddRow(int64(8), "file", "/archive/bar.tiff"))
+	caller.Conn.ExpectExec(`UPDATE encoding`).
+		WithArgs(int64(7), pgxmock.AnyArg(), 1920, 1080, "P", MimeJPEG, "ABCD1234").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(7), "file", "/baz/bar.jpg").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(103)))
+	caller.Conn.ExpectExec(`DELETE FROM locator`).
+		WithArgs(int64(7), "file", "/old/bar.jpg").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(1), pgxmock.AnyArg(), 640, 480, "P", MimePNG, "FFFF0000").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(9)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(9), "file", "/thumbs/bar.png").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(104)))
+	caller.Conn.ExpectExec(`DELETE FROM locator WHERE encoding_id`).
+		WithArgs(int64(8)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	caller.Conn.ExpectExec(`DELETE FROM encoding`).
+		WithArgs(int64(8)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	metadata := buildNewMetadata()
+	metadata.ID = 1
+	metadata.Data[0].ID = 7
+	metadata.Data[1] = Encoding{
+		Resolution: Resolution{Width: 640, Height: 480, Scan: 'P'},
+		MimeType:   MimePNG,
+		Hash:       "FFFF0000",
+		Locator:    []Locator{fileSystemLocator{Path: "/thumbs/bar.png"}},
+	}
+
+	ms := NewMetadataServer(caller)
+	if err := ms.Save(ctx, metadata); err != nil {
+		t.Fatalf("Unexpected error saving metadata: %v", err)
+	}
+
+	if !caller.Committed || caller.RolledBack {
+		t.Error("Expected the transaction to be committed")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbMetadataServer_SaveNotFound(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectExec(`UPDATE metadata`).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	metadata := buildNewMetadata()
+	metadata.ID = 42
+
+	ms := NewMetadataServer(caller)
+	if err := ms.Save(ctx, metadata); err != ErrMetadataNotFound {
+		t.Errorf("Expected metadata not found but got %v", err)
+	}
+
+	if caller.Committed || !caller.RolledBack {
+		t.Error("Expected the transaction to be rolled back")
+	}
+}
+
+func TestDbMetadataServer_SaveForeignEncoding(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectExec(`UPDATE metadata`).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	caller.Conn.ExpectQuery(`SELECT encoding\.id, locator\.source, locator\.path`).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "source", "path"}).
+			AddRow(int64(7), "file", "/foo/bar.jpg"))
+
+	metadata := buildNewMetadata()
+	metadata.ID = 1
+	metadata.Data[0].ID = 99
+
+	ms := NewMetadataServer(caller)
+	if err := ms.Save(ctx, metadata); err != ErrEncodingNotFound {
+		t.Errorf("Expected encoding not found but got %v", err)
+	}
+}
+
+func TestDbMetadataServer_FindOpenEndedDateRange(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	startDate := time.Date(2021, 02, 20, 0, 0, 0, 0, time.UTC)
+	caller.Conn.ExpectQuery(`WHERE date_captured BETWEEN \$1 AND \$2`).
+		WithArgs(startDate, pgxmock.AnyArg()).
+		WillReturnRows(buildMetadataTestResults())
+
+	ms := NewMetadataServer(caller)
+	metadata, err := ms.Find(ctx, MetadataQuery{StartDate: startDate})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(metadata) != 2 {
+		t.Errorf("Expected 2 metadata records but got: %d", len(metadata))
+	}
+}
+
+func TestDbMetadataServer_FindSortedRows(t *testing.T) {
+	late := time.Date(2021, 3, 20, 13, 24, 56, 0, time.UTC)
+	resolution := Resolution{Width: 1024, Height: 768, Scan: 'P'}
+	rows := pgxmock.NewRows([]string{
+		"id", "date_captured", "date_estimated", "location", "tags", "latitude", "longitude", "altitude", "description", "snippet",
+		"encoding.id", "runtime", "resolution", "mime_type", "file_hash", "locator.id", "source", "path",
+	}).
+		AddRow(int64(2), late, false, "work", []string{}, nil, nil, nil, "", "",
+			int64(20), time.Duration(0), resolution, MimeJPEG, "EF01", int64(200), SourceFile, "/b/first.jpg").
+		AddRow(int64(1), dedupeEarly, false, "home", []string{}, nil, nil, nil, "", "",
+			int64(10), time.Duration(0), resolution, MimeJPEG, "ABCD", int64(100), SourceFile, "/a/bar.jpg").
+		AddRow(int64(2), late, false, "work", []string{}, nil, nil, nil, "", "",
+			int64(20), time.Duration(0), resolution, MimeJPEG, "EF01", int64(201), SourceFile, "/c/first.jpg").
+		AddRow(int64(2), late, false, "work", []string{}, nil, nil, nil, "", "",
+			int64(21), time.Duration(0), resolution, MimeTIFF, "2345", int64(202), SourceFile, "/b/first.tiff")
+
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`ORDER BY metadata\.date_captured DESC, metadata\.id, encoding\.id, locator\.id ASC`).
+		WillReturnRows(rows)
+
+	metadata, err := NewMetadataServer(caller).Find(ctx, MetadataQuery{Sort: SortByDateDescending})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(metadata) != 2 || metadata[0].ID != 2 || metadata[1].ID != 1 {
+		t.Fatalf("Expected metadata 2 then 1 but got %+v", metadata)
+	}
+	if len(metadata[0].Data) != 2 || len(metadata[0].Data[0].Locator) != 2 {
+		t.Errorf("Expected the rows of metadata 2 to be grouped together but got %+v", metadata[0].Data)
+	}
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid page cursor")
+)
+
+const (
+	// DefaultPageSize is the metadata in a page when the request doesn't say.
+	DefaultPageSize = 100
+	// MaxPageSize is the most metadata a page can hold.
+	MaxPageSize = 1000
+)
+
+// PageRequest asks for one page of the metadata matching a query.
+type PageRequest struct {
+	// Cursor is the NextCursor of the page before, or empty for the first page.
+	Cursor string
+	// Limit is the most metadata in the page, defaulting to DefaultPageSize and
+	// capped at MaxPageSize.
+	Limit int
+	// WithTotal asks for the number of metadata matching the query, which costs
+	// another query.
+	WithTotal bool
+}
+
+// MetadataPage is a page of metadata, each with all of its matching encodings
+// and locators.
+type MetadataPage struct {
+	Metadata []Metadata
+	// NextCursor is passed back to get the following page.  It is empty on the last page.
+	NextCursor string
+	// Total is the number of metadata matching the query across every page, when
+	// it was asked for.
+	Total *int64
+}
+
+// pageCursor is where a page starts: the last metadata of the page before, and its
+// sort key.  It is handed out encoded, so that what's in it can change without
+// breaking clients.
+type pageCursor struct {
+	Sort      SortOrder  `json:"s,omitempty"`
+	After     int64      `json:"a"`
+	Date      *time.Time `json:"d,omitempty"`
+	Location  *string    `json:"l,omitempty"`
+	Encodings *int64     `json:"e,omitempty"`
+	Rank      *float64   `json:"r,omitempty"`
+}
+
+func (pc pageCursor) String() string {
+	encoded, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// key returns where the sort key of the cursor is scanned into.
+func (pc *pageCursor) key() interface{} {
+	switch pc.Sort {
+	case SortByDate, SortByDateDescending:
+		pc.Date = new(time.Time)
+		return pc.Date
+	case SortByLocation:
+		pc.Location = new(string)
+		return pc.Location
+	case SortByEncodings:
+		pc.Encodings = new(int64)
+		return pc.Encodings
+	case SortByRelevance:
+		pc.Rank = new(float64)
+		return pc.Rank
+	}
+	return new(int64)
+}
+
+// args are the parameters of the After clause.
+func (pc pageCursor) args() []interface{} {
+	switch {
+	case pc.Date != nil:
+		return []interface{}{*pc.Date, pc.After}
+	case pc.Location != nil:
+		return []interface{}{*pc.Location, pc.After}
+	case pc.Encodings != nil:
+		return []interface{}{*pc.Encodings, pc.After}
+	case pc.Rank != nil:
+		return []interface{}{*pc.Rank, pc.After}
+	}
+	return []interface{}{pc.After}
+}
+
+// parsePageCursor decodes the cursor, which must have been made for the same sort order.
+func parsePageCursor(cursor string, sort SortOrder) (pageCursor, error) {
+	result := pageCursor{Sort: sort}
+	if cursor == "" {
+		return result, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(decoded, &result); err != nil || result.After < 0 {
+		return pageCursor{}, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+
+	var hasKey bool
+	switch result.Sort {
+	case SortByID:
+		hasKey = result.Date == nil && result.Location == nil && result.Encodings == nil && result.Rank == nil
+	case SortByDate, SortByDateDescending:
+		hasKey = result.Date != nil
+	case SortByLocation:
+		hasKey = result.Location != nil
+	case SortByEncodings:
+		hasKey = result.Encodings != nil
+	case SortByRelevance:
+		hasKey = result.Rank != nil
+	}
+	if result.Sort != sort || !hasKey {
+		return pageCursor{}, fmt.Errorf("%w: %q is not for sorting by %q", ErrInvalidCursor, cursor, sort)
+	}
+	return result, nil
+}
+
+// limit is the page size asked for, within bounds.
+func (pr PageRequest) limit() int {
+	switch {
+	case pr.Limit <= 0:
+		return DefaultPageSize
+	case pr.Limit > MaxPageSize:
+		return MaxPageSize
+	}
+	return pr.Limit
+}
+
+// FindPage searches for matching Metadata a page at a time.  The ids and sort keys of
+// the page are found first, reading one more than the limit to learn whether there is
+// another page, and then the rows of those metadata are read.
+func (dms dbMetadataServer) FindPage(ctx context.Context, query MetadataQuery, page PageRequest) (MetadataPage, error) {
+	builder, args, err := query.builder()
+	if err != nil {
+		return MetadataPage{}, err
+	}
+	cursor, err := parsePageCursor(page.Cursor, query.sortOrder())
+	if err != nil {
+		return MetadataPage{}, err
+	}
+	limit := page.limit()
+
+	var result MetadataPage
+	if page.WithTotal {
+		var total int64
+		if err := dms.db.QueryRow(ctx, builder.Count(), args...).Scan(&total); err != nil {
+			return MetadataPage{}, err
+		}
+		result.Total = &total
+	}
+
+	if page.Cursor != "" {
+		builder = builder.After()
+		args = append(args, cursor.args()...)
+	}
+	ids, cursors, err := dms.pageIds(ctx, builder.PageIds(), append(args, limit+1), query.sortOrder())
+	if err != nil {
+		return MetadataPage{}, err
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+		result.NextCursor = cursors[limit-1].String()
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	builder, args, _ = query.builder()
+	rows, err := dms.db.Query(ctx, builder.WithIds().String(), append(args, ids)...)
+	if err != nil {
+		return MetadataPage{}, err
+	}
+	defer rows.Close()
+
+	if result.Metadata, err = dms.processRows(rows); err != nil {
+		return MetadataPage{}, err
+	}
+	return result, nil
+}
+
+// pageIds reads the ids of the metadata in a page, with a cursor for each that starts
+// the page after it.
+func (dms dbMetadataServer) pageIds(ctx context.Context, query string, args []interface{}, sort SortOrder) ([]int64, []pageCursor, error) {
+	rows, err := dms.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var cursors []pageCursor
+	for rows.Next() {
+		cursor := pageCursor{Sort: sort}
+		if err := rows.Scan(&cursor.After, cursor.key()); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, cursor.After)
+		cursors = append(cursors, cursor)
+	}
+	return ids, cursors, rows.Err()
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+func TestMetadataQueryBuilder_PageIds(t *testing.T) {
+	qb := NewMetadataQueryBuilder()
+	query := qb.OrderBy(SortByDateDescending).AddTags(1).After().PageIds()
+
+	target := `SELECT metadata.id, metadata.date_captured FROM metadata
+			INNER JOIN encoding on metadata.id = encoding.metadata_id
+			INNER JOIN locator on encoding.id = locator.encoding_id
+		WHERE $1 = ANY(tags)
+			AND (metadata.date_captured < $2 OR (metadata.date_captured = $2 AND metadata.id > $3))
+		GROUP BY metadata.id
+		ORDER BY metadata.date_captured DESC, metadata.id LIMIT $4`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if target != query {
+		t.Errorf("Expected %s but got %s", target, query)
+	}
+}
+
+func TestMetadataQueryBuilder_After(t *testing.T) {
+	tests := []struct {
+		order    SortOrder
+		expected string
+	}{
+		{SortByID, "WHERE metadata.id > $1 ORDER BY metadata.id, encoding.id, locator.id ASC"},
+		{SortByLocation, "WHERE (metadata.location, metadata.id) > ($1, $2) " +
+			"ORDER BY metadata.location ASC, metadata.id, encoding.id, locator.id ASC"},
+	}
+
+	for _, test := range tests {
+		query := NewMetadataQueryBuilder().OrderBy(test.order).After().String()
+		query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+		if !strings.HasSuffix(query, test.expected) {
+			t.Errorf("Expected the query sorted by %q to end %s but got %s", test.order, test.expected, query)
+		}
+	}
+}
+
+func TestPageCursor(t *testing.T) {
+	location := "home"
+	cursor, err := parsePageCursor(pageCursor{Sort: SortByLocation, After: 1234, Location: &location}.String(), SortByLocation)
+	if err != nil || cursor.After != 1234 || cursor.Location == nil || *cursor.Location != "home" {
+		t.Errorf("Expected the cursor to round trip but got %+v, %v", cursor, err)
+	}
+
+	if cursor, err := parsePageCursor("", SortByDate); err != nil || cursor.After != 0 || cursor.Sort != SortByDate {
+		t.Errorf("Expected no cursor to start at the beginning but got %+v, %v", cursor, err)
+	}
+
+	for _, invalid := range []string{"not base64!", "bm90IGpzb24", "eyJhIjotMX0", pageCursor{Sort: SortByDate, After: 1}.String(),
+		pageCursor{Sort: SortByLocation, After: 1, Location: &location}.String()} {
+		if _, err := parsePageCursor(invalid, SortByID); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("Expected %q to be invalid but got %v", invalid, err)
+		}
+	}
+}
+
+func TestPageRequest_Limit(t *testing.T) {
+	if limit := (PageRequest{}).limit(); limit != DefaultPageSize {
+		t.Errorf("Expected the default page size but got %d", limit)
+	}
+	if limit := (PageRequest{Limit: MaxPageSize + 1}).limit(); limit != MaxPageSize {
+		t.Errorf("Expected the page size to be capped but got %d", limit)
+	}
+}
+
+func TestDbMetadataServer_FindPage(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT count\(DISTINCT metadata\.id\) FROM metadata .* WHERE location = \$1`).
+		WithArgs("home").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(5)))
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, metadata\.id FROM .* WHERE location = \$1 GROUP BY metadata\.id .* LIMIT \$2`).
+		WithArgs("home", 2).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "key"}).AddRow(int64(1), int64(1)).AddRow(int64(2), int64(2)))
+	caller.Conn.ExpectQuery(`WHERE location = \$1 AND metadata\.id = ANY\(\$2\)`).
+		WithArgs("home", []int64{1}).
+		WillReturnRows(buildMetadataTestResults())
+
+	page, err := NewMetadataServer(caller).FindPage(ctx, MetadataQuery{LocatedAt: []string{"home"}},
+		PageRequest{Limit: 1, WithTotal: true})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(page.Metadata) == 0 || len(page.Metadata[0].Data) != 2 {
+		t.Fatalf("Expected the first metadata with both its encodings but got %+v", page.Metadata)
+	}
+	if page.Total == nil || *page.Total != 5 {
+		t.Errorf("Expected a total of 5 but got %v", page.Total)
+	}
+
+	cursor, err := parsePageCursor(page.NextCursor, SortByID)
+	if err != nil || cursor.After != 1 {
+		t.Errorf("Expected the next page to start after 1 but got %+v, %v", cursor, err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbMetadataServer_FindPageSorted(t *testing.T) {
+	after := time.Date(2021, 3, 20, 0, 0, 0, 0, time.UTC)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, metadata\.date_captured FROM .* WHERE \(metadata\.date_captured < \$1 OR`).
+		WithArgs(after, int64(7), DefaultPageSize+1).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "date_captured"}).AddRow(int64(2), after).AddRow(int64(1), after))
+	caller.Conn.ExpectQuery(`WHERE metadata\.id = ANY\(\$1\) ORDER BY metadata\.date_captured DESC, metadata\.id`).
+		WithArgs([]int64{2, 1}).
+		WillReturnRows(buildMetadataTestResults())
+
+	cursor := pageCursor{Sort: SortByDateDescending, After: 7, Date: &after}
+	page, err := NewMetadataServer(caller).FindPage(ctx, MetadataQuery{Sort: SortByDateDescending},
+		PageRequest{Cursor: cursor.String()})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	if len(page.Metadata) != 2 || page.NextCursor != "" || page.Total != nil {
+		t.Errorf("Expected the last page without a total but got %+v", page)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbMetadataServer_FindPageText(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, ts_rank\(metadata\.document, websearch_to_tsquery\('english', \$1\)\) FROM .*
+			WHERE metadata\.document @@ websearch_to_tsquery\('english', \$1\) GROUP BY metadata\.id
+			ORDER BY ts_rank\(metadata\.document, websearch_to_tsquery\('english', \$1\)\) DESC, metadata\.id LIMIT \$2`).
+		WithArgs("boat", 2).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "rank"}).AddRow(int64(2), 0.5).AddRow(int64(1), 0.25))
+	caller.Conn.ExpectQuery(`metadata\.id = ANY\(\$2\) ORDER BY ts_rank`).
+		WithArgs("boat", []int64{2}).
+		WillReturnRows(buildMetadataTestResults())
+
+	page, err := NewMetadataServer(caller).FindPage(ctx, MetadataQuery{Text: "boat"}, PageRequest{Limit: 1})
+	if err != nil {
+		t.Fatalf("Error returned from find: %v", err)
+	}
+
+	cursor, err := parsePageCursor(page.NextCursor, SortByRelevance)
+	if err != nil || cursor.After != 2 || cursor.Rank == nil || *cursor.Rank != 0.5 {
+		t.Errorf("Expected the next page to start after 2 ranked 0.5 but got %+v, %v", cursor, err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbMetadataServer_FindPageEmpty(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT metadata\.id, metadata\.id FROM`).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "key"}))
+
+	page, err := NewMetadataServer(caller).FindPage(ctx, MetadataQuery{}, PageRequest{})
+	if err != nil || len(page.Metadata) != 0 || page.NextCursor != "" {
+		t.Errorf("Expected an empty last page but got %+v, %v", page, err)
+	}
+}
+
+func TestDbMetadataServer_FindPageInvalid(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	ms := NewMetadataServer(caller)
+
+	if _, err := ms.FindPage(ctx, MetadataQuery{}, PageRequest{Cursor: "!"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected an invalid cursor but got %v", err)
+	}
+	if _, err := ms.FindPage(ctx, MetadataQuery{Sort: "size"}, PageRequest{}); !errors.Is(err, ErrUnknownSort) {
+		t.Errorf("Expected an unknown sort but got %v", err)
+	}
+	if _, err := ms.FindPage(ctx, MetadataQuery{Sort: SortByRelevance}, PageRequest{}); !errors.Is(err, ErrUnknownSort) {
+		t.Errorf("Expected sorting by relevance without text to fail but got %v", err)
+	}
+}
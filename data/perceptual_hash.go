@@ -0,0 +1,473 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // Registers the GIF decoder.
+	_ "image/jpeg" // Registers the JPEG decoder.
+	_ "image/png"  // Registers the PNG decoder.
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/jackc/pgx/v4"
+	_ "golang.org/x/image/tiff" // Registers the TIFF decoder.
+	_ "golang.org/x/image/webp" // Registers the WebP decoder.
+)
+
+// Perceptual hashes are kept in the encoding_perceptual_hash table, for the encodings
+// that could be decoded:
+//
+//	CREATE TABLE encoding_perceptual_hash (
+//		encoding_id BIGINT PRIMARY KEY REFERENCES encoding (id) ON DELETE CASCADE,
+//		dhash       BIGINT NOT NULL,
+//		phash       BIGINT NOT NULL
+//	);
+const (
+	insertPerceptualHash = `INSERT INTO encoding_perceptual_hash (encoding_id, dhash, phash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (encoding_id) DO UPDATE SET dhash = EXCLUDED.dhash, phash = EXCLUDED.phash`
+	selectPerceptualHash = `SELECT dhash, phash FROM encoding_perceptual_hash
+		WHERE encoding_id = $1`
+	// The bits that differ are counted from the text of the XOR, as bit_count needs
+	// PostgreSQL 14.
+	selectSimilarMetadata = `SELECT metadata_id, min(distance) AS distance
+		FROM (
+			SELECT encoding.metadata_id, GREATEST(
+				length(replace(((dhash # $1)::bit(64))::text, '0', '')),
+				length(replace(((phash # $2)::bit(64))::text, '0', ''))) AS distance
+			FROM encoding_perceptual_hash
+				INNER JOIN encoding on encoding.id = encoding_perceptual_hash.encoding_id
+		) AS candidates
+		WHERE distance <= $3
+		GROUP BY metadata_id
+		ORDER BY distance, metadata_id
+		LIMIT $4`
+	selectEncodingsWithoutPerceptualHash = `SELECT encoding.id, encoding.file_hash, locator.source, locator.path
+		FROM encoding
+			INNER JOIN locator on encoding.id = locator.encoding_id
+		WHERE encoding.mime_type = ANY($3) AND encoding.id > $1 AND NOT EXISTS (
+			SELECT 1 FROM encoding_perceptual_hash WHERE encoding_id = encoding.id)
+		ORDER BY encoding.id, locator.id
+		LIMIT $2`
+)
+
+const (
+	// dHashWidth is one wider than the hash, as each bit compares neighbouring pixels.
+	dHashWidth  = 9
+	dHashHeight = 8
+	// pHashSize is the side of the image the DCT is taken of, of which the lowest
+	// 8x8 frequencies make the hash.
+	pHashSize = 32
+	// similarLimit is the most candidates FindSimilar returns.
+	similarLimit = 100
+	// backfillBatchSize is how many locators Backfill reads at a time.
+	backfillBatchSize = 500
+	// maxDecodePixels is the largest image that is decoded, so that one huge or
+	// malicious file can't use up the memory of an ingest.  It's about 256MB once
+	// decoded to RGBA.
+	maxDecodePixels = 64 << 20
+)
+
+var (
+	ErrNoPerceptualHash = errors.New("encoding has no perceptual hash")
+	ErrImageTooLarge    = errors.New("image is too large to decode")
+)
+
+// PerceptualHash identifies what an image looks like, rather than its bytes, so the
+// same picture at another size or in another format hashes the same, or within a
+// few bits.  DHash compares the brightness of neighbouring areas and PHash the low
+// frequencies of the image.
+type PerceptualHash struct {
+	DHash uint64
+	PHash uint64
+}
+
+// Distance is the number of bits that differ, the larger of the two hashes'.
+func (ph PerceptualHash) Distance(other PerceptualHash) int {
+	dDistance := bits.OnesCount64(ph.DHash ^ other.DHash)
+	pDistance := bits.OnesCount64(ph.PHash ^ other.PHash)
+	if dDistance > pDistance {
+		return dDistance
+	}
+	return pDistance
+}
+
+// ComputePerceptualHash decodes the image and hashes it.  Any format registered with
+// the image package can be decoded; JPEG, PNG, GIF, TIFF and WebP always are.
+func ComputePerceptualHash(r io.Reader) (PerceptualHash, error) {
+	img, _, err := decodeImage(r)
+	if err != nil {
+		return PerceptualHash{}, err
+	}
+
+	return PerceptualHash{
+		DHash: dHash(img),
+		PHash: pHash(img),
+	}, nil
+}
+
+// decodeImage decodes the image, first reading its header so an image of more than
+// maxDecodePixels is refused with ErrImageTooLarge before any of it is decoded.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	_, _, r, err := readImageConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return image.Decode(r)
+}
+
+// readImageConfig reads the dimensions and format from the header of the image,
+// refusing one of more than maxDecodePixels with ErrImageTooLarge.  The reader
+// returned starts again from the beginning of the image.
+func readImageConfig(r io.Reader) (image.Config, string, io.Reader, error) {
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return image.Config{}, "", nil, err
+	}
+	if err := checkImageSize(config); err != nil {
+		return image.Config{}, "", nil, err
+	}
+	return config, format, io.MultiReader(&header, r), nil
+}
+
+func checkImageSize(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxDecodePixels {
+		return fmt.Errorf("%w: %dx%d", ErrImageTooLarge, config.Width, config.Height)
+	}
+	return nil
+}
+
+// perceptualHashFile hashes the image in a file.
+func perceptualHashFile(path string) (PerceptualHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return PerceptualHash{}, err
+	}
+	defer f.Close()
+
+	return ComputePerceptualHash(f)
+}
+
+// dHash sets a bit for each pixel brighter than the one to its right, in the image
+// shrunk to 9x8.
+func dHash(img image.Image) uint64 {
+	pixels := shrinkGray(img, dHashWidth, dHashHeight)
+
+	var hash uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			hash <<= 1
+			if pixels[y*dHashWidth+x] > pixels[y*dHashWidth+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// pHash sets a bit for each of the lowest 8x8 frequencies of the image, shrunk to
+// 32x32, that is above their median.  The constant term is left out of the median
+// since it only reflects the overall brightness.
+func pHash(img image.Image) uint64 {
+	pixels := shrinkGray(img, pHashSize, pHashSize)
+	coefficients := dct8x8(pixels)
+
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range coefficients {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// dct8x8 returns the lowest 8x8 coefficients of the two dimensional DCT-II of the
+// pHashSize square of pixels.
+func dct8x8(pixels []float64) []float64 {
+	var cosines [8][pHashSize]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < pHashSize; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * pHashSize))
+		}
+	}
+
+	// The rows first, then the columns of the result.
+	var rows [pHashSize][8]float64
+	for y := 0; y < pHashSize; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < pHashSize; x++ {
+				sum += pixels[y*pHashSize+x] * cosines[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+
+	result := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < pHashSize; y++ {
+				sum += rows[y][u] * cosines[v][y]
+			}
+			result = append(result, sum)
+		}
+	}
+	return result
+}
+
+// shrinkGray averages the brightness of the image over a width x height grid.
+func shrinkGray(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	// Each source row and column falls in exactly one cell of the grid.
+	columns := make([]int, bounds.Dx())
+	for x := range columns {
+		columns[x] = x * width / bounds.Dx()
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * height / bounds.Dy() * width
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cell := row + columns[x-bounds.Min.X]
+			sums[cell] += luminance(img, x, y)
+			counts[cell]++
+		}
+	}
+
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= counts[i]
+		}
+	}
+	return sums
+}
+
+// luminance is the brightness of a pixel from 0 to 255, read straight from the
+// luma of the common JPEG and grayscale images.
+func luminance(img image.Image, x, y int) float64 {
+	switch typed := img.(type) {
+	case *image.YCbCr:
+		return float64(typed.Y[typed.YOffset(x, y)])
+	case *image.Gray:
+		return float64(typed.Pix[typed.PixOffset(x, y)])
+	}
+	return float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+}
+
+// SimilarMetadata is metadata with an encoding that looks like the image searched
+// for.  Distance is how many bits its closest encoding differs by.
+type SimilarMetadata struct {
+	Metadata Metadata
+	Distance int
+}
+
+// PerceptualIndex stores the perceptual hashes of encodings and finds the metadata
+// whose images look alike, so the encodings of the same shot can be grouped.
+type PerceptualIndex struct {
+	db DBCaller
+}
+
+func NewPerceptualIndex(db DBCaller) PerceptualIndex {
+	return PerceptualIndex{
+		db: db,
+	}
+}
+
+// Save records the hash of the encoding, replacing any it had.
+func (pi PerceptualIndex) Save(ctx context.Context, encodingID int64, hash PerceptualHash) error {
+	return savePerceptualHash(ctx, pi.db, encodingID, hash)
+}
+
+func savePerceptualHash(ctx context.Context, tx DBCaller, encodingID int64, hash PerceptualHash) error {
+	_, err := tx.Exec(ctx, insertPerceptualHash, encodingID, int64(hash.DHash), int64(hash.PHash))
+	return err
+}
+
+// Find returns the hash of the encoding, or ErrNoPerceptualHash if it has none.
+func (pi PerceptualIndex) Find(ctx context.Context, encodingID int64) (PerceptualHash, error) {
+	var dhash, phash int64
+	err := pi.db.QueryRow(ctx, selectPerceptualHash, encodingID).Scan(&dhash, &phash)
+	if err == pgx.ErrNoRows {
+		return PerceptualHash{}, fmt.Errorf("%w: encoding %d", ErrNoPerceptualHash, encodingID)
+	}
+	if err != nil {
+		return PerceptualHash{}, err
+	}
+	return PerceptualHash{DHash: uint64(dhash), PHash: uint64(phash)}, nil
+}
+
+// FindSimilar returns the metadata with an encoding within maxDistance bits of the
+// hash, closest first.  Around 10 bits finds resized and recompressed copies without
+// many false matches.
+func (pi PerceptualIndex) FindSimilar(ctx context.Context, hash PerceptualHash, maxDistance int) ([]SimilarMetadata, error) {
+	rows, err := pi.db.Query(ctx, selectSimilarMetadata, int64(hash.DHash), int64(hash.PHash), maxDistance, similarLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		metadataID int64
+		distance   int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.metadataID, &c.distance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ms := dbMetadataServer{db: pi.db}
+	var result []SimilarMetadata
+	for _, c := range candidates {
+		metadata, err := ms.FindById(ctx, c.metadataID)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != nil {
+			result = append(result, SimilarMetadata{Metadata: *metadata, Distance: c.distance})
+		}
+	}
+	return result, nil
+}
+
+// SimilarTo returns the other metadata with an encoding that looks like the given
+// encoding.
+func (pi PerceptualIndex) SimilarTo(ctx context.Context, encodingID int64, maxDistance int) ([]SimilarMetadata, error) {
+	hash, err := pi.Find(ctx, encodingID)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadataID int64
+	if err := pi.db.QueryRow(ctx, selectEncodingMetadataId, encodingID).Scan(&metadataID); err != nil {
+		return nil, err
+	}
+
+	similar, err := pi.FindSimilar(ctx, hash, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+
+	result := similar[:0]
+	for _, s := range similar {
+		if s.Metadata.ID != metadataID {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// Backfill hashes the image encodings catalogued without a perceptual hash, such as
+// those ingested before hashes were kept, returning how many were hashed.  Encodings
+// that can't be decoded are skipped.
+func (pi PerceptualIndex) Backfill(ctx context.Context) (int, error) {
+	hashed := 0
+	var lastID int64
+	for {
+		batch, full, err := pi.unhashedBatch(ctx, lastID)
+		if err != nil {
+			return hashed, err
+		}
+
+		for _, encoding := range batch {
+			if err := ctx.Err(); err != nil {
+				return hashed, err
+			}
+			lastID = encoding.ID
+
+			stream, err := OpenEncodingContext(ctx, encoding)
+			if err != nil {
+				continue
+			}
+			hash, err := ComputePerceptualHash(stream)
+			stream.Close()
+			if err != nil {
+				continue
+			}
+
+			if err := pi.Save(ctx, encoding.ID, hash); err != nil {
+				return hashed, err
+			}
+			hashed++
+		}
+
+		if !full {
+			return hashed, nil
+		}
+	}
+}
+
+// unhashedBatch reads the next encodings without a hash, with their locators.  The
+// last encoding may be missing locators when the batch is full, so it's dropped and
+// read again with the next batch.
+func (pi PerceptualIndex) unhashedBatch(ctx context.Context, afterID int64) ([]Encoding, bool, error) {
+	rows, err := pi.db.Query(ctx, selectEncodingsWithoutPerceptualHash, afterID, backfillBatchSize, decodableImages)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var batch []Encoding
+	count := 0
+	for rows.Next() {
+		var encodingID int64
+		var hash, source, path string
+		if err := rows.Scan(&encodingID, &hash, &source, &path); err != nil {
+			return nil, false, err
+		}
+		count++
+
+		if len(batch) == 0 || batch[len(batch)-1].ID != encodingID {
+			batch = append(batch, Encoding{ID: encodingID, Hash: hash})
+		}
+		current := &batch[len(batch)-1]
+		current.Locator = append(current.Locator, resolveLocator(source, path))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	full := count == backfillBatchSize
+	if full && len(batch) > 1 {
+		batch = batch[:len(batch)-1]
+	}
+	return batch, full, nil
+}
+
+// decodableImages are the mime types of the images that have a decoder registered.
+// Other images, such as BMPs, are catalogued without a perceptual hash rather than
+// failing to decode every time they're tried.
+var decodableImages = []string{MimeJPEG, MimePNG, MimeGIF, MimeTIFF, MimeWEBP}
+
+// isImage reports whether the mime type can be decoded for a perceptual hash.
+func isImage(mimeType string) bool {
+	for _, decodable := range decodableImages {
+		if mimeType == decodable {
+			return true
+		}
+	}
+	return false
+}
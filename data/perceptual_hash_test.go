@@ -0,0 +1,249 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pashagolub/pgxmock"
+	"golang.org/x/image/tiff"
+)
+
+// testScene draws the same picture at any size.  With invert, the light and dark
+// areas are swapped, making a different picture.
+func testScene(width, height int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			value := 128 + 90*math.Sin(5*u+1)*math.Cos(3*v) + 30*math.Cos(11*u*v)
+			if invert {
+				value = 255 - value
+			}
+			level := uint8(value)
+			img.Set(x, y, color.RGBA{R: level, G: level / 2, B: 255 - level, A: 255})
+		}
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, img image.Image, asJPEG bool) []byte {
+	var buffer bytes.Buffer
+	var err error
+	if asJPEG {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 75})
+	} else {
+		err = png.Encode(&buffer, img)
+	}
+	if err != nil {
+		t.Fatalf("Unable to encode the test image: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestComputePerceptualHash(t *testing.T) {
+	original, err := ComputePerceptualHash(bytes.NewReader(encodeTestImage(t, testScene(640, 480, false), false)))
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+
+	resized, err := ComputePerceptualHash(bytes.NewReader(encodeTestImage(t, testScene(160, 120, false), true)))
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+	if distance := original.Distance(resized); distance > 6 {
+		t.Errorf("Expected a resized JPEG to hash within 6 bits but it was %d", distance)
+	}
+
+	different, err := ComputePerceptualHash(bytes.NewReader(encodeTestImage(t, testScene(640, 480, true), false)))
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+	if distance := original.Distance(different); distance < 20 {
+		t.Errorf("Expected a different image to be far away but it was %d", distance)
+	}
+}
+
+func TestComputePerceptualHash_JPEGAndTIFF(t *testing.T) {
+	jpegHash, err := ComputePerceptualHash(bytes.NewReader(encodeTestImage(t, testScene(640, 480, false), true)))
+	if err != nil {
+		t.Fatalf("Unexpected error hashing the JPEG: %v", err)
+	}
+
+	var content bytes.Buffer
+	if err := tiff.Encode(&content, testScene(320, 240, false), nil); err != nil {
+		t.Fatalf("Unable to encode the test TIFF: %v", err)
+	}
+	tiffHash, err := ComputePerceptualHash(&content)
+	if err != nil {
+		t.Fatalf("Unexpected error hashing the TIFF: %v", err)
+	}
+
+	if distance := jpegHash.Distance(tiffHash); distance > 6 {
+		t.Errorf("Expected the JPEG and the resized TIFF to hash within 6 bits but it was %d", distance)
+	}
+}
+
+// largePNG returns a PNG whose header says it's far too large to decode.
+func largePNG(t *testing.T) []byte {
+	var content bytes.Buffer
+	if err := png.Encode(&content, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("Unable to encode the test image: %v", err)
+	}
+	header := content.Bytes()
+	binary.BigEndian.PutUint32(header[16:], 100000)
+	binary.BigEndian.PutUint32(header[20:], 100000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	return header
+}
+
+func TestComputePerceptualHash_TooLarge(t *testing.T) {
+	if _, err := ComputePerceptualHash(bytes.NewReader(largePNG(t))); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Expected the image to be refused as too large but got %v", err)
+	}
+}
+
+func TestComputePerceptualHash_NotAnImage(t *testing.T) {
+	if _, err := ComputePerceptualHash(strings.NewReader(testContent)); !errors.Is(err, image.ErrFormat) {
+		t.Errorf("Expected an unknown format but got %v", err)
+	}
+}
+
+func TestPerceptualHash_Distance(t *testing.T) {
+	a := PerceptualHash{DHash: 0xFF, PHash: 0x0F}
+	b := PerceptualHash{DHash: 0x0F, PHash: 0x0E}
+
+	if distance := a.Distance(b); distance != 4 {
+		t.Errorf("Expected the larger distance, 4, but got %d", distance)
+	}
+}
+
+func TestIngester_IngestFileImage(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	content := encodeTestImage(t, testScene(64, 48, false), false)
+	path := writeTestFile(t, t.TempDir(), "bar.png", content)
+	hash := contentHash(content)
+	expected, _ := ComputePerceptualHash(bytes.NewReader(content))
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO all_files`).
+		WithArgs(path, hash, "bar.png", int64(len(content)), testFileModified(t, path)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+	caller.Conn.ExpectExec(`INSERT INTO encoding_perceptual_hash`).
+		WithArgs(int64(3), int64(expected.DHash), int64(expected.PHash)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	if _, err := NewIngester(caller).IngestFile(ctx, path); err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestPerceptualIndex_SimilarTo(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	caller.Conn.ExpectQuery(`SELECT dhash, phash FROM encoding_perceptual_hash`).
+		WithArgs(int64(10)).
+		WillReturnRows(pgxmock.NewRows([]string{"dhash", "phash"}).AddRow(int64(-1), int64(42)))
+	caller.Conn.ExpectQuery(`SELECT metadata_id FROM encoding`).
+		WithArgs(int64(10)).
+		WillReturnRows(pgxmock.NewRows([]string{"metadata_id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT metadata_id, min\(distance\)`).
+		WithArgs(int64(-1), int64(42), 8, similarLimit).
+		WillReturnRows(pgxmock.NewRows([]string{"metadata_id", "distance"}).
+			AddRow(int64(1), 0).
+			AddRow(int64(2), 3))
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(1)).
+		WillReturnRows(dedupeRows(1, dedupeLate, false, "", []string{}, 10, "ABCD", "/a/bar.jpg"))
+	caller.Conn.ExpectQuery(`SELECT metadata.id`).WithArgs(int64(2)).
+		WillReturnRows(dedupeRows(2, dedupeLate, false, "", []string{}, 20, "EF01", "/a/bar.tif"))
+
+	similar, err := NewPerceptualIndex(caller).SimilarTo(ctx, 10, 8)
+	if err != nil {
+		t.Fatalf("Unexpected error finding similar images: %v", err)
+	}
+
+	if len(similar) != 1 || similar[0].Metadata.ID != 2 || similar[0].Distance != 3 {
+		t.Errorf("Expected metadata 2 at distance 3 but got %+v", similar)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestPerceptualIndex_FindMissing(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT dhash, phash`).
+		WithArgs(int64(10)).
+		WillReturnError(pgx.ErrNoRows)
+
+	if _, err := NewPerceptualIndex(caller).Find(ctx, 10); !errors.Is(err, ErrNoPerceptualHash) {
+		t.Errorf("Expected no perceptual hash but got %v", err)
+	}
+}
+
+func TestPerceptualIndex_Backfill(t *testing.T) {
+	caller, _ := createTestDBCaller()
+	content := encodeTestImage(t, testScene(64, 48, false), true)
+	path := writeTestFile(t, t.TempDir(), "bar.jpg", content)
+	expected, _ := ComputePerceptualHash(bytes.NewReader(content))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	caller.Conn.ExpectQuery(`SELECT encoding.id, encoding.file_hash, locator.source, locator.path`).
+		WithArgs(int64(0), backfillBatchSize, []string{MimeJPEG, MimePNG, MimeGIF, MimeTIFF, MimeWEBP}).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "source", "path"}).
+			AddRow(int64(10), contentHash(content), SourceFile, path).
+			AddRow(int64(11), "ABCD", SourceFile, "/missing/bar.jpg"))
+	caller.Conn.ExpectExec(`INSERT INTO encoding_perceptual_hash`).
+		WithArgs(int64(10), int64(expected.DHash), int64(expected.PHash)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	hashed, err := NewPerceptualIndex(caller).Backfill(ctx)
+	if err != nil || hashed != 1 {
+		t.Errorf("Expected a single encoding to be hashed but got %d, %v", hashed, err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIsImage(t *testing.T) {
+	for _, mimeType := range []string{MimeJPEG, MimePNG, MimeGIF, MimeTIFF, MimeWEBP} {
+		if !isImage(mimeType) {
+			t.Errorf("Expected %s to be decodable", mimeType)
+		}
+	}
+	for _, mimeType := range []string{MimeBMP, MimeSVG, MimeMP4} {
+		if isImage(mimeType) {
+			t.Errorf("Expected %s not to be decodable", mimeType)
+		}
+	}
+}
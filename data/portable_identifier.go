@@ -21,38 +21,124 @@ var encodingKey = map[byte]uint8{
 	'J': 24, 'K': 25, 'M': 26, 'N': 27, 'P': 28, 'R': 29, 'S': 30, 'T': 31,
 }
 
+// checkSymbols are the 37 symbols used for the check symbol, the encoding
+// symbols followed by five that only ever appear in the check position.
+var checkSymbols = append(append([]uint8{}, encodingSymbols...), 'u', 'v', 'w', 'x', 'y')
+
+var checkKey = map[byte]uint8{
+	'u': 32, 'v': 33, 'w': 34, 'x': 35, 'y': 36,
+}
+
 var mask uint8 = 0x1F
-var randomBytes = [14]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
-func MakeIdentifier(time time.Time, id int64) Identifier {
+const (
+	identifierSymbols = 14
+	idBits            = 54
+	maxIdentifierId   = int64(1)<<idBits - 1
+)
+
+var (
+	ErrIdentifierIdOutOfRange = errors.New("id does not fit in an identifier")
+	ErrIdentifierCheck        = errors.New("identifier check symbol does not match")
+)
+
+// MakeIdentifier builds the identifier for an entity published at the given time
+// with the id of its published_entity row.  The payload is masked with the current
+// identifier key, see SetIdentifierKeys, and it is an error to make one before a
+// secret has been set.  Ids must be between 0 and 2^54 - 1.
+func MakeIdentifier(time time.Time, id int64) (Identifier, error) {
+	if id < 0 || id > maxIdentifierId {
+		return Identifier{}, ErrIdentifierIdOutOfRange
+	}
+	keys := currentIdentifierKeys()
+	if !keys.configured() {
+		return Identifier{}, ErrIdentifierSecretNotSet
+	}
+	return keys.Mask(identifierPayload(time, id)), nil
+}
+
+// DecodedIdentifier is the plain content of an identifier.  Only the low 16 bits
+// of the creation time in seconds are kept, so the creation time is known to
+// within a window of about 18 hours.
+type DecodedIdentifier struct {
+	ID       int64
+	TimeBits uint16
+}
+
+// DecodeIdentifier unmasks an identifier with the current key.
+func DecodeIdentifier(id Identifier) DecodedIdentifier {
+	return decodePayload(currentIdentifierKeys().current.Decrypt(id))
+}
+
+// Decode unmasks an identifier with the current key followed by each of the
+// retired keys.  The identifier was made by one of the candidates.
+func (k IdentifierKeys) Decode(id Identifier) []DecodedIdentifier {
+	var result []DecodedIdentifier
+	for _, payload := range k.Unmask(id) {
+		result = append(result, decodePayload(payload))
+	}
+	return result
+}
+
+func decodePayload(payload Identifier) DecodedIdentifier {
+	// The 16 time bits lead the left half, the 54 id bits fill the rest of the
+	// left half and all of the right.
+	l, r := payload.halves()
+	idBitsInLeft := idBits - halfBits
+	return DecodedIdentifier{
+		ID:       int64((l&(1<<idBitsInLeft-1))<<halfBits | r),
+		TimeBits: uint16(l >> idBitsInLeft),
+	}
+}
+
+// CreatedBefore returns the latest time, at or before t, that matches the time
+// kept in the identifier.
+func (d DecodedIdentifier) CreatedBefore(t time.Time) time.Time {
+	seconds := t.Unix()
+	delta := uint16(seconds) - d.TimeBits
+	return time.Unix(seconds-int64(delta), 0)
+}
+
+// Matches reports whether the identifier could have been made from the given
+// time and id.
+func (d DecodedIdentifier) Matches(created time.Time, id int64) bool {
+	return d.ID == id && d.TimeBits == uint16(created.Unix())
+}
+
+// identifierPayload lays out the low 16 bits of the time in seconds followed
+// by the low 54 bits of the id as fourteen 5 bit symbols.
+func identifierPayload(time time.Time, id int64) Identifier {
 	timePortion := uint64(time.Unix())
 	uId := uint64(id)
 	return []uint8{
-		(uint8(timePortion>>11) & mask) ^ randomBytes[0],
-		(uint8(timePortion>>6) & mask) ^ randomBytes[1],
-		(uint8(timePortion>>1) & mask) ^ randomBytes[2],
-		(uint8(timePortion<<4)&0x10 | uint8(uId>>50)&0x0F) ^ randomBytes[3],
-		(uint8(uId>>45) & mask) ^ randomBytes[4],
-		(uint8(uId>>40) & mask) ^ randomBytes[5],
-		(uint8(uId>>35) & mask) ^ randomBytes[6],
-		(uint8(uId>>30) & mask) ^ randomBytes[7],
-		(uint8(uId>>25) & mask) ^ randomBytes[8],
-		(uint8(uId>>20) & mask) ^ randomBytes[9],
-		(uint8(uId>>15) & mask) ^ randomBytes[10],
-		(uint8(uId>>10) & mask) ^ randomBytes[11],
-		(uint8(uId>>5) & mask) ^ randomBytes[12],
-		(uint8(uId) & mask) ^ randomBytes[13],
+		uint8(timePortion>>11) & mask,
+		uint8(timePortion>>6) & mask,
+		uint8(timePortion>>1) & mask,
+		uint8(timePortion<<4)&0x10 | uint8(uId>>50)&0x0F,
+		uint8(uId>>45) & mask,
+		uint8(uId>>40) & mask,
+		uint8(uId>>35) & mask,
+		uint8(uId>>30) & mask,
+		uint8(uId>>25) & mask,
+		uint8(uId>>20) & mask,
+		uint8(uId>>15) & mask,
+		uint8(uId>>10) & mask,
+		uint8(uId>>5) & mask,
+		uint8(uId) & mask,
 	}
 }
 
+// ParseIdentifier parses an identifier in the form returned by String, with or
+// without the '-'.  Identifiers whose check symbol doesn't match are rejected,
+// which catches any single mistyped symbol or pair of swapped symbols.
 func ParseIdentifier(id string) (Identifier, error) {
-	if len(id) != 15 && len(id) != 14 {
-		return Identifier{}, errors.New("parse exception - identifier is 15 characters or 14 characters without the '-'")
+	if len(id) != 16 && len(id) != 15 {
+		return Identifier{}, errors.New("parse exception - identifier is 16 characters or 15 characters without the '-'")
 	}
 
-	result := make([]uint8, 14)
+	result := make([]uint8, identifierSymbols)
 	idx := 0
-	for _, r := range id {
+	for _, r := range id[:len(id)-1] {
 		if r == '-' {
 			continue
 		}
@@ -60,14 +146,40 @@ func ParseIdentifier(id string) (Identifier, error) {
 		if !ok {
 			return Identifier{}, errors.New("invalid character in identifier string")
 		}
+		if idx >= len(result) {
+			return Identifier{}, errors.New("parse exception - identifier has too many characters")
+		}
 
 		result[idx] = v
 		idx++
 	}
 
+	if idx != len(result) {
+		return Identifier{}, errors.New("parse exception - identifier has too few characters")
+	}
+
+	check, ok := encodingKey[id[len(id)-1]]
+	if !ok {
+		check, ok = checkKey[id[len(id)-1]]
+	}
+	if !ok || check != Identifier(result).check() {
+		return Identifier{}, ErrIdentifierCheck
+	}
+
 	return result, nil
 }
 
+// check computes the check symbol, the value of the identifier modulo 37.
+// Since 37 is prime and larger than the 32 symbols, changing any one symbol
+// or swapping two neighbouring symbols always changes the check.
+func (i Identifier) check() uint8 {
+	var sum uint
+	for _, v := range i {
+		sum = (sum*32 + uint(v&mask)) % 37
+	}
+	return uint8(sum)
+}
+
 func (i Identifier) String() string {
 	front := []byte{
 		encodingSymbols[i[0]&mask],
@@ -88,7 +200,7 @@ func (i Identifier) String() string {
 		encodingSymbols[i[13]&mask],
 	}
 
-	return fmt.Sprintf("%s-%s", string(front), string(back))
+	return fmt.Sprintf("%s-%s%c", string(front), string(back), checkSymbols[i.check()])
 }
 
 func (i Identifier) Pack() PackedIdentifier {
@@ -5,45 +5,210 @@ import (
 	"time"
 )
 
-func TestMakeIdentifier_Zero(t *testing.T) {
-	id := MakeIdentifier(time.Unix(0, 0), 0)
-	if id.String() != "aaaaaaa-aaaaaaa" {
-		t.Errorf("expected 'aaaaaaa-aaaaaaa' but got %s", id.String())
+func TestIdentifierPayload(t *testing.T) {
+	id := identifierPayload(time.Unix(0, 0), 0)
+	if id.String() != "aaaaaaa-aaaaaaaa" {
+		t.Errorf("expected 'aaaaaaa-aaaaaaaa' but got %s", id.String())
 	}
 
-	id = MakeIdentifier(time.Unix(0b0001_1000_1000_0010, 0), 0b0010_0000_1100_0100_0001)
-	if id.String() != "dcbaaaa-aaaedcb" {
-		t.Errorf("expected 'dcbaaaa-aaaedcb' but got %s", id.String())
+	id = identifierPayload(time.Unix(0b0001_1000_1000_0010, 0), 0b0010_0000_1100_0100_0001)
+	if id.String() != "dcbaaaa-aaaedcbM" {
+		t.Errorf("expected 'dcbaaaa-aaaedcbM' but got %s", id.String())
+	}
+}
+
+func TestMakeIdentifier(t *testing.T) {
+	oldKeys := currentIdentifierKeys()
+	defer SetIdentifierKeys(oldKeys)
+
+	SetIdentifierKeys(NewIdentifierKeys([]byte("deployment secret")))
+	created := time.Unix(0b0001_1000_1000_0010, 0)
+	id, err := MakeIdentifier(created, 0b0010_0000_1100_0100_0001)
+	if err != nil {
+		t.Fatalf("Unexpected error making identifier: %v", err)
+	}
+	if id.String() == "dcbaaaa-aaaedcbM" {
+		t.Error("expected the identifier to be masked")
+	}
+
+	again, _ := MakeIdentifier(created, 0b0010_0000_1100_0100_0001)
+	if id.String() != again.String() {
+		t.Error("expected the same inputs to make the same identifier")
 	}
 
-	oldBytes := randomBytes
-	randomBytes = [14]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-	id = MakeIdentifier(time.Unix(0b1110_0111_0111_1101, 0), 0b1111_1111_1111_1111_1111_1111_1111_1111_1111_1101_1111_0011_1011_1110)
-	if id.String() != "dcbaaaa-aaaedcb" {
-		t.Errorf("expected 'dcbaaaa-aaaedcb' but got %s", id.String())
+	SetIdentifierKeys(NewIdentifierKeys([]byte("another secret")))
+	other, _ := MakeIdentifier(created, 0b0010_0000_1100_0100_0001)
+	if id.String() == other.String() {
+		t.Error("expected a different key to make a different identifier")
 	}
-	randomBytes = oldBytes
 }
 
 func TestIdentifier_String(t *testing.T) {
 	id := Identifier([]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13})
-	if id.String() != "abcdefg-hjkmnpr" {
-		t.Errorf("Expected abcdefg-hjkmnpr but got %s", id.String())
+	if id.String() != "abcdefg-hjkmnpra" {
+		t.Errorf("Expected abcdefg-hjkmnpra but got %s", id.String())
 	}
 
 	id = Identifier([]uint8{14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27})
-	if id.String() != "stABCDE-FGHJKMN" {
-		t.Errorf("Expected stABCDE-FGHJKMN but got %s", id.String())
+	if id.String() != "stABCDE-FGHJKMNn" {
+		t.Errorf("Expected stABCDE-FGHJKMNn but got %s", id.String())
 	}
 }
 
 func TestPackedIdentifier_PackAndUnpack(t *testing.T) {
-	id := MakeIdentifier(time.Unix(0b0001_1000_1000_0010, 0), 0b0010_0000_1100_0100_0001)
+	id := identifierPayload(time.Unix(0b0001_1000_1000_0010, 0), 0b0010_0000_1100_0100_0001)
 
 	packedId := id.Pack()
 	id = packedId.Unpack()
 
-	if id.String() != "dcbaaaa-aaaedcb" {
-		t.Errorf("expected 'dcbaaaa-aaaedcb' but got %s", id.String())
+	if id.String() != "dcbaaaa-aaaedcbM" {
+		t.Errorf("expected 'dcbaaaa-aaaedcbM' but got %s", id.String())
+	}
+}
+
+func TestParseIdentifier(t *testing.T) {
+	id, err := ParseIdentifier("dcbaaaa-aaaedcbM")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing identifier: %v", err)
+	}
+	if id.String() != "dcbaaaa-aaaedcbM" {
+		t.Errorf("expected 'dcbaaaa-aaaedcbM' but got %s", id.String())
+	}
+
+	id, err = ParseIdentifier("dcbaaaaaaaedcbM")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing identifier without a dash: %v", err)
+	}
+	if id.String() != "dcbaaaa-aaaedcbM" {
+		t.Errorf("expected 'dcbaaaa-aaaedcbM' but got %s", id.String())
+	}
+
+	if _, err := ParseIdentifier("dcbaaaaaaaaedcbM"); err == nil {
+		t.Error("Expected an error for 15 symbols without a dash")
+	}
+
+	if _, err := ParseIdentifier("dcbaa-a-aaaedcbM"); err == nil {
+		t.Error("Expected an error for 13 symbols")
+	}
+
+	if _, err := ParseIdentifier("dcbaaaa-aaaedczM"); err == nil {
+		t.Error("Expected an error for an invalid symbol")
+	}
+}
+
+func TestParseIdentifier_Check(t *testing.T) {
+	if _, err := ParseIdentifier("dcbaaaa-aaaedcb"); err == nil {
+		t.Error("Expected an error for a missing check symbol")
+	}
+
+	// A single mistyped symbol.
+	if _, err := ParseIdentifier("dcbaaaa-aaaedccM"); err != ErrIdentifierCheck {
+		t.Errorf("Expected a check error for a mistyped symbol but got %v", err)
+	}
+
+	// Two neighbouring symbols swapped.
+	if _, err := ParseIdentifier("cdbaaaa-aaaedcbM"); err != ErrIdentifierCheck {
+		t.Errorf("Expected a check error for swapped symbols but got %v", err)
+	}
+
+	// Every single symbol substitution is caught.
+	valid := "dcbaaaa-aaaedcbM"
+	for pos := 0; pos < len(valid)-1; pos++ {
+		if valid[pos] == '-' {
+			continue
+		}
+		for _, sym := range encodingSymbols {
+			if sym == valid[pos] {
+				continue
+			}
+			typo := valid[:pos] + string(sym) + valid[pos+1:]
+			if _, err := ParseIdentifier(typo); err != ErrIdentifierCheck {
+				t.Fatalf("Expected a check error for %s but got %v", typo, err)
+			}
+		}
 	}
 }
+
+func TestMakeIdentifier_NoSecret(t *testing.T) {
+	oldKeys := currentIdentifierKeys()
+	defer SetIdentifierKeys(oldKeys)
+
+	SetIdentifierKeys(IdentifierKeys{})
+	if _, err := MakeIdentifier(time.Now(), 1234); err != ErrIdentifierSecretNotSet {
+		t.Errorf("Expected secret not set without keys but got %v", err)
+	}
+
+	SetIdentifierKeys(NewIdentifierKeys(nil))
+	if _, err := MakeIdentifier(time.Now(), 1234); err != ErrIdentifierSecretNotSet {
+		t.Errorf("Expected secret not set with an empty secret but got %v", err)
+	}
+}
+
+func TestMakeIdentifier_OutOfRange(t *testing.T) {
+	useTestIdentifierKeys(t)
+	if _, err := MakeIdentifier(time.Now(), 1<<54); err != ErrIdentifierIdOutOfRange {
+		t.Errorf("Expected id out of range for 2^54 but got %v", err)
+	}
+
+	if _, err := MakeIdentifier(time.Now(), -1); err != ErrIdentifierIdOutOfRange {
+		t.Errorf("Expected id out of range for -1 but got %v", err)
+	}
+
+	if _, err := MakeIdentifier(time.Now(), 1<<54-1); err != nil {
+		t.Errorf("Unexpected error for 2^54 - 1: %v", err)
+	}
+}
+
+func TestDecodeIdentifier(t *testing.T) {
+	oldKeys := currentIdentifierKeys()
+	defer SetIdentifierKeys(oldKeys)
+	SetIdentifierKeys(NewIdentifierKeys([]byte("deployment secret")))
+
+	created := time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC)
+	for _, id := range []int64{0, 1234, 1<<54 - 1} {
+		identifier, err := MakeIdentifier(created, id)
+		if err != nil {
+			t.Fatalf("Unexpected error making identifier: %v", err)
+		}
+
+		parsed, err := ParseIdentifier(identifier.String())
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %v", identifier.String(), err)
+		}
+
+		decoded := DecodeIdentifier(parsed)
+		if decoded.ID != id {
+			t.Errorf("Expected id %d but got %d", id, decoded.ID)
+		}
+
+		if !decoded.Matches(created, id) {
+			t.Errorf("Expected %s to match the time and id it was made from", identifier.String())
+		}
+
+		if !decoded.CreatedBefore(created.Add(10 * time.Hour)).Equal(created) {
+			t.Errorf("Expected creation time %v but got %v", created, decoded.CreatedBefore(created.Add(10*time.Hour)))
+		}
+	}
+}
+
+func TestIdentifierKeys_Decode(t *testing.T) {
+	created := time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC)
+	minted := NewIdentifierKeys([]byte("old secret")).Mask(identifierPayload(created, 1234))
+
+	rotated := NewIdentifierKeys([]byte("new secret"), []byte("old secret"))
+	candidates := rotated.Decode(minted)
+	if len(candidates) != 2 {
+		t.Fatalf("Expected 2 candidates but got %d", len(candidates))
+	}
+
+	if !candidates[1].Matches(created, 1234) {
+		t.Errorf("Expected the retired key to decode 1234 but got %d", candidates[1].ID)
+	}
+}
+
+// useTestIdentifierKeys sets identifier keys for the length of a test.
+func useTestIdentifierKeys(t *testing.T) {
+	oldKeys := currentIdentifierKeys()
+	t.Cleanup(func() { SetIdentifierKeys(oldKeys) })
+	SetIdentifierKeys(NewIdentifierKeys([]byte("test secret")))
+}
@@ -3,7 +3,74 @@ package data
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	EntityMetadata = "metadata"
+	EntityEncoding = "encoding"
+	EntityFile     = "file"
+)
+
+var (
+	ErrPublishedEntityNotFound = errors.New("published entity not found")
+	ErrUnknownEntityType       = errors.New("unknown entity type")
+	ErrEntityNotFound          = errors.New("referenced entity not found")
+	ErrMismatchedEntities      = errors.New("entity names and ids are not the same length")
+)
+
+// entityTables maps the published entity types onto the tables that hold them.
+var entityTables = map[string]string{
+	EntityMetadata: "metadata",
+	EntityEncoding: "encoding",
+	EntityFile:     "all_files",
+}
+
+// Published entities are kept in the published_entity table:
+//
+//	CREATE TABLE published_entity (
+//		id                BIGSERIAL PRIMARY KEY,
+//		identifier        VARCHAR(16) NOT NULL UNIQUE,
+//		referenced_entity VARCHAR(32) NOT NULL,
+//		referenced_id     BIGINT NOT NULL,
+//		created           TIMESTAMP WITH TIME ZONE NOT NULL,
+//		UNIQUE (referenced_entity, referenced_id)
+//	);
+//
+// An entity keeps the identifiers of the entities merged into it by the Deduper, so
+// permalinks to them go on working.  Only one identifier of an entity is canonical,
+// and that's the one Find returns:
+//
+//	ALTER TABLE published_entity ADD COLUMN canonical BOOLEAN NOT NULL DEFAULT TRUE;
+//	ALTER TABLE published_entity DROP CONSTRAINT published_entity_referenced_entity_referenced_id_key;
+//	CREATE UNIQUE INDEX published_entity_canonical_idx ON published_entity (referenced_entity, referenced_id)
+//		WHERE canonical;
+const (
+	selectEntityExists          = `SELECT id FROM %s WHERE id = $1`
+	selectNextPublishedEntityId = `SELECT nextval(pg_get_serial_sequence('published_entity', 'id'))`
+	insertPublishedEntity       = `INSERT INTO published_entity
+		(id, identifier, referenced_entity, referenced_id, created)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+	insertMissingPublishedEntity = `INSERT INTO published_entity
+		(id, identifier, referenced_entity, referenced_id, created)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (referenced_entity, referenced_id) WHERE canonical DO NOTHING
+		RETURNING id`
+	selectPublishedByIdentifier = `SELECT id, referenced_id, referenced_entity, created, identifier
+		FROM published_entity
+		WHERE identifier = $1`
+	selectPublishedByEntity = `SELECT id, referenced_id, referenced_entity, created, identifier
+		FROM published_entity
+		WHERE referenced_entity = $1 AND referenced_id = $2 AND canonical`
+	selectPublishedByEntities = `SELECT id, referenced_id, referenced_entity, created, identifier
+		FROM published_entity
+		WHERE (referenced_entity, referenced_id) IN (SELECT * FROM unnest($1::text[], $2::bigint[])) AND canonical
+		ORDER BY id`
+	selectEncodingMetadataId = `SELECT metadata_id FROM encoding WHERE id = $1`
 )
 
 // PublishedEntity is a data entity that is published outside the system.  The id is an internal
@@ -61,34 +128,269 @@ func NewPublishedEntityServer(db DBCaller) PublishedEntityService {
 	return dbPublishedEntityServer{db: db}
 }
 
+func (pes dbPublishedEntityServer) scanEntity(row pgx.Row) (PublishedEntity, error) {
+	var result PublishedEntity
+	err := row.Scan(&result.id, &result.RelatedId, &result.Type, &result.Created, &result.PublishedIdentifier)
+	if err == pgx.ErrNoRows {
+		return PublishedEntity{}, ErrPublishedEntityNotFound
+	}
+	if err != nil {
+		return PublishedEntity{}, err
+	}
+
+	return result, nil
+}
+
+// resolve loads the value a published entity refers to.
+func (pes dbPublishedEntityServer) resolve(ctx context.Context, entity PublishedEntity) (interface{}, error) {
+	switch entity.Type {
+	case EntityMetadata:
+		metadata, err := NewMetadataServer(pes.db).FindById(ctx, entity.RelatedId)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			return nil, ErrEntityNotFound
+		}
+		return *metadata, nil
+	case EntityEncoding:
+		return pes.resolveEncoding(ctx, entity.RelatedId)
+	case EntityFile:
+		info, err := NewFileService(pes.db).FindById(ctx, entity.RelatedId)
+		if err == pgx.ErrNoRows {
+			return nil, ErrEntityNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+
+	return nil, ErrUnknownEntityType
+}
+
+// resolveEncoding finds an encoding by way of its metadata, so the encoding is
+// returned with its locators and the metadata it belongs to.
+func (pes dbPublishedEntityServer) resolveEncoding(ctx context.Context, id int64) (Encoding, error) {
+	var metadataID int64
+	err := pes.db.QueryRow(ctx, selectEncodingMetadataId, id).Scan(&metadataID)
+	if err == pgx.ErrNoRows {
+		return Encoding{}, ErrEntityNotFound
+	}
+	if err != nil {
+		return Encoding{}, err
+	}
+
+	metadata, err := NewMetadataServer(pes.db).FindById(ctx, metadataID)
+	if err != nil {
+		return Encoding{}, err
+	}
+	if metadata == nil {
+		return Encoding{}, ErrEntityNotFound
+	}
+
+	for _, encoding := range metadata.Data {
+		if encoding.ID == id {
+			encoding.Metadata = *metadata
+			encoding.Metadata.Data = nil
+			return encoding, nil
+		}
+	}
+
+	return Encoding{}, ErrEntityNotFound
+}
+
+// matches reports whether the identifier was made for the published entity, by the current key or
+// a retired one.  A row is only trusted if its id and creation time are the ones in the identifier.
+func (entity PublishedEntity) matches(identifier Identifier) bool {
+	for _, decoded := range currentIdentifierKeys().Decode(identifier) {
+		if decoded.Matches(entity.Created, entity.id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (pes dbPublishedEntityServer) Lookup(ctx context.Context, publishedId string) (LookupResult, error) {
-	return LookupResult{}, errors.New("not implemented")
+	result := LookupResult{SearchedFor: publishedId}
+
+	identifier, err := ParseIdentifier(publishedId)
+	if err != nil {
+		return result, err
+	}
+
+	entity, err := pes.scanEntity(pes.db.QueryRow(ctx, selectPublishedByIdentifier, identifier.String()))
+	if err != nil {
+		return result, err
+	}
+	if !entity.matches(identifier) {
+		return result, ErrPublishedEntityNotFound
+	}
+
+	result.OfType = entity.Type
+	result.Found, err = pes.resolve(ctx, entity)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
 }
 
+// LookupAll looks up each of the published ids in turn.  A failure to find one id is reported
+// in the WithError of its result rather than failing the whole batch.
 func (pes dbPublishedEntityServer) LookupAll(ctx context.Context, publishedIds []string) ([]LookupResult, error) {
-	return nil, errors.New("not implemented")
+	result := make([]LookupResult, len(publishedIds))
+	for i, publishedId := range publishedIds {
+		found, err := pes.Lookup(ctx, publishedId)
+		found.WithError = err
+		result[i] = found
+	}
+
+	return result, nil
 }
 
+// Create publishes an entity.  The identifier is made from the id of the published_entity row
+// rather than the id of the entity, so entities of different types with the same id created in the
+// same second still get different identifiers.
 func (pes dbPublishedEntityServer) Create(ctx context.Context, entityName string, id int64) (PublishedEntity, error) {
-	return PublishedEntity{}, errors.New("not implemented")
+	return pes.create(ctx, insertPublishedEntity, entityName, id)
+}
+
+// create publishes an entity with the given insert statement.  If the insert returns no row, as
+// when it does nothing on a conflict, the error is pgx.ErrNoRows.
+func (pes dbPublishedEntityServer) create(ctx context.Context, insert string, entityName string, id int64) (PublishedEntity, error) {
+	table, ok := entityTables[entityName]
+	if !ok {
+		return PublishedEntity{}, ErrUnknownEntityType
+	}
+
+	var foundID int64
+	err := pes.db.QueryRow(ctx, fmt.Sprintf(selectEntityExists, table), id).Scan(&foundID)
+	if err == pgx.ErrNoRows {
+		return PublishedEntity{}, ErrEntityNotFound
+	}
+	if err != nil {
+		return PublishedEntity{}, err
+	}
+
+	result := PublishedEntity{
+		RelatedId: id,
+		Type:      entityName,
+		Created:   time.Now(),
+	}
+	if err := pes.db.QueryRow(ctx, selectNextPublishedEntityId).Scan(&result.id); err != nil {
+		return PublishedEntity{}, err
+	}
+	identifier, err := MakeIdentifier(result.Created, result.id)
+	if err != nil {
+		return PublishedEntity{}, err
+	}
+	result.PublishedIdentifier = identifier.String()
+
+	row := pes.db.QueryRow(ctx, insert, result.id, result.PublishedIdentifier, entityName, id, result.Created)
+	if err := row.Scan(&result.id); err != nil {
+		return PublishedEntity{}, err
+	}
+
+	return result, nil
 }
 
 func (pes dbPublishedEntityServer) CreateAll(ctx context.Context, entityNames []string, ids []int64) ([]PublishedEntity, error) {
-	return nil, errors.New("not implemented")
+	if len(entityNames) != len(ids) {
+		return nil, ErrMismatchedEntities
+	}
+
+	tx, err := pes.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txServer := dbPublishedEntityServer{db: tx}
+	result := make([]PublishedEntity, len(ids))
+	for i := range ids {
+		result[i], err = txServer.Create(ctx, entityNames[i], ids[i])
+		if err != nil {
+			rollback(ctx, tx)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 func (pes dbPublishedEntityServer) Find(ctx context.Context, entityType string, id int64) (PublishedEntity, error) {
-	return PublishedEntity{}, errors.New("not implemented")
+	return pes.scanEntity(pes.db.QueryRow(ctx, selectPublishedByEntity, entityType, id))
 }
 
+// FindAll returns the published entities that exist for the given database entities.  Entities
+// that have not been published are left out of the result.
 func (pes dbPublishedEntityServer) FindAll(ctx context.Context, entityType []string, ids []int64) ([]PublishedEntity, error) {
-	return nil, errors.New("not implemented")
+	if len(entityType) != len(ids) {
+		return nil, ErrMismatchedEntities
+	}
+
+	rows, err := pes.db.Query(ctx, selectPublishedByEntities, entityType, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []PublishedEntity
+	for rows.Next() {
+		entity, err := pes.scanEntity(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entity)
+	}
+
+	return result, rows.Err()
 }
 
+// FindOrCreate finds the published entity or creates it.  When another request publishes the same
+// entity between the find and the create, the insert does nothing and the entity it published is
+// found instead.
 func (pes dbPublishedEntityServer) FindOrCreate(ctx context.Context, entityName string, id int64) (PublishedEntity, error) {
-	return PublishedEntity{}, errors.New("not implemented")
+	result, err := pes.Find(ctx, entityName, id)
+	if err != ErrPublishedEntityNotFound {
+		return result, err
+	}
+
+	result, err = pes.create(ctx, insertMissingPublishedEntity, entityName, id)
+	if err == pgx.ErrNoRows {
+		return pes.Find(ctx, entityName, id)
+	}
+
+	return result, err
 }
 
 func (pes dbPublishedEntityServer) FindOrCreateAll(ctx context.Context, entityNames []string, ids []int64) ([]PublishedEntity, error) {
-	return nil, errors.New("not implemented")
+	if len(entityNames) != len(ids) {
+		return nil, ErrMismatchedEntities
+	}
+
+	tx, err := pes.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txServer := dbPublishedEntityServer{db: tx}
+	result := make([]PublishedEntity, len(ids))
+	for i := range ids {
+		result[i], err = txServer.FindOrCreate(ctx, entityNames[i], ids[i])
+		if err != nil {
+			rollback(ctx, tx)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
@@ -1,9 +1,13 @@
 package data
 
 import (
+	"errors"
+	"github.com/jackc/pgx/v4"
 	"github.com/pashagolub/pgxmock"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewPublishedEntityServer(t *testing.T) {
@@ -44,11 +48,15 @@ func TestNewPublishedEntityServer(t *testing.T) {
 // of 8. aDkfbzQr-Tmqldfd
 //
 func TestDbPublishedEntityServer_Create(t *testing.T) {
+	useTestIdentifierKeys(t)
 	caller, ctx := createTestDBCaller()
-	caller.Conn.ExpectQuery("SELECT id FROM metadata WHERE id = 1234").
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WithArgs(int64(1234)).
 		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1234)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(1)))
 	caller.Conn.ExpectQuery(`INSERT INTO published_entity 
-		(identifier, referenced_entity, referenced_id)
+		\(id, identifier, referenced_entity, referenced_id, created\)
 		VALUES `).WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
 
 	pes := NewPublishedEntityServer(caller)
@@ -72,32 +80,477 @@ func TestDbPublishedEntityServer_Create(t *testing.T) {
 	if pe.RelatedId != 1234 {
 		t.Errorf("Expected entity id to be 1234 but got %d", pe.RelatedId)
 	}
+
+	identifier, _ := MakeIdentifier(pe.Created, 1)
+	if pe.PublishedIdentifier != identifier.String() {
+		t.Errorf("Expected identifier to be made from created and published id but got %s", pe.PublishedIdentifier)
+	}
+}
+
+func TestDbPublishedEntityServer_CreateMissingEntity(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id FROM all_files WHERE id = \$1`).
+		WillReturnError(pgx.ErrNoRows)
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Create(ctx, EntityFile, 1234); err != ErrEntityNotFound {
+		t.Errorf("Expected entity not found but got %v", err)
+	}
+}
+
+func TestDbPublishedEntityServer_CreateUnknownType(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Create(ctx, "users; DROP TABLE metadata", 1234); err != ErrUnknownEntityType {
+		t.Errorf("Expected unknown entity type but got %v", err)
+	}
 }
 
 func TestDbPublishedEntityServer_CreateAll(t *testing.T) {
-	t.Error("Not implemented")
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WithArgs(int64(1)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(10)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(10)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding WHERE id = \$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(11)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(11)))
+
+	pes := NewPublishedEntityServer(caller)
+	entities, err := pes.CreateAll(ctx, []string{EntityMetadata, EntityEncoding}, []int64{1, 7})
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#CreateAll: %v", err)
+	}
+
+	if len(entities) != 2 {
+		t.Fatalf("Expected 2 entities but got %d", len(entities))
+	}
+
+	if entities[0].Type != EntityMetadata || entities[0].RelatedId != 1 || entities[0].id != 10 {
+		t.Errorf("Expected metadata 1 published as 10 but got %s %d published as %d",
+			entities[0].Type, entities[0].RelatedId, entities[0].id)
+	}
+
+	if entities[1].Type != EntityEncoding || entities[1].RelatedId != 7 || entities[1].id != 11 {
+		t.Errorf("Expected encoding 7 published as 11 but got %s %d published as %d",
+			entities[1].Type, entities[1].RelatedId, entities[1].id)
+	}
+
+	if !caller.Committed {
+		t.Error("Expected the transaction to be committed")
+	}
+}
+
+func TestDbPublishedEntityServer_CreateAllMismatched(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.CreateAll(ctx, []string{EntityMetadata}, []int64{1, 2}); err != ErrMismatchedEntities {
+		t.Errorf("Expected mismatched entities but got %v", err)
+	}
+}
+
+func TestDbPublishedEntityServer_CreateAllRollsBack(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnError(errors.New("random database error"))
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.CreateAll(ctx, []string{EntityMetadata}, []int64{1}); err == nil {
+		t.Error("Expected database error")
+	}
+
+	if caller.Committed || !caller.RolledBack {
+		t.Error("Expected the transaction to be rolled back")
+	}
 }
 
 func TestDbPublishedEntityServer_Find(t *testing.T) {
-	t.Error("Not implemented")
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1234)).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(1234), EntityMetadata, created, "dcbaaaa-aaaedcbM"))
+
+	pes := NewPublishedEntityServer(caller)
+	pe, err := pes.Find(ctx, EntityMetadata, 1234)
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#Find: %v", err)
+	}
+
+	if pe.id != 1 || pe.RelatedId != 1234 || pe.Type != EntityMetadata || pe.PublishedIdentifier != "dcbaaaa-aaaedcbM" {
+		t.Errorf("Expected 1 1234 metadata dcbaaaa-aaaedcbM but got %d %d %s %s",
+			pe.id, pe.RelatedId, pe.Type, pe.PublishedIdentifier)
+	}
+}
+
+func TestDbPublishedEntityServer_FindNotFound(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WillReturnError(pgx.ErrNoRows)
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Find(ctx, EntityMetadata, 1234); err != ErrPublishedEntityNotFound {
+		t.Errorf("Expected published entity not found but got %v", err)
+	}
 }
 
 func TestDbPublishedEntityServer_FindAll(t *testing.T) {
-	t.Error("Not implemented")
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs([]string{EntityMetadata, EntityEncoding, EntityFile}, []int64{1, 7, 9}).
+		WillReturnRows(publishedEntityRows().
+			AddRow(int64(1), int64(1), EntityMetadata, created, "aaaaaaa-aaaaaabb").
+			AddRow(int64(2), int64(9), EntityFile, created, "aaaaaaa-aaaaaakk"))
+
+	pes := NewPublishedEntityServer(caller)
+	entities, err := pes.FindAll(ctx, []string{EntityMetadata, EntityEncoding, EntityFile}, []int64{1, 7, 9})
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#FindAll: %v", err)
+	}
+
+	if len(entities) != 2 {
+		t.Fatalf("Expected 2 entities but got %d", len(entities))
+	}
+
+	if entities[0].Type != EntityMetadata || entities[1].Type != EntityFile {
+		t.Errorf("Expected metadata and file but got %s and %s", entities[0].Type, entities[1].Type)
+	}
 }
 
 func TestDbPublishedEntityServer_FindOrCreate(t *testing.T) {
-	t.Error("Not implemented")
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1234)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1234)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(5)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(5)))
+
+	pes := NewPublishedEntityServer(caller)
+	pe, err := pes.FindOrCreate(ctx, EntityMetadata, 1234)
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#FindOrCreate: %v", err)
+	}
+
+	if pe.id != 5 || pe.RelatedId != 1234 {
+		t.Errorf("Expected 5 for 1234 but got %d for %d", pe.id, pe.RelatedId)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestDbPublishedEntityServer_FindOrCreateRace(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1234)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1234)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(6)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity .* ON CONFLICT \(referenced_entity, referenced_id\) WHERE canonical DO NOTHING`).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1234)).
+		WillReturnRows(publishedEntityRows().AddRow(int64(5), int64(1234), EntityMetadata, created, "dcbaaaa-aaaedcbM"))
+
+	pes := NewPublishedEntityServer(caller)
+	pe, err := pes.FindOrCreate(ctx, EntityMetadata, 1234)
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#FindOrCreate: %v", err)
+	}
+
+	if pe.id != 5 || pe.PublishedIdentifier != "dcbaaaa-aaaedcbM" {
+		t.Errorf("Expected the entity published by the other request but got %d %s", pe.id, pe.PublishedIdentifier)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
 }
 
 func TestDbPublishedEntityServer_FindOrCreateAll(t *testing.T) {
-	t.Error("Not implemented")
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1)).
+		WillReturnRows(publishedEntityRows().AddRow(int64(3), int64(1), EntityMetadata, created, "aaaaaaa-aaaaaabb"))
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(2)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(4)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+
+	pes := NewPublishedEntityServer(caller)
+	entities, err := pes.FindOrCreateAll(ctx, []string{EntityMetadata, EntityMetadata}, []int64{1, 2})
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#FindOrCreateAll: %v", err)
+	}
+
+	if len(entities) != 2 || entities[0].id != 3 || entities[1].id != 4 {
+		t.Errorf("Expected entities 3 and 4 but got %v", entities)
+	}
+
+	if !caller.Committed {
+		t.Error("Expected the transaction to be committed")
+	}
+}
+
+func TestDbPublishedEntityServer_FindOrCreateAllSameIds(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityMetadata, int64(1)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id FROM metadata WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(EntityEncoding, int64(1)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding WHERE id = \$1`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT nextval`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`INSERT INTO published_entity`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+
+	pes := NewPublishedEntityServer(caller)
+	entities, err := pes.FindOrCreateAll(ctx, []string{EntityMetadata, EntityEncoding}, []int64{1, 1})
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#FindOrCreateAll: %v", err)
+	}
+
+	if entities[0].PublishedIdentifier == entities[1].PublishedIdentifier {
+		t.Errorf("Expected metadata 1 and encoding 1 to have different identifiers but both are %s",
+			entities[0].PublishedIdentifier)
+	}
+
+	// Even in the same second the identifiers differ, as they come from the published ids.
+	metadata, _ := MakeIdentifier(entities[0].Created, 1)
+	encoding, _ := MakeIdentifier(entities[0].Created, 2)
+	if metadata.String() == encoding.String() {
+		t.Errorf("Expected identifiers made in the same second to differ but both are %s", metadata)
+	}
+
+	if !caller.Committed {
+		t.Error("Expected the transaction to be committed")
+	}
 }
 
 func TestDbPublishedEntityServer_Lookup(t *testing.T) {
-	t.Error("Not implemented")
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(identifier.String()).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(1), EntityMetadata, created, identifier.String()))
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).
+		WithArgs(int64(1)).
+		WillReturnRows(buildSingleResult())
+
+	pes := NewPublishedEntityServer(caller)
+	result, err := pes.Lookup(ctx, strings.Replace(identifier.String(), "-", "", 1))
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#Lookup: %v", err)
+	}
+
+	if result.OfType != EntityMetadata {
+		t.Errorf("Expected a metadata but got %s", result.OfType)
+	}
+
+	metadata, ok := result.Found.(Metadata)
+	if !ok {
+		t.Fatalf("Expected to find a Metadata but got %v", reflect.TypeOf(result.Found))
+	}
+
+	if metadata.ID != 1 || len(metadata.Data) != 2 {
+		t.Errorf("Expected metadata 1 with 2 encodings but got %d with %d", metadata.ID, len(metadata.Data))
+	}
+}
+
+func TestDbPublishedEntityServer_LookupEncoding(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(11), EntityEncoding, created, identifier.String()))
+	caller.Conn.ExpectQuery(`SELECT metadata_id FROM encoding WHERE id = \$1`).
+		WithArgs(int64(11)).
+		WillReturnRows(pgxmock.NewRows([]string{"metadata_id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).
+		WithArgs(int64(1)).
+		WillReturnRows(buildSingleResult())
+
+	pes := NewPublishedEntityServer(caller)
+	result, err := pes.Lookup(ctx, identifier.String())
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#Lookup: %v", err)
+	}
+
+	encoding, ok := result.Found.(Encoding)
+	if !ok {
+		t.Fatalf("Expected to find an Encoding but got %v", reflect.TypeOf(result.Found))
+	}
+
+	if encoding.ID != 11 || encoding.MimeType != MimeTIFF || encoding.Metadata.ID != 1 {
+		t.Errorf("Expected TIFF encoding 11 of metadata 1 but got %s encoding %d of metadata %d",
+			encoding.MimeType, encoding.ID, encoding.Metadata.ID)
+	}
+}
+
+func TestDbPublishedEntityServer_LookupFile(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(3), EntityFile, created, identifier.String()))
+	caller.Conn.ExpectQuery(`SELECT id, full_path, file_hash, filename, size`).
+		WithArgs(int64(3)).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_path", "file_hash", "filename", "size"}).
+			AddRow(int64(3), "/foo/bar.jpg", "ABCD1234", "bar.jpg", int64(35536)))
+
+	pes := NewPublishedEntityServer(caller)
+	result, err := pes.Lookup(ctx, identifier.String())
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#Lookup: %v", err)
+	}
+
+	info, ok := result.Found.(FileInfo)
+	if !ok {
+		t.Fatalf("Expected to find a FileInfo but got %v", reflect.TypeOf(result.Found))
+	}
+
+	if info.ID != 3 || info.FullPath != "/foo/bar.jpg" {
+		t.Errorf("Expected file 3 at /foo/bar.jpg but got %d at %s", info.ID, info.FullPath)
+	}
+}
+
+func TestDbPublishedEntityServer_LookupRetiredKey(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	SetIdentifierKeys(NewIdentifierKeys([]byte("rotated secret"), []byte("test secret")))
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(1), EntityMetadata, created, identifier.String()))
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).
+		WillReturnRows(buildSingleResult())
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Lookup(ctx, identifier.String()); err != nil {
+		t.Errorf("Expected an identifier made with a retired key to be found but got %v", err)
+	}
+}
+
+func TestDbPublishedEntityServer_LookupMismatchedRow(t *testing.T) {
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WillReturnRows(publishedEntityRows().AddRow(int64(2), int64(1), EntityMetadata, created, identifier.String()))
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Lookup(ctx, identifier.String()); err != ErrPublishedEntityNotFound {
+		t.Errorf("Expected a row that doesn't match the identifier to be not found but got %v", err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Expected the entity not to be resolved: %v", err)
+	}
+}
+
+func TestDbPublishedEntityServer_LookupInvalidIdentifier(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Lookup(ctx, "not-an-identifier"); err == nil {
+		t.Error("Expected a parse error")
+	}
 }
 
 func TestDbPublishedEntityServer_LookupAll(t *testing.T) {
-	t.Error("Not implemented")
+	useTestIdentifierKeys(t)
+	caller, ctx := createTestDBCaller()
+	created := time.Now()
+	identifier, _ := MakeIdentifier(created, 1)
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs(identifier.String()).
+		WillReturnRows(publishedEntityRows().AddRow(int64(1), int64(1), EntityMetadata, created, identifier.String()))
+	caller.Conn.ExpectQuery(`SELECT metadata\.id`).
+		WillReturnRows(buildSingleResult())
+	caller.Conn.ExpectQuery(`SELECT id, referenced_id, referenced_entity, created, identifier`).
+		WithArgs("aaaaaaa-aaaaaabb").
+		WillReturnError(pgx.ErrNoRows)
+
+	pes := NewPublishedEntityServer(caller)
+	results, err := pes.LookupAll(ctx, []string{identifier.String(), "aaaaaaa-aaaaaabb"})
+	if err != nil {
+		t.Fatalf("Unexpected error when calling PublishedEntityServer#LookupAll: %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results but got %d", len(results))
+	}
+
+	if results[0].WithError != nil || results[0].OfType != EntityMetadata {
+		t.Errorf("Expected first result to be a metadata but got %s and %v", results[0].OfType, results[0].WithError)
+	}
+
+	if results[1].SearchedFor != "aaaaaaa-aaaaaabb" || results[1].WithError != ErrPublishedEntityNotFound {
+		t.Errorf("Expected second result to be not found but got %v", results[1].WithError)
+	}
+}
+
+func TestDbPublishedEntityServer_LookupMistypedIdentifier(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	pes := NewPublishedEntityServer(caller)
+	if _, err := pes.Lookup(ctx, "dcbaaaa-aaaedccM"); err != ErrIdentifierCheck {
+		t.Errorf("Expected a check error but got %v", err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Expected no queries but got: %v", err)
+	}
+}
+
+func publishedEntityRows() *pgxmock.Rows {
+	return pgxmock.NewRows([]string{"id", "referenced_id", "referenced_entity", "created", "identifier"})
 }
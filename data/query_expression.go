@@ -0,0 +1,120 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expression is a condition on metadata built from Tag, Location and Mime, and
+// combined with And, Or and Not.  For example, boats at home or work that aren't
+// TIFFs:
+//
+//	And(Tag("boat"), Or(Location("home"), Location("work")), Not(Mime("image/tiff")))
+//
+// Values are always passed as parameters, never written into the SQL.
+type Expression interface {
+	compile(c *expressionCompiler) string
+}
+
+// expressionCompiler numbers the parameters of an expression from where the
+// query builder is up to.
+type expressionCompiler struct {
+	idx  int
+	args []interface{}
+}
+
+func (ec *expressionCompiler) parameter(value interface{}) string {
+	ec.args = append(ec.args, value)
+	ec.idx++
+	return fmt.Sprintf("$%d", ec.idx-1)
+}
+
+type tagExpression string
+
+// Tag matches metadata tagged with the tag.
+func Tag(tag string) Expression {
+	return tagExpression(tag)
+}
+
+func (te tagExpression) compile(c *expressionCompiler) string {
+	return fmt.Sprintf("%s = ANY(tags)", c.parameter(string(te)))
+}
+
+type locationExpression string
+
+// Location matches metadata captured at the location.
+func Location(location string) Expression {
+	return locationExpression(location)
+}
+
+func (le locationExpression) compile(c *expressionCompiler) string {
+	return fmt.Sprintf("location = %s", c.parameter(string(le)))
+}
+
+type mimeExpression string
+
+// Mime matches the encodings of the mime type.  Like ByMimeTypes, it picks out
+// encodings rather than metadata, so only the encodings that match are returned and
+// And(Mime("image/jpeg"), Mime("image/tiff")) matches nothing.
+func Mime(mimeType string) Expression {
+	return mimeExpression(mimeType)
+}
+
+func (me mimeExpression) compile(c *expressionCompiler) string {
+	return fmt.Sprintf("encoding.mime_type = %s", c.parameter(string(me)))
+}
+
+type andExpression []Expression
+
+// And matches when every one of the expressions does.  With none it matches everything.
+func And(expressions ...Expression) Expression {
+	return andExpression(expressions)
+}
+
+func (ae andExpression) compile(c *expressionCompiler) string {
+	return join(c, ae, " AND ", "TRUE")
+}
+
+type orExpression []Expression
+
+// Or matches when any of the expressions does.  With none it matches nothing.
+func Or(expressions ...Expression) Expression {
+	return orExpression(expressions)
+}
+
+func (oe orExpression) compile(c *expressionCompiler) string {
+	return join(c, oe, " OR ", "FALSE")
+}
+
+type notExpression struct {
+	expression Expression
+}
+
+// Not matches when the expression doesn't.
+func Not(expression Expression) Expression {
+	return notExpression{expression: expression}
+}
+
+func (ne notExpression) compile(c *expressionCompiler) string {
+	return fmt.Sprintf("NOT %s", ne.expression.compile(c))
+}
+
+func join(c *expressionCompiler, expressions []Expression, operator, empty string) string {
+	if len(expressions) == 0 {
+		return empty
+	}
+
+	parts := make([]string, len(expressions))
+	for i, expression := range expressions {
+		parts[i] = expression.compile(c)
+	}
+	return "(" + strings.Join(parts, operator) + ")"
+}
+
+// Parameters returns the values an expression passes to the query, in the order of
+// its placeholders.
+func Parameters(expression Expression) []interface{} {
+	c := expressionCompiler{idx: 1}
+	expression.compile(&c)
+	return c.args
+}
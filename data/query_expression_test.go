@@ -0,0 +1,46 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataQueryBuilder_Matching(t *testing.T) {
+	expression := And(Tag("boat"), Or(Location("home"), Location("work")), Not(Mime("image/tiff")))
+	query := NewMetadataQueryBuilder().AddTags(1).Matching(expression).BetweenDates().String()
+
+	target := `SELECT metadata.id, date_captured, date_estimated, location, tags, latitude, longitude, altitude, description, '',
+			encoding.id, encoding.runtime, encoding.resolution, encoding.mime_type, encoding.file_hash,
+			locator.id, locator.source, locator.path
+ 		FROM metadata
+			INNER JOIN encoding on metadata.id = encoding.metadata_id
+    		INNER JOIN locator on encoding.id = locator.encoding_id
+		WHERE $1 = ANY(tags) AND ($2 = ANY(tags) AND (location = $3 OR location = $4) AND NOT encoding.mime_type = $5)
+			AND date_captured BETWEEN $6 AND $7
+		ORDER BY metadata.id, encoding.id, locator.id ASC`
+
+	query = strings.Trim(whitespace.ReplaceAllString(query, " "), " ")
+	target = strings.Trim(whitespace.ReplaceAllString(target, " "), " ")
+
+	if target != query {
+		t.Errorf("Expected %s but got %s", target, query)
+	}
+}
+
+func TestMetadataQueryBuilder_MatchingEmpty(t *testing.T) {
+	query := NewMetadataQueryBuilder().Matching(Or(And(), Not(Or()))).Count()
+
+	if !strings.Contains(query, "WHERE (TRUE OR NOT FALSE)") {
+		t.Errorf("Expected empty expressions to be constants but got %s", query)
+	}
+}
+
+func TestParameters(t *testing.T) {
+	expression := And(Tag("boat"), Or(Location("home"), Location("work")), Not(Mime("image/tiff")))
+
+	expected := []interface{}{"boat", "home", "work", "image/tiff"}
+	if args := Parameters(expression); !reflect.DeepEqual(expected, args) {
+		t.Errorf("Expected %v but got %v", expected, args)
+	}
+}
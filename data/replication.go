@@ -0,0 +1,430 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	selectEncodingLocators = `SELECT encoding.id, encoding.file_hash, encoding.mime_type, locator.source, locator.path
+		FROM encoding
+			LEFT JOIN locator on encoding.id = locator.encoding_id
+		WHERE encoding.id IN (SELECT id FROM encoding WHERE id > $1 ORDER BY id LIMIT $2)
+		ORDER BY encoding.id, locator.id`
+)
+
+// replicateBatchSize is how many encodings are read from the database at a time.
+const replicateBatchSize = 200
+
+var (
+	ErrInvalidPolicy = errors.New("invalid replication policy")
+	ErrNoTarget      = errors.New("no replica target can hold another copy")
+)
+
+// ReplicationRule is how many copies the encodings of a mime type need.
+type ReplicationRule struct {
+	// MimeType is matched exactly, as type/* for every subtype, or * for anything.
+	MimeType string
+	// Copies is the number of locators the encoding needs.
+	Copies int
+	// OffBox is how many of those copies must be somewhere other than the local
+	// machine, in S3 or behind http.
+	OffBox int
+}
+
+// ReplicationPolicy is the rules for each mime type.  The most specific rule that
+// matches the mime type of an encoding applies.
+type ReplicationPolicy []ReplicationRule
+
+// ParseReplicationPolicy reads a policy written as comma separated rules of
+// mimetype=copies or mimetype=copies:offbox, e.g. image/tiff=2:1,image/*=2,*=1.
+func ParseReplicationPolicy(text string) (ReplicationPolicy, error) {
+	var policy ReplicationPolicy
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		rule := strings.SplitN(part, "=", 2)
+		if len(rule) != 2 || rule[0] == "" {
+			return nil, fmt.Errorf("%w: %q is not mimetype=copies", ErrInvalidPolicy, part)
+		}
+		counts := strings.SplitN(rule[1], ":", 2)
+		copies, err := strconv.Atoi(counts[0])
+		if err != nil || copies < 1 {
+			return nil, fmt.Errorf("%w: %q is not a number of copies", ErrInvalidPolicy, part)
+		}
+		offBox := 0
+		if len(counts) == 2 {
+			offBox, err = strconv.Atoi(counts[1])
+			if err != nil || offBox < 0 || offBox > copies {
+				return nil, fmt.Errorf("%w: %q is not a number of off box copies", ErrInvalidPolicy, part)
+			}
+		}
+		policy = append(policy, ReplicationRule{MimeType: rule[0], Copies: copies, OffBox: offBox})
+	}
+	return policy, nil
+}
+
+// Rule returns the rule for the mime type, the one copy already stored if no rule
+// matches.
+func (rp ReplicationPolicy) Rule(mimeType string) ReplicationRule {
+	wildcard := mimeType
+	if slash := strings.Index(mimeType, "/"); slash >= 0 {
+		wildcard = mimeType[:slash] + "/*"
+	}
+
+	for _, match := range []string{mimeType, wildcard, "*"} {
+		for _, rule := range rp {
+			if rule.MimeType == match {
+				return rule
+			}
+		}
+	}
+	return ReplicationRule{MimeType: "*", Copies: 1}
+}
+
+// offBox reports whether the locator is somewhere other than the local machine.  Files
+// and the members of zip archives are on a local disk, as is anything from a source
+// that isn't known to be remote.
+func offBox(source string) bool {
+	switch source {
+	case SourceS3, SourceHTTP, SourceHTTPS:
+		return true
+	}
+	return false
+}
+
+// ReplicaTarget is a backend that copies of encodings can be made to.
+type ReplicaTarget interface {
+	// Source is the source of the locators the target makes.
+	Source() string
+	// Copy stores the data of the encoding, returning where the copy is.  It doesn't
+	// record the locator.
+	Copy(ctx context.Context, encoding Encoding) (Locator, error)
+}
+
+// FileSystemTarget copies encodings into a directory, such as a second disk, as
+// files named by their hash.
+type FileSystemTarget struct {
+	root string
+}
+
+func NewFileSystemTarget(root string) FileSystemTarget {
+	return FileSystemTarget{
+		root: root,
+	}
+}
+
+func (ft FileSystemTarget) Source() string {
+	return SourceFile
+}
+
+// Copy writes the data to root/ab/abcdef..., where abcdef... is the hash, checking
+// the hash as it's written.  The file only appears once it's complete.
+func (ft FileSystemTarget) Copy(ctx context.Context, encoding Encoding) (Locator, error) {
+	if len(encoding.Hash) < 2 {
+		return nil, fmt.Errorf("%w: encoding %d has no hash", ErrHashMismatch, encoding.ID)
+	}
+	stream, err := OpenEncodingContext(ctx, encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	l, err := ft.write(encoding.Hash, stream)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %d: %w", encoding.ID, err)
+	}
+	return l, nil
+}
+
+// Store writes generated content, named by its hash like a copy.
+func (ft FileSystemTarget) Store(ctx context.Context, hash, mimeType string, content []byte) (Locator, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("%w: no hash for the content", ErrHashMismatch)
+	}
+	return ft.write(hash, bytes.NewReader(content))
+}
+
+// write puts the data in the file named by the hash, failing if it doesn't match.
+func (ft FileSystemTarget) write(expected string, r io.Reader) (Locator, error) {
+	dir := filepath.Join(ft.root, strings.ToLower(expected[:2]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, ".copy-")
+	if err != nil {
+		return nil, err
+	}
+	partial := tempFile{f}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if err == nil {
+		if actual := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(actual, expected) {
+			err = fmt.Errorf("%w: expected %s but wrote %s", ErrHashMismatch, expected, actual)
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		partial.Close()
+		return nil, err
+	}
+
+	path := filepath.Join(dir, strings.ToLower(expected))
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return fileSystemLocator{Path: path}, nil
+}
+
+// ReplicationProgress is reported after each encoding the reconciler looks at.
+type ReplicationProgress struct {
+	EncodingID      int64
+	Checked         int
+	UnderReplicated int
+	Copied          int
+	Failed          int
+}
+
+// ReplicationFailure is an encoding that couldn't be brought up to its policy.
+type ReplicationFailure struct {
+	EncodingID int64
+	Err        error
+}
+
+// ReplicationResult is what a reconciliation did.
+type ReplicationResult struct {
+	ReplicationProgress
+	Failures []ReplicationFailure
+}
+
+// Replicator brings every encoding up to the number of copies its policy asks for,
+// copying the data to the targets.  The locators of the new copies of an encoding are
+// added in a single transaction, after the data has been copied.
+type Replicator struct {
+	db      DBCaller
+	policy  ReplicationPolicy
+	targets []ReplicaTarget
+	// progress, if set, is called after each encoding is looked at.
+	progress func(ReplicationProgress)
+}
+
+func NewReplicator(db DBCaller, policy ReplicationPolicy, targets ...ReplicaTarget) Replicator {
+	return Replicator{
+		db:      db,
+		policy:  policy,
+		targets: targets,
+	}
+}
+
+// WithProgress returns a replicator that reports its progress to the function.
+func (rp Replicator) WithProgress(progress func(ReplicationProgress)) Replicator {
+	rp.progress = progress
+	return rp
+}
+
+// Reconcile checks every encoding against the policy.  An encoding that can't be
+// replicated is recorded in the result and the reconciliation carries on.  It stops if
+// ctx is done.
+func (rp Replicator) Reconcile(ctx context.Context) (ReplicationResult, error) {
+	var result ReplicationResult
+	var lastID int64
+	for {
+		batch, err := rp.encodingBatch(ctx, lastID)
+		if err != nil {
+			return result, err
+		}
+
+		for _, encoding := range batch {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			lastID = encoding.ID
+
+			result.EncodingID = encoding.ID
+			result.Checked++
+			copied, needed, err := rp.replicate(ctx, encoding)
+			if needed {
+				result.UnderReplicated++
+			}
+			result.Copied += copied
+			if err != nil {
+				result.Failed++
+				result.Failures = append(result.Failures, ReplicationFailure{EncodingID: encoding.ID, Err: err})
+			}
+			if rp.progress != nil {
+				rp.progress(result.ReplicationProgress)
+			}
+		}
+
+		if len(batch) < replicateBatchSize {
+			return result, nil
+		}
+	}
+}
+
+// encodingBatch reads the next encodings with their locators.  Encodings without
+// locators are included, so a short batch means there are no more.
+func (rp Replicator) encodingBatch(ctx context.Context, afterID int64) ([]Encoding, error) {
+	rows, err := rp.db.Query(ctx, selectEncodingLocators, afterID, replicateBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []Encoding
+	for rows.Next() {
+		var encodingID int64
+		var hash, mimeType string
+		var source, path pgtype.Text
+		if err := rows.Scan(&encodingID, &hash, &mimeType, &source, &path); err != nil {
+			return nil, err
+		}
+
+		if len(batch) == 0 || batch[len(batch)-1].ID != encodingID {
+			batch = append(batch, Encoding{ID: encodingID, Hash: hash, MimeType: mimeType})
+		}
+		if source.Status == pgtype.Present && path.Status == pgtype.Present {
+			current := &batch[len(batch)-1]
+			current.Locator = append(current.Locator, resolveLocator(source.String, path.String))
+		}
+	}
+	return batch, rows.Err()
+}
+
+// replicate copies the encoding until it meets its rule, returning the number of
+// copies made and whether any were needed.  Each target is tried once.
+func (rp Replicator) replicate(ctx context.Context, encoding Encoding) (int, bool, error) {
+	if len(encoding.Locator) == 0 {
+		// Nothing is left to copy from.
+		return 0, true, fmt.Errorf("%w: encoding %d", ErrNoLocator, encoding.ID)
+	}
+
+	rule := rp.policy.Rule(encoding.MimeType)
+	copies, remote := len(encoding.Locator), 0
+	existing := map[locatorKey]bool{}
+	for _, l := range encoding.Locator {
+		path, _ := locatorPath(l)
+		existing[locatorKey{source: l.Source(), path: path}] = true
+		if offBox(l.Source()) {
+			remote++
+		}
+	}
+	if copies >= rule.Copies && remote >= rule.OffBox {
+		return 0, false, nil
+	}
+
+	var added []Locator
+	var err error
+	tried := make([]bool, len(rp.targets))
+	for copies < rule.Copies || remote < rule.OffBox {
+		target := rp.chooseTarget(tried, remote < rule.OffBox)
+		if target < 0 {
+			if err == nil {
+				err = fmt.Errorf("%w: encoding %d has %d of %d copies, %d of %d off box", ErrNoTarget,
+					encoding.ID, copies, rule.Copies, remote, rule.OffBox)
+			}
+			break
+		}
+		tried[target] = true
+
+		l, copyErr := rp.targets[target].Copy(ctx, encoding)
+		if copyErr != nil {
+			err = copyErr
+			continue
+		}
+		path, copyErr := locatorPath(l)
+		if copyErr != nil {
+			err = copyErr
+			continue
+		}
+		key := locatorKey{source: l.Source(), path: path}
+		if existing[key] {
+			// The target already held this copy.
+			continue
+		}
+		existing[key] = true
+
+		added = append(added, l)
+		copies++
+		if offBox(l.Source()) {
+			remote++
+		}
+	}
+	if copies >= rule.Copies && remote >= rule.OffBox {
+		// A target that failed was made up for by another.
+		err = nil
+	}
+
+	// The copies that were made are kept, even if the encoding is still short.
+	if len(added) > 0 {
+		if addErr := rp.addLocators(ctx, encoding.ID, added); addErr != nil {
+			return 0, true, addErr
+		}
+	}
+	return len(added), true, err
+}
+
+// chooseTarget picks the first target not yet tried, one off box if that's what's
+// needed, or -1 if there are none left.
+func (rp Replicator) chooseTarget(tried []bool, needOffBox bool) int {
+	for i, target := range rp.targets {
+		if tried[i] || (needOffBox && !offBox(target.Source())) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// addLocators records the copies of the encoding in one transaction.  A copy that is
+// already recorded, by a reconciliation running alongside, isn't added again.
+func (rp Replicator) addLocators(ctx context.Context, encodingID int64, locators []Locator) error {
+	tx, err := rp.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	dms := dbMetadataServer{db: tx}
+	for _, l := range locators {
+		path, err := locatorPath(l)
+		if err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+
+		var locatorID int64
+		err = tx.QueryRow(ctx, selectLocatorId, encodingID, l.Source(), path).Scan(&locatorID)
+		if err == pgx.ErrNoRows {
+			err = dms.createLocator(ctx, tx, encodingID, l)
+		}
+		if err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,248 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pashagolub/pgxmock"
+)
+
+// vaultTarget pretends to copy encodings off box, into an S3 compatible store.
+type vaultTarget struct {
+	copied *[]int64
+	err    error
+}
+
+func (vt vaultTarget) Source() string {
+	return SourceS3
+}
+
+func (vt vaultTarget) Copy(ctx context.Context, encoding Encoding) (Locator, error) {
+	if vt.err != nil {
+		return nil, vt.err
+	}
+	*vt.copied = append(*vt.copied, encoding.ID)
+	return unresolvedLocator{source: SourceS3, path: encoding.Hash}, nil
+}
+
+func TestParseReplicationPolicy(t *testing.T) {
+	policy, err := ParseReplicationPolicy("image/tiff=2:1, image/*=2,*=1")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the policy: %v", err)
+	}
+
+	expected := ReplicationPolicy{
+		{MimeType: "image/tiff", Copies: 2, OffBox: 1},
+		{MimeType: "image/*", Copies: 2},
+		{MimeType: "*", Copies: 1},
+	}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, policy)
+	}
+
+	for _, invalid := range []string{"image/tiff", "image/tiff=none", "image/tiff=0", "image/tiff=1:2", "=2"} {
+		if _, err := ParseReplicationPolicy(invalid); !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("Expected %q to be invalid but got %v", invalid, err)
+		}
+	}
+}
+
+func TestReplicationPolicy_Rule(t *testing.T) {
+	policy := ReplicationPolicy{
+		{MimeType: "*", Copies: 1},
+		{MimeType: "image/*", Copies: 2},
+		{MimeType: "image/tiff", Copies: 3, OffBox: 1},
+	}
+
+	for mimeType, copies := range map[string]int{"image/tiff": 3, "image/png": 2, "video/mp4": 1} {
+		if rule := policy.Rule(mimeType); rule.Copies != copies {
+			t.Errorf("Expected %s to need %d copies but got %+v", mimeType, copies, rule)
+		}
+	}
+
+	if rule := (ReplicationPolicy{}).Rule("image/png"); rule.Copies != 1 {
+		t.Errorf("Expected a single copy without a policy but got %+v", rule)
+	}
+}
+
+func TestFileSystemTarget_Copy(t *testing.T) {
+	source := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	root := t.TempDir()
+	hash := contentHash(pngHeader)
+
+	l, err := NewFileSystemTarget(root).Copy(context.Background(), Encoding{
+		ID:      7,
+		Locator: []Locator{fileSystemLocator{Path: source}},
+		Hash:    hash,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error copying: %v", err)
+	}
+
+	expected := filepath.Join(root, hash[:2], hash)
+	if path, _ := locatorPath(l); path != expected {
+		t.Errorf("Expected the copy at %s but got %s", expected, path)
+	}
+	if content, err := os.ReadFile(expected); err != nil || string(content) != string(pngHeader) {
+		t.Errorf("Expected the data to be copied but got %v", err)
+	}
+}
+
+func TestFileSystemTarget_CopyHashMismatch(t *testing.T) {
+	source := writeTestFile(t, t.TempDir(), "bar.png", pngHeader)
+	root := t.TempDir()
+
+	_, err := NewFileSystemTarget(root).Copy(context.Background(), Encoding{
+		ID:      7,
+		Locator: []Locator{fileSystemLocator{Path: source}},
+		Hash:    strings.Repeat("ab", 32),
+	})
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Expected a hash mismatch but got %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(root, "ab"))
+	if len(entries) != 0 {
+		t.Errorf("Expected the partial copy to be removed but found %d files", len(entries))
+	}
+}
+
+func TestOffBox(t *testing.T) {
+	for _, source := range []string{SourceS3, SourceHTTP, SourceHTTPS} {
+		if !offBox(source) {
+			t.Errorf("Expected %s to be off box", source)
+		}
+	}
+	for _, source := range []string{SourceFile, SourceZip, "tape"} {
+		if offBox(source) {
+			t.Errorf("Expected %s to be on box", source)
+		}
+	}
+}
+
+func TestReplicator_Reconcile(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	source := writeTestFile(t, t.TempDir(), "bar.tif", pngHeader)
+	root := t.TempDir()
+	hash := contentHash(pngHeader)
+	var copied []int64
+
+	caller.Conn.ExpectQuery(`SELECT encoding.id, encoding.file_hash, encoding.mime_type, locator.source, locator.path`).
+		WithArgs(int64(0), replicateBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "mime_type", "source", "path"}).
+			AddRow(int64(10), hash, MimeTIFF, SourceFile, source).
+			AddRow(int64(11), "ABCD", MimePNG, SourceFile, "/photos/bar.png"))
+	caller.Conn.ExpectQuery(`SELECT id FROM locator`).
+		WithArgs(int64(10), SourceS3, hash).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(10), SourceS3, hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(100)))
+	caller.Conn.ExpectQuery(`SELECT id FROM locator`).
+		WithArgs(int64(10), SourceFile, filepath.Join(root, hash[:2], hash)).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(10), SourceFile, filepath.Join(root, hash[:2], hash)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(101)))
+
+	policy := ReplicationPolicy{{MimeType: MimeTIFF, Copies: 3, OffBox: 1}}
+	var reported []ReplicationProgress
+	replicator := NewReplicator(caller, policy, NewFileSystemTarget(root), vaultTarget{copied: &copied}).
+		WithProgress(func(progress ReplicationProgress) {
+			reported = append(reported, progress)
+		})
+
+	result, err := replicator.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling: %v", err)
+	}
+
+	expected := ReplicationProgress{EncodingID: 11, Checked: 2, UnderReplicated: 1, Copied: 2}
+	if result.ReplicationProgress != expected || len(result.Failures) != 0 {
+		t.Errorf("Expected %+v but got %+v", expected, result)
+	}
+	if len(reported) != 2 || reported[0].EncodingID != 10 || reported[0].Copied != 2 {
+		t.Errorf("Expected progress after each encoding but got %+v", reported)
+	}
+	if !reflect.DeepEqual(copied, []int64{10}) {
+		t.Errorf("Expected only the tiff to be copied off box but got %v", copied)
+	}
+	if !caller.Committed {
+		t.Errorf("Expected the new locators to be committed")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestReplicator_ReconcileWithoutLocators(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	// A full batch where one encoding has lost its locators.
+	rows := pgxmock.NewRows([]string{"id", "file_hash", "mime_type", "source", "path"})
+	for id := int64(1); id <= replicateBatchSize; id++ {
+		if id == 5 {
+			rows.AddRow(id, "ABCD", MimePNG, nil, nil)
+			continue
+		}
+		rows.AddRow(id, "ABCD", MimePNG, SourceFile, "/photos/bar.png")
+	}
+	caller.Conn.ExpectQuery(`SELECT encoding.id`).
+		WithArgs(int64(0), replicateBatchSize).
+		WillReturnRows(rows)
+	caller.Conn.ExpectQuery(`SELECT encoding.id`).
+		WithArgs(int64(replicateBatchSize), replicateBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "mime_type", "source", "path"}).
+			AddRow(int64(replicateBatchSize+1), "EF01", MimePNG, SourceFile, "/photos/foo.png"))
+
+	result, err := NewReplicator(caller, ReplicationPolicy{}).Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling: %v", err)
+	}
+
+	if result.Checked != replicateBatchSize+1 {
+		t.Errorf("Expected the encodings after the batch to be checked but got %+v", result.ReplicationProgress)
+	}
+	if result.Failed != 1 || len(result.Failures) != 1 || result.Failures[0].EncodingID != 5 ||
+		!errors.Is(result.Failures[0].Err, ErrNoLocator) {
+		t.Errorf("Expected the encoding without locators to fail but got %+v", result)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestReplicator_ReconcileNoTarget(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	failed := errors.New("vault unavailable")
+	var copied []int64
+
+	caller.Conn.ExpectQuery(`SELECT encoding.id`).
+		WithArgs(int64(0), replicateBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "file_hash", "mime_type", "source", "path"}).
+			AddRow(int64(10), "ABCD", MimeTIFF, SourceFile, "/photos/bar.tif"))
+
+	policy := ReplicationPolicy{{MimeType: "*", Copies: 2, OffBox: 1}}
+	result, err := NewReplicator(caller, policy, vaultTarget{copied: &copied, err: failed}).Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling: %v", err)
+	}
+
+	if result.Failed != 1 || len(result.Failures) != 1 || !errors.Is(result.Failures[0].Err, failed) {
+		t.Errorf("Expected the encoding to fail with the target's error but got %+v", result)
+	}
+	if caller.Committed {
+		t.Errorf("Expected nothing to be committed without a copy")
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	EnvS3Endpoint  = "S3_ENDPOINT"
+	EnvS3Region    = "S3_REGION"
+	EnvS3AccessKey = "S3_ACCESS_KEY_ID"
+	EnvS3SecretKey = "S3_SECRET_ACCESS_KEY"
+
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3DateLayout      = "20060102"
+	s3TimestampLayout = "20060102T150405Z"
+	s3DefaultRegion   = "us-east-1"
+	// emptyPayloadHash is the SHA-256 of no bytes, the payload of a GET.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	ErrS3Request  = errors.New("s3 request failed")
+	ErrS3NotFound = fmt.Errorf("%w: not found", ErrS3Request)
+)
+
+// S3Config is how to reach an S3 compatible object store, such as AWS or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the store, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000.
+	Endpoint string
+	// Region is used to sign requests, defaulting to us-east-1.
+	Region    string
+	AccessKey string
+	SecretKey string
+	// VirtualHostStyle puts the bucket in the host name, bucket.s3.amazonaws.com,
+	// instead of the path.  Path style is what MinIO and most other stores expect.
+	VirtualHostStyle bool
+	// Client makes the requests, defaulting to http.DefaultClient.
+	Client *http.Client
+}
+
+// S3Client makes signed requests to an S3 compatible object store.
+type S3Client struct {
+	config S3Config
+	now    func() time.Time
+}
+
+func NewS3Client(config S3Config) (S3Client, error) {
+	if _, err := url.Parse(config.Endpoint); err != nil || config.Endpoint == "" {
+		return S3Client{}, fmt.Errorf("%w: endpoint %q is not a URL", ErrS3Request, config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return S3Client{
+		config: config,
+		now:    time.Now,
+	}, nil
+}
+
+// objectURL is where an object is found, in path or virtual host style.
+func (c S3Client) objectURL(bucket, key string) (*url.URL, error) {
+	u, err := url.Parse(c.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.VirtualHostStyle {
+		u.Host = bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+	return u, nil
+}
+
+// newRequest builds a request for an object.  It's signed by do.
+func (c S3Client) newRequest(ctx context.Context, method, bucket, key string, body io.Reader) (*http.Request, error) {
+	u, err := c.objectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and sends the request.  Anything but a 2xx, 304 or 416 status is
+// returned as an error.
+func (c S3Client) do(r *http.Request, payloadHash string) (*http.Response, error) {
+	signS3Request(r, c.config.AccessKey, c.config.SecretKey, c.config.Region, payloadHash, c.now())
+
+	response, err := c.config.Client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300,
+		response.StatusCode == http.StatusNotModified,
+		response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return response, nil
+	}
+
+	defer response.Body.Close()
+	failure := ErrS3Request
+	if response.StatusCode == http.StatusNotFound {
+		// NoSuchKey or NoSuchBucket.
+		failure = ErrS3NotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return nil, fmt.Errorf("%w: %s %s returned %s %s", failure, r.Method, r.URL.Path,
+		response.Status, strings.TrimSpace(string(message)))
+}
+
+// Get reads an object.  If rangeHeader is set, e.g. bytes=100-, only that part of
+// the object is returned.
+func (c S3Client) Get(ctx context.Context, bucket, key, rangeHeader string) (*http.Response, error) {
+	r, err := c.newRequest(ctx, http.MethodGet, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	return c.do(r, emptyPayloadHash)
+}
+
+// Stat returns the length of an object and when it was last modified.
+func (c S3Client) Stat(ctx context.Context, bucket, key string) (LocatorInfo, error) {
+	r, err := c.newRequest(ctx, http.MethodHead, bucket, key, nil)
+	if err != nil {
+		return LocatorInfo{}, err
+	}
+	response, err := c.do(r, emptyPayloadHash)
+	if err != nil {
+		return LocatorInfo{}, err
+	}
+	response.Body.Close()
+	return responseInfo(response), nil
+}
+
+// Put writes an object.  The size and SHA-256 of the body must be known up front,
+// as S3 needs both to accept it.
+func (c S3Client) Put(ctx context.Context, bucket, key string, body io.Reader, size int64, payloadHash, contentType string) error {
+	if size == 0 {
+		// Otherwise the body would be sent chunked, which S3 refuses.
+		body = http.NoBody
+	}
+	r, err := c.newRequest(ctx, http.MethodPut, bucket, key, body)
+	if err != nil {
+		return err
+	}
+	r.ContentLength = size
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := c.do(r, payloadHash)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// signS3Request adds the AWS signature version 4 headers to the request.  The
+// host, range and x-amz-* headers are signed.
+func signS3Request(r *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	timestamp := now.Format(s3TimestampLayout)
+	r.Header.Set("X-Amz-Date", timestamp)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": r.URL.Host}
+	for name, values := range r.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateLayout), region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, timestamp, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{now.Format(s3DateLayout), region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	var parts []string
+	for name, values := range query {
+		for _, value := range values {
+			parts = append(parts, s3EscapeQuery(name)+"="+s3EscapeQuery(value))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything but the unreserved characters and '/', as
+// the signature asks.
+func s3Escape(value string) string {
+	var result strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
+
+func s3EscapeQuery(value string) string {
+	return strings.ReplaceAll(s3Escape(value), "/", "%2F")
+}
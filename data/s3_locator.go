@@ -0,0 +1,206 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// SourceS3 is the source of a locator for an object in an S3 compatible store.
+	// Its path is the bucket and key, bucket/key.
+	SourceS3 = "s3"
+)
+
+var (
+	ErrInvalidS3Path = errors.New("s3 locator path must be bucket/key")
+	ErrHashMismatch  = errors.New("data does not match the hash of the encoding")
+)
+
+// RegisterS3Locator resolves stored s3 locators to objects reached through the client.
+func RegisterS3Locator(client S3Client) {
+	RegisterLocator(SourceS3, func(path string) (Locator, error) {
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidS3Path, path)
+		}
+		return s3Locator{client: client, bucket: parts[0], key: parts[1]}, nil
+	})
+}
+
+type s3Locator struct {
+	client S3Client
+	bucket string
+	key    string
+}
+
+func (sl s3Locator) Source() string {
+	return SourceS3
+}
+
+// Data streams the object.  The stream can seek, each seek starting a new ranged
+// GET from that offset, so only the parts that are read are transferred.
+func (sl s3Locator) Data() (io.ReadCloser, error) {
+	return sl.Open(context.Background())
+}
+
+func (sl s3Locator) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	get := func(ctx context.Context, rangeHeader string) (*http.Response, error) {
+		return sl.client.Get(ctx, sl.bucket, sl.key, rangeHeader)
+	}
+	return newRangeReader(ctx, get, sl.Stat), nil
+}
+
+func (sl s3Locator) Stat(ctx context.Context) (LocatorInfo, error) {
+	return sl.client.Stat(ctx, sl.bucket, sl.key)
+}
+
+func (sl s3Locator) URL() url.URL {
+	return url.URL{
+		Scheme: SourceS3,
+		Host:   sl.bucket,
+		Path:   "/" + sl.key,
+	}
+}
+
+func (sl s3Locator) StoredPath() string {
+	return sl.bucket + "/" + sl.key
+}
+
+// S3Uploader copies encodings into a bucket, recording each copy as another
+// locator of the encoding.
+type S3Uploader struct {
+	db     DBCaller
+	client S3Client
+	bucket string
+	// prefix is put in front of the key of every object, e.g. "media/".
+	prefix string
+}
+
+func NewS3Uploader(db DBCaller, client S3Client, bucket, prefix string) S3Uploader {
+	return S3Uploader{
+		db:     db,
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// Source is the source of the locators made by the uploader.
+func (su S3Uploader) Source() string {
+	return SourceS3
+}
+
+// Copy copies the data of the encoding into the bucket, keyed by its hash so the
+// same data is only stored once.  The data is read from the first locator of the
+// encoding that can be opened, and must match the hash of the encoding.
+func (su S3Uploader) Copy(ctx context.Context, encoding Encoding) (Locator, error) {
+	stream, err := OpenEncodingContext(ctx, encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	body, size, hash, err := spool(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if encoding.Hash != "" && !strings.EqualFold(encoding.Hash, hash) {
+		return nil, fmt.Errorf("%w: encoding %d", ErrHashMismatch, encoding.ID)
+	}
+
+	locator := s3Locator{client: su.client, bucket: su.bucket, key: su.prefix + hash}
+	if err := su.client.Put(ctx, su.bucket, locator.key, body, size, hash, encoding.MimeType); err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// Store puts generated content in the bucket, keyed by its hash like a copy.
+func (su S3Uploader) Store(ctx context.Context, hash, mimeType string, content []byte) (Locator, error) {
+	locator := s3Locator{client: su.client, bucket: su.bucket, key: su.prefix + hash}
+	err := su.client.Put(ctx, su.bucket, locator.key, bytes.NewReader(content), int64(len(content)), hash, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// Upload copies the data of the encoding into the bucket and records the copy as
+// another locator of the encoding.
+func (su S3Uploader) Upload(ctx context.Context, encoding Encoding) (Locator, error) {
+	locator, err := su.Copy(ctx, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := (dbMetadataServer{db: su.db}).createLocator(ctx, su.db, encoding.ID, locator); err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// spool makes the stream something that can be read twice, once to hash and once
+// to send, returning it with its size and SHA-256.  A stream that can't seek is
+// copied to a temporary file, removed again on Close.
+func spool(stream io.Reader) (io.ReadSeekCloser, int64, string, error) {
+	hash := sha256.New()
+
+	if seeker, ok := stream.(io.ReadSeeker); ok {
+		size, err := io.Copy(hash, seeker)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, "", err
+		}
+		return nopSeekCloser{seeker}, size, hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	f, err := os.CreateTemp("", "simple-upload-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	spooled := tempFile{f}
+	size, err := io.Copy(io.MultiWriter(f, hash), stream)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, "", err
+	}
+	return spooled, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// nopSeekCloser leaves closing the stream to its owner.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// tempFile is removed when it's closed.
+type tempFile struct {
+	*os.File
+}
+
+func (tf tempFile) Close() error {
+	err := tf.File.Close()
+	if removeErr := os.Remove(tf.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSize = errors.New("size of the data is not known")
+)
+
+// LocatorInfo describes the data at a location.
+type LocatorInfo struct {
+	Size int64
+	// ModTime is when the data was last changed, or zero if the location doesn't say.
+	ModTime time.Time
+}
+
+// SeekableLocator is a Locator that can be read from any offset, without reading the
+// data in front of it, and whose reads can be cancelled.
+type SeekableLocator interface {
+	Locator
+	// Open opens the data for reading and seeking.  The context covers every read
+	// made through the stream, not just opening it.
+	Open(ctx context.Context) (io.ReadSeekCloser, error)
+	// Stat describes the data without reading it.
+	Stat(ctx context.Context) (LocatorInfo, error)
+}
+
+// Seekable returns the locator as a SeekableLocator.  A locator that can't seek by
+// itself is adapted by copying its data to a temporary file when opened, so prefer
+// locators that implement SeekableLocator for large media.
+func Seekable(l Locator) SeekableLocator {
+	if seekable, ok := l.(SeekableLocator); ok {
+		return seekable
+	}
+	return seekableAdapter{l}
+}
+
+type seekableAdapter struct {
+	Locator
+}
+
+func (sa seekableAdapter) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stream, err := sa.Data()
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := stream.(io.ReadSeekCloser); ok {
+		return seeker, nil
+	}
+	defer stream.Close()
+
+	spooled, _, _, err := spool(stream)
+	return spooled, err
+}
+
+func (sa seekableAdapter) Stat(ctx context.Context) (LocatorInfo, error) {
+	stream, err := sa.Open(ctx)
+	if err != nil {
+		return LocatorInfo{}, err
+	}
+	defer stream.Close()
+
+	size, err := stream.Seek(0, io.SeekEnd)
+	return LocatorInfo{Size: size}, err
+}
+
+// OpenEncodingContext opens the data of the first locator of the encoding that can
+// be read, like OpenEncoding.  SeekableLocators are opened with Open, so the stream
+// can seek.  A VerifyingLocator checks the data against the hash of the encoding
+// whenever it is read whole, see verifyingSeeker.
+func OpenEncodingContext(ctx context.Context, encoding Encoding) (io.ReadCloser, error) {
+	err := ErrNoLocator
+	for _, l := range encoding.Locator {
+		var stream io.ReadCloser
+		if stream, err = openVerifiedLocator(ctx, l, encoding.Hash); err == nil {
+			return stream, nil
+		}
+		log.Printf("Warning - Unable to open %s locator for encoding %d: %v", l.Source(), encoding.ID, err)
+	}
+	return nil, err
+}
+
+// openVerifiedLocator opens the data at the locator like openLocator, checking it
+// against the expected hash if the locator is a VerifyingLocator.
+func openVerifiedLocator(ctx context.Context, l Locator, expected string) (io.ReadCloser, error) {
+	verifying, ok := l.(VerifyingLocator)
+	if !ok || expected == "" {
+		return openLocator(ctx, l)
+	}
+
+	seekable, ok := l.(SeekableLocator)
+	if !ok {
+		return verifying.VerifiedData(expected)
+	}
+	stream, err := seekable.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingSeeker(stream, expected), nil
+}
+
+// openLocator opens the data at the locator, with the context if it's a
+// SeekableLocator.
+func openLocator(ctx context.Context, l Locator) (io.ReadCloser, error) {
+	if seekable, ok := l.(SeekableLocator); ok {
+		return seekable.Open(ctx)
+	}
+	return l.Data()
+}
+
+// verifyingSeeker checks a stream against the hash of its encoding for as long as it
+// is read in order from the start, which includes seeking to the end to find the
+// size and back again first, as http.ServeContent does.  Reads anywhere else, such
+// as for a range, can't be checked and are passed through.  The read that completes
+// the data fails with ErrHashMismatch, and without its part of the data, if the data
+// doesn't hash to the encoding.
+type verifyingSeeker struct {
+	stream   io.ReadSeekCloser
+	hash     hash.Hash
+	expected string
+	// offset is the position of the stream and hashed is how much of the data from
+	// the start has been hashed.
+	offset int64
+	hashed int64
+	// size is the length of the data, or -1 until a seek from the end finds it.
+	size int64
+}
+
+func newVerifyingSeeker(stream io.ReadSeekCloser, expected string) *verifyingSeeker {
+	return &verifyingSeeker{
+		stream:   stream,
+		hash:     sha256.New(),
+		expected: expected,
+		size:     -1,
+	}
+}
+
+func (vs *verifyingSeeker) Read(p []byte) (int, error) {
+	n, err := vs.stream.Read(p)
+	if vs.offset == vs.hashed {
+		vs.hash.Write(p[:n])
+		vs.hashed += int64(n)
+		if err == io.EOF || vs.hashed == vs.size {
+			if mismatch := checkHash(vs.hash, vs.expected); mismatch != nil {
+				return 0, mismatch
+			}
+		}
+	}
+	vs.offset += int64(n)
+	return n, err
+}
+
+func (vs *verifyingSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := vs.stream.Seek(offset, whence)
+	if err != nil {
+		return position, err
+	}
+	if whence == io.SeekEnd {
+		vs.size = position - offset
+	}
+	vs.offset = position
+	return position, nil
+}
+
+func (vs *verifyingSeeker) Close() error {
+	return vs.stream.Close()
+}
+
+// NewReaderAt reads from any offset of the stream.  A stream that is already an
+// io.ReaderAt, such as a file, is returned as it is.  Otherwise reads are made by
+// seeking, one at a time, so the stream mustn't be used directly as well.
+func NewReaderAt(stream io.ReadSeeker) io.ReaderAt {
+	if readerAt, ok := stream.(io.ReaderAt); ok {
+		return readerAt
+	}
+	return &seekingReaderAt{stream: stream}
+}
+
+type seekingReaderAt struct {
+	lock   sync.Mutex
+	stream io.ReadSeeker
+}
+
+func (sr *seekingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if _, err := sr.stream.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(sr.stream, p)
+}
+
+// rangeReader reads remote data with ranged GETs.  The request isn't made until the
+// first read, so seeking straight after opening costs nothing, and each seek after
+// that starts a new request from the offset.
+type rangeReader struct {
+	ctx context.Context
+	// get requests the data with the Range header, e.g. bytes=100-.
+	get func(ctx context.Context, rangeHeader string) (*http.Response, error)
+	// stat is used to find the size when seeking from the end.
+	stat   func(ctx context.Context) (LocatorInfo, error)
+	offset int64
+	// size is the length of the data, or -1 until it's known.
+	size int64
+	body io.ReadCloser
+}
+
+func newRangeReader(ctx context.Context, get func(context.Context, string) (*http.Response, error),
+	stat func(context.Context) (LocatorInfo, error)) *rangeReader {
+	return &rangeReader{
+		ctx:  ctx,
+		get:  get,
+		stat: stat,
+		size: -1,
+	}
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	if rr.body == nil {
+		if rr.size >= 0 && rr.offset >= rr.size {
+			return 0, io.EOF
+		}
+		if err := rr.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rr.body.Read(p)
+	rr.offset += int64(n)
+	return n, err
+}
+
+// open starts a GET from the current offset, learning the size of the data from the
+// response.
+func (rr *rangeReader) open() error {
+	response, err := rr.get(rr.ctx, fmt.Sprintf("bytes=%d-", rr.offset))
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		response.Body.Close()
+		rr.body = io.NopCloser(strings.NewReader(""))
+		if total, ok := contentRangeSize(response.Header.Get("Content-Range")); ok {
+			rr.size = total
+		}
+		return nil
+	case http.StatusPartialContent:
+		if total, ok := contentRangeSize(response.Header.Get("Content-Range")); ok {
+			rr.size = total
+		}
+	default:
+		// The server ignored the range and sent all of the data.
+		rr.size = response.ContentLength
+		if rr.offset > 0 {
+			if _, err := io.CopyN(io.Discard, response.Body, rr.offset); err != nil {
+				response.Body.Close()
+				return err
+			}
+		}
+	}
+
+	rr.body = response.Body
+	return nil
+}
+
+// contentRangeSize reads the complete length from a Content-Range header, such
+// as bytes 0-99/1234 or bytes */1234.
+func contentRangeSize(header string) (int64, bool) {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(header[slash+1:], 10, 64)
+	return size, err == nil
+}
+
+func (rr *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.offset
+	case io.SeekEnd:
+		if rr.size < 0 {
+			info, err := rr.stat(rr.ctx)
+			if err != nil {
+				return rr.offset, err
+			}
+			if info.Size < 0 {
+				return rr.offset, ErrUnknownSize
+			}
+			rr.size = info.Size
+		}
+		offset += rr.size
+	}
+	if offset < 0 {
+		return rr.offset, errors.New("range reader: negative position")
+	}
+
+	if offset != rr.offset && rr.body != nil {
+		rr.body.Close()
+		rr.body = nil
+	}
+	rr.offset = offset
+	return offset, nil
+}
+
+func (rr *rangeReader) Close() error {
+	if rr.body == nil {
+		return nil
+	}
+	err := rr.body.Close()
+	rr.body = nil
+	return err
+}
+
+// responseInfo describes the data from the headers of a response.
+func responseInfo(response *http.Response) LocatorInfo {
+	info := LocatorInfo{Size: response.ContentLength}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modified
+	}
+	return info
+}
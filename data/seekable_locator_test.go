@@ -0,0 +1,235 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamLocator only offers its data as a stream that can't seek.
+type streamLocator struct {
+	content string
+}
+
+func (sl streamLocator) Source() string {
+	return "stream"
+}
+
+func (sl streamLocator) Data() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(sl.content)), nil
+}
+
+func (sl streamLocator) URL() url.URL {
+	return url.URL{Scheme: "stream"}
+}
+
+func readFrom(t *testing.T, stream io.ReadSeeker, offset int64, length int) string {
+	if _, err := stream.Seek(offset, io.SeekStart); err != nil {
+		t.Fatalf("Unexpected error seeking to %d: %v", offset, err)
+	}
+	part := make([]byte, length)
+	if _, err := io.ReadFull(stream, part); err != nil {
+		t.Fatalf("Unexpected error reading from %d: %v", offset, err)
+	}
+	return string(part)
+}
+
+func TestFileSystemLocator_Open(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "bar.jpg", []byte(testContent))
+	l := Seekable(fileSystemLocator{Path: path})
+
+	info, err := l.Stat(context.Background())
+	if err != nil || info.Size != int64(len(testContent)) || info.ModTime.IsZero() {
+		t.Errorf("Expected the size and modification time but got %+v, %v", info, err)
+	}
+
+	stream, err := l.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+
+	if part := readFrom(t, stream, 10, 5); part != "abcde" {
+		t.Errorf("Expected bytes 10 to 14 but got %s", part)
+	}
+}
+
+func TestFileSystemLocator_OpenCancelled(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "bar.jpg", []byte(testContent))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := (fileSystemLocator{Path: path}).Open(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the open to be cancelled but got %v", err)
+	}
+}
+
+func TestSeekable_Adapter(t *testing.T) {
+	l := Seekable(streamLocator{content: testContent})
+
+	info, err := l.Stat(context.Background())
+	if err != nil || info.Size != int64(len(testContent)) {
+		t.Errorf("Expected the size but got %+v, %v", info, err)
+	}
+
+	stream, err := l.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+
+	if part := readFrom(t, stream, 15, 5); part != "fghij" {
+		t.Errorf("Expected bytes 15 to 19 but got %s", part)
+	}
+	if part := readFrom(t, stream, 0, 3); part != "012" {
+		t.Errorf("Expected bytes 0 to 2 but got %s", part)
+	}
+}
+
+func TestNewReaderAt(t *testing.T) {
+	readerAt := NewReaderAt(strings.NewReader(testContent))
+	if _, ok := readerAt.(*strings.Reader); !ok {
+		t.Errorf("Expected a stream that can already read at an offset to be used as it is")
+	}
+
+	readerAt = NewReaderAt(&rangeReader{get: serveRange(testContent), size: -1})
+	part := make([]byte, 4)
+	if _, err := readerAt.ReadAt(part, 6); err != nil || string(part) != "6789" {
+		t.Errorf("Expected bytes 6 to 9 but got %s, %v", part, err)
+	}
+}
+
+// serveRange answers ranged GETs from the content.
+func serveRange(content string) func(context.Context, string) (*http.Response, error) {
+	return func(ctx context.Context, rangeHeader string) (*http.Response, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		return w.Result(), nil
+	}
+}
+
+func TestHTTPLocator_Open(t *testing.T) {
+	var ranges []string
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Date(2021, 10, 19, 12, 0, 0, 0, time.UTC), strings.NewReader(testContent))
+	})
+	seekable := l.(SeekableLocator)
+
+	info, err := seekable.Stat(context.Background())
+	if err != nil || info.Size != int64(len(testContent)) || !info.ModTime.Equal(time.Date(2021, 10, 19, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the size and modification time but got %+v, %v", info, err)
+	}
+
+	stream, err := seekable.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+
+	if part := readFrom(t, stream, 12, 3); part != "cde" {
+		t.Errorf("Expected bytes 12 to 14 but got %s", part)
+	}
+	if ranges[len(ranges)-1] != "bytes=12-" {
+		t.Errorf("Expected a ranged GET from 12 but got %v", ranges)
+	}
+}
+
+func TestHTTPLocator_OpenWithoutRanges(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testContent)
+	})
+
+	stream, err := l.(SeekableLocator).Open(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+
+	if part := readFrom(t, stream, 12, 3); part != "cde" {
+		t.Errorf("Expected bytes 12 to 14 but got %s", part)
+	}
+}
+
+func TestHTTPLocator_OpenCancelled(t *testing.T) {
+	l := newTestHTTPLocator(t, HTTPConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testContent)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := l.(SeekableLocator).Open(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+	cancel()
+
+	if _, err := io.ReadAll(stream); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the read to be cancelled but got %v", err)
+	}
+}
+
+func TestOpenEncodingContext(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "bar.jpg", []byte(testContent))
+	encoding := Encoding{Locator: []Locator{
+		unresolvedLocator{source: "tape", path: "bar", err: ErrUnknownLocatorSource},
+		fileSystemLocator{Path: path},
+	}}
+
+	stream, err := OpenEncodingContext(context.Background(), encoding)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer stream.Close()
+
+	if _, ok := stream.(io.ReadSeeker); !ok {
+		t.Errorf("Expected the file to be opened so it can seek")
+	}
+	content, _ := io.ReadAll(stream)
+	if !bytes.Equal(content, []byte(testContent)) {
+		t.Errorf("Expected the content of the file but got %s", content)
+	}
+}
+
+func TestVerifyingSeeker(t *testing.T) {
+	expected := contentHash([]byte(testContent))
+	tampered := strings.ToUpper(testContent)
+
+	dir := t.TempDir()
+	open := func(content string) *verifyingSeeker {
+		file, err := os.Open(writeTestFile(t, dir, "bar.jpg", []byte(content)))
+		if err != nil {
+			t.Fatalf("Unable to open test file: %v", err)
+		}
+		t.Cleanup(func() { file.Close() })
+		return newVerifyingSeeker(file, expected)
+	}
+
+	// Served whole after finding the size, as http.ServeContent does, stopping at the size.
+	stream := open(tampered)
+	size, _ := stream.Seek(0, io.SeekEnd)
+	_, _ = stream.Seek(0, io.SeekStart)
+	if _, err := io.CopyN(io.Discard, stream, size); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Expected a hash mismatch reading the tampered data whole but got %v", err)
+	}
+
+	stream = open(testContent)
+	if content, err := io.ReadAll(stream); err != nil || string(content) != testContent {
+		t.Errorf("Expected the data that matches to be read but got %s, %v", content, err)
+	}
+
+	// A range can't be checked, so it's passed through.
+	if part := readFrom(t, open(tampered), 10, 5); part != "ABCDE" {
+		t.Errorf("Expected bytes 10 to 14 but got %s", part)
+	}
+}
@@ -0,0 +1,295 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outcome of checking each locator is kept in the locator_verification table,
+// replaced each time the locator is checked again:
+//
+//	CREATE TABLE locator_verification (
+//		locator_id BIGINT PRIMARY KEY REFERENCES locator (id) ON DELETE CASCADE,
+//		status     VARCHAR(16) NOT NULL,
+//		detail     TEXT NOT NULL,
+//		verified   TIMESTAMP WITH TIME ZONE NOT NULL
+//	);
+const (
+	selectLocatorsToVerify = `SELECT locator.id, encoding.id, encoding.file_hash, locator.source, locator.path
+		FROM locator
+			INNER JOIN encoding on encoding.id = locator.encoding_id
+		WHERE locator.id > $1
+		ORDER BY locator.id
+		LIMIT $2`
+	upsertVerification = `INSERT INTO locator_verification (locator_id, status, detail, verified)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (locator_id) DO UPDATE
+			SET status = EXCLUDED.status, detail = EXCLUDED.detail, verified = EXCLUDED.verified`
+	selectVerifications = `SELECT locator.id, locator.encoding_id, locator.source, locator.path,
+			locator_verification.status, locator_verification.detail, locator_verification.verified
+		FROM locator_verification
+			INNER JOIN locator on locator.id = locator_verification.locator_id
+		WHERE cardinality($1::text[]) = 0 OR locator_verification.status = ANY($1)
+		ORDER BY locator.id`
+)
+
+// verifyBatchSize is how many locators are read from the database at a time.
+const verifyBatchSize = 500
+
+// VerificationStatus is what was found when the data at a locator was checked.
+type VerificationStatus string
+
+const (
+	// VerificationOK is data that matches the hash of its encoding.
+	VerificationOK VerificationStatus = "ok"
+	// VerificationMissing is data that is no longer there, such as a deleted file or
+	// a URL or object that isn't found.
+	VerificationMissing VerificationStatus = "missing"
+	// VerificationUnreadable is data that couldn't be read for any other reason, such
+	// as an unreachable server, a timeout or an error partway through, which says
+	// nothing about whether it's still there.
+	VerificationUnreadable VerificationStatus = "unreadable"
+	// VerificationCorrupt is data that no longer matches the hash of its encoding.
+	VerificationCorrupt VerificationStatus = "corrupt"
+)
+
+// Verification is the last check of a locator.  Detail explains a status other
+// than ok.
+type Verification struct {
+	LocatorID  int64
+	EncodingID int64
+	Source     string
+	Path       string
+	Status     VerificationStatus
+	Detail     string
+	Verified   time.Time
+}
+
+// VerifyResult counts the locators checked by Verify.
+type VerifyResult struct {
+	Checked    int
+	OK         int
+	Missing    int
+	Unreadable int
+	Corrupt    int
+}
+
+// Verifier rehashes the data at every locator, recording whether it still matches
+// the hash of its encoding.  Locators are checked concurrently, by a fixed number
+// of workers.
+type Verifier struct {
+	db      DBCaller
+	workers int
+	now     func() time.Time
+}
+
+func NewVerifier(db DBCaller, workers int) Verifier {
+	if workers < 1 {
+		workers = 1
+	}
+	return Verifier{
+		db:      db,
+		workers: workers,
+		now:     time.Now,
+	}
+}
+
+// verifyJob is a locator waiting to be checked against the hash of its encoding.
+type verifyJob struct {
+	locatorID  int64
+	encodingID int64
+	hash       string
+	locator    Locator
+}
+
+// Verify checks every locator, recording each outcome as it goes.  If ctx is done the
+// checks stop, and the locators already checked keep their new status.
+func (v Verifier) Verify(ctx context.Context) (VerifyResult, error) {
+	var result VerifyResult
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan verifyJob)
+	results := make(chan Verification)
+	var workers sync.WaitGroup
+	for i := 0; i < v.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				results <- v.check(ctx, job)
+			}
+		}()
+	}
+
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- v.listLocators(ctx, jobs)
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	var err error
+	for verification := range results {
+		if err != nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			// An interrupted check says nothing about the data.
+			err = ctx.Err()
+			continue
+		}
+		if err = v.record(ctx, verification); err != nil {
+			cancel()
+			continue
+		}
+
+		result.Checked++
+		switch verification.Status {
+		case VerificationOK:
+			result.OK++
+		case VerificationMissing:
+			result.Missing++
+		case VerificationUnreadable:
+			result.Unreadable++
+		case VerificationCorrupt:
+			result.Corrupt++
+		}
+	}
+
+	if listErr := <-listErr; err == nil {
+		err = listErr
+	}
+	if parent.Err() != nil {
+		// Whatever failed, it was because the verification was stopped.
+		err = parent.Err()
+	}
+	return result, err
+}
+
+// listLocators sends every stored locator to be checked, a batch at a time.
+func (v Verifier) listLocators(ctx context.Context, jobs chan<- verifyJob) error {
+	var lastID int64
+	for {
+		batch, err := v.locatorBatch(ctx, lastID)
+		if err != nil {
+			return err
+		}
+		for _, job := range batch {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			lastID = job.locatorID
+		}
+		if len(batch) < verifyBatchSize {
+			return nil
+		}
+	}
+}
+
+func (v Verifier) locatorBatch(ctx context.Context, afterID int64) ([]verifyJob, error) {
+	rows, err := v.db.Query(ctx, selectLocatorsToVerify, afterID, verifyBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []verifyJob
+	for rows.Next() {
+		var job verifyJob
+		var source, path string
+		if err := rows.Scan(&job.locatorID, &job.encodingID, &job.hash, &source, &path); err != nil {
+			return nil, err
+		}
+		job.locator = resolveLocator(source, path)
+		batch = append(batch, job)
+	}
+	return batch, rows.Err()
+}
+
+// check rehashes the data at the locator.
+func (v Verifier) check(ctx context.Context, job verifyJob) Verification {
+	path, _ := locatorPath(job.locator)
+	verification := Verification{
+		LocatorID:  job.locatorID,
+		EncodingID: job.encodingID,
+		Source:     job.locator.Source(),
+		Path:       path,
+		Status:     VerificationOK,
+	}
+
+	stream, err := openLocator(ctx, job.locator)
+	if err == nil {
+		hash := sha256.New()
+		_, err = io.Copy(hash, stream)
+		stream.Close()
+
+		if actual := hex.EncodeToString(hash.Sum(nil)); err == nil && !strings.EqualFold(actual, job.hash) {
+			verification.Status = VerificationCorrupt
+			verification.Detail = fmt.Sprintf("expected %s but read %s", job.hash, actual)
+		}
+	}
+	if err != nil {
+		verification.Status = VerificationUnreadable
+		if isNotFound(err) {
+			verification.Status = VerificationMissing
+		}
+		verification.Detail = err.Error()
+	}
+
+	verification.Verified = v.now().UTC()
+	return verification
+}
+
+// isNotFound reports whether the error says the data isn't there, rather than that it
+// couldn't be read.
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrHTTPNotFound) || errors.Is(err, ErrS3NotFound)
+}
+
+func (v Verifier) record(ctx context.Context, verification Verification) error {
+	_, err := v.db.Exec(ctx, upsertVerification, verification.LocatorID, string(verification.Status),
+		verification.Detail, verification.Verified)
+	return err
+}
+
+// Verifications returns the last check of each locator with one of the statuses,
+// or of every checked locator if no status is given.
+func (v Verifier) Verifications(ctx context.Context, statuses ...VerificationStatus) ([]Verification, error) {
+	filter := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		filter = append(filter, string(status))
+	}
+
+	rows, err := v.db.Query(ctx, selectVerifications, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Verification
+	for rows.Next() {
+		var verification Verification
+		var status string
+		err := rows.Scan(&verification.LocatorID, &verification.EncodingID, &verification.Source,
+			&verification.Path, &status, &verification.Detail, &verification.Verified)
+		if err != nil {
+			return nil, err
+		}
+		verification.Status = VerificationStatus(status)
+		result = append(result, verification)
+	}
+	return result, rows.Err()
+}
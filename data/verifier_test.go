@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+var verifyTime = time.Date(2021, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func newTestVerifier(db DBCaller, workers int) Verifier {
+	verifier := NewVerifier(db, workers)
+	verifier.now = func() time.Time {
+		return verifyTime
+	}
+	return verifier
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+	caller.Conn.MatchExpectationsInOrder(false)
+	dir := t.TempDir()
+	good := writeTestFile(t, dir, "good.png", pngHeader)
+	corrupt := writeTestFile(t, dir, "corrupt.png", []byte("bit rot"))
+	missing := filepath.Join(dir, "missing.png")
+	hash := contentHash(pngHeader)
+
+	caller.Conn.ExpectQuery(`SELECT locator.id, encoding.id, encoding.file_hash, locator.source, locator.path FROM locator`).
+		WithArgs(int64(0), verifyBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "id", "file_hash", "source", "path"}).
+			AddRow(int64(1), int64(10), hash, SourceFile, good).
+			AddRow(int64(2), int64(10), hash, SourceFile, corrupt).
+			AddRow(int64(3), int64(11), hash, SourceFile, missing).
+			AddRow(int64(4), int64(11), hash, "tape", "bar"))
+	caller.Conn.ExpectExec(`INSERT INTO locator_verification`).
+		WithArgs(int64(1), "ok", "", verifyTime).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	caller.Conn.ExpectExec(`INSERT INTO locator_verification`).
+		WithArgs(int64(2), "corrupt", "expected "+hash+" but read "+contentHash([]byte("bit rot")), verifyTime).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	caller.Conn.ExpectExec(`INSERT INTO locator_verification`).
+		WithArgs(int64(3), "missing", pgxmock.AnyArg(), verifyTime).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	caller.Conn.ExpectExec(`INSERT INTO locator_verification`).
+		WithArgs(int64(4), "unreadable", pgxmock.AnyArg(), verifyTime).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	result, err := newTestVerifier(caller, 2).Verify(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying: %v", err)
+	}
+
+	expected := VerifyResult{Checked: 4, OK: 1, Missing: 1, Unreadable: 1, Corrupt: 1}
+	if result != expected {
+		t.Errorf("Expected %+v but got %+v", expected, result)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestVerifier_VerifyCancelled(t *testing.T) {
+	caller, _ := createTestDBCaller()
+	good := writeTestFile(t, t.TempDir(), "good.png", pngHeader)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	caller.Conn.ExpectQuery(`SELECT locator.id`).
+		WithArgs(int64(0), verifyBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "id", "file_hash", "source", "path"}).
+			AddRow(int64(1), int64(10), contentHash(pngHeader), SourceFile, good))
+
+	result, err := newTestVerifier(caller, 1).Verify(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected the verification to be cancelled but got %v", err)
+	}
+	if result.Checked != 0 {
+		t.Errorf("Expected nothing to be recorded but got %+v", result)
+	}
+}
+
+func TestVerifier_Verifications(t *testing.T) {
+	caller, ctx := createTestDBCaller()
+
+	caller.Conn.ExpectQuery(`FROM locator_verification`).
+		WithArgs([]string{"missing", "corrupt"}).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "encoding_id", "source", "path", "status", "detail", "verified"}).
+			AddRow(int64(3), int64(11), SourceFile, "/photos/missing.png", "missing", "no such file", verifyTime))
+
+	found, err := newTestVerifier(caller, 1).Verifications(ctx, VerificationMissing, VerificationCorrupt)
+	if err != nil {
+		t.Fatalf("Unexpected error querying: %v", err)
+	}
+
+	expected := Verification{
+		LocatorID:  3,
+		EncodingID: 11,
+		Source:     SourceFile,
+		Path:       "/photos/missing.png",
+		Status:     VerificationMissing,
+		Detail:     "no such file",
+		Verified:   verifyTime,
+	}
+	if len(found) != 1 || found[0] != expected {
+		t.Errorf("Expected %+v but got %+v", expected, found)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestVerifier_CheckMissingFile(t *testing.T) {
+	verification := newTestVerifier(nil, 1).check(context.Background(), verifyJob{
+		locatorID: 1,
+		hash:      contentHash(pngHeader),
+		locator:   fileSystemLocator{Path: filepath.Join(t.TempDir(), "gone.png")},
+	})
+
+	if verification.Status != VerificationMissing || verification.Detail == "" {
+		t.Errorf("Expected a missing file but got %+v", verification)
+	}
+	if _, err := os.Stat(verification.Path); !os.IsNotExist(err) {
+		t.Errorf("Expected the path of the missing file but got %s", verification.Path)
+	}
+}
+
+func TestVerifier_CheckUnreadable(t *testing.T) {
+	// A directory opens but fails partway through the read.
+	verification := newTestVerifier(nil, 1).check(context.Background(), verifyJob{
+		locatorID: 1,
+		hash:      contentHash(pngHeader),
+		locator:   fileSystemLocator{Path: t.TempDir()},
+	})
+
+	if verification.Status != VerificationUnreadable || verification.Detail == "" {
+		t.Errorf("Expected data that can't be read to be unreadable but got %+v", verification)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	for _, err := range []error{os.ErrNotExist, fmt.Errorf("%w: GET /bar.jpg", ErrHTTPNotFound), ErrS3NotFound} {
+		if !isNotFound(err) {
+			t.Errorf("Expected %v to be not found", err)
+		}
+	}
+	for _, err := range []error{ErrHTTPRequest, ErrS3Request, context.DeadlineExceeded, io.ErrUnexpectedEOF} {
+		if isNotFound(err) {
+			t.Errorf("Expected %v not to be not found", err)
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+var (
+	ErrInvalidVideo = errors.New("invalid video container")
+)
+
+const (
+	// maxVideoHeader is the most read of any one box or element that is parsed,
+	// rather than skipped over.
+	maxVideoHeader = 1 << 16
+
+	ebmlHeader        = 0x1A45DFA3
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlTrackType     = 0x83
+	ebmlVideo         = 0xE0
+	ebmlPixelWidth    = 0xB0
+	ebmlPixelHeight   = 0xBA
+	ebmlInterlaced    = 0x9A
+	ebmlCluster       = 0x1F43B675
+
+	// matroskaVideoTrack is the TrackType of video.
+	matroskaVideoTrack = 1
+	// matroskaInterlaced is the FlagInterlaced of interlaced video.
+	matroskaInterlaced = 1
+	// defaultTimecodeScale is the nanoseconds in a Matroska tick when the
+	// file doesn't say.
+	defaultTimecodeScale = 1000000
+)
+
+// VideoInfo is what the container of a video says about it.
+type VideoInfo struct {
+	Runtime    time.Duration
+	Resolution Resolution
+}
+
+// isISOBMFF is true of the mime types held in ISO base media files: MP4, 3GPP
+// and QuickTime.
+func isISOBMFF(mimeType string) bool {
+	switch mimeType {
+	case MimeMP4, Mime3GPP, Mime3GPP2, MimeQuickTime:
+		return true
+	}
+	return false
+}
+
+// isMatroska is true of the mime types held in Matroska files, including WebM.
+func isMatroska(mimeType string) bool {
+	return mimeType == MimeWEBM || mimeType == MimeMatroska
+}
+
+// ProbeVideo reads the duration, frame size and scan of the first video track of an
+// MP4, 3GPP, QuickTime, WebM or Matroska file.  Only the headers are read, not the
+// media.  Any other mime type gives an empty VideoInfo.
+func ProbeVideo(path, mimeType string) (VideoInfo, error) {
+	if !isISOBMFF(mimeType) && !isMatroska(mimeType) {
+		return VideoInfo{}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return VideoInfo{}, err
+	}
+
+	if isMatroska(mimeType) {
+		return probeMatroska(f, info.Size())
+	}
+	return probeISOBMFF(f, info.Size())
+}
+
+// readPayload reads up to maxVideoHeader bytes starting at offset.
+func readPayload(r io.ReaderAt, offset, size int64) ([]byte, error) {
+	if size > maxVideoHeader {
+		size = maxVideoHeader
+	}
+	result := make([]byte, size)
+	if _, err := r.ReadAt(result, offset); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVideo, err)
+	}
+	return result, nil
+}
+
+// toDuration converts a count of ticks at timescale per second, without the
+// rounding of floating point.
+func toDuration(ticks, timescale uint64) time.Duration {
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(ticks/timescale)*time.Second +
+		time.Duration(ticks%timescale)*time.Second/time.Duration(timescale)
+}
+
+// mp4Box is a box of an ISO base media file, with the offset and size of its payload.
+type mp4Box struct {
+	kind   string
+	offset int64
+	size   int64
+}
+
+// readBoxes lists the boxes between offset and end.
+func readBoxes(r io.ReaderAt, offset, end int64) ([]mp4Box, error) {
+	var result []mp4Box
+	for offset+8 <= end {
+		var header [16]byte
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidVideo, err)
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The box runs to the end of the file.
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:], offset+8); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidVideo, err)
+			}
+			large := binary.BigEndian.Uint64(header[8:])
+			if large > math.MaxInt64 {
+				return nil, fmt.Errorf("%w: box of %d bytes", ErrInvalidVideo, large)
+			}
+			size = int64(large)
+			headerSize = 16
+		}
+		if size < headerSize || size > end-offset {
+			return nil, fmt.Errorf("%w: box %q of %d bytes at %d", ErrInvalidVideo, header[4:8], size, offset)
+		}
+
+		result = append(result, mp4Box{
+			kind:   string(header[4:8]),
+			offset: offset + headerSize,
+			size:   size - headerSize,
+		})
+		offset += size
+	}
+	return result, nil
+}
+
+func findBox(boxes []mp4Box, kind string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.kind == kind {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// findPath follows the path of box kinds down from the boxes given.
+func findPath(r io.ReaderAt, boxes []mp4Box, path ...string) (mp4Box, bool, error) {
+	var found mp4Box
+	for i, kind := range path {
+		var ok bool
+		if found, ok = findBox(boxes, kind); !ok {
+			return mp4Box{}, false, nil
+		}
+		if i == len(path)-1 {
+			break
+		}
+
+		var err error
+		if boxes, err = readBoxes(r, found.offset, found.offset+found.size); err != nil {
+			return mp4Box{}, false, err
+		}
+	}
+	return found, true, nil
+}
+
+// mediaDuration reads the timescale and duration of an mvhd or mdhd box, which
+// share a layout.  A duration of all ones is unknown.
+func mediaDuration(r io.ReaderAt, b mp4Box) (time.Duration, error) {
+	payload, err := readPayload(r, b.offset, b.size)
+	if err != nil {
+		return 0, err
+	}
+
+	var timescale, duration uint64
+	switch {
+	case len(payload) >= 32 && payload[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(payload[20:]))
+		duration = binary.BigEndian.Uint64(payload[24:])
+		if duration == math.MaxUint64 {
+			duration = 0
+		}
+	case len(payload) >= 20:
+		timescale = uint64(binary.BigEndian.Uint32(payload[12:]))
+		duration = uint64(binary.BigEndian.Uint32(payload[16:]))
+		if duration == math.MaxUint32 {
+			duration = 0
+		}
+	default:
+		return 0, fmt.Errorf("%w: %s of %d bytes", ErrInvalidVideo, b.kind, b.size)
+	}
+	return toDuration(duration, timescale), nil
+}
+
+// probeISOBMFF reads the movie header for the duration, and the first video track
+// for the frame size.  The presentation size in the track header is preferred over
+// the coded size in the sample description.  Interlacing is taken from the fiel box
+// of the sample description, since that is the only place the container records it.
+func probeISOBMFF(r io.ReaderAt, size int64) (VideoInfo, error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return VideoInfo{}, fmt.Errorf("%w: no movie box", ErrInvalidVideo)
+	}
+	movie, err := readBoxes(r, moov.offset, moov.offset+moov.size)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+
+	var result VideoInfo
+	if mvhd, ok := findBox(movie, "mvhd"); ok {
+		if result.Runtime, err = mediaDuration(r, mvhd); err != nil {
+			return VideoInfo{}, err
+		}
+	}
+	if result.Runtime == 0 {
+		// A fragmented file may only give its duration in the movie extends header.
+		mehd, ok, err := findPath(r, movie, "mvex", "mehd")
+		if err != nil {
+			return VideoInfo{}, err
+		}
+		if ok {
+			result.Runtime, err = fragmentDuration(r, mehd, movie)
+			if err != nil {
+				return VideoInfo{}, err
+			}
+		}
+	}
+
+	for _, trak := range movie {
+		if trak.kind != "trak" {
+			continue
+		}
+		track, err := readBoxes(r, trak.offset, trak.offset+trak.size)
+		if err != nil {
+			return VideoInfo{}, err
+		}
+		resolution, runtime, ok, err := videoTrack(r, track)
+		if err != nil {
+			return VideoInfo{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		result.Resolution = resolution
+		if result.Runtime == 0 {
+			result.Runtime = runtime
+		}
+		break
+	}
+	return result, nil
+}
+
+// fragmentDuration reads the mehd box, which counts in the timescale of the movie header.
+func fragmentDuration(r io.ReaderAt, mehd mp4Box, movie []mp4Box) (time.Duration, error) {
+	mvhd, ok := findBox(movie, "mvhd")
+	if !ok {
+		return 0, nil
+	}
+	header, err := readPayload(r, mvhd.offset, mvhd.size)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := readPayload(r, mehd.offset, mehd.size)
+	if err != nil {
+		return 0, err
+	}
+
+	var timescale, duration uint64
+	if len(header) >= 24 && header[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(header[20:]))
+	} else if len(header) >= 16 {
+		timescale = uint64(binary.BigEndian.Uint32(header[12:]))
+	}
+	if len(payload) >= 12 && payload[0] == 1 {
+		duration = binary.BigEndian.Uint64(payload[4:])
+	} else if len(payload) >= 8 {
+		duration = uint64(binary.BigEndian.Uint32(payload[4:]))
+	}
+	return toDuration(duration, timescale), nil
+}
+
+// videoTrack reads the resolution and duration of a track, reporting false if it
+// isn't video.
+func videoTrack(r io.ReaderAt, track []mp4Box) (Resolution, time.Duration, bool, error) {
+	mdia, ok := findBox(track, "mdia")
+	if !ok {
+		return Resolution{}, 0, false, nil
+	}
+	media, err := readBoxes(r, mdia.offset, mdia.offset+mdia.size)
+	if err != nil {
+		return Resolution{}, 0, false, err
+	}
+	hdlr, ok := findBox(media, "hdlr")
+	if !ok {
+		return Resolution{}, 0, false, nil
+	}
+	handler, err := readPayload(r, hdlr.offset, hdlr.size)
+	if err != nil {
+		return Resolution{}, 0, false, err
+	}
+	if len(handler) < 12 || string(handler[8:12]) != "vide" {
+		return Resolution{}, 0, false, nil
+	}
+
+	var runtime time.Duration
+	if mdhd, ok := findBox(media, "mdhd"); ok {
+		if runtime, err = mediaDuration(r, mdhd); err != nil {
+			return Resolution{}, 0, false, err
+		}
+	}
+
+	resolution := Resolution{Scan: 'P'}
+	if tkhd, ok := findBox(track, "tkhd"); ok {
+		header, err := readPayload(r, tkhd.offset, tkhd.size)
+		if err != nil {
+			return Resolution{}, 0, false, err
+		}
+		// The size is 16.16 fixed point at the end of the header.
+		at := 76
+		if len(header) > 0 && header[0] == 1 {
+			at = 88
+		}
+		if len(header) >= at+8 {
+			resolution.Width = int(binary.BigEndian.Uint32(header[at:]) >> 16)
+			resolution.Height = int(binary.BigEndian.Uint32(header[at+4:]) >> 16)
+		}
+	}
+
+	stsd, ok, err := findPath(r, media, "minf", "stbl", "stsd")
+	if err != nil {
+		return Resolution{}, 0, false, err
+	}
+	if ok && stsd.size > 8 {
+		// The sample entries follow the version, flags and entry count.
+		entries, err := readBoxes(r, stsd.offset+8, stsd.offset+stsd.size)
+		if err != nil {
+			return Resolution{}, 0, false, err
+		}
+		if len(entries) > 0 {
+			if err := sampleEntry(r, entries[0], &resolution); err != nil {
+				return Resolution{}, 0, false, err
+			}
+		}
+	}
+	return resolution, runtime, true, nil
+}
+
+// sampleEntry reads the coded size and field count of a visual sample entry.  The
+// coded size is only used when the track header didn't give one.
+func sampleEntry(r io.ReaderAt, entry mp4Box, resolution *Resolution) error {
+	// The boxes within a visual sample entry start after its 78 bytes of fields.
+	const visualFields = 78
+	if entry.size < visualFields {
+		return nil
+	}
+	fields, err := readPayload(r, entry.offset, visualFields)
+	if err != nil {
+		return err
+	}
+	if resolution.Width == 0 || resolution.Height == 0 {
+		resolution.Width = int(binary.BigEndian.Uint16(fields[24:]))
+		resolution.Height = int(binary.BigEndian.Uint16(fields[26:]))
+	}
+
+	children, err := readBoxes(r, entry.offset+visualFields, entry.offset+entry.size)
+	if err != nil {
+		return err
+	}
+	if fiel, ok := findBox(children, "fiel"); ok && fiel.size >= 1 {
+		count, err := readPayload(r, fiel.offset, 1)
+		if err != nil {
+			return err
+		}
+		if count[0] == 2 {
+			resolution.Scan = 'I'
+		}
+	}
+	return nil
+}
+
+// ebmlElement is an element of a Matroska file, with the offset and size of its
+// payload.  An element of unknown size runs to the end of its parent.
+type ebmlElement struct {
+	id     uint32
+	offset int64
+	size   int64
+}
+
+// readVint reads an EBML variable length integer, returning it with the marker bit
+// kept, its length, and whether every value bit was set.
+func readVint(r io.ReaderAt, offset int64) (uint64, int, bool, error) {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:1], offset); err != nil {
+		return 0, 0, false, fmt.Errorf("%w: %v", ErrInvalidVideo, err)
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, false, fmt.Errorf("%w: variable length integer at %d", ErrInvalidVideo, offset)
+	}
+	if length > 1 {
+		if _, err := r.ReadAt(b[1:length], offset+1); err != nil {
+			return 0, 0, false, fmt.Errorf("%w: %v", ErrInvalidVideo, err)
+		}
+	}
+
+	var value uint64
+	for _, c := range b[:length] {
+		value = value<<8 | uint64(c)
+	}
+	marker := uint64(1) << (7 * length)
+	allOnes := value == marker|(marker-1)
+	return value, length, allOnes, nil
+}
+
+// walkElements calls visit with each element between offset and end, until visit
+// returns false.
+func walkElements(r io.ReaderAt, offset, end int64, visit func(ebmlElement) (bool, error)) error {
+	for offset < end {
+		id, idLength, _, err := readVint(r, offset)
+		if err != nil {
+			return err
+		}
+		if idLength > 4 {
+			return fmt.Errorf("%w: element id at %d", ErrInvalidVideo, offset)
+		}
+		size, sizeLength, unknown, err := readVint(r, offset+int64(idLength))
+		if err != nil {
+			return err
+		}
+
+		element := ebmlElement{id: uint32(id), offset: offset + int64(idLength+sizeLength)}
+		size &^= uint64(1) << (7 * sizeLength)
+		if unknown {
+			element.size = end - element.offset
+		} else if size > uint64(end-element.offset) {
+			return fmt.Errorf("%w: element %x of %d bytes at %d", ErrInvalidVideo, id, size, offset)
+		} else {
+			element.size = int64(size)
+		}
+
+		more, err := visit(element)
+		if err != nil || !more {
+			return err
+		}
+		offset = element.offset + element.size
+	}
+	return nil
+}
+
+func readUnsigned(r io.ReaderAt, element ebmlElement) (uint64, error) {
+	if element.size > 8 {
+		return 0, fmt.Errorf("%w: integer of %d bytes", ErrInvalidVideo, element.size)
+	}
+	payload, err := readPayload(r, element.offset, element.size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, c := range payload {
+		value = value<<8 | uint64(c)
+	}
+	return value, nil
+}
+
+func readFloat(r io.ReaderAt, element ebmlElement) (float64, error) {
+	payload, err := readPayload(r, element.offset, element.size)
+	if err != nil {
+		return 0, err
+	}
+	switch len(payload) {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), nil
+	}
+	return 0, fmt.Errorf("%w: float of %d bytes", ErrInvalidVideo, len(payload))
+}
+
+// probeMatroska reads the segment info for the duration and the first video track
+// entry for the frame size and interlacing.  Both come before the clusters in any
+// file written for playback, so the walk stops at the first cluster.
+func probeMatroska(r io.ReaderAt, size int64) (VideoInfo, error) {
+	var segment *ebmlElement
+	first := true
+	err := walkElements(r, 0, size, func(element ebmlElement) (bool, error) {
+		if first && element.id != ebmlHeader {
+			return false, fmt.Errorf("%w: no EBML header", ErrInvalidVideo)
+		}
+		first = false
+		if element.id == ebmlSegment {
+			segment = &element
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	if segment == nil {
+		return VideoInfo{}, fmt.Errorf("%w: no segment", ErrInvalidVideo)
+	}
+
+	var result VideoInfo
+	var foundInfo, foundTracks bool
+	err = walkElements(r, segment.offset, segment.offset+segment.size, func(element ebmlElement) (bool, error) {
+		var err error
+		switch element.id {
+		case ebmlInfo:
+			foundInfo = true
+			result.Runtime, err = matroskaDuration(r, element)
+		case ebmlTracks:
+			foundTracks = true
+			result.Resolution, err = matroskaVideo(r, element)
+		case ebmlCluster:
+			return false, nil
+		}
+		return err == nil && !(foundInfo && foundTracks), err
+	})
+	return result, err
+}
+
+// matroskaDuration reads the duration from the segment info, which counts in ticks
+// of the timecode scale.
+func matroskaDuration(r io.ReaderAt, info ebmlElement) (time.Duration, error) {
+	scale := uint64(defaultTimecodeScale)
+	var duration float64
+	err := walkElements(r, info.offset, info.offset+info.size, func(element ebmlElement) (bool, error) {
+		var err error
+		switch element.id {
+		case ebmlTimecodeScale:
+			scale, err = readUnsigned(r, element)
+		case ebmlDuration:
+			duration, err = readFloat(r, element)
+		}
+		return true, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(duration * float64(scale)), nil
+}
+
+// matroskaVideo reads the resolution of the first video track entry.
+func matroskaVideo(r io.ReaderAt, tracks ebmlElement) (Resolution, error) {
+	var result Resolution
+	err := walkElements(r, tracks.offset, tracks.offset+tracks.size, func(entry ebmlElement) (bool, error) {
+		if entry.id != ebmlTrackEntry {
+			return true, nil
+		}
+
+		var trackType uint64
+		resolution := Resolution{Scan: 'P'}
+		err := walkElements(r, entry.offset, entry.offset+entry.size, func(element ebmlElement) (bool, error) {
+			var err error
+			switch element.id {
+			case ebmlTrackType:
+				trackType, err = readUnsigned(r, element)
+			case ebmlVideo:
+				err = matroskaVideoSettings(r, element, &resolution)
+			}
+			return true, err
+		})
+		if err != nil {
+			return false, err
+		}
+		if trackType != matroskaVideoTrack {
+			return true, nil
+		}
+		result = resolution
+		return false, nil
+	})
+	return result, err
+}
+
+// matroskaVideoSettings reads the frame size and interlacing of a video track.
+func matroskaVideoSettings(r io.ReaderAt, video ebmlElement, resolution *Resolution) error {
+	return walkElements(r, video.offset, video.offset+video.size, func(setting ebmlElement) (bool, error) {
+		if setting.id != ebmlPixelWidth && setting.id != ebmlPixelHeight && setting.id != ebmlInterlaced {
+			return true, nil
+		}
+		value, err := readUnsigned(r, setting)
+		switch setting.id {
+		case ebmlPixelWidth:
+			resolution.Width = int(value)
+		case ebmlPixelHeight:
+			resolution.Height = int(value)
+		case ebmlInterlaced:
+			if value == matroskaInterlaced {
+				resolution.Scan = 'I'
+			}
+		}
+		return true, err
+	})
+}
@@ -0,0 +1,226 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pashagolub/pgxmock"
+)
+
+func mp4Atom(kind string, payload ...[]byte) []byte {
+	content := bytes.Join(payload, nil)
+	result := make([]byte, 8, 8+len(content))
+	binary.BigEndian.PutUint32(result, uint32(8+len(content)))
+	copy(result[4:], kind)
+	return append(result, content...)
+}
+
+func be32(values ...uint32) []byte {
+	result := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(result[4*i:], value)
+	}
+	return result
+}
+
+// movieHeader is a version 0 mvhd or mdhd payload.
+func movieHeader(timescale, duration uint32) []byte {
+	return append(be32(0, 0, 0, timescale, duration), make([]byte, 80)...)
+}
+
+func trackHeader(width, height uint32) []byte {
+	header := make([]byte, 84)
+	binary.BigEndian.PutUint32(header[76:], width<<16)
+	binary.BigEndian.PutUint32(header[80:], height<<16)
+	return header
+}
+
+func mp4Handler(kind string) []byte {
+	return append(append(be32(0, 0), kind...), make([]byte, 13)...)
+}
+
+// sampleDescription is an stsd with a single visual sample entry, and a fiel box
+// when fields is given.
+func sampleDescription(width, height uint16, fields byte) []byte {
+	entry := make([]byte, 78)
+	binary.BigEndian.PutUint16(entry[24:], width)
+	binary.BigEndian.PutUint16(entry[26:], height)
+	if fields > 0 {
+		entry = append(entry, mp4Atom("fiel", []byte{fields, 6})...)
+	}
+	return append(be32(0, 1), mp4Atom("avc1", entry)...)
+}
+
+func mp4Track(kind string, header, stsd []byte) []byte {
+	return mp4Atom("trak",
+		mp4Atom("tkhd", header),
+		mp4Atom("mdia",
+			mp4Atom("mdhd", movieHeader(1000, 0)),
+			mp4Atom("hdlr", mp4Handler(kind)),
+			mp4Atom("minf", mp4Atom("stbl", mp4Atom("stsd", stsd)))))
+}
+
+func testMP4(mvhd []byte, tracks ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		mp4Atom("ftyp", []byte("mp42\x00\x00\x00\x00mp42isom")),
+		mp4Atom("moov", append([][]byte{mp4Atom("mvhd", mvhd)}, tracks...)...),
+		mp4Atom("mdat", make([]byte, 32)),
+	}, nil)
+}
+
+func TestProbeISOBMFF(t *testing.T) {
+	content := testMP4(movieHeader(600, 7530),
+		mp4Track("soun", make([]byte, 84), be32(0, 0)),
+		mp4Track("vide", trackHeader(1920, 1080), sampleDescription(1920, 1088, 0)))
+
+	info, err := probeISOBMFF(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Unexpected error probing: %v", err)
+	}
+
+	expected := VideoInfo{Runtime: 12550 * time.Millisecond, Resolution: Resolution{Width: 1920, Height: 1080, Scan: 'P'}}
+	if info != expected {
+		t.Errorf("Expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestProbeISOBMFF_Interlaced(t *testing.T) {
+	// A version 1 header, with 64 bit times, and no size in the track header.
+	mvhd := append(append([]byte{1, 0, 0, 0}, make([]byte, 16)...), be32(25, 0, 250)...)
+	content := testMP4(mvhd, mp4Track("vide", make([]byte, 84), sampleDescription(720, 576, 2)))
+
+	info, err := probeISOBMFF(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Unexpected error probing: %v", err)
+	}
+
+	expected := VideoInfo{Runtime: 10 * time.Second, Resolution: Resolution{Width: 720, Height: 576, Scan: 'I'}}
+	if info != expected {
+		t.Errorf("Expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestProbeISOBMFF_Invalid(t *testing.T) {
+	for name, content := range map[string][]byte{
+		"no movie":  mp4Atom("ftyp", []byte("mp42")),
+		"truncated": testMP4(movieHeader(600, 7530))[:40],
+	} {
+		if _, err := probeISOBMFF(bytes.NewReader(content), int64(len(content))); !errors.Is(err, ErrInvalidVideo) {
+			t.Errorf("Expected %s to be invalid but got %v", name, err)
+		}
+	}
+}
+
+func ebml(id uint32, payload ...[]byte) []byte {
+	var result []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(result) > 0 {
+			result = append(result, b)
+		}
+	}
+	content := bytes.Join(payload, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(content)))
+	size[0] = 0x01
+	return append(append(result, size...), content...)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, value)
+	return ebml(id, payload)
+}
+
+func testMatroska(segment []byte) []byte {
+	return append(ebml(ebmlHeader, ebml(0x4282, []byte("webm"))), segment...)
+}
+
+func TestProbeMatroska(t *testing.T) {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(12345))
+	content := testMatroska(ebml(ebmlSegment,
+		ebml(ebmlInfo, ebmlUint(ebmlTimecodeScale, 1000000), ebml(ebmlDuration, duration)),
+		ebml(ebmlTracks,
+			ebml(ebmlTrackEntry, ebmlUint(ebmlTrackType, 2)),
+			ebml(ebmlTrackEntry, ebmlUint(ebmlTrackType, matroskaVideoTrack),
+				ebml(ebmlVideo, ebmlUint(ebmlPixelWidth, 1920), ebmlUint(ebmlPixelHeight, 1080),
+					ebmlUint(ebmlInterlaced, matroskaInterlaced)))),
+		ebml(ebmlCluster, make([]byte, 64))))
+
+	info, err := probeMatroska(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Unexpected error probing: %v", err)
+	}
+
+	expected := VideoInfo{Runtime: 12345 * time.Millisecond, Resolution: Resolution{Width: 1920, Height: 1080, Scan: 'I'}}
+	if info != expected {
+		t.Errorf("Expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestProbeMatroska_UnknownSize(t *testing.T) {
+	duration := make([]byte, 4)
+	binary.BigEndian.PutUint32(duration, math.Float32bits(2500))
+	segment := ebml(ebmlSegment,
+		ebml(ebmlTracks, ebml(ebmlTrackEntry, ebmlUint(ebmlTrackType, matroskaVideoTrack),
+			ebml(ebmlVideo, ebmlUint(ebmlPixelWidth, 640), ebmlUint(ebmlPixelHeight, 360)))),
+		ebml(ebmlInfo, ebmlUint(ebmlTimecodeScale, 1000), ebml(ebmlDuration, duration)))
+	// A live stream doesn't know how long its segment is.
+	copy(segment[4:], []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	content := testMatroska(segment)
+
+	info, err := probeMatroska(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Unexpected error probing: %v", err)
+	}
+
+	expected := VideoInfo{Runtime: 2500 * time.Microsecond, Resolution: Resolution{Width: 640, Height: 360, Scan: 'P'}}
+	if info != expected {
+		t.Errorf("Expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestProbeMatroska_Invalid(t *testing.T) {
+	content := ebml(ebmlSegment, ebml(ebmlInfo))
+	if _, err := probeMatroska(bytes.NewReader(content), int64(len(content))); !errors.Is(err, ErrInvalidVideo) {
+		t.Errorf("Expected a file without an EBML header to be invalid but got %v", err)
+	}
+}
+
+func TestIngester_IngestVideo(t *testing.T) {
+	content := testMP4(movieHeader(1000, 4000), mp4Track("vide", trackHeader(1280, 720), sampleDescription(1280, 720, 0)))
+	caller, ctx := createTestDBCaller()
+	path := writeTestFile(t, t.TempDir(), "clip.mp4", content)
+	hash := contentHash(content)
+
+	caller.Conn.ExpectQuery(`SELECT id, file_hash, size, modified FROM all_files`).
+		WithArgs(path).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO all_files`).
+		WithArgs(path, hash, "clip.mp4", int64(len(content)), testFileModified(t, path)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(1)))
+	caller.Conn.ExpectQuery(`SELECT id FROM encoding`).
+		WithArgs(hash).
+		WillReturnError(pgx.ErrNoRows)
+	caller.Conn.ExpectQuery(`INSERT INTO metadata`).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(2)))
+	caller.Conn.ExpectQuery(`INSERT INTO encoding`).
+		WithArgs(int64(2), 4*time.Second, 1280, 720, "P", MimeMP4, hash).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	caller.Conn.ExpectQuery(`INSERT INTO locator`).
+		WithArgs(int64(3), pgxmock.AnyArg(), path).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(4)))
+
+	if _, err := NewIngester(caller).IngestFile(ctx, path); err != nil {
+		t.Fatalf("Unexpected error ingesting file: %v", err)
+	}
+
+	if err := caller.Conn.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/darcinc/Simple/data"
@@ -16,6 +17,12 @@ type Source struct {
 	// filesystem image would file:///some/path/to/image.jpg and
 	// an API might be https://foo.bar.com/images?id=1234&format=jpeg
 	Location url.URL
+	// Kind is the kind of storage the location is in, the source of
+	// its locator.  For example file or s3.
+	Kind string
+	// EncodingID is the encoding the image data belongs to.  It is
+	// what the data is published under, rather than the location.
+	EncodingID int64
 	// Resolution gives the width and the height of the encoded image
 	Resolution data.Resolution
 
@@ -30,7 +37,8 @@ type Source struct {
 // another copy as a JPEG in AWS.  And I have a thumbnail in an API, and
 // they all reference the same image.
 type Image struct {
-	id int64
+	// ID is the metadata the image was found from.
+	ID int64
 	// Date is the time the original image was captured or created.
 	// This is not the same as the file time.  It is
 	// possible that the other representations were created
@@ -43,13 +51,19 @@ type Image struct {
 	Subjects []string
 	// Location indicates where the image was taken, in a
 	// human read-able context.  It could be an address or
-	// place name like 'home'.  Features such as the
-	// latitude or longitude the image was taken would be
-	// in an extended image data section.
+	// place name like 'home'.  The latitude and longitude
+	// the image was taken at are in Coordinates.
 	Location string
+	// Coordinates are where on the earth the image was
+	// taken, if it was recorded.
+	Coordinates *data.Coordinates
 	// Description is the human readable information about
 	// the image.
 	Description string
+	// Snippet is the part of the description that matched a
+	// text search, with the matching words between
+	// data.HighlightStart and data.HighlightStop.
+	Snippet string
 	// Sources are the various resource that can contain the
 	// image data.  For example, I can take an image and
 	// store it in its original JPEG format but also save a
@@ -71,6 +85,21 @@ type QueryParameters struct {
 	Subjects []string
 	// Locations represents a list of OR'd together locations.
 	Locations []string
+	// MimeTypes limits the search to images with an encoding
+	// in one of the mime types, e.g. image/jpeg.
+	MimeTypes []string
+	// Sort is the order of the images, such as by date.
+	Sort data.SortOrder
+	// Text is searched for in the descriptions, subjects and
+	// locations of the images, e.g. "red boat" -sea.
+	Text string
+	// Near and Within limit the search to images taken in an
+	// area, by their coordinates.
+	Near   *data.Radius
+	Within *data.Box
+	// Match is a further condition the images must meet, such as
+	// data.Or(data.Location("home"), data.Location("work")).
+	Match data.Expression
 }
 
 // ImageRepository allows the user to query for images and open
@@ -91,9 +120,61 @@ func NewImageRepository(server data.MetadataServer) ImageRepository {
 	}
 }
 
+// metadataQuery maps the query parameters onto the data layer's query.
+func (qp QueryParameters) metadataQuery() data.MetadataQuery {
+	return data.MetadataQuery{
+		Tags:      qp.Subjects,
+		StartDate: qp.FromDate,
+		EndDate:   qp.ToDate,
+		LocatedAt: qp.Locations,
+		MimeType:  qp.MimeTypes,
+		Sort:      qp.Sort,
+		Text:      qp.Text,
+		Near:      qp.Near,
+		Within:    qp.Within,
+		Match:     qp.Match,
+	}
+}
+
+// describe returns the stored description of the image, or builds one from what
+// is known about it, e.g. "boat, man at home on March 20, 2021".
+func describe(metadata data.Metadata) string {
+	if metadata.Description != "" {
+		return metadata.Description
+	}
+
+	var parts []string
+	if len(metadata.Tags) > 0 {
+		parts = append(parts, strings.Join(metadata.Tags, ", "))
+	}
+	if metadata.Location != "" {
+		parts = append(parts, "at "+metadata.Location)
+	}
+	if !metadata.Date.IsZero() {
+		parts = append(parts, "on "+metadata.Date.Format("January 2, 2006"))
+	}
+	return strings.Join(parts, " ")
+}
+
+// sources returns a source for every copy of every encoding of the image.
+func sources(metadata data.Metadata) []Source {
+	var result []Source
+	for _, encoding := range metadata.Data {
+		for _, locator := range encoding.Locator {
+			result = append(result, Source{
+				Location:   locator.URL(),
+				Kind:       locator.Source(),
+				EncodingID: encoding.ID,
+				Resolution: encoding.Resolution,
+				Encoding:   data.MimeType(encoding.MimeType),
+			})
+		}
+	}
+	return result
+}
+
 func (dir dataImageRepository) Find(ctx context.Context, qp QueryParameters) ([]Image, error) {
-	mq := data.MetadataQuery{}
-	metadata, err := dir.metadataServer.Find(ctx, mq)
+	metadata, err := dir.metadataServer.Find(ctx, qp.metadataQuery())
 	if err != nil {
 		return nil, err
 	}
@@ -102,15 +183,14 @@ func (dir dataImageRepository) Find(ctx context.Context, qp QueryParameters) ([]
 
 	for i := range metadata {
 		result[i] = Image{
-			id:       metadata[i].ID,
-			Subjects: metadata[i].Tags,
-			Date:     metadata[i].Date,
-			Location: metadata[i].Location,
-		}
-
-		result[i].Sources = make([]Source, len(metadata[i].Data))
-		for _ = range metadata[i].Data {
-			//result[i].Sources[l] = Source{Name: "foo"}
+			ID:          metadata[i].ID,
+			Subjects:    metadata[i].Tags,
+			Date:        metadata[i].Date,
+			Location:    metadata[i].Location,
+			Coordinates: metadata[i].Coordinates,
+			Description: describe(metadata[i]),
+			Snippet:     metadata[i].Snippet,
+			Sources:     sources(metadata[i]),
 		}
 	}
 
@@ -2,6 +2,9 @@ package model
 
 import (
 	"context"
+	"io"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,12 +15,23 @@ type mockMetadataServer struct {
 	results     []data.Metadata
 	single      *data.Metadata
 	returnError error
+	lastQuery   *data.MetadataQuery
 }
 
-func (mms mockMetadataServer) Find(_ context.Context, _ data.MetadataQuery) ([]data.Metadata, error) {
+func (mms mockMetadataServer) Find(_ context.Context, query data.MetadataQuery) ([]data.Metadata, error) {
+	if mms.lastQuery != nil {
+		*mms.lastQuery = query
+	}
 	return mms.results, mms.returnError
 }
 
+func (mms mockMetadataServer) FindPage(_ context.Context, query data.MetadataQuery, _ data.PageRequest) (data.MetadataPage, error) {
+	if mms.lastQuery != nil {
+		*mms.lastQuery = query
+	}
+	return data.MetadataPage{Metadata: mms.results}, mms.returnError
+}
+
 func (mms mockMetadataServer) FindById(_ context.Context, _ int64) (*data.Metadata, error) {
 	return mms.single, mms.returnError
 }
@@ -78,3 +92,152 @@ func TestDataImageRepository_Find(t *testing.T) {
 	}
 
 }
+
+type mockLocator struct {
+	location string
+}
+
+func (ml mockLocator) Source() string {
+	return "file"
+}
+
+func (ml mockLocator) Data() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (ml mockLocator) URL() url.URL {
+	return url.URL{Scheme: "file", Path: ml.location}
+}
+
+func TestDataImageRepository_FindQueryParameters(t *testing.T) {
+	var query data.MetadataQuery
+	ir := NewImageRepository(mockMetadataServer{lastQuery: &query})
+
+	from := time.Date(2021, 03, 20, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, 04, 20, 0, 0, 0, 0, time.UTC)
+	qp := QueryParameters{
+		FromDate:  from,
+		ToDate:    to,
+		Subjects:  []string{"boat", "man"},
+		Locations: []string{"home", "work"},
+		MimeTypes: []string{data.MimeJPEG},
+		Near:      &data.Radius{Latitude: 50.82, Longitude: -0.14, Meters: 500},
+	}
+
+	if _, err := ir.Find(context.Background(), qp); err != nil {
+		t.Fatalf("Find method returned an error: %v", err)
+	}
+
+	if !query.StartDate.Equal(from) || !query.EndDate.Equal(to) {
+		t.Errorf("Expected %v to %v but got %v to %v", from, to, query.StartDate, query.EndDate)
+	}
+
+	if len(query.Tags) != 2 || query.Tags[0] != "boat" || query.Tags[1] != "man" {
+		t.Errorf("Expected tags boat and man but got %v", query.Tags)
+	}
+
+	if len(query.LocatedAt) != 2 || query.LocatedAt[0] != "home" || query.LocatedAt[1] != "work" {
+		t.Errorf("Expected locations home and work but got %v", query.LocatedAt)
+	}
+
+	if len(query.MimeType) != 1 || query.MimeType[0] != data.MimeJPEG {
+		t.Errorf("Expected mime type image/jpeg but got %v", query.MimeType)
+	}
+
+	if query.Near == nil || query.Near.Meters != 500 || query.Within != nil {
+		t.Errorf("Expected to search within 500 metres but got %v, %v", query.Near, query.Within)
+	}
+}
+
+func TestDataImageRepository_FindSources(t *testing.T) {
+	ir := NewImageRepository(mockMetadataServer{
+		results: []data.Metadata{
+			{
+				ID:          1,
+				Date:        time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC),
+				Location:    "home",
+				Tags:        []string{"boat", "man"},
+				Coordinates: &data.Coordinates{Latitude: 50.82, Longitude: -0.14},
+				Data: []data.Encoding{
+					{
+						ID:         7,
+						Resolution: data.Resolution{Width: 1920, Height: 1080, Scan: 'P'},
+						MimeType:   data.MimeJPEG,
+						Locator:    []data.Locator{mockLocator{"/foo/bar.jpg"}, mockLocator{"/baz/bar.jpg"}},
+					},
+					{
+						ID:         8,
+						Resolution: data.Resolution{Width: 4096, Height: 2160, Scan: 'P'},
+						MimeType:   data.MimeTIFF,
+						Locator:    []data.Locator{mockLocator{"/archive/bar.tiff"}},
+					},
+				},
+			},
+		},
+	})
+
+	images, err := ir.Find(context.Background(), QueryParameters{})
+	if err != nil {
+		t.Fatalf("Find method returned an error: %v", err)
+	}
+
+	if len(images) != 1 {
+		t.Fatalf("Expected 1 image but got %d", len(images))
+	}
+
+	image := images[0]
+	if len(image.Sources) != 3 {
+		t.Fatalf("Expected 3 sources but got %d", len(image.Sources))
+	}
+
+	if image.Sources[0].Location.String() != "file:///foo/bar.jpg" || image.Sources[0].Encoding != data.MimeJPEG {
+		t.Errorf("Expected a JPEG at file:///foo/bar.jpg but got %s at %s",
+			image.Sources[0].Encoding, image.Sources[0].Location.String())
+	}
+
+	if image.ID != 1 || image.Sources[1].EncodingID != 7 || image.Sources[2].EncodingID != 8 || image.Sources[0].Kind != "file" {
+		t.Errorf("Expected the ids of the metadata and encodings but got %d, %d and %d",
+			image.ID, image.Sources[1].EncodingID, image.Sources[2].EncodingID)
+	}
+
+	if image.Sources[2].Location.String() != "file:///archive/bar.tiff" || image.Sources[2].Resolution.Width != 4096 {
+		t.Errorf("Expected a 4096 wide TIFF at file:///archive/bar.tiff but got %d wide at %s",
+			image.Sources[2].Resolution.Width, image.Sources[2].Location.String())
+	}
+
+	if image.Coordinates == nil || image.Coordinates.Latitude != 50.82 {
+		t.Errorf("Expected the coordinates of the image but got %v", image.Coordinates)
+	}
+
+	if image.Description != "boat, man at home on March 20, 2021" {
+		t.Errorf("Expected a description but got '%s'", image.Description)
+	}
+}
+
+func TestDataImageRepository_FindText(t *testing.T) {
+	var query data.MetadataQuery
+	ir := NewImageRepository(mockMetadataServer{
+		lastQuery: &query,
+		results: []data.Metadata{
+			{
+				ID:          1,
+				Tags:        []string{"boat"},
+				Description: "A red boat in the harbour",
+				Snippet:     "A red " + data.HighlightStart + "boat" + data.HighlightStop + " in the harbour",
+			},
+		},
+	})
+
+	images, err := ir.Find(context.Background(), QueryParameters{Text: "boat"})
+	if err != nil {
+		t.Fatalf("Find method returned an error: %v", err)
+	}
+
+	if query.Text != "boat" {
+		t.Errorf("Expected the text to be searched for but got '%s'", query.Text)
+	}
+
+	if len(images) != 1 || images[0].Description != "A red boat in the harbour" || images[0].Snippet == "" {
+		t.Errorf("Expected the stored description and snippet but got %+v", images)
+	}
+}
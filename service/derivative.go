@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/reflex"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Deriver makes smaller versions of the images of metadata, such as thumbnails.
+// data.DerivativeGenerator is the usual one.
+type Deriver interface {
+	Size(name string) (data.DerivativeSize, error)
+	Derivative(ctx context.Context, metadataID int64, size data.DerivativeSize) (data.Encoding, error)
+}
+
+// DerivativeHandler serves GET /derivative/{id}?size=name, where id is the published
+// identifier of metadata.  The derivative is generated the first time it's asked for
+// and then served like any other media.  Without a size the thumbnail is served.
+type DerivativeHandler struct {
+	ErrorPage *template.Template
+}
+
+func (dh DerivativeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusMethodNotAllowed, "Media can only be read")
+		return
+	}
+
+	found, ok := reflex.GlobalReflex().Get("derivativeGenerator")
+	deriver, isDeriver := found.(Deriver)
+	if !ok || !isDeriver {
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusNotFound, "Derivatives are not available")
+		return
+	}
+
+	name := r.URL.Query().Get("size")
+	if name == "" {
+		name = "thumbnail"
+	}
+	size, err := deriver.Size(name)
+	if err != nil {
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusNotFound, "There is no derivative of that size")
+		return
+	}
+
+	result, ok := lookup(w, r, DerivativePrefix, dh.ErrorPage)
+	if !ok {
+		return
+	}
+	metadata, ok := result.Found.(data.Metadata)
+	if !ok {
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusNotFound, "This permalink does not refer to an image")
+		return
+	}
+
+	encoding, err := deriver.Derivative(r.Context(), metadata.ID, size)
+	switch {
+	case errors.Is(err, data.ErrNotDerivable):
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusNotFound, "This permalink does not refer to an image")
+		return
+	case err != nil:
+		log.Printf("Error - Unable to make the %s derivative of metadata %d: %v", size.Name, metadata.ID, err)
+		writeErrorPage(w, r, dh.ErrorPage, http.StatusBadGateway, "The image could not be rendered")
+		return
+	}
+
+	serveEncoding(w, r, encoding, dh.ErrorPage)
+}
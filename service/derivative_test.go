@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/reflex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testDerivative = "/derivative/dcbaaaa-aaaedcbM"
+
+type mockDeriver struct {
+	encoding data.Encoding
+	err      error
+	asked    *data.DerivativeSize
+}
+
+func (md mockDeriver) Size(name string) (data.DerivativeSize, error) {
+	for _, size := range data.DefaultDerivativeSizes {
+		if size.Name == name {
+			return size, nil
+		}
+	}
+	return data.DerivativeSize{}, data.ErrUnknownDerivative
+}
+
+func (md mockDeriver) Derivative(_ context.Context, _ int64, size data.DerivativeSize) (data.Encoding, error) {
+	if md.asked != nil {
+		*md.asked = size
+	}
+	return md.encoding, md.err
+}
+
+func registerDeriver(deriver Deriver) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{Found: data.Metadata{ID: 1}, OfType: data.EntityMetadata},
+	})
+	reflex.GlobalReflex().Register("derivativeGenerator", deriver)
+}
+
+func TestDerivativeHandler(t *testing.T) {
+	var asked data.DerivativeSize
+	registerDeriver(mockDeriver{
+		encoding: data.Encoding{
+			ID:       3,
+			Locator:  []data.Locator{mockLocator{content: testContent, seekable: true}},
+			MimeType: data.MimeJPEG,
+			Hash:     "45678901",
+		},
+		asked: &asked,
+	})
+	handler := DerivativeHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testDerivative, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if asked.Name != "thumbnail" {
+		t.Errorf("Expected the thumbnail by default but got %s", asked.Name)
+	}
+
+	if w.Body.String() != testContent {
+		t.Errorf("Expected the content of the derivative but got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != data.MimeJPEG {
+		t.Errorf("Expected the mime type of the derivative but got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestDerivativeHandler_UnknownSize(t *testing.T) {
+	registerDeriver(mockDeriver{})
+	handler := DerivativeHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testDerivative+"?size=poster", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 but got %d", w.Code)
+	}
+}
+
+func TestDerivativeHandler_NotDerivable(t *testing.T) {
+	registerDeriver(mockDeriver{err: data.ErrNotDerivable})
+	handler := DerivativeHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testDerivative+"?size=preview", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 but got %d", w.Code)
+	}
+}
+
+func TestDerivativeHandler_Unavailable(t *testing.T) {
+	registerDeriver(mockDeriver{})
+	reflex.GlobalReflex().Register("derivativeGenerator", func(dm reflex.Reflex) (interface{}, bool) {
+		return nil, false
+	})
+	handler := DerivativeHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testDerivative, nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 but got %d", w.Code)
+	}
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/reflex"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	PermalinkPrefix  = "/image/"
+	MediaPrefix      = "/media/"
+	DerivativePrefix = "/derivative/"
+)
+
+// FileListing is the catalogue returned by GET /files, a page at a time.
+type FileListing struct {
+	Metadata []MetadataResult `json:"metadata"`
+	// Next is the cursor of the following page, or empty on the last page.
+	Next string `json:"next,omitempty"`
+	// Total is the number of metadata across every page, when asked for with total=true.
+	Total *int64 `json:"total,omitempty"`
+}
+
+// MetadataResult is the outside view of a data.Metadata.
+type MetadataResult struct {
+	Permalink string    `json:"permalink,omitempty"`
+	Date      time.Time `json:"date"`
+	// DateEstimated is set when the date is a guess, such as the time the file was modified.
+	DateEstimated bool             `json:"dateEstimated,omitempty"`
+	Location      string           `json:"location"`
+	Tags          []string         `json:"tags"`
+	Encodings     []EncodingResult `json:"encodings"`
+	Description   string           `json:"description,omitempty"`
+	// Coordinates are where the media was captured, if it was recorded.
+	Coordinates *CoordinatesResult `json:"coordinates,omitempty"`
+	// Snippet is the part of the description that matched the text searched for.
+	Snippet template.HTML `json:"snippet,omitempty"`
+}
+
+// EncodingResult is the outside view of a data.Encoding.
+type EncodingResult struct {
+	Permalink string          `json:"permalink,omitempty"`
+	Media     string          `json:"media,omitempty"`
+	Runtime   string          `json:"runtime,omitempty"`
+	Width     int             `json:"width"`
+	Height    int             `json:"height"`
+	Scan      string          `json:"scan"`
+	MimeType  string          `json:"mimeType"`
+	Locators  []LocatorResult `json:"locators"`
+}
+
+// LocatorResult is the outside view of a data.Locator.  Only the kind of storage is
+// given, the data itself is reached through the permalink of the encoding.
+type LocatorResult struct {
+	Source string `json:"source"`
+}
+
+// permalinks holds the published identifiers, keyed by entity type and id.
+type permalinks map[string]map[int64]string
+
+// link returns the path of the permalink for an entity, if it has one.
+func (p permalinks) link(entityType string, id int64) string {
+	return p.path(PermalinkPrefix, entityType, id)
+}
+
+// media returns the path the bytes of an encoding are served from, if it has a permalink.
+func (p permalinks) media(id int64) string {
+	return p.path(MediaPrefix, data.EntityEncoding, id)
+}
+
+// derivative returns the path smaller renderings of metadata are served from, if it
+// has a permalink.
+func (p permalinks) derivative(id int64) string {
+	return p.path(DerivativePrefix, data.EntityMetadata, id)
+}
+
+func (p permalinks) path(prefix string, entityType string, id int64) string {
+	identifier, ok := p[entityType][id]
+	if !ok {
+		return ""
+	}
+	return prefix + identifier
+}
+
+// publish finds or creates the permalinks for every metadata and encoding given.
+func publish(ctx context.Context, publisher data.PublishedEntityService, metadata []data.Metadata) (permalinks, error) {
+	var names []string
+	var ids []int64
+	for _, m := range metadata {
+		names = append(names, data.EntityMetadata)
+		ids = append(ids, m.ID)
+		for _, e := range m.Data {
+			names = append(names, data.EntityEncoding)
+			ids = append(ids, e.ID)
+		}
+	}
+	return publishEntities(ctx, publisher, names, ids)
+}
+
+func publishEntities(ctx context.Context, publisher data.PublishedEntityService, names []string, ids []int64) (permalinks, error) {
+	result := permalinks{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	entities, err := publisher.FindOrCreateAll(ctx, names, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range entities {
+		if _, ok := result[entity.Type]; !ok {
+			result[entity.Type] = make(map[int64]string)
+		}
+		result[entity.Type][entity.RelatedId] = entity.PublishedIdentifier
+	}
+
+	return result, nil
+}
+
+func encodingResult(encoding data.Encoding, links permalinks) EncodingResult {
+	result := EncodingResult{
+		Permalink: links.link(data.EntityEncoding, encoding.ID),
+		Media:     links.media(encoding.ID),
+		Width:     encoding.Resolution.Width,
+		Height:    encoding.Resolution.Height,
+		Scan:      scanName(encoding.Resolution.Scan),
+		MimeType:  encoding.MimeType,
+		Locators:  []LocatorResult{},
+	}
+	if encoding.Runtime > 0 {
+		result.Runtime = encoding.Runtime.String()
+	}
+	for _, locator := range encoding.Locator {
+		result.Locators = append(result.Locators, LocatorResult{Source: locator.Source()})
+	}
+	return result
+}
+
+func metadataResult(metadata data.Metadata, links permalinks) MetadataResult {
+	result := MetadataResult{
+		Permalink:     links.link(data.EntityMetadata, metadata.ID),
+		Date:          metadata.Date,
+		DateEstimated: metadata.DateEstimated,
+		Location:      metadata.Location,
+		Tags:          metadata.Tags,
+		Description:   metadata.Description,
+		Coordinates:   coordinatesResult(metadata.Coordinates),
+		Snippet:       highlight(metadata.Snippet),
+		Encodings:     []EncodingResult{},
+	}
+	for _, encoding := range metadata.Data {
+		result.Encodings = append(result.Encodings, encodingResult(encoding, links))
+	}
+	return result
+}
+
+// FilesHandler serves GET /files, the catalogue of metadata along with its encodings and
+// locators.  It takes the same query parameters as the image search, and is paged with
+// cursor, limit and total.  Every metadata and encoding is given a permalink, if it
+// doesn't already have one.
+type FilesHandler struct {
+	ErrorPage *template.Template
+	// Timeout bounds how long the listing can run, defaulting to 15 seconds.
+	Timeout time.Duration
+}
+
+func (fh FilesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	theReflex := reflex.GlobalReflex()
+	metadataService, ok := theReflex.MustGet("metadataService").(data.MetadataServer)
+	if !ok {
+		log.Printf("Error - metadataService is not a data.MetadataServer")
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusInternalServerError, "The file listing is not available")
+		return
+	}
+	publisher, ok := theReflex.MustGet("publishedEntityService").(data.PublishedEntityService)
+	if !ok {
+		log.Printf("Error - publishedEntityService is not a data.PublishedEntityService")
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusInternalServerError, "The file listing is not available")
+		return
+	}
+
+	isr, err := ParseImageSearchRequest(r)
+	if err != nil {
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := ParsePageRequest(r)
+	if err != nil {
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	timeout := fh.Timeout
+	if timeout <= 0 {
+		timeout = defaultSearchTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	found, err := metadataService.FindPage(ctx, data.MetadataQuery{
+		Tags:      isr.Subjects,
+		StartDate: isr.From,
+		EndDate:   isr.To,
+		LocatedAt: isr.Locations,
+		MimeType:  isr.MimeTypes,
+		Sort:      data.SortOrder(isr.Sort),
+		Text:      isr.Text,
+		Near:      isr.Near,
+		Within:    isr.Within,
+		Match:     isr.Match,
+	}, page)
+	if errors.Is(err, data.ErrInvalidCursor) {
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusBadRequest, "The cursor is not valid")
+		return
+	}
+	if err != nil {
+		fh.fail(w, r, err)
+		return
+	}
+
+	links, err := publish(ctx, publisher, found.Metadata)
+	if err != nil {
+		fh.fail(w, r, err)
+		return
+	}
+
+	listing := FileListing{
+		Metadata: []MetadataResult{},
+		Next:     found.NextCursor,
+		Total:    found.Total,
+	}
+	for _, m := range found.Metadata {
+		listing.Metadata = append(listing.Metadata, metadataResult(m, links))
+	}
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// ParsePageRequest pulls the page out of the query string: the cursor of the page,
+// the limit of results in it, and total=true to count every result.
+func ParsePageRequest(r *http.Request) (data.PageRequest, error) {
+	query := r.URL.Query()
+	page := data.PageRequest{Cursor: query.Get("cursor")}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return data.PageRequest{}, fmt.Errorf("%w: limit %q is not a positive number", ErrBadSearchRequest, limit)
+		}
+		page.Limit = n
+	}
+
+	if total := query.Get("total"); total != "" {
+		withTotal, err := strconv.ParseBool(total)
+		if err != nil {
+			return data.PageRequest{}, fmt.Errorf("%w: total %q is not true or false", ErrBadSearchRequest, total)
+		}
+		page.WithTotal = withTotal
+	}
+
+	return page, nil
+}
+
+func (fh FilesHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Error - File listing timed out: %v", err)
+		writeErrorPage(w, r, fh.ErrorPage, http.StatusGatewayTimeout, "The file listing took too long")
+		return
+	}
+	log.Printf("Error - File listing failed: %v", err)
+	writeErrorPage(w, r, fh.ErrorPage, http.StatusInternalServerError, "The file listing failed")
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/reflex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockMetadataServer struct {
+	data.MetadataServer
+	metadata  []data.Metadata
+	next      string
+	total     *int64
+	err       error
+	lastQuery *data.MetadataQuery
+	lastPage  *data.PageRequest
+}
+
+func (mms mockMetadataServer) Find(_ context.Context, query data.MetadataQuery) ([]data.Metadata, error) {
+	if mms.lastQuery != nil {
+		*mms.lastQuery = query
+	}
+	return mms.metadata, mms.err
+}
+
+func (mms mockMetadataServer) FindPage(_ context.Context, query data.MetadataQuery, page data.PageRequest) (data.MetadataPage, error) {
+	if mms.lastQuery != nil {
+		*mms.lastQuery = query
+	}
+	if mms.lastPage != nil {
+		*mms.lastPage = page
+	}
+	if mms.err != nil {
+		return data.MetadataPage{}, mms.err
+	}
+	return data.MetadataPage{Metadata: mms.metadata, NextCursor: mms.next, Total: mms.total}, nil
+}
+
+type mockPublisher struct {
+	data.PublishedEntityService
+	lookup data.LookupResult
+	err    error
+}
+
+func (mp mockPublisher) Lookup(_ context.Context, publishedId string) (data.LookupResult, error) {
+	result := mp.lookup
+	result.SearchedFor = publishedId
+	return result, mp.err
+}
+
+func (mp mockPublisher) FindOrCreateAll(_ context.Context, entityNames []string, ids []int64) ([]data.PublishedEntity, error) {
+	if mp.err != nil {
+		return nil, mp.err
+	}
+	var result []data.PublishedEntity
+	for i := range ids {
+		result = append(result, data.PublishedEntity{
+			RelatedId:           ids[i],
+			Type:                entityNames[i],
+			PublishedIdentifier: entityNames[i][:1] + "aaaaaa-aaaaaaaa",
+		})
+	}
+	return result, nil
+}
+
+func testMetadata() []data.Metadata {
+	return []data.Metadata{
+		{
+			ID:       1,
+			Date:     time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC),
+			Location: "home",
+			Tags:     []string{"boat", "man"},
+			Data: []data.Encoding{
+				{
+					ID:         2,
+					Resolution: data.Resolution{Width: 1920, Height: 1080, Scan: 'P'},
+					MimeType:   data.MimeJPEG,
+				},
+			},
+		},
+	}
+}
+
+func registerFileServices(metadataServer data.MetadataServer, publisher data.PublishedEntityService) {
+	reflex.GlobalReflex().Register("metadataService", metadataServer)
+	reflex.GlobalReflex().Register("publishedEntityService", publisher)
+}
+
+func TestFilesHandler(t *testing.T) {
+	var query data.MetadataQuery
+	registerFileServices(mockMetadataServer{metadata: testMetadata(), lastQuery: &query}, mockPublisher{})
+	handler := FilesHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/files?subject=boat&location=home", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if len(query.Tags) != 1 || query.Tags[0] != "boat" || len(query.LocatedAt) != 1 {
+		t.Errorf("Expected the query parameters to be passed along but got %v", query)
+	}
+
+	var listing FileListing
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if len(listing.Metadata) != 1 {
+		t.Fatalf("Expected one metadata but got %d", len(listing.Metadata))
+	}
+
+	metadata := listing.Metadata[0]
+	if metadata.Permalink != "/image/maaaaaa-aaaaaaaa" {
+		t.Errorf("Expected the metadata permalink but got %s", metadata.Permalink)
+	}
+
+	if len(metadata.Encodings) != 1 || metadata.Encodings[0].Permalink != "/image/eaaaaaa-aaaaaaaa" {
+		t.Errorf("Expected one encoding with a permalink but got %v", metadata.Encodings)
+	}
+
+	if len(metadata.Encodings) == 1 && metadata.Encodings[0].Media != "/media/eaaaaaa-aaaaaaaa" {
+		t.Errorf("Expected the encoding to link to its media but got %s", metadata.Encodings[0].Media)
+	}
+}
+
+func TestFilesHandler_Error(t *testing.T) {
+	registerFileServices(mockMetadataServer{err: errors.New("database is down")}, mockPublisher{})
+	handler := FilesHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/files", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 but got %d", w.Code)
+	}
+}
+
+func TestFilesHandler_PublishError(t *testing.T) {
+	registerFileServices(mockMetadataServer{metadata: testMetadata()}, mockPublisher{err: errors.New("database is down")})
+	handler := FilesHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/files", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 but got %d", w.Code)
+	}
+}
+
+func TestFilesHandler_Page(t *testing.T) {
+	var page data.PageRequest
+	total := int64(12)
+	registerFileServices(mockMetadataServer{metadata: testMetadata(), next: "eyJhIjoxfQ", total: &total, lastPage: &page},
+		mockPublisher{})
+	handler := FilesHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/files?cursor=eyJhIjowfQ&limit=1&total=true", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if page.Cursor != "eyJhIjowfQ" || page.Limit != 1 || !page.WithTotal {
+		t.Errorf("Expected the page to be passed along but got %+v", page)
+	}
+
+	var listing FileListing
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if listing.Next != "eyJhIjoxfQ" || listing.Total == nil || *listing.Total != 12 {
+		t.Errorf("Expected the next cursor and the total but got %+v", listing)
+	}
+}
+
+func TestFilesHandler_BadPage(t *testing.T) {
+	handler := FilesHandler{ErrorPage: errorPage}
+
+	for _, target := range []string{"/files?limit=none", "/files?limit=0", "/files?total=maybe"} {
+		registerFileServices(mockMetadataServer{}, mockPublisher{})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s but got %d", target, w.Code)
+		}
+	}
+
+	registerFileServices(mockMetadataServer{err: data.ErrInvalidCursor}, mockPublisher{})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/files?cursor=bogus", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad cursor but got %d", w.Code)
+	}
+}
@@ -1,23 +1,109 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/darcinc/Simple/data"
 	"github.com/darcinc/Simple/model"
 	"github.com/darcinc/Simple/reflex"
 	"html/template"
+	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	defaultSearchTimeout = 15 * time.Second
+	searchDateLayout     = "2006-01-02"
+)
+
+var (
+	ErrBadSearchRequest = errors.New("bad search request")
+)
+
+// ImageSearchRequest is the search as asked for by the outside world, pulled from
+// the query string of the request.
 type ImageSearchRequest struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Subjects  []string  `json:"subjects"`
+	Locations []string  `json:"locations"`
+	MimeTypes []string  `json:"mimeTypes"`
+	// Sort is the name of the order of the results, e.g. -date for the newest first.
+	Sort string `json:"sort,omitempty"`
+	// Text is searched for in the descriptions, subjects and locations, with the best
+	// matches first unless another sort is given.
+	Text string `json:"text,omitempty"`
+	// Near and Within limit the search to images taken in an area.
+	Near   *data.Radius `json:"near,omitempty"`
+	Within *data.Box    `json:"within,omitempty"`
+	// Query is a search in the syntax of ParseSearchExpression, and Match is what
+	// it was parsed into.
+	Query string          `json:"query,omitempty"`
+	Match data.Expression `json:"-"`
 }
 
 // ImageSearchResponse is a holding of data that our output representation can understand.
 // We pass this along to the template to format as a page.
 type ImageSearchResponse struct {
+	Request ImageSearchRequest `json:"request"`
+	Images  []ImageResult      `json:"images"`
+}
+
+// ImageResult is a single image found by the search.
+type ImageResult struct {
+	Date        time.Time      `json:"date"`
+	Subjects    []string       `json:"subjects"`
+	Location    string         `json:"location"`
+	Description string         `json:"description"`
+	Sources     []SourceResult `json:"sources"`
+	// Thumbnail is where a small rendering of the image is served from.
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Coordinates are where the image was taken, if it was recorded.
+	Coordinates *CoordinatesResult `json:"coordinates,omitempty"`
+	// Snippet is the part of the description that matched the text searched for,
+	// with the matching words marked.
+	Snippet template.HTML `json:"snippet,omitempty"`
+}
+
+// CoordinatesResult is a position on the earth in decimal degrees.
+type CoordinatesResult struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Altitude is in metres above sea level.
+	Altitude *float64 `json:"altitude,omitempty"`
+}
+
+// SourceResult is one place the data for an image can be found.  Where it is stored
+// isn't given away, only the kind of storage, and the data is served through the
+// permalink of the encoding.
+type SourceResult struct {
+	Media    string `json:"media,omitempty"`
+	Source   string `json:"source"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Scan     string `json:"scan"`
+	MimeType string `json:"mimeType"`
+}
+
+// ErrorResponse is passed to the error page, or written as JSON, when a search fails.
+type ErrorResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
 }
 
 type ImageSearcher struct {
 	Repository model.ImageRepository
+	// Publisher gives the images and their encodings permalinks.  Without it the
+	// images are found without links to their data.
+	Publisher data.PublishedEntityService
 }
 
 // TODO: Need a permanent reference model for internal objects.
@@ -33,47 +119,355 @@ type ImageSearcher struct {
 // two places, meaning there are two copies of the same JPEG.
 //
 // Here's where we also need to generate permalinks, if they don't already exist.
-func (is ImageSearcher) Search(ctx context.Context, _ ImageSearchRequest) (ImageSearchResponse, error) {
-	qp := model.QueryParameters{}
+func (is ImageSearcher) Search(ctx context.Context, isr ImageSearchRequest) (ImageSearchResponse, error) {
+	qp := model.QueryParameters{
+		FromDate:  isr.From,
+		ToDate:    isr.To,
+		Subjects:  isr.Subjects,
+		Locations: isr.Locations,
+		MimeTypes: isr.MimeTypes,
+		Sort:      data.SortOrder(isr.Sort),
+		Text:      isr.Text,
+		Near:      isr.Near,
+		Within:    isr.Within,
+		Match:     isr.Match,
+	}
 
 	images, err := is.Repository.Find(ctx, qp)
 	if err != nil {
-		// TODO: Wrap error appropriately
-		return ImageSearchResponse{}, err
+		return ImageSearchResponse{}, fmt.Errorf("image search failed: %w", err)
+	}
+
+	links := permalinks{}
+	if is.Publisher != nil {
+		links, err = publishImages(ctx, is.Publisher, images)
+		if err != nil {
+			return ImageSearchResponse{}, fmt.Errorf("image search failed: %w", err)
+		}
 	}
 
-	response := ImageSearchResponse{}
-	for range images {
-		// TODO: Handle adding an image to the response.
+	response := ImageSearchResponse{
+		Request: isr,
+		Images:  make([]ImageResult, 0, len(images)),
+	}
+	for _, image := range images {
+		result := ImageResult{
+			Date:        image.Date,
+			Subjects:    image.Subjects,
+			Location:    image.Location,
+			Description: image.Description,
+			Coordinates: coordinatesResult(image.Coordinates),
+			Snippet:     highlight(image.Snippet),
+		}
+		for _, source := range image.Sources {
+			if strings.HasPrefix(string(source.Encoding), "image/") && result.Thumbnail == "" {
+				result.Thumbnail = links.derivative(image.ID)
+			}
+			result.Sources = append(result.Sources, SourceResult{
+				Media:    links.media(source.EncodingID),
+				Source:   source.Kind,
+				Width:    source.Resolution.Width,
+				Height:   source.Resolution.Height,
+				Scan:     scanName(source.Resolution.Scan),
+				MimeType: string(source.Encoding),
+			})
+		}
+		response.Images = append(response.Images, result)
 	}
 
 	return response, nil
 }
 
+// publishImages finds or creates the permalinks for the metadata and encodings of every
+// image given.
+func publishImages(ctx context.Context, publisher data.PublishedEntityService, images []model.Image) (permalinks, error) {
+	var names []string
+	var ids []int64
+	for _, image := range images {
+		names = append(names, data.EntityMetadata)
+		ids = append(ids, image.ID)
+		published := map[int64]bool{}
+		for _, source := range image.Sources {
+			if !published[source.EncodingID] {
+				published[source.EncodingID] = true
+				names = append(names, data.EntityEncoding)
+				ids = append(ids, source.EncodingID)
+			}
+		}
+	}
+	return publishEntities(ctx, publisher, names, ids)
+}
+
+func coordinatesResult(coordinates *data.Coordinates) *CoordinatesResult {
+	if coordinates == nil {
+		return nil
+	}
+	return &CoordinatesResult{
+		Latitude:  coordinates.Latitude,
+		Longitude: coordinates.Longitude,
+		Altitude:  coordinates.Altitude,
+	}
+}
+
+// highlight escapes a snippet for HTML, marking the words that matched the search.
+func highlight(snippet string) template.HTML {
+	if snippet == "" {
+		return ""
+	}
+	marker := strings.NewReplacer(data.HighlightStart, "<mark>", data.HighlightStop, "</mark>")
+	return template.HTML(marker.Replace(template.HTMLEscapeString(snippet)))
+}
+
+func scanName(scan rune) string {
+	if scan == 0 {
+		return ""
+	}
+	return string(scan)
+}
+
+// ParseImageSearchRequest pulls the search out of the query string.  Dates are given as
+// from=2021-03-20 or as RFC 3339 timestamps.  The subject, location and mime parameters
+// can be repeated or hold a comma separated list.  The text parameter is searched for
+// in the descriptions, subjects and locations.  The sort is one of date, -date,
+// location, encodings or relevance, which needs text.  Images taken in an area are
+// found with near=latitude,longitude,metres or within=south,west,north,east, in
+// decimal degrees.  The q parameter is a search such as
+// boat (location:home OR location:work), which must match as well.
+func ParseImageSearchRequest(r *http.Request) (ImageSearchRequest, error) {
+	query := r.URL.Query()
+	isr := ImageSearchRequest{
+		Subjects:  listParameter(query["subject"]),
+		Locations: listParameter(query["location"]),
+		MimeTypes: listParameter(query["mime"]),
+		Sort:      query.Get("sort"),
+		Text:      strings.TrimSpace(query.Get("text")),
+		Query:     query.Get("q"),
+	}
+
+	if _, err := data.ParseSortOrder(isr.Sort); err != nil {
+		return ImageSearchRequest{}, fmt.Errorf("%w: %v", ErrBadSearchRequest, err)
+	}
+	if data.SortOrder(isr.Sort) == data.SortByRelevance && isr.Text == "" {
+		return ImageSearchRequest{}, fmt.Errorf("%w: sorting by relevance needs text", ErrBadSearchRequest)
+	}
+
+	if near := query.Get("near"); near != "" {
+		values, err := floatsParameter(near, 3)
+		if err != nil {
+			return ImageSearchRequest{}, fmt.Errorf("%w: near %v", ErrBadSearchRequest, err)
+		}
+		isr.Near = &data.Radius{Latitude: values[0], Longitude: values[1], Meters: values[2]}
+		if err := isr.Near.Validate(); err != nil {
+			return ImageSearchRequest{}, fmt.Errorf("%w: %v", ErrBadSearchRequest, err)
+		}
+	}
+	if within := query.Get("within"); within != "" {
+		values, err := floatsParameter(within, 4)
+		if err != nil {
+			return ImageSearchRequest{}, fmt.Errorf("%w: within %v", ErrBadSearchRequest, err)
+		}
+		isr.Within = &data.Box{South: values[0], West: values[1], North: values[2], East: values[3]}
+		if err := isr.Within.Validate(); err != nil {
+			return ImageSearchRequest{}, fmt.Errorf("%w: %v", ErrBadSearchRequest, err)
+		}
+	}
+
+	var err error
+	if isr.Match, err = ParseSearchExpression(isr.Query); err != nil {
+		return ImageSearchRequest{}, err
+	}
+	if isr.From, err = dateParameter(query.Get("from")); err != nil {
+		return ImageSearchRequest{}, fmt.Errorf("%w: from %v", ErrBadSearchRequest, err)
+	}
+	if isr.To, err = dateParameter(query.Get("to")); err != nil {
+		return ImageSearchRequest{}, fmt.Errorf("%w: to %v", ErrBadSearchRequest, err)
+	}
+	if !isr.From.IsZero() && !isr.To.IsZero() && isr.To.Before(isr.From) {
+		return ImageSearchRequest{}, fmt.Errorf("%w: to is before from", ErrBadSearchRequest)
+	}
+
+	for _, m := range isr.MimeTypes {
+		if mediaType, _, err := mime.ParseMediaType(m); err != nil || !strings.Contains(mediaType, "/") {
+			return ImageSearchRequest{}, fmt.Errorf("%w: %s is not a mime type", ErrBadSearchRequest, m)
+		}
+	}
+
+	return isr, nil
+}
+
+func listParameter(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// floatsParameter reads a comma separated list of exactly n numbers.
+func floatsParameter(value string, n int) ([]float64, error) {
+	items := strings.Split(value, ",")
+	if len(items) != n {
+		return nil, fmt.Errorf("%q is not %d numbers", value, n)
+	}
+
+	result := make([]float64, n)
+	for i, item := range items {
+		number, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("%q is not a number", item)
+		}
+		result[i] = number
+	}
+	return result, nil
+}
+
+func dateParameter(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(searchDateLayout, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML, going by the quality
+// values in the Accept header.
+func wantsJSON(r *http.Request) bool {
+	jsonQuality, htmlQuality := -1.0, -1.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			if quality > jsonQuality {
+				jsonQuality = quality
+			}
+		case "text/html", "text/*", "*/*":
+			if quality > htmlQuality {
+				htmlQuality = quality
+			}
+		}
+	}
+
+	return jsonQuality > 0 && jsonQuality > htmlQuality
+}
+
 type ImageSearchHandler struct {
 	SearchPage *template.Template
+	// ErrorPage is given an ErrorResponse.  Without one, errors are written as plain text.
+	ErrorPage *template.Template
+	// Timeout bounds how long a search can run, defaulting to 15 seconds.
+	Timeout time.Duration
 }
 
-func (ish ImageSearchHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+func (ish ImageSearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	theReflex := reflex.GlobalReflex()
 	searcher, ok := theReflex.MustGet("ImageSearcher").(ImageSearcher)
 	if !ok {
-		w.WriteHeader(500)
-		// TODO: Fill in the error page.
+		log.Printf("Error - ImageSearcher is not a service.ImageSearcher")
+		ish.writeError(w, r, http.StatusInternalServerError, "The image search is not available")
 		return
 	}
 
-	// TODO: Extract search request from parameters
-	isr := ImageSearchRequest{}
-
-	// TODO: Set appropriate context (e.g. timeout)
-	results, err := searcher.Search(context.Background(), isr)
+	isr, err := ParseImageSearchRequest(r)
 	if err != nil {
-		w.WriteHeader(500)
-		// TODO: Fill in error handling
+		ish.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	timeout := ish.Timeout
+	if timeout <= 0 {
+		timeout = defaultSearchTimeout
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 
-	if err := ish.SearchPage.Execute(w, results); err != nil {
-		// TODO: Handle page execution error
+	results, err := searcher.Search(ctx, isr)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("Error - Image search timed out: %v", err)
+		ish.writeError(w, r, http.StatusGatewayTimeout, "The image search took too long")
+		return
+	case err != nil:
+		log.Printf("Error - Image search failed: %v", err)
+		ish.writeError(w, r, http.StatusInternalServerError, "The image search failed")
+		return
 	}
+
+	// Finding nothing is still a successful search.
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	var page bytes.Buffer
+	if err := ish.SearchPage.Execute(&page, results); err != nil {
+		log.Printf("Error - Failed to render the search page: %v", err)
+		ish.writeError(w, r, http.StatusInternalServerError, "The search results could not be displayed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = page.WriteTo(w)
+}
+
+func (ish ImageSearchHandler) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeErrorPage(w, r, ish.ErrorPage, status, message)
+}
+
+// writeErrorPage writes the error as JSON if the client asked for it, otherwise with the
+// error page.  If there's no error page, or it fails, the error is written as plain text.
+func writeErrorPage(w http.ResponseWriter, r *http.Request, errorPage *template.Template, status int, message string) {
+	response := ErrorResponse{
+		Status:  status,
+		Message: message,
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, status, response)
+		return
+	}
+
+	if errorPage != nil {
+		var page bytes.Buffer
+		err := errorPage.Execute(&page, response)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			_, _ = page.WriteTo(w)
+			return
+		}
+		log.Printf("Error - Failed to render the error page: %v", err)
+	}
+
+	http.Error(w, message, status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Error - Failed to encode JSON response: %v", err)
+		http.Error(w, "The response could not be encoded", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
 }
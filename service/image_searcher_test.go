@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/model"
+	"github.com/darcinc/Simple/reflex"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockImageRepository struct {
+	images    []model.Image
+	err       error
+	lastQuery *model.QueryParameters
+	delay     time.Duration
+}
+
+func (mir mockImageRepository) Find(ctx context.Context, qp model.QueryParameters) ([]model.Image, error) {
+	if mir.lastQuery != nil {
+		*mir.lastQuery = qp
+	}
+	if mir.delay > 0 {
+		select {
+		case <-time.After(mir.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return mir.images, mir.err
+}
+
+func testImages() []model.Image {
+	return []model.Image{
+		{
+			ID:          1,
+			Date:        time.Date(2021, 03, 20, 13, 24, 56, 0, time.UTC),
+			Subjects:    []string{"boat", "man"},
+			Location:    "home",
+			Description: "boat, man at home on March 20, 2021",
+			Coordinates: &data.Coordinates{Latitude: 50.82, Longitude: -0.14},
+			Sources: []model.Source{
+				{
+					Location:   url.URL{Scheme: "file", Path: "/foo/bar.jpg"},
+					Kind:       data.SourceFile,
+					EncodingID: 10,
+					Resolution: data.Resolution{Width: 1920, Height: 1080, Scan: 'P'},
+					Encoding:   data.MimeJPEG,
+				},
+			},
+		},
+	}
+}
+
+var searchPage = template.Must(template.New("search").Parse(
+	`{{range .Images}}<p>{{.Description}}</p>{{else}}<p>Nothing found</p>{{end}}`))
+
+var errorPage = template.Must(template.New("error").Parse(`<h1>{{.Status}}</h1><p>{{.Message}}</p>`))
+
+func registerSearcher(repository model.ImageRepository) {
+	reflex.GlobalReflex().Register("ImageSearcher", ImageSearcher{Repository: repository})
+}
+
+func TestParseImageSearchRequest(t *testing.T) {
+	r := httptest.NewRequest("GET",
+		"/images?from=2021-03-20&to=2021-04-20T10:00:00Z&subject=boat,man&subject=sea&location=home&mime=image/jpeg&sort=-date&q=-at:work&text=red+boat&near=50.82,-0.14,500&within=50,170,51,-170", nil)
+
+	isr, err := ParseImageSearchRequest(r)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the request: %v", err)
+	}
+
+	if !isr.From.Equal(time.Date(2021, 03, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected from to be 2021-03-20 but got %v", isr.From)
+	}
+
+	if !isr.To.Equal(time.Date(2021, 04, 20, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected to to be 2021-04-20 10:00 but got %v", isr.To)
+	}
+
+	if strings.Join(isr.Subjects, "|") != "boat|man|sea" {
+		t.Errorf("Expected subjects boat, man, sea but got %v", isr.Subjects)
+	}
+
+	if len(isr.Locations) != 1 || isr.Locations[0] != "home" {
+		t.Errorf("Expected location home but got %v", isr.Locations)
+	}
+
+	if len(isr.MimeTypes) != 1 || isr.MimeTypes[0] != data.MimeJPEG {
+		t.Errorf("Expected mime type image/jpeg but got %v", isr.MimeTypes)
+	}
+
+	if isr.Sort != string(data.SortByDateDescending) {
+		t.Errorf("Expected the newest first but got %q", isr.Sort)
+	}
+
+	if isr.Text != "red boat" {
+		t.Errorf("Expected the text red boat but got %q", isr.Text)
+	}
+
+	if isr.Near == nil || *isr.Near != (data.Radius{Latitude: 50.82, Longitude: -0.14, Meters: 500}) {
+		t.Errorf("Expected 500 metres around 50.82, -0.14 but got %v", isr.Near)
+	}
+
+	if isr.Within == nil || *isr.Within != (data.Box{South: 50, West: 170, North: 51, East: -170}) {
+		t.Errorf("Expected a box across the antimeridian but got %v", isr.Within)
+	}
+
+	if !reflect.DeepEqual(isr.Match, data.Not(data.Location("work"))) {
+		t.Errorf("Expected the search to exclude work but got %#v", isr.Match)
+	}
+}
+
+func TestParseImageSearchRequest_Invalid(t *testing.T) {
+	for _, query := range []string{
+		"from=yesterday",
+		"to=2021-13-45",
+		"from=2021-04-20&to=2021-03-20",
+		"mime=jpeg",
+		"sort=size",
+		"q=boat+OR",
+		"sort=relevance",
+		"near=50.82,-0.14",
+		"near=north,west,500",
+		"near=91,0,500",
+		"near=50.82,-0.14,0",
+		"within=51,0,50,1",
+	} {
+		r := httptest.NewRequest("GET", "/images?"+query, nil)
+		if _, err := ParseImageSearchRequest(r); !errors.Is(err, ErrBadSearchRequest) {
+			t.Errorf("Expected a bad search request for %s but got %v", query, err)
+		}
+	}
+}
+
+func TestImageSearcher_Search(t *testing.T) {
+	var query model.QueryParameters
+	searcher := ImageSearcher{Repository: mockImageRepository{images: testImages(), lastQuery: &query}, Publisher: mockPublisher{}}
+
+	isr := ImageSearchRequest{Subjects: []string{"boat"}, MimeTypes: []string{data.MimeJPEG}, Sort: "location",
+		Match: data.Location("home")}
+	response, err := searcher.Search(context.Background(), isr)
+	if err != nil {
+		t.Fatalf("Unexpected error searching: %v", err)
+	}
+
+	if len(query.Subjects) != 1 || len(query.MimeTypes) != 1 || query.Sort != data.SortByLocation || query.Match == nil {
+		t.Errorf("Expected the request to be passed to the repository but got %v", query)
+	}
+
+	if len(response.Images) != 1 || len(response.Images[0].Sources) != 1 {
+		t.Fatalf("Expected 1 image with 1 source but got %v", response.Images)
+	}
+
+	if coordinates := response.Images[0].Coordinates; coordinates == nil || coordinates.Latitude != 50.82 {
+		t.Errorf("Expected the coordinates of the image but got %v", coordinates)
+	}
+
+	source := response.Images[0].Sources[0]
+	if source.Media != MediaPrefix+"eaaaaaa-aaaaaaaa" || source.Width != 1920 || source.Scan != "P" || source.MimeType != data.MimeJPEG {
+		t.Errorf("Expected a 1920 wide JPEG served from its permalink but got %v", source)
+	}
+
+	if source.Source != data.SourceFile {
+		t.Errorf("Expected the kind of storage but got %q", source.Source)
+	}
+
+	if thumbnail := response.Images[0].Thumbnail; thumbnail != DerivativePrefix+"maaaaaa-aaaaaaaa" {
+		t.Errorf("Expected the thumbnail of the image but got %q", thumbnail)
+	}
+}
+
+func TestImageSearchHandler_HidesLocations(t *testing.T) {
+	images := testImages()
+	images[0].Sources[0].Location = url.URL{Scheme: "https", User: url.UserPassword("admin", "secret"), Host: "nas.local", Path: "/private/bar.jpg"}
+	reflex.GlobalReflex().Register("ImageSearcher", ImageSearcher{Repository: mockImageRepository{images: images}, Publisher: mockPublisher{}})
+	handler := ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/images", nil)
+	r.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(w, r)
+
+	for _, hidden := range []string{"nas.local", "secret", "/private/bar.jpg"} {
+		if strings.Contains(w.Body.String(), hidden) {
+			t.Errorf("Expected the location of the data to be hidden but found %s in %s", hidden, w.Body.String())
+		}
+	}
+	if !strings.Contains(w.Body.String(), MediaPrefix+"eaaaaaa-aaaaaaaa") {
+		t.Errorf("Expected the permalink of the encoding but got %s", w.Body.String())
+	}
+}
+
+func TestImageSearcher_SearchText(t *testing.T) {
+	var query model.QueryParameters
+	images := testImages()
+	images[0].Snippet = "A <red> " + data.HighlightStart + "boat" + data.HighlightStop + " & a man"
+	searcher := ImageSearcher{Repository: mockImageRepository{images: images, lastQuery: &query}}
+
+	response, err := searcher.Search(context.Background(), ImageSearchRequest{Text: "boat"})
+	if err != nil {
+		t.Fatalf("Unexpected error searching: %v", err)
+	}
+
+	if query.Text != "boat" {
+		t.Errorf("Expected the text to be passed to the repository but got %q", query.Text)
+	}
+
+	if snippet := response.Images[0].Snippet; snippet != "A &lt;red&gt; <mark>boat</mark> &amp; a man" {
+		t.Errorf("Expected an escaped snippet with the match marked but got %s", snippet)
+	}
+}
+
+func TestImageSearchHandler_HTML(t *testing.T) {
+	registerSearcher(mockImageRepository{images: testImages()})
+	handler := ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/images?subject=boat", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "boat, man at home") {
+		t.Errorf("Expected the page to describe the image but got %s", w.Body.String())
+	}
+}
+
+func TestImageSearchHandler_JSON(t *testing.T) {
+	registerSearcher(mockImageRepository{images: testImages()})
+	handler := ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/images?subject=boat", nil)
+	r.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", w.Code)
+	}
+
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON but got %s", w.Header().Get("Content-Type"))
+	}
+
+	var response ImageSearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if len(response.Images) != 1 || response.Images[0].Location != "home" {
+		t.Errorf("Expected one image at home but got %v", response.Images)
+	}
+}
+
+func TestImageSearchHandler_BadRequest(t *testing.T) {
+	registerSearcher(mockImageRepository{images: testImages()})
+	handler := ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/images?from=yesterday", nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 but got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "<h1>400</h1>") {
+		t.Errorf("Expected the error page but got %s", w.Body.String())
+	}
+}
+
+func TestImageSearchHandler_NoResults(t *testing.T) {
+	registerSearcher(mockImageRepository{})
+	handler := ImageSearchHandler{SearchPage: searchPage, ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/images?subject=unicorn", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "Nothing found") {
+		t.Errorf("Expected the search page but got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/images?subject=unicorn", nil)
+	r.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", w.Code)
+	}
+
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if images := string(response["images"]); images != "[]" {
+		t.Errorf("Expected an empty list of images but got %s", images)
+	}
+}
+
+func TestImageSearchHandler_SearchError(t *testing.T) {
+	registerSearcher(mockImageRepository{err: errors.New("random database error")})
+	handler := ImageSearchHandler{SearchPage: searchPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/images", nil)
+	r.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 but got %d", w.Code)
+	}
+
+	var response ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if response.Status != http.StatusInternalServerError || strings.Contains(response.Message, "random") {
+		t.Errorf("Expected a 500 without the internal error but got %v", response)
+	}
+}
+
+func TestImageSearchHandler_Timeout(t *testing.T) {
+	registerSearcher(mockImageRepository{images: testImages(), delay: time.Second})
+	handler := ImageSearchHandler{SearchPage: searchPage, Timeout: 10 * time.Millisecond}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/images", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 but got %d", w.Code)
+	}
+}
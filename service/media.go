@@ -0,0 +1,106 @@
+package service
+
+import (
+	"github.com/darcinc/Simple/data"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MediaHandler serves GET /media/{id}, where id is the published identifier of an
+// encoding or a file.  It streams the bytes of the encoding from the first of its
+// locators that can be opened, or those of the file from where it was catalogued.  When the stored data can seek, Range and conditional requests are
+// supported, so a browser can scrub through a video.
+type MediaHandler struct {
+	ErrorPage *template.Template
+}
+
+// entityTag is the strong ETag for an encoding, taken from the hash of its data.
+func entityTag(encoding data.Encoding) string {
+	if encoding.Hash == "" {
+		return ""
+	}
+	return `"` + encoding.Hash + `"`
+}
+
+// noneMatch reports whether the If-None-Match header rules out the entity tag, meaning
+// the client already has the data.  Tags are compared weakly, as RFC 7232 asks.
+func noneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mh MediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeErrorPage(w, r, mh.ErrorPage, http.StatusMethodNotAllowed, "Media can only be read")
+		return
+	}
+
+	result, ok := lookup(w, r, MediaPrefix, mh.ErrorPage)
+	if !ok {
+		return
+	}
+
+	switch found := result.Found.(type) {
+	case data.Encoding:
+		serveEncoding(w, r, found, mh.ErrorPage)
+	case data.FileInfo:
+		serveEncoding(w, r, found.Encoding(), mh.ErrorPage)
+	default:
+		writeErrorPage(w, r, mh.ErrorPage, http.StatusNotFound, "This permalink does not refer to media")
+	}
+}
+
+// serveEncoding streams the bytes of the encoding, answering Range and conditional
+// requests when the data can seek.
+func serveEncoding(w http.ResponseWriter, r *http.Request, encoding data.Encoding, errorPage *template.Template) {
+	etag := entityTag(encoding)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	stream, err := data.OpenEncodingContext(r.Context(), encoding)
+	if err != nil {
+		log.Printf("Error - Unable to open the data for encoding %d: %v", encoding.ID, err)
+		writeErrorPage(w, r, errorPage, http.StatusBadGateway, "The media could not be read")
+		return
+	}
+	defer stream.Close()
+
+	if encoding.MimeType != "" {
+		w.Header().Set("Content-Type", encoding.MimeType)
+	}
+
+	// ServeContent handles Range, If-Range and the remaining conditional headers, but it
+	// needs to seek to find the size and the start of each range.
+	if seeker, ok := stream.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, stream); err != nil {
+		log.Printf("Error - Failed streaming encoding %d: %v", encoding.ID, err)
+	}
+}
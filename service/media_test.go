@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testMedia   = "/media/dcbaaaa-aaaedcbM"
+	testContent = "0123456789abcdefghij"
+)
+
+type seekableData struct {
+	*bytes.Reader
+}
+
+func (sd seekableData) Close() error {
+	return nil
+}
+
+type mockLocator struct {
+	content  string
+	seekable bool
+	err      error
+}
+
+func (ml mockLocator) Source() string {
+	return "mock"
+}
+
+func (ml mockLocator) Data() (io.ReadCloser, error) {
+	if ml.err != nil {
+		return nil, ml.err
+	}
+	if ml.seekable {
+		return seekableData{bytes.NewReader([]byte(ml.content))}, nil
+	}
+	return io.NopCloser(bytes.NewBufferString(ml.content)), nil
+}
+
+func (ml mockLocator) URL() url.URL {
+	return url.URL{Scheme: "mock", Path: "/" + ml.content}
+}
+
+func registerMedia(locators ...data.Locator) {
+	registerEncoding(data.Encoding{
+		ID:       2,
+		Locator:  locators,
+		MimeType: data.MimeMP4,
+		Hash:     "78901234",
+	})
+}
+
+func registerEncoding(encoding data.Encoding) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{Found: encoding, OfType: data.EntityEncoding},
+	})
+}
+
+func TestMediaHandler(t *testing.T) {
+	registerMedia(mockLocator{err: errors.New("offline")}, mockLocator{content: testContent, seekable: true})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testMedia, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if w.Body.String() != testContent {
+		t.Errorf("Expected the content of the second locator but got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != data.MimeMP4 {
+		t.Errorf("Expected the mime type of the encoding but got %s", w.Header().Get("Content-Type"))
+	}
+
+	if w.Header().Get("ETag") != `"78901234"` {
+		t.Errorf("Expected the ETag to be the hash but got %s", w.Header().Get("ETag"))
+	}
+}
+
+func TestMediaHandler_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bar.jpg")
+	if err := os.WriteFile(path, []byte(testContent), 0644); err != nil {
+		t.Fatalf("Unable to write the test file: %v", err)
+	}
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{
+			Found:  data.FileInfo{ID: 45, FullPath: path, FileHash: "78901234", Filename: "bar.jpg"},
+			OfType: data.EntityFile,
+		},
+	})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testMedia, nil)
+	r.Header.Set("Range", "bytes=10-14")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206 but got %d", w.Code)
+	}
+
+	if w.Body.String() != "abcde" {
+		t.Errorf("Expected bytes 10 to 14 of the file but got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != data.MimeJPEG {
+		t.Errorf("Expected the mime type of the file but got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestMediaHandler_Range(t *testing.T) {
+	registerMedia(mockLocator{content: testContent, seekable: true})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testMedia, nil)
+	r.Header.Set("Range", "bytes=10-14")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206 but got %d", w.Code)
+	}
+
+	if w.Body.String() != "abcde" {
+		t.Errorf("Expected bytes 10 to 14 but got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Content-Range") != "bytes 10-14/20" {
+		t.Errorf("Expected the content range but got %s", w.Header().Get("Content-Range"))
+	}
+}
+
+func TestMediaHandler_NotModified(t *testing.T) {
+	registerMedia(mockLocator{content: testContent, seekable: true})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	for _, ifNoneMatch := range []string{`"78901234"`, `W/"78901234"`, `"other", "78901234"`, `*`} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", testMedia, nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for %s but got %d", ifNoneMatch, w.Code)
+		}
+
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected no body for %s but got %s", ifNoneMatch, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testMedia, nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 when the tag differs but got %d", w.Code)
+	}
+}
+
+func TestMediaHandler_NotSeekable(t *testing.T) {
+	registerMedia(mockLocator{content: testContent})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testMedia, nil)
+	r.Header.Set("Range", "bytes=10-14")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the whole content when it can't seek but got %d", w.Code)
+	}
+
+	if w.Body.String() != testContent || w.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("Expected the whole content without ranges but got %s", w.Body.String())
+	}
+}
+
+func TestMediaHandler_TamperedLocator(t *testing.T) {
+	original := []byte(testContent)
+	tampered := []byte("0123456789ABCDEFGHIJ")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tampered))
+	}))
+	defer server.Close()
+
+	// The same as the server registers, so other tests are unaffected.
+	data.RegisterHTTPLocator(data.HTTPConfig{})
+	locator, err := data.NewLocator(data.SourceHTTP, server.URL+"/clip.mp4")
+	if err != nil {
+		t.Fatalf("Unable to build the http locator: %v", err)
+	}
+	sum := sha256.Sum256(original)
+	registerEncoding(data.Encoding{
+		ID:       2,
+		Locator:  []data.Locator{locator},
+		MimeType: data.MimeMP4,
+		Hash:     hex.EncodeToString(sum[:]),
+	})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testMedia, nil))
+
+	if bytes.Equal(w.Body.Bytes(), tampered) {
+		t.Errorf("Expected the tampered content not to be served whole but got %s", w.Body.String())
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(original))
+	})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testMedia, nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != testContent {
+		t.Errorf("Expected the content that matches the hash to be served but got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMediaHandler_NoData(t *testing.T) {
+	registerMedia(mockLocator{err: errors.New("offline")})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testMedia, nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 but got %d", w.Code)
+	}
+}
+
+func TestMediaHandler_NotMedia(t *testing.T) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{Found: testMetadata()[0], OfType: data.EntityMetadata},
+	})
+	handler := MediaHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testMedia, nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 but got %d", w.Code)
+	}
+}
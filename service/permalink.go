@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"github.com/darcinc/Simple/reflex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// FileInfoResult is the outside view of a data.FileInfo.
+type FileInfoResult struct {
+	Filename string `json:"filename"`
+	FileHash string `json:"fileHash"`
+	Size     int64  `json:"size"`
+}
+
+// PermalinkHandler serves GET /image/{id}, where id is a published identifier.  It
+// describes the metadata, encoding or file the identifier was published for.
+type PermalinkHandler struct {
+	ErrorPage *template.Template
+}
+
+// permalinkId pulls the published identifier off the end of the path, checking that
+// it is well formed before anything goes to the database.
+func permalinkId(r *http.Request, prefix string) (string, bool) {
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if _, err := data.ParseIdentifier(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// lookup resolves the permalink at the end of the request path, writing the error page
+// if it can't.
+func lookup(w http.ResponseWriter, r *http.Request, prefix string, errorPage *template.Template) (data.LookupResult, bool) {
+	publisher, ok := reflex.GlobalReflex().MustGet("publishedEntityService").(data.PublishedEntityService)
+	if !ok {
+		log.Printf("Error - publishedEntityService is not a data.PublishedEntityService")
+		writeErrorPage(w, r, errorPage, http.StatusInternalServerError, "Permalinks are not available")
+		return data.LookupResult{}, false
+	}
+
+	id, ok := permalinkId(r, prefix)
+	if !ok {
+		writeErrorPage(w, r, errorPage, http.StatusNotFound, "There is nothing at this permalink")
+		return data.LookupResult{}, false
+	}
+
+	result, err := publisher.Lookup(r.Context(), id)
+	switch {
+	case errors.Is(err, data.ErrPublishedEntityNotFound), errors.Is(err, data.ErrEntityNotFound):
+		writeErrorPage(w, r, errorPage, http.StatusNotFound, "There is nothing at this permalink")
+		return data.LookupResult{}, false
+	case err != nil:
+		log.Printf("Error - Failed to look up permalink %s: %v", id, err)
+		writeErrorPage(w, r, errorPage, http.StatusInternalServerError, "The permalink could not be looked up")
+		return data.LookupResult{}, false
+	}
+
+	return result, true
+}
+
+func (ph PermalinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result, ok := lookup(w, r, PermalinkPrefix, ph.ErrorPage)
+	if !ok {
+		return
+	}
+
+	self := permalinks{result.OfType: {}}
+	switch found := result.Found.(type) {
+	case data.Metadata:
+		self[result.OfType][found.ID] = result.SearchedFor
+		writeJSON(w, http.StatusOK, metadataResult(found, self))
+	case data.Encoding:
+		self[result.OfType][found.ID] = result.SearchedFor
+		writeJSON(w, http.StatusOK, encodingResult(found, self))
+	case data.FileInfo:
+		writeJSON(w, http.StatusOK, FileInfoResult{
+			Filename: found.Filename,
+			FileHash: found.FileHash,
+			Size:     found.Size,
+		})
+	default:
+		log.Printf("Error - Permalink %s refers to an unknown %s", result.SearchedFor, result.OfType)
+		writeErrorPage(w, r, ph.ErrorPage, http.StatusInternalServerError, "The permalink could not be looked up")
+	}
+}
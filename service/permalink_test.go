@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/darcinc/Simple/data"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPermalink = "/image/dcbaaaa-aaaedcbM"
+
+func TestPermalinkHandler_Metadata(t *testing.T) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{Found: testMetadata()[0], OfType: data.EntityMetadata},
+	})
+	handler := PermalinkHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testPermalink, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	var result MetadataResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if result.Permalink != testPermalink || result.Location != "home" {
+		t.Errorf("Expected the metadata at home but got %v", result)
+	}
+}
+
+func TestPermalinkHandler_Encoding(t *testing.T) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		lookup: data.LookupResult{Found: testMetadata()[0].Data[0], OfType: data.EntityEncoding},
+	})
+	handler := PermalinkHandler{ErrorPage: errorPage}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", testPermalink, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	var result EncodingResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if result.MimeType != data.MimeJPEG || result.Width != 1920 {
+		t.Errorf("Expected the jpeg encoding but got %v", result)
+	}
+}
+
+func TestPermalinkHandler_NotFound(t *testing.T) {
+	registerFileServices(mockMetadataServer{}, mockPublisher{
+		err: fmt.Errorf("%w: dcbaaaa-aaaedcbM", data.ErrPublishedEntityNotFound),
+	})
+	handler := PermalinkHandler{ErrorPage: errorPage}
+
+	for _, path := range []string{testPermalink, "/image/not-an-identifier", "/image/"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s but got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"fmt"
+	"github.com/darcinc/Simple/data"
+	"mime"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxSearchTerms and maxSearchNesting keep a search from building an
+	// unreasonable query.
+	maxSearchTerms   = 32
+	maxSearchNesting = 8
+)
+
+type searchTokenKind int
+
+const (
+	searchTerm searchTokenKind = iota
+	searchOpen
+	searchClose
+	searchAnd
+	searchOr
+	searchNot
+)
+
+type searchToken struct {
+	kind  searchTokenKind
+	field string
+	value string
+}
+
+// ParseSearchExpression parses the text syntax of a search into an expression.  A
+// search is made of terms, such as boat, subject:boat, location:home or
+// mime:image/jpeg, where a bare term is a subject.  Values with spaces are quoted, as
+// in location:"new york".  Terms next to each other must all match, and can be
+// combined with AND, OR and NOT, or - for not, with parentheses to group them:
+//
+//	boat (location:home OR location:work) -mime:image/tiff
+//
+// An empty search is a nil expression.
+func ParseSearchExpression(text string) (data.Expression, error) {
+	tokens, err := tokenizeSearch(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	parser := searchParser{tokens: tokens}
+	expression, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		return nil, fmt.Errorf("%w: unexpected %s", ErrBadSearchRequest, parser.peek())
+	}
+	return expression, nil
+}
+
+func tokenizeSearch(text string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: searchOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: searchClose})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, searchToken{kind: searchNot})
+			i++
+		default:
+			token, next, err := scanSearchTerm(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			i = next
+		}
+	}
+
+	return tokens, nil
+}
+
+// scanSearchTerm reads the term starting at i, returning it and where it ends.
+func scanSearchTerm(runes []rune, i int) (searchToken, int, error) {
+	start := i
+	for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+		i++
+	}
+	word := string(runes[start:i])
+
+	if i < len(runes) && runes[i] == '"' {
+		if word != "" && !strings.HasSuffix(word, ":") {
+			return searchToken{}, 0, fmt.Errorf("%w: unexpected quote after %q", ErrBadSearchRequest, word)
+		}
+		end := i + 1
+		for end < len(runes) && runes[end] != '"' {
+			end++
+		}
+		if end == len(runes) {
+			return searchToken{}, 0, fmt.Errorf("%w: unterminated quote", ErrBadSearchRequest)
+		}
+		return searchToken{kind: searchTerm, field: strings.TrimSuffix(word, ":"), value: string(runes[i+1 : end])}, end + 1, nil
+	}
+
+	switch word {
+	case "AND":
+		return searchToken{kind: searchAnd}, i, nil
+	case "OR":
+		return searchToken{kind: searchOr}, i, nil
+	case "NOT":
+		return searchToken{kind: searchNot}, i, nil
+	}
+
+	if colon := strings.IndexRune(word, ':'); colon >= 0 {
+		return searchToken{kind: searchTerm, field: word[:colon], value: word[colon+1:]}, i, nil
+	}
+	return searchToken{kind: searchTerm, value: word}, i, nil
+}
+
+func (st searchToken) String() string {
+	switch st.kind {
+	case searchOpen:
+		return `"("`
+	case searchClose:
+		return `")"`
+	case searchAnd:
+		return "AND"
+	case searchOr:
+		return "OR"
+	case searchNot:
+		return "NOT"
+	}
+	if st.field != "" {
+		return fmt.Sprintf("%s:%q", st.field, st.value)
+	}
+	return fmt.Sprintf("%q", st.value)
+}
+
+// searchParser is a recursive descent parser over the tokens of a search, where OR
+// binds looser than AND, which binds looser than NOT.
+type searchParser struct {
+	tokens  []searchToken
+	pos     int
+	terms   int
+	nesting int
+}
+
+func (sp *searchParser) done() bool {
+	return sp.pos >= len(sp.tokens)
+}
+
+func (sp *searchParser) peek() searchToken {
+	return sp.tokens[sp.pos]
+}
+
+func (sp *searchParser) or() (data.Expression, error) {
+	var expressions []data.Expression
+	for {
+		expression, err := sp.and()
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+
+		if sp.done() || sp.peek().kind != searchOr {
+			break
+		}
+		sp.pos++
+	}
+
+	if len(expressions) == 1 {
+		return expressions[0], nil
+	}
+	return data.Or(expressions...), nil
+}
+
+func (sp *searchParser) and() (data.Expression, error) {
+	var expressions []data.Expression
+	for {
+		expression, err := sp.not()
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+
+		if sp.done() || sp.peek().kind == searchOr || sp.peek().kind == searchClose {
+			break
+		}
+		// Terms next to each other are joined by AND whether or not it's written.
+		if sp.peek().kind == searchAnd {
+			sp.pos++
+		}
+	}
+
+	if len(expressions) == 1 {
+		return expressions[0], nil
+	}
+	return data.And(expressions...), nil
+}
+
+func (sp *searchParser) not() (data.Expression, error) {
+	if sp.done() {
+		return nil, fmt.Errorf("%w: the search ends too soon", ErrBadSearchRequest)
+	}
+	if sp.peek().kind != searchNot {
+		return sp.primary()
+	}
+
+	sp.pos++
+	if err := sp.nest(); err != nil {
+		return nil, err
+	}
+	expression, err := sp.not()
+	sp.nesting--
+	if err != nil {
+		return nil, err
+	}
+	return data.Not(expression), nil
+}
+
+func (sp *searchParser) primary() (data.Expression, error) {
+	token := sp.peek()
+	sp.pos++
+
+	switch token.kind {
+	case searchTerm:
+		return sp.term(token)
+	case searchOpen:
+		if err := sp.nest(); err != nil {
+			return nil, err
+		}
+		expression, err := sp.or()
+		sp.nesting--
+		if err != nil {
+			return nil, err
+		}
+		if sp.done() || sp.peek().kind != searchClose {
+			return nil, fmt.Errorf("%w: missing \")\"", ErrBadSearchRequest)
+		}
+		sp.pos++
+		return expression, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %s", ErrBadSearchRequest, token)
+}
+
+func (sp *searchParser) nest() error {
+	if sp.nesting++; sp.nesting > maxSearchNesting {
+		return fmt.Errorf("%w: the search is nested more than %d deep", ErrBadSearchRequest, maxSearchNesting)
+	}
+	return nil
+}
+
+func (sp *searchParser) term(token searchToken) (data.Expression, error) {
+	if sp.terms++; sp.terms > maxSearchTerms {
+		return nil, fmt.Errorf("%w: the search has more than %d terms", ErrBadSearchRequest, maxSearchTerms)
+	}
+	if token.value == "" {
+		return nil, fmt.Errorf("%w: %s has no value", ErrBadSearchRequest, token)
+	}
+
+	switch token.field {
+	case "", "subject", "tag":
+		return data.Tag(token.value), nil
+	case "location", "at":
+		return data.Location(token.value), nil
+	case "mime", "type":
+		if mediaType, _, err := mime.ParseMediaType(token.value); err != nil || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("%w: %s is not a mime type", ErrBadSearchRequest, token.value)
+		}
+		return data.Mime(token.value), nil
+	}
+	return nil, fmt.Errorf("%w: unknown field %q", ErrBadSearchRequest, token.field)
+}
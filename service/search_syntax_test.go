@@ -0,0 +1,51 @@
+package service
+
+import (
+	"errors"
+	"github.com/darcinc/Simple/data"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchExpression(t *testing.T) {
+	for text, expected := range map[string]data.Expression{
+		"":     nil,
+		"boat": data.Tag("boat"),
+		`boat subject:man AND location:"new york"`: data.And(data.Tag("boat"), data.Tag("man"), data.Location("new york")),
+		"boat (location:home OR at:work) -mime:image/tiff": data.And(data.Tag("boat"),
+			data.Or(data.Location("home"), data.Location("work")), data.Not(data.Mime(data.MimeTIFF))),
+		// AND binds tighter than OR, and NOT tighter than AND.
+		"sea OR boat NOT man":           data.Or(data.Tag("sea"), data.And(data.Tag("boat"), data.Not(data.Tag("man")))),
+		`NOT (type:image/jpeg OR "or")`: data.Not(data.Or(data.Mime(data.MimeJPEG), data.Tag("or"))),
+	} {
+		expression, err := ParseSearchExpression(text)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, expression) {
+			t.Errorf("Expected %q to parse to %#v but got %#v", text, expected, expression)
+		}
+	}
+}
+
+func TestParseSearchExpression_Invalid(t *testing.T) {
+	for _, text := range []string{
+		"boat OR",
+		"(boat",
+		"boat)",
+		"()",
+		`location:"home`,
+		`tag"boat"`,
+		"colour:blue",
+		"location:",
+		"mime:jpeg",
+		strings.Repeat("(", maxSearchNesting+1) + "boat" + strings.Repeat(")", maxSearchNesting+1),
+		strings.Repeat("boat ", maxSearchTerms+1),
+	} {
+		if _, err := ParseSearchExpression(text); !errors.Is(err, ErrBadSearchRequest) {
+			t.Errorf("Expected %q to be a bad search but got %v", text, err)
+		}
+	}
+}
@@ -4,9 +4,22 @@ package service
 // GET /files -> metadata {date captured, location, tags},
 //               encodings {runtime?, resolution, mime type},
 //               locators {source} [locations has permalink]
+//        a page at a time, ?cursor=next&limit=100&total=true, sorted
+//        with ?sort=date, -date, location, encodings or relevance, and
+//        narrowed with ?q=boat (location:home OR location:work) -mime:image/tiff
+//        or searched with ?text="red boat", which ranks by relevance, and
+//        kept to an area with ?near=lat,lon,metres or ?within=s,w,n,e
 //
-// GET /image with a location permalink of 45 -> This looks up the file
-//        based on the location, to get back the file data.
+// GET /image with a permalink -> describes the metadata, encoding or
+//        file it was published for.
+//
+// GET /media with an encoding permalink -> streams the bytes of the
+//        encoding, supporting ranges so video can be scrubbed.  With a
+//        file permalink, such as one for location 45, it looks up the
+//        file to stream the file data.
+//
+// GET /derivative with a metadata permalink and ?size=thumbnail -> a
+//        smaller rendering of the image, generated the first time.
 //
 // What's a permalink
 // It is a fabricated ID that we can use to get to a piece of data.